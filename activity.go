@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const activityDayLayout = "2006-01-02"
+
+//Longest range of days of an activity calendar
+const maxActivityDays = 731
+
+type ActivityDay struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+//Activity calendar of a user, the days are the days of the timezone of the user
+//Count is the number of progress transitions of the day, a streak is a run of consecutive days with transitions
+//The current streak ends today or yesterday, it is 0 otherwise
+type UserActivity struct {
+	UserId        string        `json:"userId"`
+	Timezone      string        `json:"timezone"`
+	From          string        `json:"from"`
+	To            string        `json:"to"`
+	Total         int           `json:"total"`
+	CurrentStreak int           `json:"currentStreak"`
+	LongestStreak int           `json:"longestStreak"`
+	LastActiveDay string        `json:"lastActiveDay,omitempty"`
+	Days          []ActivityDay `json:"days"`
+}
+
+type ActivityTimezone struct {
+	Timezone string `json:"timezone"`
+}
+
+//Streaks of a user, maintained with the daily activity counts by every progress transition
+type activityStreak struct {
+	stored   bool
+	timezone string
+	lastDay  string
+	current  int
+	longest  int
+}
+
+//Registers the write hook counting the progress transitions by day
+func initActivity() {
+	onProgressWrite(recordActivity)
+}
+
+//Returns the location of the timezone, UTC if it can't be loaded
+func activityLocation(timezone string) *time.Location {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Println("Failed to load timezone " + timezone + ", using UTC. \nCause: " + err.Error())
+		return time.UTC
+	}
+	return location
+}
+
+//Returns the day after the day
+func nextActivityDay(day string) string {
+	t, _ := time.Parse(activityDayLayout, day)
+	return t.AddDate(0, 0, 1).Format(activityDayLayout)
+}
+
+//Returns the streaks of the days with activity, sorted ascending
+func streaksOf(days []string) (lastDay string, current, longest int) {
+	for _, day := range days {
+		if lastDay != "" && day == nextActivityDay(lastDay) {
+			current++
+		} else {
+			current = 1
+		}
+		if current > longest {
+			longest = current
+		}
+		lastDay = day
+	}
+	return lastDay, current, longest
+}
+
+//Reads the streaks of the user, locking them inside the transaction if forUpdate is set
+//The streaks of a user without stored streaks have the default timezone
+func (s *ProgressStore) getStreak(ctx context.Context, tx *sql.Tx, userId string, forUpdate bool) (*activityStreak, error) {
+	var row *sql.Row
+	if forUpdate {
+		row = tx.StmtContext(ctx, s.selectStreakForUpdate).QueryRowContext(ctx, userId)
+	} else {
+		row = s.selectStreak.QueryRowContext(ctx, userId)
+	}
+	streak := activityStreak{stored: true}
+	var lastDay *time.Time
+	err := row.Scan(&streak.timezone, &lastDay, &streak.current, &streak.longest)
+	if err == sql.ErrNoRows {
+		return &activityStreak{timezone: config.ActivityTimezone}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lastDay != nil {
+		streak.lastDay = lastDay.Format(activityDayLayout)
+	}
+	return &streak, nil
+}
+
+//Writes the streaks of the user inside the transaction
+//A concurrent first write of the streaks of the user is retried by the caller
+func (s *ProgressStore) putStreak(ctx context.Context, tx *sql.Tx, userId string, streak *activityStreak) error {
+	var lastDay interface{}
+	if streak.lastDay != "" {
+		lastDay = streak.lastDay
+	}
+	if streak.stored {
+		_, err := tx.StmtContext(ctx, s.updateStreak).ExecContext(ctx, streak.timezone, lastDay, streak.current, streak.longest, userId)
+		return err
+	}
+	_, err := tx.StmtContext(ctx, s.insertStreak).ExecContext(ctx, userId, streak.timezone, lastDay, streak.current, streak.longest)
+	if err != nil && s.dialect.isDuplicate(err) {
+		return errConcurrentInsert
+	}
+	return err
+}
+
+//Adds transitions to the activity count of the day inside the transaction
+func (s *ProgressStore) addActivity(ctx context.Context, tx *sql.Tx, userId, day string, transitions int) error {
+	result, err := tx.StmtContext(ctx, s.updateActivity).ExecContext(ctx, transitions, userId, day)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+	_, err = tx.StmtContext(ctx, s.insertActivity).ExecContext(ctx, userId, day, transitions)
+	return err
+}
+
+//Returns the days with activity of the user inside the transaction, sorted ascending
+func (s *ProgressStore) activityDays(ctx context.Context, tx *sql.Tx, userId string) ([]string, error) {
+	rows, err := tx.StmtContext(ctx, s.selectActivityDays).QueryContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []string
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		days = append(days, day.Format(activityDayLayout))
+	}
+	return days, rows.Err()
+}
+
+//Counts the transition of the change in the activity of its day and updates the streaks of the user
+//The streaks are extended from the last active day, and recomputed from the daily counts when a transition is older than it
+//Only the transitions made by the user are activity, not resets, writes of the same progress, or the writes of admins and bulk jobs
+func recordActivity(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	if !change.learnerTransition() {
+		return nil
+	}
+	streak, err := store.getStreak(ctx, tx, change.UserId, true)
+	if err != nil {
+		return err
+	}
+	at := time.Now()
+	if change.Current.UpdatedAt != nil {
+		at = *change.Current.UpdatedAt
+	}
+	day := at.In(activityLocation(streak.timezone)).Format(activityDayLayout)
+	if err := store.addActivity(ctx, tx, change.UserId, day, 1); err != nil {
+		return err
+	}
+
+	switch {
+	case day == streak.lastDay:
+		return nil
+	case streak.lastDay == "" || day > streak.lastDay:
+		if streak.lastDay != "" && day == nextActivityDay(streak.lastDay) {
+			streak.current++
+		} else {
+			streak.current = 1
+		}
+		streak.lastDay = day
+		if streak.current > streak.longest {
+			streak.longest = streak.current
+		}
+	default:
+		days, err := store.activityDays(ctx, tx, change.UserId)
+		if err != nil {
+			return err
+		}
+		streak.lastDay, streak.current, streak.longest = streaksOf(days)
+	}
+	return store.putStreak(ctx, tx, change.UserId, streak)
+}
+
+//Recounts the activity of the user from the progress history, in the days of the timezone
+//Returns the streaks of the user
+func (s *ProgressStore) rebuildActivity(ctx context.Context, userId, timezone string) (*activityStreak, error) {
+	var streak *activityStreak
+	_, err := s.runBulkWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		var err error
+		streak, err = s.getStreak(ctx, tx, userId, true)
+		if err != nil {
+			return nil, err
+		}
+		streak.timezone = timezone
+		location := activityLocation(timezone)
+
+		rows, err := tx.StmtContext(ctx, s.selectUserTransitions).QueryContext(ctx, userId, true)
+		if err != nil {
+			return nil, err
+		}
+		counts := make(map[string]int)
+		var days []string
+		for rows.Next() {
+			var changedAt time.Time
+			if err := rows.Scan(&changedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			day := changedAt.In(location).Format(activityDayLayout)
+			if counts[day] == 0 {
+				days = append(days, day)
+			}
+			counts[day]++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		if _, err := s.deleteActivity.in(tx).ExecContext(ctx, userId); err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			if err := s.addActivity(ctx, tx, userId, day, counts[day]); err != nil {
+				return nil, err
+			}
+		}
+		streak.lastDay, streak.current, streak.longest = streaksOf(days)
+		return nil, s.putStreak(ctx, tx, userId, streak)
+	})
+	return streak, err
+}
+
+//Recounts the activity of every user with progress history, in the timezone of the user
+//Returns the number of users
+func (s *ProgressStore) rebuildAllActivity(ctx context.Context) (int, error) {
+	rows, err := s.selectHistoryUsers.QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var userIds []string
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, userId := range userIds {
+		queryCtx, cancel := queryContext(ctx)
+		streak, err := s.getStreak(queryCtx, nil, userId, false)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := s.rebuildActivity(ctx, userId, streak.timezone); err != nil {
+			return 0, err
+		}
+	}
+	return len(userIds), nil
+}
+
+//Returns the activity counts of the user from the day to the day, both included
+func (s *ProgressStore) getActivity(ctx context.Context, userId, from, to string) (map[string]int, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectActivity.QueryContext(ctx, userId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var day time.Time
+		var transitions int
+		if err := rows.Scan(&day, &transitions); err != nil {
+			return nil, err
+		}
+		counts[day.Format(activityDayLayout)] = transitions
+	}
+	return counts, rows.Err()
+}
+
+//Returns the range of days of the from and to query parameters, the year ending today if they are absent
+func activityRange(r *http.Request, today time.Time) (time.Time, time.Time, error) {
+	parse := func(name string, value time.Time) (time.Time, error) {
+		text := r.URL.Query().Get(name)
+		if text == "" {
+			return value, nil
+		}
+		day, err := time.Parse(activityDayLayout, text)
+		if err != nil {
+			return day, newServiceError(http.StatusUnprocessableEntity, "Invalid "+name+" day, expected YYYY-MM-DD.", err)
+		}
+		return day, nil
+	}
+	to, err := parse("to", today)
+	if err != nil {
+		return to, to, err
+	}
+	from, err := parse("from", to.AddDate(0, 0, -364))
+	if err != nil {
+		return from, to, err
+	}
+	if from.After(to) || to.Sub(from) >= maxActivityDays*24*time.Hour {
+		return from, to, newServiceError(http.StatusUnprocessableEntity, "The range of days must be ordered and at most 731 days long", nil)
+	}
+	return from, to, nil
+}
+
+//Handles the get method on /activity/:user
+//Returns 200 status code and the activity calendar of the user, every day of the range with its count of progress transitions
+func HandleUserActivityGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := checkDatabase(r.Context()); err != nil {
+		respondError(w, err)
+		return
+	}
+	userId := ps.ByName("user")
+	queryCtx, cancel := queryContext(r.Context())
+	streak, err := store.getStreak(queryCtx, nil, userId, false)
+	cancel()
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read activity.", err))
+		return
+	}
+	location := activityLocation(streak.timezone)
+	now := time.Now().In(location)
+	today, _ := time.Parse(activityDayLayout, now.Format(activityDayLayout))
+	from, to, err := activityRange(r, today)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	counts, err := store.getActivity(r.Context(), userId, from.Format(activityDayLayout), to.Format(activityDayLayout))
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read activity.", err))
+		return
+	}
+
+	activity := UserActivity{
+		UserId:        userId,
+		Timezone:      streak.timezone,
+		From:          from.Format(activityDayLayout),
+		To:            to.Format(activityDayLayout),
+		LongestStreak: streak.longest,
+		LastActiveDay: streak.lastDay,
+		Days:          make([]ActivityDay, 0),
+	}
+	if streak.lastDay == today.Format(activityDayLayout) || streak.lastDay == today.AddDate(0, 0, -1).Format(activityDayLayout) {
+		activity.CurrentStreak = streak.current
+	}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(activityDayLayout)
+		activity.Days = append(activity.Days, ActivityDay{Date: date, Count: counts[date]})
+		activity.Total += counts[date]
+	}
+	respondJSON(w, activity)
+}
+
+//Handles the put method on /activity/:user/timezone
+//Sets the timezone of the days of the activity of the user, and recounts the activity from the progress history in its days
+//Returns 200 status code and the timezone
+func HandleUserActivityTimezonePut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request ActivityTimezone
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		respondError(w, newServiceError(http.StatusBadRequest, "Failed to read timezone.", err))
+		return
+	}
+	if _, err := time.LoadLocation(request.Timezone); err != nil || request.Timezone == "" {
+		respondError(w, newServiceError(http.StatusUnprocessableEntity, "Unknown timezone "+request.Timezone, err))
+		return
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		respondError(w, err)
+		return
+	}
+	if _, err := store.rebuildActivity(r.Context(), ps.ByName("user"), request.Timezone); err != nil {
+		respondError(w, failure(r.Context(), "Failed to recount activity.", err))
+		return
+	}
+	respondJSON(w, request)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//Restricts the handle to the requests authenticated with the admin token as bearer token
+//Responds with 403 status code if no admin token is configured and 401 if the token doesn't match
+func requireAdmin(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if config.AdminToken == "" {
+			respondErrorV2(w, newServiceError(http.StatusForbidden, "Admin endpoints are disabled, no admin token is configured", nil))
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondErrorV2(w, newServiceError(http.StatusUnauthorized, "Invalid admin token", nil))
+			return
+		}
+		handle(w, r, ps)
+	}
+}
+
+//Handles the get method on /admin/reconciliation
+//Returns 200 status code and the report of the last finished reconciliation, 404 if none has finished
+func HandleReconciliationGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	last, running := lastReconciliation()
+	if last == nil {
+		message := "No reconciliation has finished"
+		if running {
+			message += ", a reconciliation is running"
+		}
+		respondErrorV2(w, newServiceError(http.StatusNotFound, message, nil))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: last})
+}
+
+//Handles the post method on /admin/reconciliation
+//Starts a reconciliation with the options of the body
+//Returns 202 status code and the report of the running reconciliation, 409 if one is already running
+func HandleReconciliationPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var options ReconciliationOptions
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &options)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read reconciliation options.", err))
+		return
+	}
+
+	report, err := startReconciliation(jobContext, options)
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	respondJSON(w, ObjectEnvelope{Data: report})
+}
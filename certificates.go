@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/ed25519"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Prefix of the signed payload of a certificate, changed with the fields of the payload
+const certificatePayloadVersion = "course-progress-certificate/v1"
+
+//Certificate of completion of every task of a course by a user, signed with the Ed25519 key of the service
+//TasksHash is the SHA-256 of the sorted ids of the completed tasks, one per line
+type Certificate struct {
+	Id          string    `json:"id"`
+	UserId      string    `json:"userId"`
+	CourseId    string    `json:"courseId"`
+	CompletedAt time.Time `json:"completedAt"`
+	TasksHash   string    `json:"tasksHash"`
+	IssuedAt    time.Time `json:"issuedAt"`
+	KeyId       string    `json:"keyId"`
+	Signature   string    `json:"signature"`
+}
+
+type CertificateVerification struct {
+	Valid       bool         `json:"valid"`
+	Reason      string       `json:"reason,omitempty"`
+	Certificate *Certificate `json:"certificate"`
+}
+
+var errCertificatesDisabled = newServiceError(http.StatusServiceUnavailable, "Certificates are disabled, no signing key is configured", nil)
+
+//Returns the signing key of the certificates, decoded from the base64 seed or private key of the configuration
+func certificateKey() (ed25519.PrivateKey, error) {
+	if config.CertificateSigningKey == "" {
+		return nil, errCertificatesDisabled
+	}
+	key, err := base64.StdEncoding.DecodeString(config.CertificateSigningKey)
+	if err != nil {
+		return nil, errors.New("Invalid certificate signing key. \nCause: " + err.Error())
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, errors.New("Invalid certificate signing key. \nCause: expected a base64 seed of 32 bytes or private key of 64 bytes")
+}
+
+//Returns the id of the public key, the hex prefix of its SHA-256
+func certificateKeyId(key ed25519.PublicKey) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+//Returns the public keys verifying the certificates by id, the one of the signing key and the previous ones of the configuration
+func certificateVerifyKeys() (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	if key, err := certificateKey(); err == nil {
+		public := key.Public().(ed25519.PublicKey)
+		keys[certificateKeyId(public)] = public
+	} else if err != errCertificatesDisabled {
+		return nil, err
+	}
+	for _, encoded := range config.CertificatePreviousKeys {
+		public, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid previous certificate key " + encoded)
+		}
+		keys[certificateKeyId(public)] = public
+	}
+	return keys, nil
+}
+
+//Returns the hash of the completed task set
+func completedTasksHash(tasks []TaskProgress) string {
+	ids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.TaskId)
+	}
+	sort.Strings(ids)
+	hash := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+//Returns the signed payload of the certificate, its fields one per line
+func (c *Certificate) payload() []byte {
+	return []byte(strings.Join([]string{certificatePayloadVersion, c.Id, c.UserId, c.CourseId,
+		c.CompletedAt.UTC().Format(time.RFC3339), c.TasksHash, c.IssuedAt.UTC().Format(time.RFC3339), c.KeyId}, "\n"))
+}
+
+//Returns the reason the signature of the certificate is invalid, empty if it is valid
+func (c *Certificate) verify(keys map[string]ed25519.PublicKey) string {
+	key, ok := keys[c.KeyId]
+	if !ok {
+		return "Unknown signing key " + c.KeyId
+	}
+	signature, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(key, c.payload(), signature) {
+		return "Signature doesn't match the certificate"
+	}
+	return ""
+}
+
+//Returns a new certificate of the completed course signed with the key
+//The completion date is the last completion of the tasks from the progress log, or their last update if it has none
+func newCertificate(userId string, course *CourseState, completions completionTimes, key ed25519.PrivateKey) (*Certificate, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	certificate := &Certificate{
+		Id:        hex.EncodeToString(id),
+		UserId:    userId,
+		CourseId:  course.CourseId,
+		TasksHash: completedTasksHash(course.Tasks),
+		IssuedAt:  time.Now().UTC().Truncate(time.Second),
+		KeyId:     certificateKeyId(key.Public().(ed25519.PublicKey)),
+	}
+	for _, task := range course.Tasks {
+		completedAt := completions.completedAt(course.CourseId, task.TaskId)
+		if completedAt == nil {
+			completedAt = task.UpdatedAt
+		}
+		if completedAt != nil && completedAt.After(certificate.CompletedAt) {
+			certificate.CompletedAt = *completedAt
+		}
+	}
+	certificate.CompletedAt = certificate.CompletedAt.UTC().Truncate(time.Second)
+	certificate.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, certificate.payload()))
+	return certificate, nil
+}
+
+func scanCertificate(row *sql.Row) (*Certificate, error) {
+	var c Certificate
+	err := row.Scan(&c.Id, &c.UserId, &c.CourseId, &c.CompletedAt, &c.TasksHash, &c.IssuedAt, &c.KeyId, &c.Signature)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.CompletedAt, c.IssuedAt = c.CompletedAt.UTC(), c.IssuedAt.UTC()
+	return &c, nil
+}
+
+//Returns the certificate, nil if there is none with the id
+func (s *ProgressStore) getCertificate(ctx context.Context, id string) (*Certificate, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return scanCertificate(s.selectCertificate.QueryRowContext(ctx, id))
+}
+
+//Returns the certificate of the user for the course with the completed task set, nil if none was issued
+func (s *ProgressStore) findCertificate(ctx context.Context, userId, courseId, tasksHash string) (*Certificate, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return scanCertificate(s.selectCertificateByHash.QueryRowContext(ctx, userId, courseId, tasksHash))
+}
+
+func (s *ProgressStore) insertCertificateRecord(ctx context.Context, c *Certificate) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	_, err := s.insertCertificate.ExecContext(ctx, c.Id, c.UserId, c.CourseId, c.CompletedAt, c.TasksHash, c.IssuedAt, c.KeyId, c.Signature)
+	return err
+}
+
+//Issues the certificate of the course to the user if every task of the course is completed
+//The progress is merged with the catalog like every other read, a certificate already issued for the same task set is returned again
+//Returns the certificate and true if it was issued by this call
+func issueCertificate(ctx context.Context, userId, courseId string) (*Certificate, bool, error) {
+	key, err := certificateKey()
+	if err != nil {
+		return nil, false, err
+	}
+	course, err := loadCourseState(ctx, userId, courseId)
+	if err != nil {
+		return nil, false, err
+	}
+	if newEnrollmentResource(course).Progress != "completed" {
+		return nil, false, newServiceError(http.StatusConflict, "Course "+courseId+" isn't completed by user "+userId, nil)
+	}
+
+	existing, err := store.findCertificate(ctx, userId, courseId, completedTasksHash(course.Tasks))
+	if err != nil {
+		return nil, false, failure(ctx, "Database error: can not read certificates.", err)
+	}
+	if existing != nil {
+		return existing, false, nil
+	}
+	completions, err := store.getCompletionTimes(ctx, store.selectUserCompletions, userId)
+	if err != nil {
+		return nil, false, failure(ctx, "Database error: can not read completion times.", err)
+	}
+	certificate, err := newCertificate(userId, course, completions[userId], key)
+	if err != nil {
+		return nil, false, failure(ctx, "Failed to sign certificate.", err)
+	}
+	err = store.insertCertificateRecord(ctx, certificate)
+	if err != nil && store.dialect.isDuplicate(err) {
+		//Issued concurrently for the same task set
+		existing, err = store.findCertificate(ctx, userId, courseId, certificate.TasksHash)
+		if err == nil && existing != nil {
+			return existing, false, nil
+		}
+	}
+	if err != nil {
+		return nil, false, failure(ctx, "Database error: can not write certificate.", err)
+	}
+	return certificate, true, nil
+}
+
+//Courses checked per run of the certificate issuance
+const certificateIssueBatch = 50
+
+//Attempts after which a queued course is left in the queue and no longer checked
+const certificateMaxAttempts = 10
+
+//Registers the write hook queueing the courses of the completed tasks for their certificate, if a signing key is configured
+//Courses are queued by every command writing progress and their certificates are issued by the server
+func initCertificates() {
+	if config.CertificateSigningKey == "" {
+		return
+	}
+	onProgressWrite(queueCertificate)
+}
+
+//Queues the course of a completed task, its certificate is issued once every task of the course is completed
+//The completion of the course is checked against the catalog after the write, outside of its transaction
+func queueCertificate(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	if change.Current == nil || change.Current.Progress != "completed" || (change.Previous != nil && change.Previous.Progress == "completed") {
+		return nil
+	}
+	_, err := tx.StmtContext(ctx, store.insertCertificateQueue).ExecContext(ctx, change.UserId, change.CourseId)
+	return err
+}
+
+//Issues the certificates of the oldest queued courses, a course isn't checked again once its certificate is issued or it isn't completed
+//The attempts of the courses that couldn't be checked are counted
+//Returns the number of queued courses checked
+func (s *ProgressStore) issueQueuedCertificates(ctx context.Context) (int, error) {
+	queryCtx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectCertificateQueue.QueryContext(queryCtx, certificateMaxAttempts, certificateIssueBatch)
+	if err != nil {
+		return 0, err
+	}
+	type queuedCourse struct {
+		id               int64
+		userId, courseId string
+	}
+	var queued []queuedCourse
+	for rows.Next() {
+		var course queuedCourse
+		if err := rows.Scan(&course.id, &course.userId, &course.courseId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		queued = append(queued, course)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, course := range queued {
+		certificate, issued, issueErr := issueCertificate(ctx, course.userId, course.courseId)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		//A course not found or not completed is removed from the queue, its next completion queues it again
+		update := s.deleteCertificateQueue
+		serviceErr, _ := issueErr.(*serviceError)
+		if issueErr != nil && (serviceErr == nil || serviceErr.Status != http.StatusNotFound && serviceErr.Status != http.StatusConflict) {
+			log.Println("Failed to issue the certificate of course " + course.courseId + " to user " + course.userId + ". \nCause: " + issueErr.Error())
+			update = s.failCertificateQueue
+		} else if issued {
+			log.Println("Issued certificate " + certificate.Id + " of course " + certificate.CourseId + " to user " + certificate.UserId)
+		}
+		queryCtx, cancel := queryContext(ctx)
+		_, err = update.ExecContext(queryCtx, course.id)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(queued), nil
+}
+
+//Issues the certificates of the queued courses at the configured interval, until shutdown
+func scheduleCertificateIssuance() {
+	if config.CertificateSigningKey == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.CertificateIssueInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for {
+					checked, err := store.issueQueuedCertificates(jobContext)
+					if err != nil {
+						log.Println("Failed to issue the queued certificates. \nCause: " + err.Error())
+					}
+					if checked < certificateIssueBatch {
+						break
+					}
+				}
+			case <-jobContext.Done():
+				return
+			}
+		}
+	}()
+}
+
+//Returns the text escaped for a PDF string, characters outside of printable ASCII are replaced
+func pdfString(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			escaped.WriteRune('?')
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+//Renders the certificate as a one page landscape A4 PDF document using the standard Helvetica fonts
+func renderCertificatePDF(c *Certificate) []byte {
+	var content bytes.Buffer
+	text := func(font string, size, y int, value string) {
+		//Shrinks long values to fit the width of the page, estimating the width of a character to 0.6 of its size
+		if width := float64(len(value)) * float64(size) * 0.6; width > 698 {
+			size = int(float64(size) * 698 / width)
+		}
+		fmt.Fprintf(&content, "BT /%s %d Tf 72 %d Td (%s) Tj ET\n", font, size, y, pdfString(value))
+	}
+	text("F2", 36, 480, "Certificate of Completion")
+	text("F1", 16, 420, "This certifies that")
+	text("F2", 24, 385, c.UserId)
+	text("F1", 16, 340, "has completed every task of the course")
+	text("F2", 24, 305, c.CourseId)
+	text("F1", 16, 260, "on "+c.CompletedAt.Format("2 January 2006"))
+	text("F1", 9, 120, "Certificate "+c.Id+", issued "+c.IssuedAt.Format(time.RFC3339))
+	text("F1", 9, 105, "Task set SHA-256 "+c.TasksHash)
+	text("F1", 9, 90, "Ed25519 signature with key "+c.KeyId+": "+c.Signature)
+	text("F1", 9, 75, "Verify with GET /certificates/"+c.Id+"/verify")
+	stream := strings.TrimSuffix(content.String(), "\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 842 595] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+	}
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+//Handles the post method on /v2/users/:user/courses/:course/certificates
+//Returns 201 status code and the certificate issued for the completed course, 200 if it was already issued for the same completed tasks
+//Returns 409 if the course isn't completed
+func HandleCertificatePost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	certificate, issued, err := issueCertificate(r.Context(), ps.ByName("user"), ps.ByName("course"))
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	w.Header().Set("Location", "/certificates/"+certificate.Id)
+	if issued {
+		log.Println("Issued certificate " + certificate.Id + " of course " + certificate.CourseId + " to user " + certificate.UserId)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	}
+	respondJSON(w, ObjectEnvelope{Data: certificate})
+}
+
+//Returns the certificate of the id parameter or writes the error to the response
+func loadCertificate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Certificate {
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return nil
+	}
+	certificate, err := store.getCertificate(r.Context(), ps.ByName("id"))
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not read certificate.", err))
+		return nil
+	}
+	if certificate == nil {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "Certificate "+ps.ByName("id")+" not found", nil))
+	}
+	return certificate
+}
+
+//Handles the get method on /certificates/:id
+//Returns 200 status code and the certificate as JSON, or rendered as PDF with format=pdf
+func HandleCertificateGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	certificate := loadCertificate(w, r, ps)
+	if certificate == nil {
+		return
+	}
+	if r.URL.Query().Get("format") == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="certificate-`+certificate.Id+`.pdf"`)
+		w.Write(renderCertificatePDF(certificate))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: certificate})
+}
+
+//Handles the get method on /certificates/:id/verify
+//Returns 200 status code and whether the signature of the certificate is valid, 404 if no certificate has the id
+func HandleCertificateVerify(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	keys, err := certificateVerifyKeys()
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to read the certificate keys.", err))
+		return
+	}
+	certificate := loadCertificate(w, r, ps)
+	if certificate == nil {
+		return
+	}
+	reason := certificate.verify(keys)
+	respondJSON(w, ObjectEnvelope{Data: CertificateVerification{Valid: reason == "", Reason: reason, Certificate: certificate}})
+}
+
+//Generates a signing key of the certificates
+//Writes the seed to configure as COURSE_PROGRESS_CERTIFICATE_SIGNING_KEY to a new file readable only by its owner, and prints the public key verifying the certificates
+func certificateKeyCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected the file of the signing key")
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(file, "COURSE_PROGRESS_CERTIFICATE_SIGNING_KEY="+base64.StdEncoding.EncodeToString(private.Seed()))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Signing key written to " + args[0])
+	fmt.Println("Public key " + certificateKeyId(public) + ": " + base64.StdEncoding.EncodeToString(public))
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+	"time"
+)
+
+//Configures a new signing key of the certificates and returns it
+func setTestCertificateKey(t *testing.T) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	config.CertificateSigningKey = base64.StdEncoding.EncodeToString(seed)
+	key, err := certificateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCertificateSignature(t *testing.T) {
+	initConfig()
+	key := setTestCertificateKey(t)
+	created := time.Date(2018, 5, 14, 9, 30, 0, 0, time.UTC)
+	updated, completed := created.Add(48*time.Hour), created.Add(24*time.Hour)
+	course := &CourseState{CourseId: "algebra", Tasks: []TaskProgress{
+		{TaskId: "intro", Progress: "completed", CreatedAt: &created, UpdatedAt: &updated},
+		{TaskId: "matrices", Progress: "completed", CreatedAt: &created, UpdatedAt: &created},
+	}}
+
+	//The completion of the progress log is used over the last update, which changes with every write of the same progress
+	completions := completionTimes{"algebra": {"intro": completed}}
+	certificate, err := newCertificate("ana", course, completions, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.CompletedAt.Equal(completed) {
+		t.Errorf("certificate completed at %s, want the completion of the log %s", certificate.CompletedAt, completed)
+	}
+	if certificate, err = newCertificate("ana", course, nil, key); err != nil || !certificate.CompletedAt.Equal(updated) {
+		t.Errorf("certificate without logged completions completed at %s, %v, want the last update %s", certificate.CompletedAt, err, updated)
+	}
+	if certificate.TasksHash != completedTasksHash([]TaskProgress{course.Tasks[1], course.Tasks[0]}) {
+		t.Error("tasks hash depends on the order of the tasks")
+	}
+
+	keys, err := certificateVerifyKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := certificate.verify(keys); reason != "" {
+		t.Fatalf("signed certificate is invalid: %s", reason)
+	}
+	forged := *certificate
+	forged.UserId = "bogdan"
+	if forged.verify(keys) == "" {
+		t.Error("certificate of another user verified with the signature")
+	}
+	config.CertificateSigningKey = ""
+	if keys, err := certificateVerifyKeys(); err != nil || certificate.verify(keys) == "" {
+		t.Errorf("certificate verified without its key, %v", err)
+	}
+	config.CertificatePreviousKeys = []string{base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))}
+	if keys, err := certificateVerifyKeys(); err != nil || certificate.verify(keys) != "" {
+		t.Errorf("certificate not verified with its previous key, %v", err)
+	}
+
+	pdf := renderCertificatePDF(certificate)
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) || !bytes.Contains(pdf, []byte("(ana)")) {
+		t.Errorf("certificate PDF isn't a document naming the user:\n%s", pdf)
+	}
+	if escaped := pdfString(`a(b)\ ă`); escaped != `a\(b\)\\ ?` {
+		t.Errorf("PDF string escaped as %s", escaped)
+	}
+}
+
+func TestCertificatesIssuedOnCompletion(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		setTestCertificateKey(t)
+		userId, partialId, courseId := testId("user"), testId("user"), testId("course")
+		defer stubCatalog(map[string][]string{courseId: {"first", "second"}})()
+		if _, err := connection.Exec("DELETE FROM COURSEPROGRESS_CERTIFICATE_QUEUE"); err != nil {
+			t.Fatal(err)
+		}
+		hooks := progressWriteHooks
+		defer func() { progressWriteHooks = hooks }()
+		onProgressWrite(queueCertificate)
+
+		setTestProgress(t, userId, courseId, "first", "started")
+		setTestProgress(t, userId, courseId, "first", "completed")
+		last := setTestProgress(t, userId, courseId, "second", "completed")
+		setTestProgress(t, partialId, courseId, "first", "completed")
+		//A repeated write of the completion doesn't queue the course nor change its completion date
+		time.Sleep(1100 * time.Millisecond)
+		setTestProgress(t, userId, courseId, "second", "completed")
+
+		if checked, err := store.issueQueuedCertificates(ctx); err != nil || checked != 3 {
+			t.Fatalf("issuance checked %d queued courses, %v, want 3", checked, err)
+		}
+		if checked, err := store.issueQueuedCertificates(ctx); err != nil || checked != 0 {
+			t.Fatalf("issuance checked %d courses left in the queue, %v", checked, err)
+		}
+
+		var issued, partial int
+		err := connection.QueryRow(dialect.rebind("SELECT count(*) FROM COURSEPROGRESS_CERTIFICATES where user_id = ? and course_id = ?"), userId, courseId).Scan(&issued)
+		if err == nil {
+			err = connection.QueryRow(dialect.rebind("SELECT count(*) FROM COURSEPROGRESS_CERTIFICATES where user_id = ?"), partialId).Scan(&partial)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issued != 1 || partial != 0 {
+			t.Fatalf("%d certificates of the completed course and %d of the partial one, want 1 and 0", issued, partial)
+		}
+		var id string
+		if err := connection.QueryRow(dialect.rebind("SELECT id FROM COURSEPROGRESS_CERTIFICATES where user_id = ?"), userId).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		certificate, err := store.getCertificate(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !certificate.CompletedAt.Equal(*last.Current.UpdatedAt) {
+			t.Errorf("certificate completed at %s, want the completion of the last task %s", certificate.CompletedAt, last.Current.UpdatedAt)
+		}
+	})
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Group of learners following the courses assigned to it
+type Cohort struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Members   []string  `json:"members"`
+	Courses   []string  `json:"courses"`
+}
+
+type CohortRequest struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Courses []string `json:"courses"`
+}
+
+//Progress of the members of a cohort on a task, CompletionRate is the part of the members who completed it
+type CohortTask struct {
+	Id             string  `json:"id"`
+	Group          string  `json:"group"`
+	Completed      int     `json:"completed"`
+	Started        int     `json:"started"`
+	NotStarted     int     `json:"notStarted"`
+	CompletionRate float64 `json:"completionRate"`
+}
+
+//Progress of a member of a cohort on every task of a course, in the order of the tasks of the course
+type CohortMemberProgress struct {
+	UserId         string   `json:"userId"`
+	CompletedTasks int      `json:"completedTasks"`
+	Progress       []string `json:"progress"`
+}
+
+type CohortCourseProgress struct {
+	CourseId string                 `json:"courseId"`
+	Tasks    []CohortTask           `json:"tasks"`
+	Members  []CohortMemberProgress `json:"members"`
+}
+
+//Matrix of the progress of the members of a cohort on the tasks of its courses
+type CohortProgress struct {
+	CohortId string                 `json:"cohortId"`
+	Courses  []CohortCourseProgress `json:"courses"`
+}
+
+//Returns the ids of the query, by the id of their cohort
+func cohortLists(ctx context.Context, query storeQuery, args ...interface{}) (map[string][]string, error) {
+	rows, err := query.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := make(map[string][]string)
+	for rows.Next() {
+		var cohortId, id string
+		if err := rows.Scan(&cohortId, &id); err != nil {
+			return nil, err
+		}
+		lists[cohortId] = append(lists[cohortId], id)
+	}
+	return lists, rows.Err()
+}
+
+//Returns the cohort with its members and courses, nil if it doesn't exist
+func (s *ProgressStore) getCohort(ctx context.Context, cohortId string) (*Cohort, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	cohort := Cohort{Id: cohortId, Members: make([]string, 0), Courses: make([]string, 0)}
+	err := s.selectCohort.QueryRowContext(ctx, cohortId).Scan(&cohort.Name, &cohort.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	members, err := cohortLists(ctx, s.selectCohortMembers, cohortId)
+	if err != nil {
+		return nil, err
+	}
+	courses, err := cohortLists(ctx, s.selectCohortCourses, cohortId)
+	if err != nil {
+		return nil, err
+	}
+	cohort.Members = append(cohort.Members, members[cohortId]...)
+	cohort.Courses = append(cohort.Courses, courses[cohortId]...)
+	return &cohort, nil
+}
+
+//Returns every cohort with its members and courses, ordered by name
+func (s *ProgressStore) getCohorts(ctx context.Context) ([]Cohort, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectCohorts.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cohorts := make([]Cohort, 0)
+	for rows.Next() {
+		cohort := Cohort{Members: make([]string, 0), Courses: make([]string, 0)}
+		if err := rows.Scan(&cohort.Id, &cohort.Name, &cohort.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cohorts = append(cohorts, cohort)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := cohortLists(ctx, s.selectAllCohortMembers)
+	if err != nil {
+		return nil, err
+	}
+	courses, err := cohortLists(ctx, s.selectAllCohortCourses)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cohorts {
+		cohorts[i].Members = append(cohorts[i].Members, members[cohorts[i].Id]...)
+		cohorts[i].Courses = append(cohorts[i].Courses, courses[cohorts[i].Id]...)
+	}
+	return cohorts, nil
+}
+
+//Creates the cohort with its members and courses, in one transaction
+//Returns the id of the cohort
+func (s *ProgressStore) createCohort(ctx context.Context, request CohortRequest) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	cohortId := hex.EncodeToString(id)
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := s.insertCohort.in(tx).ExecContext(ctx, cohortId, request.Name, time.Now().UTC().Truncate(time.Second)); err != nil {
+		return "", err
+	}
+	for _, userId := range uniqueIds(request.Members) {
+		if _, err := s.insertCohortMember.in(tx).ExecContext(ctx, cohortId, userId); err != nil {
+			return "", err
+		}
+	}
+	for _, courseId := range uniqueIds(request.Courses) {
+		if _, err := s.insertCohortCourse.in(tx).ExecContext(ctx, cohortId, courseId); err != nil {
+			return "", err
+		}
+	}
+	return cohortId, tx.Commit()
+}
+
+//Returns the ids without duplicates, in order
+func uniqueIds(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+//Deletes the cohort with its members and courses, in one transaction locking the cohort first
+//Returns false if the cohort doesn't exist
+func (s *ProgressStore) removeCohort(ctx context.Context, cohortId string) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var name string
+	err = s.selectCohortForUpdate.in(tx).QueryRowContext(ctx, cohortId).Scan(&name)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := s.deleteCohortMembers.in(tx).ExecContext(ctx, cohortId); err != nil {
+		return false, err
+	}
+	if _, err := s.deleteCohortCourses.in(tx).ExecContext(ctx, cohortId); err != nil {
+		return false, err
+	}
+	result, err := s.deleteCohort.in(tx).ExecContext(ctx, cohortId)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+//Adds the id to the cohort with the insert statement, or removes it with the delete statement
+//The cohort is locked in the transaction of the change, so it can't be deleted meanwhile
+//Returns false if the cohort doesn't exist
+func (s *ProgressStore) setCohortId(ctx context.Context, cohortId, id string, insert, remove storeQuery, add bool) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var name string
+	err = s.selectCohortForUpdate.in(tx).QueryRowContext(ctx, cohortId).Scan(&name)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !add {
+		_, err = remove.in(tx).ExecContext(ctx, cohortId, id)
+	} else {
+		_, err = insert.in(tx).ExecContext(ctx, cohortId, id)
+		if err != nil && s.dialect.isDuplicate(err) {
+			//Already in the cohort, nothing to commit
+			return true, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+//Returns the progress of the members of the cohort on every task of the course
+func cohortCourseProgress(ctx context.Context, cohort *Cohort, courseId string) (*CohortCourseProgress, error) {
+	taskGroups, err := loadCourseCatalog(ctx, courseId)
+	if err != nil {
+		return nil, err
+	}
+	courses, err := store.getCourseStates(ctx, courseId, taskGroups, false)
+	if err != nil {
+		return nil, failure(ctx, "Database error: can not get course progress.", err)
+	}
+
+	progress := &CohortCourseProgress{CourseId: courseId, Tasks: make([]CohortTask, 0), Members: make([]CohortMemberProgress, 0, len(cohort.Members))}
+	for _, group := range taskGroups {
+		for _, task := range group.Tasks {
+			progress.Tasks = append(progress.Tasks, CohortTask{Id: task.Id, Group: group.Title})
+		}
+	}
+	for _, userId := range cohort.Members {
+		course := courses[userId]
+		if course == nil {
+			state := newCourseState(courseId, taskGroups, nil)
+			course = &state
+		}
+		member := CohortMemberProgress{UserId: userId, CompletedTasks: course.completedTasks(), Progress: make([]string, 0, len(progress.Tasks))}
+		for i := range progress.Tasks {
+			task := course.task(progress.Tasks[i].Id)
+			member.Progress = append(member.Progress, task.Progress)
+			switch task.Progress {
+			case "completed":
+				progress.Tasks[i].Completed++
+			case "started":
+				progress.Tasks[i].Started++
+			default:
+				progress.Tasks[i].NotStarted++
+			}
+		}
+		progress.Members = append(progress.Members, member)
+	}
+	if len(cohort.Members) > 0 {
+		for i := range progress.Tasks {
+			progress.Tasks[i].CompletionRate = float64(progress.Tasks[i].Completed) / float64(len(cohort.Members))
+		}
+	}
+	return progress, nil
+}
+
+//Returns the cohort of the id parameter or writes the error to the response
+func loadCohort(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Cohort {
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return nil
+	}
+	cohort, err := store.getCohort(r.Context(), ps.ByName("id"))
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not read cohort.", err))
+		return nil
+	}
+	if cohort == nil {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "Cohort "+ps.ByName("id")+" not found", nil))
+	}
+	return cohort
+}
+
+//Handles the get method on /cohorts
+//Returns 200 status code and every cohort
+func HandleCohortsGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cohorts, err := store.getCohorts(r.Context())
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not read cohorts.", err))
+		return
+	}
+	respondJSON(w, ListEnvelope{Data: cohorts, Pagination: Pagination{Total: len(cohorts)}})
+}
+
+//Handles the post method on /cohorts
+//Returns 201 status code and the created cohort
+func HandleCohortPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request CohortRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read cohort.", err))
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		respondErrorV2(w, newServiceError(http.StatusUnprocessableEntity, "Cohort name is required", nil))
+		return
+	}
+	cohortId, err := store.createCohort(r.Context(), request)
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not create cohort.", err))
+		return
+	}
+	cohort, err := store.getCohort(r.Context(), cohortId)
+	if err != nil || cohort == nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not read cohort.", err))
+		return
+	}
+	w.Header().Set("Location", "/cohorts/"+cohortId)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	respondJSON(w, ObjectEnvelope{Data: cohort})
+}
+
+//Handles the get method on /cohorts/:id
+//Returns 200 status code and the cohort with its members and courses
+func HandleCohortGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if cohort := loadCohort(w, r, ps); cohort != nil {
+		respondJSON(w, ObjectEnvelope{Data: cohort})
+	}
+}
+
+//Handles the delete method on /cohorts/:id
+//Returns 204 status code, or 404 if the cohort doesn't exist
+func HandleCohortDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	removed, err := store.removeCohort(r.Context(), ps.ByName("id"))
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not delete cohort.", err))
+		return
+	}
+	if !removed {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "Cohort "+ps.ByName("id")+" not found", nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Responds to an update of the members or courses of the cohort
+func respondCohortUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params, found bool, err error) {
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not update cohort.", err))
+		return
+	}
+	if !found {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "Cohort "+ps.ByName("id")+" not found", nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Handles the put method on /cohorts/:id/members/:user
+//Returns 204 status code, or 404 if the cohort doesn't exist
+func HandleCohortMemberPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	found, err := store.setCohortId(r.Context(), ps.ByName("id"), ps.ByName("user"), store.insertCohortMember, store.deleteCohortMember, true)
+	respondCohortUpdate(w, r, ps, found, err)
+}
+
+//Handles the delete method on /cohorts/:id/members/:user
+//Returns 204 status code, or 404 if the cohort doesn't exist
+func HandleCohortMemberDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	found, err := store.setCohortId(r.Context(), ps.ByName("id"), ps.ByName("user"), store.insertCohortMember, store.deleteCohortMember, false)
+	respondCohortUpdate(w, r, ps, found, err)
+}
+
+//Handles the put method on /cohorts/:id/courses/:course
+//Returns 204 status code, or 404 if the cohort doesn't exist
+func HandleCohortCoursePut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	found, err := store.setCohortId(r.Context(), ps.ByName("id"), ps.ByName("course"), store.insertCohortCourse, store.deleteCohortCourse, true)
+	respondCohortUpdate(w, r, ps, found, err)
+}
+
+//Handles the delete method on /cohorts/:id/courses/:course
+//Returns 204 status code, or 404 if the cohort doesn't exist
+func HandleCohortCourseDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	found, err := store.setCohortId(r.Context(), ps.ByName("id"), ps.ByName("course"), store.insertCohortCourse, store.deleteCohortCourse, false)
+	respondCohortUpdate(w, r, ps, found, err)
+}
+
+//Handles the get method on /cohorts/:id/progress
+//Returns 200 status code and the progress of every member on every task of the courses of the cohort, with the aggregates of every task
+func HandleCohortProgressGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cohort := loadCohort(w, r, ps)
+	if cohort == nil {
+		return
+	}
+	courseIds := cohort.Courses
+	if courseId := r.URL.Query().Get("course"); courseId != "" {
+		courseIds = nil
+		for _, id := range cohort.Courses {
+			if id == courseId {
+				courseIds = []string{courseId}
+			}
+		}
+		if courseIds == nil {
+			respondErrorV2(w, newServiceError(http.StatusNotFound, "Course "+courseId+" isn't assigned to cohort "+cohort.Id, nil))
+			return
+		}
+	}
+
+	progress := CohortProgress{CohortId: cohort.Id, Courses: make([]CohortCourseProgress, 0, len(courseIds))}
+	for _, courseId := range courseIds {
+		course, err := cohortCourseProgress(r.Context(), cohort, courseId)
+		if err != nil {
+			respondErrorV2(w, err)
+			return
+		}
+		progress.Courses = append(progress.Courses, *course)
+	}
+	respondJSON(w, ObjectEnvelope{Data: progress})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//Subcommand of the service binary
+//Every command shares the configuration and the store, the database is connected and migrated before it runs unless the command is offline
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(ctx context.Context, args []string) error
+	//Offline commands don't use the database
+	offline bool
+}
+
+var commands = []command{
+	{"serve", "serve", "Runs the HTTP server, the default command", serveCommand, false},
+	{"migrate", "migrate", "Applies the pending schema migrations", migrateCommand, false},
+	{"import", "import [flags] [file]", "Imports progress records as CSV or NDJSON from the file or standard input", importCommand, false},
+	{"export", "export [flags] [file]", "Exports the stored progress as CSV, NDJSON or Parquet to the file or standard output", exportCommand, false},
+	{"reset-user", "reset-user <user>", "Resets the progress of the user on every task", resetUserCommand, false},
+	{"report-completions", "report-completions", "Reports the completion of every enrollment against the current catalogs, without writing it", reportCompletionsCommand, false},
+	{"check-orphans", "check-orphans", "Reports the stored progress of tasks missing from the current catalogs", checkOrphansCommand, false},
+	{"rebuild-projections", "rebuild-projections", "Rebuilds the projections by replaying the progress log", rebuildProjectionsCommand, false},
+	{"rebuild-activity", "rebuild-activity", "Recounts the activity calendars and streaks of every user from the progress history", rebuildActivityCommand, false},
+	{"certificate-key", "certificate-key <file>", "Generates a signing key of the certificates of completion, written to the new file", certificateKeyCommand, true},
+}
+
+//Runs the command named by the first argument, serve if there is none
+func runCommand(args []string) {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	//replay is the name of rebuild-projections before the subcommands were introduced
+	if name == "replay" {
+		name = "rebuild-projections"
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		if !cmd.offline {
+			initConnection()
+		}
+		if cmd.name == "serve" {
+			cmd.run(context.Background(), args)
+			return
+		}
+		ctx, cancel := commandContext()
+		err := cmd.run(ctx, args)
+		cancel()
+		if !cmd.offline {
+			closeConnection()
+		}
+		if err != nil {
+			log.Fatal(cmd.name + " failed. \nCause: " + err.Error())
+		}
+		return
+	}
+	printUsage()
+	if name != "help" {
+		os.Exit(2)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: "+os.Args[0]+" <command> [arguments]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", cmd.usage, cmd.description)
+	}
+}
+
+//Returns a context cancelled on SIGINT or SIGTERM, so long running commands stop between records
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Println("Received " + sig.String() + ", stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+func serveCommand(ctx context.Context, args []string) error {
+	scheduleReconciliation()
+	scheduleXapiDelivery()
+	scheduleLtiDelivery()
+	scheduleDeadlineNotifications()
+	scheduleCertificateIssuance()
+	runServer(newRouter())
+	return nil
+}
+
+func migrateCommand(ctx context.Context, args []string) error {
+	log.Println("Schema is up to date with " + strconv.Itoa(len(migrations)) + " migrations")
+	return nil
+}
+
+//Opens the file named by the first argument, or returns the standard stream if there is none or it is '-'
+func commandFile(args []string, create bool, standard *os.File) (*os.File, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return standard, nil
+	}
+	if create {
+		return os.Create(args[0])
+	}
+	return os.Open(args[0])
+}
+
+func importCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	var options ImportOptions
+	flags.StringVar(&options.Format, "format", "", "Format of the rows, 'csv' or 'ndjson', by default the extension of the file")
+	flags.StringVar(&options.ImportId, "id", "", "Id of the import, an interrupted import is resumed by running it again with the same id")
+	flags.IntVar(&options.BatchSize, "batch-size", config.ImportBatchSize, "Number of rows written per transaction")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "Only validate the rows")
+	flags.BoolVar(&options.CheckCatalog, "check-catalog", false, "Validate the tasks against the upstream course catalogs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	file, err := commandFile(flags.Args(), false, os.Stdin)
+	if err != nil {
+		return err
+	}
+	if file != os.Stdin {
+		defer file.Close()
+	}
+	if options.Format == "" {
+		options.Format = "ndjson"
+		if strings.HasSuffix(file.Name(), ".csv") {
+			options.Format = "csv"
+		}
+	}
+
+	reader, err := newImportReader(options.Format, file)
+	if err != nil {
+		return err
+	}
+	report, err := runImport(ctx, reader, options)
+	if encodeErr := json.NewEncoder(os.Stdout).Encode(report); encodeErr != nil && err == nil {
+		err = encodeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Imported " + strconv.Itoa(report.Imported) + " progress records, skipped " + strconv.Itoa(report.Skipped) + ", failed " + strconv.Itoa(report.Failed))
+	return nil
+}
+
+func exportCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	var format, course, updatedSince, watermark, watermarkFile string
+	flags.StringVar(&format, "format", "", "Format of the export, 'csv', 'ndjson' or 'parquet', by default the extension of the file")
+	flags.StringVar(&course, "course", "", "Only export the progress of the course")
+	flags.StringVar(&updatedSince, "updated-since", "", "Only export the tasks updated at or after the RFC 3339 timestamp")
+	flags.StringVar(&watermark, "watermark", "", "Only export the tasks changed since the watermark of a previous export")
+	flags.StringVar(&watermarkFile, "watermark-file", "", "File storing the watermark, read before the export if it exists and replaced after it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if watermark == "" && watermarkFile != "" {
+		stored, err := ioutil.ReadFile(watermarkFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		watermark = strings.TrimSpace(string(stored))
+	}
+
+	file, err := commandFile(flags.Args(), true, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if file != os.Stdout {
+		defer file.Close()
+	}
+	if format == "" {
+		format = "ndjson"
+		for extension := range exportContentTypes {
+			if strings.HasSuffix(file.Name(), "."+extension) {
+				format = extension
+			}
+		}
+	}
+	options, err := parseExportOptions(url.Values{"format": {format}, "course": {course}, "updatedSince": {updatedSince}, "watermark": {watermark}})
+	if err != nil {
+		return err
+	}
+
+	next, err := store.exportWatermark(ctx)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(file)
+	writer, err := newExportWriter(options.Format, buffered)
+	if err != nil {
+		return err
+	}
+	exported := 0
+	err = store.exportProgress(ctx, options, next, func(record ProgressRecord) error {
+		exported++
+		return writer.write(record)
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.close(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	//The watermark is replaced once the export is complete, a failed export is retried from the previous one
+	if watermarkFile != "" {
+		if err := ioutil.WriteFile(watermarkFile+".tmp", []byte(next.Format(time.RFC3339)+"\n"), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(watermarkFile+".tmp", watermarkFile); err != nil {
+			return err
+		}
+	}
+	log.Println("Exported " + strconv.Itoa(exported) + " progress records, watermark " + next.Format(time.RFC3339))
+	return nil
+}
+
+func resetUserCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("usage: reset-user <user>")
+	}
+	userId := args[0]
+	items, err := store.getUserProgress(ctx, userId, ProgressFilter{})
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, err := store.deleteTaskProgress(ctx, userId, item.CourseId, item.TaskId, nil); err != nil {
+			return err
+		}
+	}
+	log.Println("Reset " + strconv.Itoa(len(items)) + " tasks of user " + userId)
+	return nil
+}
+
+//Completion of an enrollment, as reported by report-completions
+type completionRecord struct {
+	UserId string `json:"userId"`
+	EnrollmentResource
+}
+
+func reportCompletionsCommand(ctx context.Context, args []string) error {
+	catalogs, err := loadCatalogs(ctx)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	var userId, courseId string
+	var seenTasks []TaskProgress
+	flush := func() error {
+		taskGroups := catalogs[courseId]
+		if seenTasks == nil || taskGroups == nil {
+			return nil
+		}
+		course := newCourseState(courseId, taskGroups, seenTasks)
+		return encoder.Encode(completionRecord{UserId: userId, EnrollmentResource: newEnrollmentResource(&course)})
+	}
+
+	err = store.eachProgress(ctx, func(record ProgressRecord) error {
+		if record.UserId != userId || record.CourseId != courseId {
+			if err := flush(); err != nil {
+				return err
+			}
+			userId, courseId, seenTasks = record.UserId, record.CourseId, nil
+		}
+		seenTasks = append(seenTasks, TaskProgress{TaskId: record.TaskId, Progress: record.Progress, CreatedAt: record.CreatedAt, UpdatedAt: record.UpdatedAt, Version: record.Version})
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+//Stored progress orphaned in the current catalogs, as reported by check-orphans
+type orphanRecord struct {
+	ProgressRecord
+	Reason string `json:"reason"`
+}
+
+func checkOrphansCommand(ctx context.Context, args []string) error {
+	catalogs, err := loadCatalogs(ctx)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	orphans := 0
+	err = store.eachProgress(ctx, func(record ProgressRecord) error {
+		reason := orphanReason(catalogs, record)
+		if reason == "" {
+			return ctx.Err()
+		}
+		orphans++
+		return encoder.Encode(orphanRecord{ProgressRecord: record, Reason: reason})
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Found " + strconv.Itoa(orphans) + " orphaned progress records")
+	return nil
+}
+
+func rebuildProjectionsCommand(ctx context.Context, args []string) error {
+	log.Println("Replaying the progress log")
+	count, err := store.rebuildProgressProjection(ctx)
+	if err != nil {
+		return err
+	}
+	log.Println("Progress projection rebuilt with " + strconv.Itoa(count) + " rows")
+	count, err = store.rebuildLeaderboards(ctx)
+	if err != nil {
+		return err
+	}
+	log.Println("Leaderboards rebuilt with " + strconv.Itoa(count) + " rankings")
+	return nil
+}
+
+func rebuildActivityCommand(ctx context.Context, args []string) error {
+	log.Println("Recounting the activity from the progress history")
+	count, err := store.rebuildAllActivity(ctx)
+	if err != nil {
+		return err
+	}
+	log.Println("Activity recounted for " + strconv.Itoa(count) + " users")
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommandsAreDocumented(t *testing.T) {
+	names := make(map[string]bool)
+	for _, cmd := range commands {
+		if names[cmd.name] {
+			t.Errorf("command %s declared twice", cmd.name)
+		}
+		names[cmd.name] = true
+		if !strings.HasPrefix(cmd.usage, cmd.name) || cmd.description == "" || cmd.run == nil {
+			t.Errorf("command %s has usage %q and description %q", cmd.name, cmd.usage, cmd.description)
+		}
+	}
+	for _, name := range []string{"serve", "migrate", "import", "export", "reset-user", "report-completions", "check-orphans", "rebuild-projections"} {
+		if !names[name] {
+			t.Errorf("command %s is missing", name)
+		}
+	}
+}
+
+func TestOfflineCommandsRunWithoutDatabase(t *testing.T) {
+	initConfig()
+	config.DatabaseUrl = "mysql://nowhere.invalid/progress"
+	dir, err := ioutil.TempDir("", "commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//The command would stop the test binary if it connected to the database
+	path := filepath.Join(dir, "signing.env")
+	runCommand([]string{"certificate-key", path})
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("signing key written with mode %s, want readable only by its owner", info.Mode().Perm())
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), "COURSE_PROGRESS_CERTIFICATE_SIGNING_KEY=") {
+		t.Errorf("signing key file written as %s", content)
+	}
+	if err := certificateKeyCommand(context.Background(), []string{path}); err == nil {
+		t.Error("existing signing key overwritten")
+	}
+}
+
+func TestCommandFile(t *testing.T) {
+	for _, args := range [][]string{nil, {"-"}} {
+		if file, err := commandFile(args, false, os.Stdin); err != nil || file != os.Stdin {
+			t.Errorf("file of %v is %v, %v, want the standard input", args, file, err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.csv")
+	if _, err := commandFile([]string{path}, false, os.Stdin); err == nil {
+		t.Error("missing input file opened")
+	}
+	file, err := commandFile([]string{path}, true, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if file == os.Stdout {
+		t.Error("output file named by the argument not created")
+	}
+}
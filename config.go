@@ -1,12 +1,78 @@
 package main
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"github.com/kelseyhightower/envconfig"
+	"time"
+)
 
 type ConfigurationSpec struct {
 	Port                    int    `default:"8002"`
 	CourseServiceUrl        string `default:"http://127.0.0.1:7310" envconfig:"COURSE_SERVICE_URL"`
 	CourseManagerServiceUrl string `default:"http://127.0.0.1:8001" envconfig:"COURSE_MANAGER_SERVICE_URL"`
 	DatabaseUrl             string `default:"Geo:aventador10@/CourseProgress" split_words:"true"`
+
+	ReadTimeout     time.Duration `default:"15s" split_words:"true"`
+	WriteTimeout    time.Duration `default:"30s" split_words:"true"`
+	IdleTimeout     time.Duration `default:"60s" split_words:"true"`
+	ShutdownTimeout time.Duration `default:"30s" split_words:"true"`
+
+	DatabaseMaxOpenConns    int           `default:"20" split_words:"true"`
+	DatabaseMaxIdleConns    int           `default:"5" split_words:"true"`
+	DatabaseConnMaxLifetime time.Duration `default:"30m" split_words:"true"`
+	QueryTimeout            time.Duration `default:"5s" split_words:"true"`
+	RequestTimeout          time.Duration `default:"25s" split_words:"true"`
+
+	DefaultPageSize int `default:"100" split_words:"true"`
+	MaxPageSize     int `default:"1000" split_words:"true"`
+	ImportBatchSize int `default:"500" split_words:"true"`
+
+	//Token of the admin endpoints, passed as bearer token. The admin endpoints are disabled if it is empty
+	AdminToken string `split_words:"true"`
+	//Interval of the report-only reconciliation of the stored progress against the catalogs, 0 disables it
+	ReconciliationInterval time.Duration `default:"0" split_words:"true"`
+	//Interval of the check of the passed deadlines appending the task.overdue events, 0 disables it
+	DeadlineCheckInterval time.Duration `default:"1m" split_words:"true"`
+	//Default timezone of the days of the activity calendars and streaks, for the users who didn't set theirs
+	ActivityTimezone string `default:"UTC" split_words:"true"`
+	//Lag of the watermark of an export behind the database time, longer than any write transaction so none commits behind the watermark
+	ExportWatermarkLag time.Duration `default:"5m" split_words:"true"`
+
+	//xAPI endpoint of the learning record store receiving the progress statements, empty disables the statements
+	XapiLrsUrl      string `split_words:"true"`
+	XapiLrsUsername string `split_words:"true"`
+	XapiLrsPassword string `split_words:"true"`
+	//Base IRI of the activities and the actor accounts of the statements
+	XapiBaseUrl          string        `default:"http://course-progress-service" split_words:"true"`
+	XapiDeliveryInterval time.Duration `default:"10s" split_words:"true"`
+	//Scaled score from which a completed task is passed, a passed statement is sent with the completion or the score meeting it
+	XapiPassThreshold float64 `default:"0.8" split_words:"true"`
+
+	//Token endpoint of the LTI platform receiving the scores of the mapped tasks, empty disables the grade passback
+	LtiTokenUrl string `split_words:"true"`
+	//Audience of the client assertion, the token endpoint if empty
+	LtiAudience string `split_words:"true"`
+	LtiClientId string `split_words:"true"`
+	LtiKeyId    string `split_words:"true"`
+	//PEM file of the RSA private key signing the client assertions
+	LtiPrivateKeyFile string `split_words:"true"`
+	//Interval of the delivery of the queued scores, and delay of the first retry of a failed score
+	LtiDeliveryInterval time.Duration `default:"10s" split_words:"true"`
+
+	//Base64 Ed25519 seed or private key signing the certificates of completion, empty disables the certificates
+	CertificateSigningKey string `split_words:"true"`
+	//Comma separated base64 public keys of the previous signing keys, still verifying the certificates they signed
+	CertificatePreviousKeys []string `split_words:"true"`
+	//Interval of the issuance of the certificates of the courses queued by the completions of their tasks
+	CertificateIssueInterval time.Duration `default:"10s" split_words:"true"`
+
+	//JSON file of the prerequisites locking the tasks of the courses, by course id, no task is locked if empty
+	PrerequisitesFile string `split_words:"true"`
+
+	//Enroll the users in a course on their first progress write on it, the listings of a user only have the enrolled courses by default
+	AutoEnroll bool `default:"true" split_words:"true"`
+
+	//Key of the pseudonyms replacing the user ids on the pseudonymized leaderboards, required to pseudonymize a leaderboard
+	LeaderboardPseudonymKey string `split_words:"true"`
 }
 
 var config ConfigurationSpec
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//Records that a task wasn't completed by a user when its deadline passed, it doesn't change the progress
+//The event occurs at the deadline and has the progress and version of the task at the time it is recorded
+const eventTaskOverdue = "task.overdue"
+
+//Deadline of a task, or of every task of the course without a deadline of its own if the task is empty
+//A null due date removes the deadline
+//Deadlines are only set through the admin endpoint, the tasks of the course-service have no due dates to read
+type Deadline struct {
+	CourseId string     `json:"courseId"`
+	TaskId   string     `json:"taskId,omitempty"`
+	DueAt    *time.Time `json:"dueAt"`
+}
+
+type DeadlinesRequest struct {
+	Deadlines []Deadline `json:"deadlines"`
+}
+
+//Task of a user past its deadline, either not completed yet or completed after the deadline
+type OverdueTask struct {
+	UserId      string     `json:"userId"`
+	CourseId    string     `json:"courseId"`
+	TaskId      string     `json:"taskId"`
+	Progress    string     `json:"progress"`
+	DueAt       time.Time  `json:"dueAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Status      string     `json:"status"`
+}
+
+//Due dates by course id and task id, the due date of the course has an empty task id
+type deadlineSet map[string]map[string]time.Time
+
+func newDeadlineSet(deadlines []Deadline) deadlineSet {
+	set := make(deadlineSet)
+	for _, deadline := range deadlines {
+		if set[deadline.CourseId] == nil {
+			set[deadline.CourseId] = make(map[string]time.Time)
+		}
+		set[deadline.CourseId][deadline.TaskId] = *deadline.DueAt
+	}
+	return set
+}
+
+//Times of the completions of the completed tasks by course id and task id
+type completionTimes map[string]map[string]time.Time
+
+//Returns the completion time of the task, nil if it isn't known
+func (c completionTimes) completedAt(courseId, taskId string) *time.Time {
+	if completedAt, ok := c[courseId][taskId]; ok {
+		return &completedAt
+	}
+	return nil
+}
+
+//Filters the ProgressCompleted events of the completions queries down to the ones since the task was last started or reset
+//The first of them is the completion of the task, the stored update time changes with every write of the same progress
+const sinceLastStart = " and e.event_type = '" + eventProgressCompleted + "' and NOT EXISTS (select 1 from COURSEPROGRESS_EVENTS l" +
+	" where l.user_id = e.user_id and l.course_id = e.course_id and l.task_id = e.task_id and l.id > e.id" +
+	" and l.event_type in ('" + eventProgressStarted + "', '" + eventProgressReset + "'))" +
+	" group by e.user_id, e.course_id, e.task_id"
+
+//Returns the completion times of the completed tasks by user id, from the progress log
+//The statement selects the completions of a user or of a course, by the given id
+func (s *ProgressStore) getCompletionTimes(ctx context.Context, stmt *sql.Stmt, id string) (map[string]completionTimes, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := stmt.QueryContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]completionTimes)
+	for rows.Next() {
+		var userId, courseId, taskId string
+		var completedAt time.Time
+		if err := rows.Scan(&userId, &courseId, &taskId, &completedAt); err != nil {
+			return nil, err
+		}
+		if users[userId] == nil {
+			users[userId] = make(completionTimes)
+		}
+		if users[userId][courseId] == nil {
+			users[userId][courseId] = make(map[string]time.Time)
+		}
+		users[userId][courseId][taskId] = completedAt.UTC()
+	}
+	return users, rows.Err()
+}
+
+//Returns the due date of the task, its own or the one of its course
+//Returns false if neither has a deadline
+func (d deadlineSet) dueAt(courseId, taskId string) (time.Time, bool) {
+	if dueAt, ok := d[courseId][taskId]; ok {
+		return dueAt, true
+	}
+	dueAt, ok := d[courseId][""]
+	return dueAt, ok
+}
+
+//Returns the timeliness of the task against its due date: on time or late if it is completed, from its completion time
+//overdue if it isn't completed past the due date, pending otherwise
+func timelinessOf(task TaskProgress, completedAt *time.Time, dueAt, now time.Time) string {
+	if task.Progress == "completed" && completedAt != nil {
+		if completedAt.After(dueAt) {
+			return "late"
+		}
+		return "on time"
+	}
+	if now.After(dueAt) {
+		return "overdue"
+	}
+	return "pending"
+}
+
+//Returns the overdue and late tasks of the user on the course, only the ones with the given status if it isn't empty
+func overdueTasks(userId string, course *CourseState, deadlines deadlineSet, completions completionTimes, now time.Time, status string) []OverdueTask {
+	tasks := make([]OverdueTask, 0)
+	for _, task := range course.Tasks {
+		dueAt, ok := deadlines.dueAt(course.CourseId, task.TaskId)
+		if !ok {
+			continue
+		}
+		//A completed task without a completion event in the progress log falls back to its update time
+		completedAt := completions.completedAt(course.CourseId, task.TaskId)
+		if completedAt == nil {
+			completedAt = task.UpdatedAt
+		}
+		timeliness := timelinessOf(task, completedAt, dueAt, now)
+		if (timeliness != "overdue" && timeliness != "late") || (status != "" && status != timeliness) {
+			continue
+		}
+		overdue := OverdueTask{UserId: userId, CourseId: course.CourseId, TaskId: task.TaskId, Progress: task.Progress, DueAt: dueAt, Status: timeliness}
+		if timeliness == "late" {
+			overdue.CompletedAt = completedAt
+		}
+		tasks = append(tasks, overdue)
+	}
+	return tasks
+}
+
+//Returns every deadline, ordered by course and task
+func (s *ProgressStore) getDeadlines(ctx context.Context) ([]Deadline, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectDeadlines.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deadlines := make([]Deadline, 0)
+	for rows.Next() {
+		var deadline Deadline
+		var dueAt time.Time
+		if err := rows.Scan(&deadline.CourseId, &deadline.TaskId, &dueAt); err != nil {
+			return nil, err
+		}
+		dueAt = dueAt.UTC()
+		deadline.DueAt = &dueAt
+		deadlines = append(deadlines, deadline)
+	}
+	return deadlines, rows.Err()
+}
+
+//Replaces the deadline of the task or course of every given deadline, in one transaction
+//A deadline set again is notified again once it passes
+func (s *ProgressStore) putDeadlines(ctx context.Context, deadlines []Deadline) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, deadline := range deadlines {
+		if _, err := s.deleteDeadline.in(tx).ExecContext(ctx, deadline.CourseId, deadline.TaskId); err != nil {
+			return err
+		}
+		if deadline.DueAt == nil {
+			continue
+		}
+		if _, err := s.insertDeadline.in(tx).ExecContext(ctx, deadline.CourseId, deadline.TaskId, deadline.DueAt.UTC().Truncate(time.Second)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//Returns the stored progress of every user on the course by user id, read inside the transaction
+func (s *ProgressStore) courseProgressByUser(ctx context.Context, tx *sql.Tx, courseId string) (map[string][]TaskProgress, error) {
+	rows, err := s.selectCourseRows.in(tx).QueryContext(ctx, courseId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string][]TaskProgress)
+	for rows.Next() {
+		var userId string
+		var task TaskProgress
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&userId, &task.TaskId, &task.Progress, &createdAt, &updatedAt, &task.Version); err != nil {
+			return nil, err
+		}
+		task.CreatedAt, task.UpdatedAt = &createdAt, &updatedAt
+		users[userId] = append(users[userId], task)
+	}
+	return users, rows.Err()
+}
+
+//Adds the users enrolled in the course or members of a cohort it is assigned to, without stored progress, read inside the transaction
+func (s *ProgressStore) addCourseLearners(ctx context.Context, tx *sql.Tx, courseId string, users map[string][]TaskProgress) error {
+	rows, err := s.selectCourseLearners.in(tx).QueryContext(ctx, courseId, courseId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err != nil {
+			return err
+		}
+		if _, ok := users[userId]; !ok {
+			users[userId] = nil
+		}
+	}
+	return rows.Err()
+}
+
+//Returns the progress of every user with stored progress on the course merged with the catalog of the course, by user id
+//With learners, also the progress of the users enrolled in the course or members of a cohort it is assigned to
+func (s *ProgressStore) getCourseStates(ctx context.Context, courseId string, taskGroups []TaskGroup, learners bool) (map[string]*CourseState, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	users, err := s.courseProgressByUser(ctx, tx, courseId)
+	if err != nil {
+		return nil, err
+	}
+	if learners {
+		if err := s.addCourseLearners(ctx, tx, courseId, users); err != nil {
+			return nil, err
+		}
+	}
+	courses := make(map[string]*CourseState, len(users))
+	for userId, seenTasks := range users {
+		course := newCourseState(courseId, taskGroups, seenTasks)
+		courses[userId] = &course
+	}
+	return courses, nil
+}
+
+//Appends a task.overdue event for every user with stored progress on the course, enrolled in it or member of a cohort it is assigned to,
+//who hasn't completed a task of the passed deadline
+//The tasks of a course deadline are the tasks of the catalog without a deadline of their own
+//Returns the number of events, the deadline is marked as notified in the same transaction
+func (s *ProgressStore) notifyDeadline(ctx context.Context, deadline Deadline, deadlines deadlineSet, taskGroups []TaskGroup) (int, error) {
+	var tasks []string
+	for _, taskId := range taskIds(taskGroups) {
+		if taskId == deadline.TaskId {
+			tasks = append(tasks, taskId)
+		} else if _, ok := deadlines[deadline.CourseId][taskId]; deadline.TaskId == "" && !ok {
+			tasks = append(tasks, taskId)
+		}
+	}
+
+	notified := 0
+	_, err := s.runBulkWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		notified = 0
+		//Locks the deadline, so it is notified once even when several instances run the job
+		var courseId string
+		err := s.selectDeadlineForUpdate.in(tx).QueryRowContext(ctx, deadline.CourseId, deadline.TaskId, *deadline.DueAt).Scan(&courseId)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		users, err := s.courseProgressByUser(ctx, tx, deadline.CourseId)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.addCourseLearners(ctx, tx, deadline.CourseId, users); err != nil {
+			return nil, err
+		}
+		for userId, seenTasks := range users {
+			course := newCourseState(deadline.CourseId, taskGroups, seenTasks)
+			for _, taskId := range tasks {
+				task := course.task(taskId)
+				if task.Progress == "completed" {
+					continue
+				}
+				var progress sql.NullString
+				if task.Progress != "not started" {
+					progress = sql.NullString{String: task.Progress, Valid: true}
+				}
+				_, err := tx.StmtContext(ctx, s.insertEvent).ExecContext(ctx, eventTaskOverdue, userId, deadline.CourseId, taskId, progress, nil, task.Version, *deadline.DueAt)
+				if err != nil {
+					return nil, err
+				}
+				notified++
+			}
+		}
+		_, err = s.markDeadlineNotified.in(tx).ExecContext(ctx, deadline.CourseId, deadline.TaskId, *deadline.DueAt)
+		return nil, err
+	})
+	return notified, err
+}
+
+//Notifies every passed deadline not notified yet
+//A deadline of a course missing from the course-manager-service is marked as notified without events
+func (s *ProgressStore) notifyDeadlines(ctx context.Context) error {
+	all, err := s.getDeadlines(ctx)
+	if err != nil {
+		return err
+	}
+	deadlines := newDeadlineSet(all)
+
+	queryCtx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectDueDeadlines.QueryContext(queryCtx, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	var due []Deadline
+	for rows.Next() {
+		var deadline Deadline
+		var dueAt time.Time
+		if err := rows.Scan(&deadline.CourseId, &deadline.TaskId, &dueAt); err != nil {
+			rows.Close()
+			return err
+		}
+		dueAt = dueAt.UTC()
+		deadline.DueAt = &dueAt
+		due = append(due, deadline)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, deadline := range due {
+		taskGroups, err := loadCourseCatalog(ctx, deadline.CourseId)
+		if serviceErr, ok := err.(*serviceError); ok && serviceErr.Status == http.StatusNotFound {
+			taskGroups, err = nil, nil
+		}
+		if err != nil {
+			log.Println("Failed to notify the deadline of course " + deadline.CourseId + ". \nCause: " + err.Error())
+			continue
+		}
+		notified, err := s.notifyDeadline(ctx, deadline, deadlines, taskGroups)
+		if err != nil {
+			return err
+		}
+		if notified > 0 {
+			log.Printf("Deadline %s of course %s task %q passed, %d tasks overdue\n", deadline.DueAt.Format(time.RFC3339), deadline.CourseId, deadline.TaskId, notified)
+		}
+	}
+	return nil
+}
+
+//Notifies the passed deadlines at the configured interval, until shutdown
+func scheduleDeadlineNotifications() {
+	if config.DeadlineCheckInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.DeadlineCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.notifyDeadlines(jobContext); err != nil {
+					log.Println("Failed to notify deadlines. \nCause: " + err.Error())
+				}
+			case <-jobContext.Done():
+				return
+			}
+		}
+	}()
+}
+
+//Handles the get method on /overdue/:user
+//Returns 200 status code and the overdue and late tasks of the user on every course with deadlines
+func HandleUserOverdueGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	deadlines, err := store.getDeadlines(r.Context())
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read deadlines.", err))
+		return
+	}
+	courses, err := loadUserState(r.Context(), ps.ByName("user"), ProgressFilter{CourseId: r.URL.Query().Get("course")})
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	completions, err := store.getCompletionTimes(r.Context(), store.selectUserCompletions, ps.ByName("user"))
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read progress log.", err))
+		return
+	}
+	set, now := newDeadlineSet(deadlines), time.Now()
+	tasks := make([]OverdueTask, 0)
+	for i := range courses {
+		tasks = append(tasks, overdueTasks(ps.ByName("user"), &courses[i], set, completions[ps.ByName("user")], now, r.URL.Query().Get("status"))...)
+	}
+	respondJSON(w, tasks)
+}
+
+//Handles the get method on /courses/:course/overdue
+//Returns 200 status code and the overdue and late tasks of every user with stored progress on the course, enrolled in it or member of a cohort it is assigned to
+func HandleCourseOverdueGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := checkDatabase(r.Context()); err != nil {
+		respondError(w, err)
+		return
+	}
+	taskGroups, err := loadCourseCatalog(r.Context(), ps.ByName("course"))
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	deadlines, err := store.getDeadlines(r.Context())
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read deadlines.", err))
+		return
+	}
+	courses, err := store.getCourseStates(r.Context(), ps.ByName("course"), taskGroups, true)
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not get course progress.", err))
+		return
+	}
+	completions, err := store.getCompletionTimes(r.Context(), store.selectCourseCompletions, ps.ByName("course"))
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read progress log.", err))
+		return
+	}
+	userIds := make([]string, 0, len(courses))
+	for userId := range courses {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	set, now := newDeadlineSet(deadlines), time.Now()
+	tasks := make([]OverdueTask, 0)
+	for _, userId := range userIds {
+		tasks = append(tasks, overdueTasks(userId, courses[userId], set, completions[userId], now, r.URL.Query().Get("status"))...)
+	}
+	respondJSON(w, tasks)
+}
+
+//Handles the get method on /admin/deadlines
+//Returns 200 status code and every deadline
+func HandleDeadlinesGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	deadlines, err := store.getDeadlines(r.Context())
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to read deadlines.", err))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: deadlines})
+}
+
+//Handles the put method on /admin/deadlines
+//Sets the deadline of every task or course of the body, a null due date removes it
+//Returns 200 status code and every deadline
+func HandleDeadlinesPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request DeadlinesRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read deadlines.", err))
+		return
+	}
+	if err := store.putDeadlines(r.Context(), request.Deadlines); err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to write deadlines.", err))
+		return
+	}
+	HandleDeadlinesGet(w, r, ps)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+)
+
+//SQL dialect of a database backend of the progress store
+//Queries are written with '?' placeholders and rebound to the placeholders of the backend
+type sqlDialect struct {
+	driver string
+
+	//Queries that can't be written the same way for every backend
+	selectUser  string
+	upsertTask  string
+	importTask  string
+	copyHistory string
+
+	rebind func(query string) string
+	//Runs the prepared upsert and returns true if it inserted a new row
+	upsertInserted func(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (bool, error)
+	//Returns true if the transaction failed because of a concurrent transaction and can be retried
+	isDeadlock func(err error) bool
+	//Returns true if the insert failed because the key already exists
+	isDuplicate func(err error) bool
+	//Returns the query of the migration for the backend
+	migration func(m migration) string
+	//Takes the lock serializing the migrations of the instances on the connection, waiting while another instance holds it
+	lockMigrations func(ctx context.Context, conn *sql.Conn) error
+	//Releases the lock of the migrations taken on the connection
+	unlockMigrations func(ctx context.Context, conn *sql.Conn) error
+}
+
+var dialect *sqlDialect
+
+var mysqlDialect = &sqlDialect{
+	driver: "mysql",
+	selectUser: "select course_id, task_id, progress, created_at, updated_at, version from COURSEPROGRESS where user_id = ?" +
+		" and (? = '' or course_id = ?) and (? = '' or progress = ?) and (? is null or updated_at >= ?)",
+	upsertTask: "INSERT INTO COURSEPROGRESS(user_id,course_id,task_id,progress,created_at,updated_at,version)" +
+		" values (?,?,?,?,CURRENT_TIMESTAMP,CURRENT_TIMESTAMP,1)" +
+		" ON DUPLICATE KEY UPDATE progress =VALUES(progress), updated_at =CURRENT_TIMESTAMP, version =version+1",
+	importTask: "INSERT INTO COURSEPROGRESS(user_id,course_id,task_id,progress,created_at,updated_at,version)" +
+		" values (?,?,?,?,?,?,1)" +
+		" ON DUPLICATE KEY UPDATE progress =VALUES(progress), updated_at =VALUES(updated_at), version =version+1",
+	copyHistory: "INSERT INTO COURSEPROGRESS_HISTORY(user_id,course_id,task_id,previous_progress,progress,version,changed_at,learner_transition)" +
+		" select user_id, ?, ?, previous_progress, progress, version, changed_at, learner_transition from COURSEPROGRESS_HISTORY where course_id = ? and task_id = ?",
+	rebind: func(query string) string {
+		return query
+	},
+	upsertInserted: func(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (bool, error) {
+		result, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return false, err
+		}
+		//MySQL reports 1 affected row for an insert and 2 for an update
+		affected, err := result.RowsAffected()
+		return affected == 1, err
+	},
+	isDeadlock: func(err error) bool {
+		mysqlErr, ok := err.(*mysql.MySQLError)
+		return ok && mysqlErr.Number == 1213
+	},
+	isDuplicate: func(err error) bool {
+		mysqlErr, ok := err.(*mysql.MySQLError)
+		return ok && mysqlErr.Number == 1062
+	},
+	migration: func(m migration) string {
+		return m.mysql
+	},
+	lockMigrations: func(ctx context.Context, conn *sql.Conn) error {
+		//GET_LOCK returns 1 when the lock is taken and 0 on timeout
+		var locked sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLock, migrationLockTimeout).Scan(&locked)
+		if err == nil && locked.Int64 != 1 {
+			err = errors.New("timed out waiting for the migrations of another instance")
+		}
+		return err
+	},
+	unlockMigrations: func(ctx context.Context, conn *sql.Conn) error {
+		var released sql.NullInt64
+		return conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", migrationLock).Scan(&released)
+	},
+}
+
+var postgresDialect = &sqlDialect{
+	driver: "postgres",
+	//Parameters compared to empty values or selected as columns are cast, as Postgres can't infer their type
+	selectUser: "select course_id, task_id, progress, created_at, updated_at, version from COURSEPROGRESS where user_id = ?" +
+		" and (CAST(? AS text) = '' or course_id = ?) and (CAST(? AS text) = '' or progress = ?)" +
+		" and (CAST(? AS timestamptz) is null or updated_at >= ?)",
+	upsertTask: "INSERT INTO COURSEPROGRESS(user_id,course_id,task_id,progress,created_at,updated_at,version)" +
+		" values (?,?,?,?,CURRENT_TIMESTAMP,CURRENT_TIMESTAMP,1)" +
+		" ON CONFLICT (user_id,course_id,task_id) DO UPDATE SET progress =EXCLUDED.progress, updated_at =CURRENT_TIMESTAMP, version =COURSEPROGRESS.version+1" +
+		" RETURNING (xmax = 0)",
+	importTask: "INSERT INTO COURSEPROGRESS(user_id,course_id,task_id,progress,created_at,updated_at,version)" +
+		" values (?,?,?,?,?,?,1)" +
+		" ON CONFLICT (user_id,course_id,task_id) DO UPDATE SET progress =EXCLUDED.progress, updated_at =EXCLUDED.updated_at, version =COURSEPROGRESS.version+1" +
+		" RETURNING (xmax = 0)",
+	copyHistory: "INSERT INTO COURSEPROGRESS_HISTORY(user_id,course_id,task_id,previous_progress,progress,version,changed_at,learner_transition)" +
+		" select user_id, CAST(? AS varchar), CAST(? AS varchar), previous_progress, progress, version, changed_at, learner_transition from COURSEPROGRESS_HISTORY where course_id = ? and task_id = ?",
+	rebind: func(query string) string {
+		var rebound strings.Builder
+		n := 0
+		for _, c := range query {
+			if c == '?' {
+				n++
+				rebound.WriteString("$" + strconv.Itoa(n))
+				continue
+			}
+			rebound.WriteRune(c)
+		}
+		return rebound.String()
+	},
+	upsertInserted: func(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (bool, error) {
+		//xmax is 0 for the row versions created by an insert
+		var inserted bool
+		err := stmt.QueryRowContext(ctx, args...).Scan(&inserted)
+		return inserted, err
+	},
+	isDeadlock: func(err error) bool {
+		pqErr, ok := err.(*pq.Error)
+		return ok && (pqErr.Code == "40P01" || pqErr.Code == "40001")
+	},
+	isDuplicate: func(err error) bool {
+		pqErr, ok := err.(*pq.Error)
+		return ok && pqErr.Code == "23505"
+	},
+	migration: func(m migration) string {
+		return m.postgres
+	},
+	lockMigrations: func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+		return err
+	},
+	unlockMigrations: func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+		return err
+	},
+}
+
+//Returns the dialect selected by the scheme of the database URL and the data source name of its driver
+//postgres:// and postgresql:// URLs select PostgreSQL, any other URL is a MySQL data source name, optionally prefixed by mysql://
+func dialectOf(databaseUrl string) (*sqlDialect, string) {
+	if strings.HasPrefix(databaseUrl, "postgres://") || strings.HasPrefix(databaseUrl, "postgresql://") {
+		return postgresDialect, databaseUrl
+	}
+	return mysqlDialect, withParseTime(strings.TrimPrefix(databaseUrl, "mysql://"))
+}
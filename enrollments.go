@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//Sources of the enrollments not made through the enrollment endpoint
+const (
+	//Enrollment made by the first progress write of the user on the course
+	enrollmentSourceAuto = "auto"
+	//Enrollment of a user with progress stored before the enrollments existed
+	enrollmentSourceProgress = "progress"
+)
+
+//Default source of an enrollment made through the enrollment endpoint
+const enrollmentSourceApi = "api"
+
+//Stored enrollment of a user in a course
+type EnrollmentRecord struct {
+	UserId     string    `json:"userId"`
+	CourseId   string    `json:"courseId"`
+	EnrolledAt time.Time `json:"enrolledAt"`
+	Source     string    `json:"source"`
+}
+
+type EnrollmentRequest struct {
+	Source string `json:"source"`
+}
+
+//Scopes of the listings of the courses of a user, the courses the user is enrolled in or every course of the catalog
+var enrollmentScopes = []string{"enrolled", "catalog"}
+
+//Query parameter of the scope of the listings of the courses of a user, documented in the OpenAPI document
+var scopeParameter = queryParameter("scope", "List the courses the user is enrolled in, the default, or every course of the catalog", &jsonSchema{Type: "string", Enum: enrollmentScopes})
+
+//Registers the write hook enrolling the users in the courses they write progress on, if auto enrollment is enabled
+func initEnrollments() {
+	if !config.AutoEnroll {
+		return
+	}
+	onProgressWrite(autoEnroll)
+}
+
+//Enrolls the user in the course of the change on the first write of a task, if the user isn't enrolled yet
+//A concurrent enrollment of the user is retried by the caller
+func autoEnroll(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	if change.Previous != nil || change.Current == nil {
+		return nil
+	}
+	var source string
+	err := tx.StmtContext(ctx, store.selectEnrollment).QueryRowContext(ctx, change.UserId, change.CourseId).Scan(&source)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	enrolledAt := time.Now().UTC().Truncate(time.Second)
+	if change.Current.CreatedAt != nil {
+		enrolledAt = change.Current.CreatedAt.UTC()
+	}
+	_, err = tx.StmtContext(ctx, store.insertEnrollment).ExecContext(ctx, change.UserId, change.CourseId, enrolledAt, enrollmentSourceAuto)
+	if err != nil && store.dialect.isDuplicate(err) {
+		return errConcurrentInsert
+	}
+	return err
+}
+
+//Returns the enrollments of the user by course id
+func (s *ProgressStore) getEnrollments(ctx context.Context, userId string) (map[string]*EnrollmentRecord, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectEnrollments.QueryContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	enrollments := make(map[string]*EnrollmentRecord)
+	for rows.Next() {
+		enrollment := EnrollmentRecord{UserId: userId}
+		if err := rows.Scan(&enrollment.CourseId, &enrollment.EnrolledAt, &enrollment.Source); err != nil {
+			return nil, err
+		}
+		enrollments[enrollment.CourseId] = &enrollment
+	}
+	return enrollments, rows.Err()
+}
+
+//Enrolls the user in the course, an existing enrollment is kept with its date and source
+//Returns the enrollment and true if it was created
+func (s *ProgressStore) enroll(ctx context.Context, userId, courseId, source string) (*EnrollmentRecord, bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	enrollment := &EnrollmentRecord{UserId: userId, CourseId: courseId, EnrolledAt: time.Now().UTC().Truncate(time.Second), Source: source}
+	_, err := s.insertEnrollment.ExecContext(ctx, userId, courseId, enrollment.EnrolledAt, source)
+	if err == nil {
+		return enrollment, true, nil
+	}
+	if !s.dialect.isDuplicate(err) {
+		return nil, false, err
+	}
+	enrollments, err := s.getEnrollments(ctx, userId)
+	if err != nil {
+		return nil, false, err
+	}
+	return enrollments[courseId], false, nil
+}
+
+//Unenrolls the user from the course, the progress of the user on the course is kept
+//Returns false if the user isn't enrolled in the course
+func (s *ProgressStore) unenroll(ctx context.Context, userId, courseId string) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	result, err := s.deleteEnrollment.ExecContext(ctx, userId, courseId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+//Restricts the filter to the courses the user is enrolled in, unless the scope parameter of the request is catalog
+//Returns a service error on an invalid scope
+func scopeFilter(r *http.Request, userId string, filter ProgressFilter) (ProgressFilter, error) {
+	switch r.URL.Query().Get("scope") {
+	case "", enrollmentScopes[0]:
+	case enrollmentScopes[1]:
+		return filter, nil
+	default:
+		return filter, newServiceError(http.StatusUnprocessableEntity, "Invalid scope. Valid scopes: 'enrolled','catalog'", nil)
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		return filter, err
+	}
+	enrollments, err := store.getEnrollments(r.Context(), userId)
+	if err != nil {
+		return filter, failure(r.Context(), "Database error: can not read enrollments.", err)
+	}
+	filter.Enrolled = enrollments
+	return filter, nil
+}
+
+//Returns the version of the enrollments, distinguishing the representations of the same courses enrolled at other dates
+func enrollmentsVersion(enrollments map[string]*EnrollmentRecord) string {
+	courseIds := make([]string, 0, len(enrollments))
+	for courseId := range enrollments {
+		courseIds = append(courseIds, courseId)
+	}
+	sort.Strings(courseIds)
+	h := newVersionHash()
+	for _, courseId := range courseIds {
+		writeVersionPart(h, courseId, enrollments[courseId].EnrolledAt.Format(time.RFC3339), enrollments[courseId].Source)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+//Returns the enrollment resources of the courses, with the dates and sources of the enrollments of the filter
+func newScopedEnrollmentResources(courses []CourseState, filter ProgressFilter) []EnrollmentResource {
+	resources := newEnrollmentResources(courses)
+	for i := range resources {
+		if enrollment := filter.Enrolled[resources[i].CourseId]; enrollment != nil {
+			resources[i].EnrolledAt = &enrollment.EnrolledAt
+			resources[i].Source = enrollment.Source
+		}
+	}
+	return resources
+}
+
+//Handles the put method on /v2/users/:user/enrollments/:course
+//Returns 201 status code and the enrollment, or 200 status code and the existing enrollment if the user is already enrolled
+func HandleEnrollmentPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request EnrollmentRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read enrollment.", err))
+		return
+	}
+	if request.Source == "" {
+		request.Source = enrollmentSourceApi
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if _, err := loadCourseCatalog(r.Context(), ps.ByName("course")); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	enrollment, created, err := store.enroll(r.Context(), ps.ByName("user"), ps.ByName("course"), request.Source)
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not enroll user.", err))
+		return
+	}
+	if created {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	}
+	respondJSON(w, ObjectEnvelope{Data: enrollment})
+}
+
+//Handles the delete method on /v2/users/:user/enrollments/:course
+//Returns 204 status code, or 404 if the user isn't enrolled in the course
+func HandleEnrollmentDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	removed, err := store.unenroll(r.Context(), ps.ByName("user"), ps.ByName("course"))
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Database error: can not unenroll user.", err))
+		return
+	}
+	if !removed {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "User "+ps.ByName("user")+" isn't enrolled in course "+ps.ByName("course"), nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
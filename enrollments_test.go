@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCatalogScopeKeepsEveryCourse(t *testing.T) {
+	filter, err := scopeFilter(httptest.NewRequest("GET", "/progress/ana?scope=catalog", nil), "ana", ProgressFilter{CourseId: "algebra"})
+	if err != nil || filter.Enrolled != nil || filter.CourseId != "algebra" {
+		t.Errorf("catalog scope filtered as %+v, %v", filter, err)
+	}
+	_, err = scopeFilter(httptest.NewRequest("GET", "/progress/ana?scope=everything", nil), "ana", ProgressFilter{})
+	if serviceErr, ok := err.(*serviceError); !ok || serviceErr.Status != http.StatusUnprocessableEntity {
+		t.Errorf("invalid scope answered %v, want 422", err)
+	}
+
+	initConfig()
+	for _, path := range []string{"/progress/ana?scope=everything", "/v2/users/ana/enrollments?scope=everything"} {
+		if resp := serveTestRequest("GET", path, "", nil); resp.Code != http.StatusUnprocessableEntity {
+			t.Errorf("GET %s answered %d, want 422", path, resp.Code)
+		}
+	}
+	if resp := serveTestRequest("PUT", "/v2/users/ana/enrollments/algebra", `{"source":`, nil); resp.Code != http.StatusBadRequest {
+		t.Errorf("malformed enrollment answered %d, want 400", resp.Code)
+	}
+}
+
+func TestScopedEnrollmentResources(t *testing.T) {
+	groups := []TaskGroup{{Title: "Tasks", Tasks: []*BaseTaskInfo{{Id: "intro"}}}}
+	courses := []CourseState{newCourseState("algebra", groups, nil), newCourseState("biology", groups, nil)}
+	enrolledAt := time.Date(2018, 5, 14, 9, 30, 0, 0, time.UTC)
+	enrollments := map[string]*EnrollmentRecord{"algebra": {UserId: "ana", CourseId: "algebra", EnrolledAt: enrolledAt, Source: enrollmentSourceApi}}
+
+	resources := newScopedEnrollmentResources(courses, ProgressFilter{Enrolled: enrollments})
+	if resources[0].EnrolledAt == nil || !resources[0].EnrolledAt.Equal(enrolledAt) || resources[0].Source != enrollmentSourceApi {
+		t.Errorf("enrolled course %+v", resources[0])
+	}
+	if resources[1].EnrolledAt != nil || resources[1].Source != "" {
+		t.Errorf("course of the catalog not enrolled in %+v", resources[1])
+	}
+
+	version := enrollmentsVersion(enrollments)
+	enrollments["algebra"].Source = enrollmentSourceAuto
+	if enrollmentsVersion(enrollments) == version {
+		t.Error("enrollments version unchanged by the source of an enrollment")
+	}
+}
+
+func TestAutoEnrollmentIsConfigurable(t *testing.T) {
+	hooks := progressWriteHooks
+	defer func() { progressWriteHooks = hooks }()
+
+	initConfig()
+	config.AutoEnroll = false
+	progressWriteHooks = nil
+	initEnrollments()
+	if len(progressWriteHooks) != 0 {
+		t.Error("auto enrollment registered while disabled")
+	}
+	config.AutoEnroll = true
+	initEnrollments()
+	if len(progressWriteHooks) != 1 {
+		t.Errorf("%d write hooks registered by the auto enrollment, want 1", len(progressWriteHooks))
+	}
+
+	//Only the first write of a task can enroll the user, the hook doesn't read the enrollments otherwise
+	started := &TaskProgress{TaskId: "intro", Progress: "started"}
+	for _, change := range []*ProgressChange{{Previous: started, Current: started}, {Previous: started}} {
+		if err := autoEnroll(context.Background(), nil, change); err != nil {
+			t.Errorf("change %+v enrolled with %v", change, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func newVersionHash() hash.Hash {
+	return sha1.New()
+}
+
+func writeVersionPart(h hash.Hash, parts ...string) {
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+}
+
+func quoteVersion(h hash.Hash) string {
+	return "\"" + hex.EncodeToString(h.Sum(nil))[:20] + "\""
+}
+
+//Returns the version of the course catalog, derived from its groups and tasks
+func catalogVersion(taskGroups []TaskGroup) string {
+	h := newVersionHash()
+	for _, group := range taskGroups {
+		writeVersionPart(h, "group", group.Title)
+		for _, task := range group.Tasks {
+			writeVersionPart(h, task.Id)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+//Returns the entity tag of the progress of a task, derived from the row version, the status and the catalog version
+func taskETag(course *CourseState, task TaskProgress) string {
+	h := newVersionHash()
+	writeVersionPart(h, course.CatalogVersion, course.CourseId, task.TaskId, strconv.Itoa(task.Version), task.Status)
+	return quoteVersion(h)
+}
+
+//Returns the entity tag of the progress of the courses, derived from the row versions, the statuses and the catalog versions
+//The variant distinguishes the representations of the same courses, like the pages of a listing
+func coursesETag(courses []CourseState, variant string) string {
+	h := newVersionHash()
+	writeVersionPart(h, variant)
+	for _, course := range courses {
+		writeVersionPart(h, course.CatalogVersion, course.CourseId)
+		for _, task := range course.Tasks {
+			writeVersionPart(h, task.TaskId, strconv.Itoa(task.Version), task.Status)
+		}
+	}
+	return quoteVersion(h)
+}
+
+//Returns true if the entity tag is matched by the If-Match or If-None-Match header value
+//Weak comparison is used, as the entity tags of this service are only weakly validated
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//Sets the ETag header and responds with 304 status code if the If-None-Match header matches it
+//Returns true if the response has been written
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+//Returns a service error if the If-Match header is present and doesn't match the entity tag
+func checkIfMatch(ifMatch, etag string) error {
+	if ifMatch != "" && !etagMatches(ifMatch, etag) {
+		return newServiceError(http.StatusPreconditionFailed, "Precondition failed: the progress was modified, current ETag is "+etag, nil)
+	}
+	return nil
+}
+
+var errVersionConflict = newServiceError(http.StatusPreconditionFailed, "Precondition failed: the progress was modified concurrently", nil)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEntityTagsFollowVersionsAndCatalogs(t *testing.T) {
+	groups := []TaskGroup{{Title: "Tasks", Tasks: []*BaseTaskInfo{{Id: "intro"}, {Id: "sets"}}}}
+	course := newCourseState("algebra", groups, []TaskProgress{{TaskId: "intro", Progress: "started", Version: 1}})
+	etag := taskETag(&course, course.Tasks[0])
+
+	updated := newCourseState("algebra", groups, []TaskProgress{{TaskId: "intro", Progress: "completed", Version: 2}})
+	if taskETag(&updated, updated.Tasks[0]) == etag {
+		t.Error("entity tag of the task unchanged by a write")
+	}
+	moved := newCourseState("algebra", []TaskGroup{{Title: "Tasks", Tasks: []*BaseTaskInfo{{Id: "sets"}, {Id: "intro"}}}}, []TaskProgress{{TaskId: "intro", Progress: "started", Version: 1}})
+	if taskETag(&moved, *moved.task("intro")) == etag {
+		t.Error("entity tag of the task unchanged by a change of the catalog")
+	}
+	if again := newCourseState("algebra", groups, []TaskProgress{{TaskId: "intro", Progress: "started", Version: 1}}); taskETag(&again, again.Tasks[0]) != etag {
+		t.Error("entity tag of the same progress changed")
+	}
+
+	courses := []CourseState{course}
+	if coursesETag(courses, "limit=1") == coursesETag(courses, "limit=2") {
+		t.Error("entity tags of two pages of the same courses are equal")
+	}
+	if coursesETag(courses, "") == coursesETag([]CourseState{updated}, "") {
+		t.Error("entity tag of the courses unchanged by a write")
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	etag := `"0123456789abcdef0123"`
+	for header, matches := range map[string]bool{
+		etag:                         true,
+		"W/" + etag:                  true,
+		`"other", ` + etag:           true,
+		"*":                          true,
+		`"other"`:                    false,
+		`"0123456789abcdef012"`:      false,
+		"0123456789abcdef0123":       false,
+		`"other", W/"0123456789abc"`: false,
+	} {
+		if etagMatches(header, etag) != matches {
+			t.Errorf("%s matches %s: %t, want %t", header, etag, !matches, matches)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/progress/ana/algebra", nil)
+	recorder := httptest.NewRecorder()
+	if notModified(recorder, request, etag) || recorder.Header().Get("ETag") != etag {
+		t.Errorf("unconditional request not modified, ETag %s", recorder.Header().Get("ETag"))
+	}
+	request.Header.Set("If-None-Match", etag)
+	recorder = httptest.NewRecorder()
+	if !notModified(recorder, request, etag) || recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("request with the current ETag answered %d:\n%s", recorder.Code, recorder.Body.String())
+	}
+	request.Header.Set("If-None-Match", `"other"`)
+	if notModified(httptest.NewRecorder(), request, etag) {
+		t.Error("request with another ETag not modified")
+	}
+
+	if err := checkIfMatch("", etag); err != nil {
+		t.Errorf("unconditional write rejected, %v", err)
+	}
+	if err := checkIfMatch(etag, etag); err != nil {
+		t.Errorf("write with the current ETag rejected, %v", err)
+	}
+	if err, ok := checkIfMatch(`"other"`, etag).(*serviceError); !ok || err.Status != http.StatusPreconditionFailed {
+		t.Errorf("write with another ETag answered %v, want 412", err)
+	}
+}
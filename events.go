@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+//Types of the events of the progress log
+const (
+	eventProgressStarted   = "ProgressStarted"
+	eventProgressCompleted = "ProgressCompleted"
+	eventProgressReset     = "ProgressReset"
+	//Records a score of the user on the task, it doesn't change the progress
+	eventScoreRecorded = "ScoreRecorded"
+)
+
+//Event of the append-only progress log
+//Version is the version of the stored progress after the event, or before it for a reset
+type ProgressEvent struct {
+	Id         int64
+	Type       string
+	UserId     string
+	CourseId   string
+	TaskId     string
+	Progress   string
+	Score      *float64
+	Version    int
+	OccurredAt time.Time
+}
+
+//Returns the type of the event recording the change
+func eventTypeOf(change *ProgressChange) string {
+	switch {
+	case change.Current == nil:
+		return eventProgressReset
+	case change.Current.Progress == "completed":
+		return eventProgressCompleted
+	}
+	return eventProgressStarted
+}
+
+//Appends the event recording the change to the progress log
+func (s *ProgressStore) appendEvent(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	var progress sql.NullString
+	version := versionOf(change.Previous)
+	if change.Current != nil {
+		progress = sql.NullString{String: change.Current.Progress, Valid: true}
+		version = change.Current.Version
+	}
+	_, err := tx.StmtContext(ctx, s.insertEvent).ExecContext(ctx, eventTypeOf(change), change.UserId, change.CourseId, change.TaskId, progress, nil, version, change.changedAt())
+	return err
+}
+
+//Functions called inside the transaction of every recorded score, after its event is appended
+//An error returned by a hook rolls back the score
+var scoreHooks []func(ctx context.Context, tx *sql.Tx, event *ProgressEvent) error
+
+//Registers a function to be called inside the transaction of every recorded score
+func onScoreRecorded(hook func(ctx context.Context, tx *sql.Tx, event *ProgressEvent) error) {
+	scoreHooks = append(scoreHooks, hook)
+}
+
+//Appends a score of the user on the task to the progress log, the stored progress isn't changed
+//The event has the version of the stored progress, 0 if the task isn't started
+//Returns the recorded event
+func (s *ProgressStore) recordScore(ctx context.Context, userId, courseId, taskId string, score float64) (*ProgressEvent, error) {
+	var event *ProgressEvent
+	_, err := s.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		current, err := s.selectForUpdate(ctx, tx, userId, courseId, taskId)
+		if err != nil {
+			return nil, err
+		}
+		event, err = s.recordScoreLocked(ctx, tx, userId, courseId, taskId, score, current)
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+//Appends the score inside the transaction, after the current progress was read for update
+func (s *ProgressStore) recordScoreLocked(ctx context.Context, tx *sql.Tx, userId, courseId, taskId string, score float64, current *TaskProgress) (*ProgressEvent, error) {
+	event := &ProgressEvent{Type: eventScoreRecorded, UserId: userId, CourseId: courseId, TaskId: taskId, Score: &score,
+		Version: versionOf(current), OccurredAt: time.Now().UTC().Truncate(time.Second)}
+	_, err := tx.StmtContext(ctx, s.insertEvent).ExecContext(ctx, event.Type, userId, courseId, taskId, nil, score, event.Version, event.OccurredAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range scoreHooks {
+		if err := hook(ctx, tx, event); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+//Returns the last score recorded on the task, read inside the transaction
+//Returns nil if no score was recorded
+func (s *ProgressStore) lastScore(ctx context.Context, tx *sql.Tx, userId, courseId, taskId string) (*float64, error) {
+	var score float64
+	err := s.selectLastScore.in(tx).QueryRowContext(ctx, userId, courseId, taskId, eventScoreRecorded).Scan(&score)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &score, nil
+}
+
+func scanEvents(rows *sql.Rows) ([]ProgressEvent, error) {
+	defer rows.Close()
+	events := make([]ProgressEvent, 0)
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func scanEvent(rows *sql.Rows) (ProgressEvent, error) {
+	var event ProgressEvent
+	var progress sql.NullString
+	var score sql.NullFloat64
+	err := rows.Scan(&event.Id, &event.Type, &event.UserId, &event.CourseId, &event.TaskId, &progress, &score, &event.Version, &event.OccurredAt)
+	event.Progress = progress.String
+	if score.Valid {
+		event.Score = &score.Float64
+	}
+	return event, err
+}
+
+//Calls the function for every event of the progress log, ordered by user, course and task, then in log order
+//The events are streamed on a connection of their own, so the function can write in a transaction meanwhile
+//The iteration isn't bounded by the query timeout and stops at the first error returned by the function
+func (s *ProgressStore) eachTaskEvent(ctx context.Context, fn func(event ProgressEvent) error) error {
+	rows, err := s.selectTaskEvents.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//Current state of the progress, folded from the events of the log
+type progressProjection map[[3]string]*ProgressItem
+
+//Applies the event on the projection, the events must be applied in log order
+func (p progressProjection) apply(event ProgressEvent) {
+	key := [3]string{event.UserId, event.CourseId, event.TaskId}
+	switch event.Type {
+	case eventProgressStarted, eventProgressCompleted:
+		occurredAt := event.OccurredAt
+		item := p[key]
+		if item == nil {
+			item = &ProgressItem{CourseId: event.CourseId, TaskId: event.TaskId, CreatedAt: &occurredAt}
+			p[key] = item
+		}
+		item.Progress = event.Progress
+		item.UpdatedAt = &occurredAt
+		item.Version = event.Version
+	case eventProgressReset:
+		delete(p, key)
+	}
+}
+
+//Returns the keys of the projection sorted by user, course and task
+func (p progressProjection) keys() [][3]string {
+	keys := make([][3]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		for k := range keys[i] {
+			if keys[i][k] != keys[j][k] {
+				return keys[i][k] < keys[j][k]
+			}
+		}
+		return false
+	})
+	return keys
+}
+
+//Get the progress of the user as it was at the given time, replayed from the progress log
+//Returns all courses with tasks and progress, and the error
+func (s *ProgressStore) getUserProgressAt(ctx context.Context, userId string, at time.Time) ([]ProgressItem, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectUserEventsUntil.QueryContext(ctx, userId, at)
+	if err != nil {
+		return nil, err
+	}
+	events, err := scanEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	projection := make(progressProjection)
+	for _, event := range events {
+		projection.apply(event)
+	}
+	items := make([]ProgressItem, 0, len(projection))
+	for _, key := range projection.keys() {
+		items = append(items, *projection[key])
+	}
+	return items, nil
+}
+
+//Rebuilds the COURSEPROGRESS projection by replaying the whole progress log, in one transaction
+//The log is streamed task by task, so only the projection of one task is held in memory
+//The rebuild isn't bounded by the query timeout, it should be run while the service doesn't take writes
+//Returns the number of rows of the rebuilt projection
+func (s *ProgressStore) rebuildProgressProjection(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM COURSEPROGRESS"); err != nil {
+		return 0, err
+	}
+	insert := tx.StmtContext(ctx, s.insertProjected)
+	count := 0
+	projection := make(progressProjection)
+	//Inserts the projection of the replayed task, if it wasn't reset
+	flush := func() error {
+		for key, item := range projection {
+			_, err := insert.ExecContext(ctx, key[0], item.CourseId, item.TaskId, item.Progress, *item.CreatedAt, *item.UpdatedAt, item.Version)
+			if err != nil {
+				return err
+			}
+			delete(projection, key)
+			count++
+		}
+		return nil
+	}
+	var task [3]string
+	err = s.eachTaskEvent(ctx, func(event ProgressEvent) error {
+		if key := [3]string{event.UserId, event.CourseId, event.TaskId}; key != task {
+			if err := flush(); err != nil {
+				return err
+			}
+			task = key
+		}
+		projection.apply(event)
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
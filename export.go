@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//Filters of an export
+//An export with a watermark is incremental: it only has the tasks changed since the watermark of a previous export
+type ExportOptions struct {
+	Format       string
+	CourseId     string
+	UpdatedSince *time.Time
+	Watermark    *time.Time
+}
+
+//Number of rows buffered in a Parquet row group
+const exportRowGroupSize = 10000
+
+var exportContentTypes = map[string]string{
+	"csv":     "text/csv",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+//Writes exported progress records in an export format
+type exportWriter interface {
+	write(record ProgressRecord) error
+	close() error
+}
+
+func newExportWriter(format string, w io.Writer) (exportWriter, error) {
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		err := writer.Write([]string{"userId", "courseId", "taskId", "progress", "createdAt", "updatedAt", "version"})
+		return &csvExportWriter{writer: writer}, err
+	case "ndjson":
+		return &ndjsonExportWriter{encoder: json.NewEncoder(w)}, nil
+	case "parquet":
+		return newParquetExportWriter(w)
+	}
+	return nil, errors.New("unknown export format " + format + ", valid formats: 'csv','ndjson','parquet'")
+}
+
+//Writes CSV rows with the columns read by the import, empty timestamps and version 0 for reset tasks
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func formatExportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (c *csvExportWriter) write(record ProgressRecord) error {
+	return c.writer.Write([]string{record.UserId, record.CourseId, record.TaskId, record.Progress,
+		formatExportTime(record.CreatedAt), formatExportTime(record.UpdatedAt), strconv.Itoa(record.Version)})
+}
+
+func (c *csvExportWriter) close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+//Writes one JSON object per line, in the format read by the import
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonExportWriter) write(record ProgressRecord) error {
+	return n.encoder.Encode(record)
+}
+
+func (n *ndjsonExportWriter) close() error {
+	return nil
+}
+
+//Writes a Parquet file, the timestamps are stored as UTC milliseconds and are null for reset tasks
+type parquetExportWriter struct {
+	writer *parquetWriter
+
+	userId, courseId, taskId, progress, createdAt, updatedAt, version *parquetColumn
+}
+
+func newParquetExportWriter(w io.Writer) (*parquetExportWriter, error) {
+	p := &parquetExportWriter{
+		userId:    &parquetColumn{name: "userId", physical: parquetByteArray, converted: parquetUTF8},
+		courseId:  &parquetColumn{name: "courseId", physical: parquetByteArray, converted: parquetUTF8},
+		taskId:    &parquetColumn{name: "taskId", physical: parquetByteArray, converted: parquetUTF8},
+		progress:  &parquetColumn{name: "progress", physical: parquetByteArray, converted: parquetUTF8},
+		createdAt: &parquetColumn{name: "createdAt", physical: parquetInt64, converted: parquetTimestampMillis, optional: true},
+		updatedAt: &parquetColumn{name: "updatedAt", physical: parquetInt64, converted: parquetTimestampMillis, optional: true},
+		version:   &parquetColumn{name: "version", physical: parquetInt32, converted: parquetNoConversion},
+	}
+	p.writer = newParquetWriter(w, exportRowGroupSize, p.userId, p.courseId, p.taskId, p.progress, p.createdAt, p.updatedAt, p.version)
+	return p, p.writer.begin()
+}
+
+func addParquetTime(column *parquetColumn, t *time.Time) {
+	if t == nil {
+		column.addNull()
+		return
+	}
+	column.addInt64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func (p *parquetExportWriter) write(record ProgressRecord) error {
+	p.userId.addByteArray(record.UserId)
+	p.courseId.addByteArray(record.CourseId)
+	p.taskId.addByteArray(record.TaskId)
+	p.progress.addByteArray(record.Progress)
+	addParquetTime(p.createdAt, record.CreatedAt)
+	addParquetTime(p.updatedAt, record.UpdatedAt)
+	p.version.addInt32(int32(record.Version))
+	return p.writer.endRow()
+}
+
+func (p *parquetExportWriter) close() error {
+	return p.writer.close()
+}
+
+//Returns the watermark of an export starting now: the database time minus the configured lag, truncated to the second
+//Writes timestamped before the watermark are expected to be committed, so the next incremental export starts at it
+func (s *ProgressStore) exportWatermark(ctx context.Context) (time.Time, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	var now time.Time
+	if err := s.db.QueryRowContext(ctx, "select CURRENT_TIMESTAMP").Scan(&now); err != nil {
+		return now, err
+	}
+	return now.Add(-config.ExportWatermarkLag).Truncate(time.Second).UTC(), nil
+}
+
+//Streams the progress records selected by the options to the function, ordered by user, course and task
+//A full export has the stored progress, an incremental export has every task with a progress log entry
+//recorded between the watermark of the options and the given one, reset tasks are exported as not started without timestamps
+//The export runs in one query that isn't bounded by the query timeout, the function is called as the rows are read
+func (s *ProgressStore) exportProgress(ctx context.Context, options ExportOptions, watermark time.Time, fn func(record ProgressRecord) error) error {
+	var query string
+	var args []interface{}
+	if options.Watermark == nil {
+		query = "select user_id, course_id, task_id, progress, created_at, updated_at, version from COURSEPROGRESS where 1 = 1"
+		if options.CourseId != "" {
+			query += " and course_id = ?"
+			args = append(args, options.CourseId)
+		}
+		if options.UpdatedSince != nil {
+			query += " and updated_at >= ?"
+			args = append(args, *options.UpdatedSince)
+		}
+		query += " order by user_id, course_id, task_id"
+	} else {
+		query = "select e.user_id, e.course_id, e.task_id, p.progress, p.created_at, p.updated_at, p.version" +
+			" from (select distinct user_id, course_id, task_id from COURSEPROGRESS_EVENTS where recorded_at >= ? and recorded_at < ?"
+		args = append(args, *options.Watermark, watermark)
+		if options.CourseId != "" {
+			query += " and course_id = ?"
+			args = append(args, options.CourseId)
+		}
+		query += ") e left join COURSEPROGRESS p on p.user_id = e.user_id and p.course_id = e.course_id and p.task_id = e.task_id" +
+			" order by e.user_id, e.course_id, e.task_id"
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record ProgressRecord
+		var progress sql.NullString
+		var version sql.NullInt64
+		err := rows.Scan(&record.UserId, &record.CourseId, &record.TaskId, &progress, &record.CreatedAt, &record.UpdatedAt, &version)
+		if err != nil {
+			return err
+		}
+		record.Progress = "not started"
+		if progress.Valid {
+			record.Progress = progress.String
+		}
+		record.Version = int(version.Int64)
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//Parses the filters of an export request
+//The export command passes its flags with the names of the query parameters
+func parseExportOptions(values url.Values) (ExportOptions, error) {
+	options := ExportOptions{Format: values.Get("format"), CourseId: values.Get("course")}
+	if options.Format == "" {
+		options.Format = "ndjson"
+	}
+	if _, ok := exportContentTypes[options.Format]; !ok {
+		return options, newServiceError(http.StatusUnprocessableEntity, "Invalid format, valid formats: 'csv','ndjson','parquet'", nil)
+	}
+	for name, timestamp := range map[string]**time.Time{"updatedSince": &options.UpdatedSince, "watermark": &options.Watermark} {
+		if text := values.Get(name); text != "" {
+			parsed, err := time.Parse(time.RFC3339, text)
+			if err != nil {
+				return options, newServiceError(http.StatusUnprocessableEntity, "Invalid "+name+", expected RFC 3339 timestamp.", err)
+			}
+			*timestamp = &parsed
+		}
+	}
+	if options.UpdatedSince != nil && options.Watermark != nil {
+		return options, newServiceError(http.StatusUnprocessableEntity, "updatedSince can't be combined with a watermark", nil)
+	}
+	return options, nil
+}
+
+//Handles the get method on /admin/exports
+//Streams the selected progress records in the requested format, with the watermark of the next incremental export in the X-Export-Watermark header
+//Errors after the first row was sent abort the response, so a truncated export can't be mistaken for a complete one
+func HandleExportGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	options, err := parseExportOptions(r.URL.Query())
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	watermark, err := store.exportWatermark(r.Context())
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to read the export watermark.", err))
+		return
+	}
+
+	var writer exportWriter
+	start := func() error {
+		w.Header().Set("Content-Type", exportContentTypes[options.Format])
+		w.Header().Set("Content-Disposition", "attachment; filename=\"progress."+options.Format+"\"")
+		w.Header().Set("X-Export-Watermark", watermark.Format(time.RFC3339))
+		var err error
+		writer, err = newExportWriter(options.Format, w)
+		return err
+	}
+	err = store.exportProgress(r.Context(), options, watermark, func(record ProgressRecord) error {
+		if writer == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return writer.write(record)
+	})
+	if err == nil && writer == nil {
+		err = start()
+	}
+	if err == nil {
+		err = writer.close()
+	}
+	if err != nil && writer == nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to export progress.", err))
+		return
+	}
+	if err != nil {
+		log.Println(failure(r.Context(), "Export aborted.", err).Error())
+		panic(http.ErrAbortHandler)
+	}
+}
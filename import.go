@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Progress states a task can be set to or imported with
+var progressStates = []string{"started", "completed"}
+
+//Options of a bulk import
+//Rows already committed by a previous run with the same import id are skipped, so an interrupted import can be resumed
+type ImportOptions struct {
+	Format       string
+	ImportId     string
+	BatchSize    int
+	DryRun       bool
+	CheckCatalog bool
+}
+
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+//Report of a bulk import
+//The counters include the rows of the previous runs of a resumed import, the errors are the ones of the current run
+type ImportReport struct {
+	ImportId        string           `json:"importId,omitempty"`
+	DryRun          bool             `json:"dryRun"`
+	ResumedAfter    int              `json:"resumedAfter"`
+	Rows            int              `json:"rows"`
+	Imported        int              `json:"imported"`
+	Skipped         int              `json:"skipped"`
+	Failed          int              `json:"failed"`
+	Errors          []ImportRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errorsTruncated,omitempty"`
+}
+
+const maxImportErrors = 1000
+
+func (r *ImportReport) fail(row int, err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, ImportRowError{Row: row, Error: err.Error()})
+	} else {
+		r.ErrorsTruncated = true
+	}
+}
+
+//Reads the rows of a bulk import
+//A malformed row is returned as row error and the reading can go on, any other error stops the import
+type importReader interface {
+	next() (record ProgressRecord, rowErr error, err error)
+}
+
+//Returns the reader of the rows in the format, 'csv' or 'ndjson'
+func newImportReader(format string, r io.Reader) (importReader, error) {
+	switch format {
+	case "csv":
+		return newCSVImportReader(r)
+	case "ndjson":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &ndjsonImportReader{scanner: scanner}, nil
+	}
+	return nil, errors.New("unknown import format " + format + ", valid formats: 'csv','ndjson'")
+}
+
+//Reads CSV rows, the header names the columns like the NDJSON fields
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+func newCSVImportReader(r io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("failed to read CSV header: " + err.Error())
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"userId", "courseId", "taskId", "progress"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.New("CSV header misses the " + name + " column")
+		}
+	}
+	return &csvImportReader{reader: reader, columns: columns}, nil
+}
+
+func (c *csvImportReader) next() (record ProgressRecord, rowErr error, err error) {
+	fields, err := c.reader.Read()
+	if _, ok := err.(*csv.ParseError); ok {
+		return record, err, nil
+	}
+	if err != nil {
+		return record, nil, err
+	}
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok && i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+	record.UserId, record.CourseId, record.TaskId, record.Progress = field("userId"), field("courseId"), field("taskId"), field("progress")
+	for name, timestamp := range map[string]**time.Time{"createdAt": &record.CreatedAt, "updatedAt": &record.UpdatedAt} {
+		if text := field(name); text != "" {
+			parsed, err := time.Parse(time.RFC3339, text)
+			if err != nil {
+				return record, errors.New("invalid " + name + ", expected RFC 3339 timestamp"), nil
+			}
+			*timestamp = &parsed
+		}
+	}
+	return record, nil, nil
+}
+
+//Reads one JSON object per line, empty lines are ignored
+type ndjsonImportReader struct {
+	scanner *bufio.Scanner
+}
+
+func (n *ndjsonImportReader) next() (record ProgressRecord, rowErr error, err error) {
+	for n.scanner.Scan() {
+		line := n.scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		return record, json.Unmarshal(line, &record), nil
+	}
+	if err := n.scanner.Err(); err != nil {
+		return record, nil, err
+	}
+	return record, nil, io.EOF
+}
+
+//Validates the imported progress and fills its missing timestamps
+//Timestamps are truncated to seconds, the precision of the MySQL DATETIME columns
+func validateImportRecord(record *ProgressRecord) error {
+	for _, id := range []string{record.UserId, record.CourseId, record.TaskId} {
+		if id == "" || len(id) > 100 {
+			return errors.New("userId, courseId and taskId are required and at most 100 characters long")
+		}
+	}
+	valid := false
+	for _, state := range progressStates {
+		valid = valid || record.Progress == state
+	}
+	if !valid {
+		return errors.New("invalid progress type " + strconv.Quote(record.Progress) + ". Valid types: '" + strings.Join(progressStates, "','") + "'")
+	}
+
+	if record.UpdatedAt == nil {
+		now := time.Now()
+		record.UpdatedAt = &now
+	}
+	if record.CreatedAt == nil {
+		record.CreatedAt = record.UpdatedAt
+	}
+	createdAt, updatedAt := record.CreatedAt.UTC().Truncate(time.Second), record.UpdatedAt.UTC().Truncate(time.Second)
+	if createdAt.After(updatedAt) {
+		return errors.New("createdAt is after updatedAt")
+	}
+	record.CreatedAt, record.UpdatedAt = &createdAt, &updatedAt
+	return nil
+}
+
+//Checks that the task of the imported progress is in the catalog of its course, caching the catalogs
+//Returns a row error if it isn't, or an error if the catalog couldn't be read
+func checkImportCatalog(ctx context.Context, catalogs map[string][]TaskGroup, record ProgressRecord) (rowErr error, err error) {
+	taskGroups, ok := catalogs[record.CourseId]
+	if !ok {
+		taskGroups, err = loadCourseCatalog(ctx, record.CourseId)
+		if serviceErr, isServiceErr := err.(*serviceError); isServiceErr && serviceErr.Status == http.StatusNotFound {
+			taskGroups = nil
+		} else if err != nil {
+			return nil, err
+		}
+		catalogs[record.CourseId] = taskGroups
+	}
+	if taskGroups == nil {
+		return errors.New("course " + record.CourseId + " not found or has no tasks"), nil
+	}
+	if !catalogHasTask(taskGroups, record.TaskId) {
+		return errors.New("task " + record.TaskId + " not found in the catalog of course " + record.CourseId), nil
+	}
+	return nil, nil
+}
+
+//Imports the rows in batched transactions
+//The checkpoint of a named import is committed with every batch, so the import can be resumed after the last committed row
+//Returns the report, also on error
+func runImport(ctx context.Context, reader importReader, options ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{ImportId: options.ImportId, DryRun: options.DryRun, Errors: make([]ImportRowError, 0)}
+	if options.BatchSize < 1 {
+		options.BatchSize = config.ImportBatchSize
+	}
+	if options.ImportId != "" {
+		if err := store.loadImport(ctx, report, !options.DryRun); err != nil {
+			return report, err
+		}
+	}
+
+	catalogs := make(map[string][]TaskGroup)
+	batch := make([]ProgressRecord, 0, options.BatchSize)
+	flush := func(row int) error {
+		if len(batch) == 0 && options.ImportId == "" {
+			return nil
+		}
+		if options.DryRun {
+			report.Imported += len(batch)
+		} else if err := store.importBatch(ctx, batch, row, report); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	row := 0
+	for {
+		record, rowErr, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		row++
+		if row <= report.ResumedAfter {
+			continue
+		}
+		report.Rows++
+
+		if rowErr == nil {
+			rowErr = validateImportRecord(&record)
+		}
+		if rowErr == nil && options.CheckCatalog {
+			if rowErr, err = checkImportCatalog(ctx, catalogs, record); err != nil {
+				return report, err
+			}
+		}
+		if rowErr != nil {
+			report.fail(row, rowErr)
+			continue
+		}
+
+		batch = append(batch, record)
+		if len(batch) >= options.BatchSize {
+			if err := flush(row); err != nil {
+				return report, err
+			}
+		}
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+	}
+	if row > report.ResumedAfter {
+		return report, flush(row)
+	}
+	return report, nil
+}
+
+//Loads the counters of the named import from its checkpoint
+//If create is true, the checkpoint is created if it doesn't exist
+func (s *ProgressStore) loadImport(ctx context.Context, report *ImportReport, create bool) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	err := s.selectImport.QueryRowContext(ctx, report.ImportId).Scan(&report.ResumedAfter, &report.Imported, &report.Skipped, &report.Failed)
+	if err == sql.ErrNoRows {
+		if !create {
+			return nil
+		}
+		_, err = s.insertImport.ExecContext(ctx, report.ImportId)
+	}
+	return err
+}
+
+//Writes a batch of imported progress in one transaction, with the checkpoint of the import if it is named
+//Progress isn't overwritten by imported progress that isn't more recent, these rows are counted as skipped
+//The imported changes are recorded in the history and the progress log, the write hooks aren't run for them
+func (s *ProgressStore) importBatch(ctx context.Context, records []ProgressRecord, row int, report *ImportReport) error {
+	var imported, skipped int
+	_, err := s.runImportWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		imported, skipped = 0, 0
+		changes := make([]*ProgressChange, 0, len(records))
+		for _, record := range records {
+			previous, err := s.selectForUpdate(ctx, tx, record.UserId, record.CourseId, record.TaskId)
+			if err != nil {
+				return nil, err
+			}
+			if previous != nil && !record.UpdatedAt.After(*previous.UpdatedAt) {
+				skipped++
+				continue
+			}
+			change, err := s.importLocked(ctx, tx, record, previous)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+			imported++
+		}
+
+		if report.ImportId != "" {
+			_, err := s.updateImport.in(tx).ExecContext(ctx, row, report.Imported+imported, report.Skipped+skipped, report.Failed, report.ImportId)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return changes, nil
+	})
+	if err != nil {
+		return err
+	}
+	report.Imported += imported
+	report.Skipped += skipped
+	return nil
+}
+
+//Returns the import format of the content type, NDJSON unless it is CSV
+func importFormatOf(contentType string) string {
+	if strings.HasPrefix(contentType, "text/csv") {
+		return "csv"
+	}
+	return "ndjson"
+}
+
+//Handles the post method on /admin/imports
+//Imports the progress rows of the body, as CSV or NDJSON
+//Returns 200 status code and the import report, or the error with the rows committed so far
+func HandleImportPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query := r.URL.Query()
+	options := ImportOptions{Format: query.Get("format"), ImportId: query.Get("importId")}
+	if options.Format == "" {
+		options.Format = importFormatOf(r.Header.Get("Content-Type"))
+	}
+	options.DryRun, _ = strconv.ParseBool(query.Get("dryRun"))
+	options.CheckCatalog, _ = strconv.ParseBool(query.Get("checkCatalog"))
+	options.BatchSize, _ = strconv.Atoi(query.Get("batchSize"))
+
+	reader, err := newImportReader(options.Format, r.Body)
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read the import.", err))
+		return
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+
+	report, err := runImport(r.Context(), reader, options)
+	if err != nil {
+		message := "Import failed after " + strconv.Itoa(report.ResumedAfter+report.Rows) + " rows, " + strconv.Itoa(report.Imported) + " imported."
+		if options.ImportId != "" {
+			message += " Resume it with the same importId."
+		}
+		respondErrorV2(w, failure(r.Context(), message, err))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: report})
+}
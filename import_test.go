@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Reads every row of the import, returns the records and the row errors by row number
+func readImportRows(t *testing.T, format, body string) ([]ProgressRecord, map[int]error) {
+	reader, err := newImportReader(format, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []ProgressRecord
+	rowErrors := make(map[int]error)
+	for row := 1; ; row++ {
+		record, rowErr, err := reader.next()
+		if err == io.EOF {
+			return records, rowErrors
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rowErr != nil {
+			rowErrors[row] = rowErr
+			continue
+		}
+		records = append(records, record)
+	}
+}
+
+func TestImportReaders(t *testing.T) {
+	csvBody := "userId, courseId,taskId,progress,updatedAt\n" +
+		"ana,course,task,completed,2018-03-01T10:00:00Z\n" +
+		"ana,course,other,started,yesterday\n" +
+		"ion,course,task,started\n"
+	records, rowErrors := readImportRows(t, "csv", csvBody)
+	if len(records) != 2 || len(rowErrors) != 1 || rowErrors[2] == nil {
+		t.Fatalf("CSV records %+v, row errors %v, want 2 records and an error on row 2", records, rowErrors)
+	}
+	if records[0].UserId != "ana" || records[0].TaskId != "task" || records[0].Progress != "completed" ||
+		records[0].UpdatedAt == nil || !records[0].UpdatedAt.Equal(time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("first CSV record %+v", records[0])
+	}
+	if records[1].UserId != "ion" || records[1].UpdatedAt != nil {
+		t.Errorf("second CSV record %+v", records[1])
+	}
+
+	ndjsonBody := `{"userId":"ana","courseId":"course","taskId":"task","progress":"completed"}` + "\n\n" +
+		`{"userId":` + "\n" +
+		`{"userId":"ion","courseId":"course","taskId":"task","progress":"started","createdAt":"2018-03-01T10:00:00Z"}` + "\n"
+	records, rowErrors = readImportRows(t, "ndjson", ndjsonBody)
+	if len(records) != 2 || len(rowErrors) != 1 || rowErrors[2] == nil {
+		t.Fatalf("NDJSON records %+v, row errors %v, want 2 records and an error on row 2", records, rowErrors)
+	}
+
+	if _, err := newImportReader("csv", strings.NewReader("userId,courseId,progress\n")); err == nil {
+		t.Error("CSV without the taskId column accepted")
+	}
+	if _, err := newImportReader("xml", strings.NewReader("")); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestValidateImportRecord(t *testing.T) {
+	createdAt := time.Date(2018, 3, 1, 10, 0, 0, 500, time.FixedZone("EET", 2*3600))
+	updatedAt := createdAt.Add(-time.Hour)
+	record := ProgressRecord{UserId: "ana", CourseId: "course", TaskId: "task", Progress: "started", CreatedAt: &createdAt, UpdatedAt: &updatedAt}
+	if err := validateImportRecord(&record); err == nil {
+		t.Fatal("progress created after its update accepted")
+	}
+
+	updatedAt = createdAt.Add(time.Hour)
+	if err := validateImportRecord(&record); err != nil {
+		t.Fatal(err)
+	}
+	if !record.CreatedAt.Equal(time.Date(2018, 3, 1, 8, 0, 0, 0, time.UTC)) || record.CreatedAt.Location() != time.UTC {
+		t.Errorf("created at %s, want the UTC time truncated to seconds", record.CreatedAt)
+	}
+
+	before := time.Now().UTC().Truncate(time.Second)
+	record.CreatedAt, record.UpdatedAt = nil, nil
+	if err := validateImportRecord(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record.UpdatedAt.Before(before) || !record.CreatedAt.Equal(*record.UpdatedAt) || record.UpdatedAt.Location() != time.UTC {
+		t.Errorf("missing timestamps filled as %s and %s", record.CreatedAt, record.UpdatedAt)
+	}
+
+	for _, invalid := range []ProgressRecord{
+		{UserId: "ana", CourseId: "course", TaskId: "task", Progress: "finished"},
+		{UserId: "ana", CourseId: "", TaskId: "task", Progress: "started"},
+		{UserId: strings.Repeat("a", 101), CourseId: "course", TaskId: "task", Progress: "started"},
+	} {
+		if err := validateImportRecord(&invalid); err == nil {
+			t.Errorf("invalid record %+v accepted", invalid)
+		}
+	}
+}
+
+func TestDryRunImportChecksCatalog(t *testing.T) {
+	initConfig()
+	defer stubCatalog(map[string][]string{"course": {"task", "other"}})()
+	body := `{"userId":"ana","courseId":"course","taskId":"task","progress":"completed"}` + "\n" +
+		`{"userId":"ana","courseId":"course","taskId":"missing","progress":"completed"}` + "\n" +
+		`{"userId":"ana","courseId":"unknown","taskId":"task","progress":"completed"}` + "\n" +
+		`{"userId":"ion","courseId":"course","taskId":"other","progress":"started"}` + "\n" +
+		`{"userId":"ion","courseId":"course","taskId":"other","progress":"stopped"}` + "\n"
+	reader, err := newImportReader("ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//A dry run without an import id doesn't read nor write the store
+	report, err := runImport(context.Background(), reader, ImportOptions{DryRun: true, CheckCatalog: true, BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Rows != 5 || report.Imported != 2 || report.Failed != 3 || len(report.Errors) != 3 {
+		t.Fatalf("report %+v, want 5 rows, 2 imported and 3 failed", report)
+	}
+	for i, row := range []int{2, 3, 5} {
+		if report.Errors[i].Row != row {
+			t.Errorf("error %d on row %d, want row %d", i, report.Errors[i].Row, row)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//Orders of the leaderboards, most completed tasks, highest score or shortest time from the first started task to the completion of the course
+var leaderboardSorts = []string{"completed", "score", "completionTime"}
+
+//Leaderboard of a course, a course without one has no leaderboard
+//Pseudonymized leaderboards replace the user ids with pseudonyms stable per course
+type LeaderboardSettings struct {
+	CourseId     string `json:"courseId"`
+	Pseudonymize bool   `json:"pseudonymize"`
+}
+
+type LeaderboardsRequest struct {
+	Leaderboards []LeaderboardSettings `json:"leaderboards"`
+}
+
+//Ranking of a user on the leaderboard of a course
+//Score is the sum of the last scores recorded on the tasks, a reset drops the score of its task
+//CompletedAt is the time of the last completed task, CompletionTime the seconds from StartedAt to the completion of the course
+type LeaderboardEntry struct {
+	Rank           int        `json:"rank"`
+	UserId         string     `json:"userId"`
+	CompletedTasks int        `json:"completedTasks"`
+	Score          float64    `json:"score"`
+	StartedAt      *time.Time `json:"startedAt,omitempty"`
+	CompletedAt    *time.Time `json:"completedAt,omitempty"`
+	CompletionTime *int64     `json:"completionTime,omitempty"`
+}
+
+//Sort key and rank of the last entry of a page, and the order of the page, encoded in the opaque cursor of the next page
+type leaderboardCursor struct {
+	UserId         string     `json:"u"`
+	CompletedTasks int        `json:"c"`
+	Score          float64    `json:"s"`
+	CompletedAt    *time.Time `json:"t,omitempty"`
+	CompletionTime *int64     `json:"d,omitempty"`
+	Rank           int        `json:"r"`
+	Sort           string     `json:"o"`
+}
+
+type LeaderboardQuery struct {
+	Sort   string
+	Cursor *LeaderboardEntry
+	Limit  int
+}
+
+//Registers the write hooks maintaining the rankings of the leaderboards
+func initLeaderboards() {
+	onProgressWrite(recordLeaderboardProgress)
+	onScoreRecorded(recordLeaderboardScore)
+}
+
+//Recomputes the ranking of the user on the course inside the transaction, from the stored progress and scores of the user on the course
+//The ranking is removed once the user has neither progress nor scores on the course
+func (s *ProgressStore) refreshLeaderboardEntry(ctx context.Context, tx *sql.Tx, courseId, userId string) error {
+	var tasks int
+	var completed sql.NullInt64
+	var startedAt, completedAt *time.Time
+	err := tx.StmtContext(ctx, s.selectLeaderboardTotals).QueryRowContext(ctx, userId, courseId).Scan(&tasks, &completed, &startedAt, &completedAt)
+	if err != nil {
+		return err
+	}
+	var scores int
+	var score sql.NullFloat64
+	if err := tx.StmtContext(ctx, s.selectLeaderboardScoreTotal).QueryRowContext(ctx, courseId, userId).Scan(&scores, &score); err != nil {
+		return err
+	}
+
+	if _, err := tx.StmtContext(ctx, s.deleteLeaderboardEntry).ExecContext(ctx, courseId, userId); err != nil {
+		return err
+	}
+	if tasks == 0 && scores == 0 {
+		return nil
+	}
+	var completionTime *int64
+	if startedAt != nil && completedAt != nil {
+		seconds := int64(completedAt.Sub(*startedAt) / time.Second)
+		completionTime = &seconds
+	}
+	_, err = tx.StmtContext(ctx, s.insertLeaderboardEntry).ExecContext(ctx, courseId, userId, completed.Int64, score.Float64, startedAt, completedAt, completionTime)
+	if err != nil && s.dialect.isDuplicate(err) {
+		return errConcurrentInsert
+	}
+	return err
+}
+
+//Replaces the score of the user on the task inside the transaction
+func (s *ProgressStore) putLeaderboardScore(ctx context.Context, tx *sql.Tx, courseId, userId, taskId string, score float64) error {
+	if _, err := tx.StmtContext(ctx, s.deleteLeaderboardScore).ExecContext(ctx, courseId, userId, taskId); err != nil {
+		return err
+	}
+	_, err := tx.StmtContext(ctx, s.insertLeaderboardScore).ExecContext(ctx, courseId, userId, taskId, score)
+	if err != nil && s.dialect.isDuplicate(err) {
+		return errConcurrentInsert
+	}
+	return err
+}
+
+//Updates the ranking of the user on the course of the change, a reset also drops the score of the task
+func recordLeaderboardProgress(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	if change.Current == nil {
+		if _, err := tx.StmtContext(ctx, store.deleteLeaderboardScore).ExecContext(ctx, change.CourseId, change.UserId, change.TaskId); err != nil {
+			return err
+		}
+	}
+	return store.refreshLeaderboardEntry(ctx, tx, change.CourseId, change.UserId)
+}
+
+//Replaces the score of the user on the task of the event and updates the ranking of the user on the course
+func recordLeaderboardScore(ctx context.Context, tx *sql.Tx, event *ProgressEvent) error {
+	if err := store.putLeaderboardScore(ctx, tx, event.CourseId, event.UserId, event.TaskId, *event.Score); err != nil {
+		return err
+	}
+	return store.refreshLeaderboardEntry(ctx, tx, event.CourseId, event.UserId)
+}
+
+//Rebuilds the rankings of every course from the stored progress and the scores of the progress log, in one transaction
+//The log is streamed task by task, the tasks of a user on a course being contiguous, so the ranking of the user is refreshed
+//once the tasks of the course are replayed and only the last score of one task is held in memory
+//Every stored progress has events in the log, so every user with progress or scores on a course is ranked
+//Returns the number of rankings
+func (s *ProgressStore) rebuildLeaderboards(ctx context.Context) (int, error) {
+	count := 0
+	_, err := s.runBulkWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		count = 0
+		if _, err := tx.ExecContext(ctx, "DELETE FROM COURSEPROGRESS_LEADERBOARD_SCORES"); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM COURSEPROGRESS_LEADERBOARD"); err != nil {
+			return nil, err
+		}
+
+		var task [3]string
+		var score *float64
+		//Stores the last score of the replayed task, unless it was reset since
+		flushTask := func() error {
+			if score == nil {
+				return nil
+			}
+			err := s.putLeaderboardScore(ctx, tx, task[1], task[0], task[2], *score)
+			score = nil
+			return err
+		}
+		//Ranks the user on the replayed course
+		flushCourse := func() error {
+			if task[0] == "" {
+				return nil
+			}
+			count++
+			return s.refreshLeaderboardEntry(ctx, tx, task[1], task[0])
+		}
+		err := s.eachTaskEvent(ctx, func(event ProgressEvent) error {
+			key := [3]string{event.UserId, event.CourseId, event.TaskId}
+			if key != task {
+				if err := flushTask(); err != nil {
+					return err
+				}
+				if key[0] != task[0] || key[1] != task[1] {
+					if err := flushCourse(); err != nil {
+						return err
+					}
+				}
+				task = key
+			}
+			switch event.Type {
+			case eventScoreRecorded:
+				score = event.Score
+			case eventProgressReset:
+				score = nil
+			}
+			return nil
+		})
+		if err == nil {
+			err = flushTask()
+		}
+		if err == nil {
+			err = flushCourse()
+		}
+		return nil, err
+	})
+	return count, err
+}
+
+//Column ranking the users in each order, its direction, and the comparison selecting the users ranked after a value
+var leaderboardOrders = map[string]struct{ column, direction, after string }{
+	"completed":      {"l.completed", "DESC", "<"},
+	"score":          {"l.score", "DESC", "<"},
+	"completionTime": {"l.completion_time", "ASC", ">"},
+}
+
+//Stands for a missing last completion, so the users without completions are ranked last in both dialects
+var leaderboardNever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+//Returns the page of the query of the rankings of the users of the course who didn't opt out of its leaderboard, and the number of ranked users
+//Only the members of the cohort are ranked if it isn't empty, and ranked by completion time only the users who completed the given number of tasks
+//Ties are broken by the earliest last completion, users without completions last, then by user id
+//The page has one entry more than the limit if there is a next page
+func (s *ProgressStore) getLeaderboardPage(ctx context.Context, courseId, cohortId string, totalTasks int, query LeaderboardQuery) ([]LeaderboardEntry, int, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	from := " from COURSEPROGRESS_LEADERBOARD l where l.course_id = ?" +
+		" and NOT EXISTS (select 1 from COURSEPROGRESS_LEADERBOARD_OPT_OUTS o where o.course_id = l.course_id and o.user_id = l.user_id)"
+	args := []interface{}{courseId}
+	if cohortId != "" {
+		from += " and EXISTS (select 1 from COURSEPROGRESS_COHORT_MEMBERS m where m.cohort_id = ? and m.user_id = l.user_id)"
+		args = append(args, cohortId)
+	}
+	if query.Sort == "completionTime" {
+		from += " and l.completed >= ? and l.completion_time IS NOT NULL"
+		args = append(args, totalTasks)
+	}
+	var total int
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind("select count(*)"+from), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	order := leaderboardOrders[query.Sort]
+	completedAt := "COALESCE(l.last_completed_at, ?)"
+	rank := 0
+	if cursor := query.Cursor; cursor != nil {
+		var value interface{} = cursor.CompletedTasks
+		switch query.Sort {
+		case "score":
+			value = cursor.Score
+		case "completionTime":
+			value = *cursor.CompletionTime
+		}
+		cursorCompletedAt := leaderboardNever
+		if cursor.CompletedAt != nil {
+			cursorCompletedAt = *cursor.CompletedAt
+		}
+		from += " and (" + order.column + " " + order.after + " ? or (" + order.column + " = ? and (" + completedAt + " > ?" +
+			" or (" + completedAt + " = ? and l.user_id > ?))))"
+		args = append(args, value, value, leaderboardNever, cursorCompletedAt, leaderboardNever, cursorCompletedAt, cursor.UserId)
+		rank = cursor.Rank
+	}
+	args = append(args, leaderboardNever, query.Limit+1)
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind("select l.user_id, l.completed, l.score, l.started_at, l.last_completed_at, l.completion_time"+from+
+		" order by "+order.column+" "+order.direction+", "+completedAt+", l.user_id LIMIT ?"), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	entries := make([]LeaderboardEntry, 0)
+	for rows.Next() {
+		var entry LeaderboardEntry
+		var completionTime sql.NullInt64
+		if err := rows.Scan(&entry.UserId, &entry.CompletedTasks, &entry.Score, &entry.StartedAt, &entry.CompletedAt, &completionTime); err != nil {
+			return nil, 0, err
+		}
+		if query.Sort == "completionTime" {
+			entry.CompletionTime = &completionTime.Int64
+		}
+		entry.Rank = rank + len(entries) + 1
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+//Returns the leaderboard of the course, nil if the course has none
+func (s *ProgressStore) getLeaderboardSettings(ctx context.Context, courseId string) (*LeaderboardSettings, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	settings := LeaderboardSettings{CourseId: courseId}
+	err := s.selectLeaderboardSettings.QueryRowContext(ctx, courseId).Scan(&settings.Pseudonymize)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+//Returns every leaderboard, ordered by course
+func (s *ProgressStore) getLeaderboards(ctx context.Context) ([]LeaderboardSettings, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectAllLeaderboardSettings.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	leaderboards := make([]LeaderboardSettings, 0)
+	for rows.Next() {
+		var settings LeaderboardSettings
+		if err := rows.Scan(&settings.CourseId, &settings.Pseudonymize); err != nil {
+			return nil, err
+		}
+		leaderboards = append(leaderboards, settings)
+	}
+	return leaderboards, rows.Err()
+}
+
+//Enables the leaderboard of every given course, replacing its settings, in one transaction
+func (s *ProgressStore) putLeaderboards(ctx context.Context, leaderboards []LeaderboardSettings) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, settings := range leaderboards {
+		if _, err := s.deleteLeaderboardSettings.in(tx).ExecContext(ctx, settings.CourseId); err != nil {
+			return err
+		}
+		if _, err := s.insertLeaderboardSettings.in(tx).ExecContext(ctx, settings.CourseId, settings.Pseudonymize); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//Disables the leaderboard of the course, its rankings are still maintained
+//Returns false if the course has no leaderboard
+func (s *ProgressStore) removeLeaderboard(ctx context.Context, courseId string) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	result, err := s.deleteLeaderboardSettings.ExecContext(ctx, courseId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+//Opts the user out of the leaderboard of the course, or back in
+func (s *ProgressStore) setLeaderboardOptOut(ctx context.Context, courseId, userId string, optOut bool) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	if !optOut {
+		_, err := s.deleteLeaderboardOptOut.ExecContext(ctx, courseId, userId)
+		return err
+	}
+	_, err := s.insertLeaderboardOptOut.ExecContext(ctx, courseId, userId)
+	if err != nil && s.dialect.isDuplicate(err) {
+		return nil
+	}
+	return err
+}
+
+//Returns the pseudonym of the user on the leaderboard of the course, a keyed hash so it can't be reversed without the key
+func leaderboardPseudonym(courseId, userId string) string {
+	mac := hmac.New(sha256.New, []byte(config.LeaderboardPseudonymKey))
+	mac.Write([]byte(courseId + "\n" + userId))
+	return "learner-" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+//Encodes the sort key and rank of the last entry of a page in the cursor of the next page
+//The cursors of the pseudonymized leaderboards are sealed, so they don't leak the user ids
+func encodeLeaderboardCursor(entry LeaderboardEntry, sortBy string, sealed bool) string {
+	data, _ := json.Marshal(leaderboardCursor{UserId: entry.UserId, CompletedTasks: entry.CompletedTasks, Score: entry.Score,
+		CompletedAt: entry.CompletedAt, CompletionTime: entry.CompletionTime, Rank: entry.Rank, Sort: sortBy})
+	if sealed {
+		aead := leaderboardCursorCipher()
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		data = aead.Seal(nonce, nonce, data, nil)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeLeaderboardCursor(encoded, sortBy string, sealed bool) (*LeaderboardEntry, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if sealed {
+		aead := leaderboardCursorCipher()
+		if len(data) < aead.NonceSize() {
+			return nil, errors.New("cursor too short")
+		}
+		if data, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil); err != nil {
+			return nil, err
+		}
+	}
+	var cursor leaderboardCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	if cursor.Sort != sortBy || (sortBy == "completionTime" && cursor.CompletionTime == nil) {
+		return nil, errors.New("cursor of another sort")
+	}
+	return &LeaderboardEntry{UserId: cursor.UserId, CompletedTasks: cursor.CompletedTasks, Score: cursor.Score,
+		CompletedAt: cursor.CompletedAt, CompletionTime: cursor.CompletionTime, Rank: cursor.Rank}, nil
+}
+
+//Returns the cipher sealing the cursors of the pseudonymized leaderboards, keyed by the pseudonym key
+func leaderboardCursorCipher() cipher.AEAD {
+	key := sha256.Sum256([]byte("leaderboard cursor\n" + config.LeaderboardPseudonymKey))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+//Parses the sort and pagination query parameters of a leaderboard
+//Returns a service error on invalid parameters
+//The cursor of a pseudonymized leaderboard must be sealed
+func parseLeaderboardQuery(r *http.Request, sealed bool) (LeaderboardQuery, error) {
+	values := r.URL.Query()
+	query := LeaderboardQuery{Sort: values.Get("sort"), Limit: config.DefaultPageSize}
+	if query.Sort == "" {
+		query.Sort = leaderboardSorts[0]
+	}
+	if query.Sort != leaderboardSorts[0] && query.Sort != leaderboardSorts[1] && query.Sort != leaderboardSorts[2] {
+		return query, newServiceError(http.StatusUnprocessableEntity, "Invalid sort. Valid sorts: 'completed','score','completionTime'", nil)
+	}
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 {
+			return query, newServiceError(http.StatusUnprocessableEntity, "Invalid limit, expected positive integer.", err)
+		}
+		query.Limit = parsed
+	}
+	if query.Limit > config.MaxPageSize {
+		query.Limit = config.MaxPageSize
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		entry, err := decodeLeaderboardCursor(cursor, query.Sort, sealed)
+		if err != nil {
+			return query, newServiceError(http.StatusBadRequest, "Invalid cursor.", err)
+		}
+		query.Cursor = entry
+	}
+	return query, nil
+}
+
+//Handles the get method on /courses/:course/leaderboard
+//Ranks the users with progress or scores on the course, except the ones who opted out, only the members of the cohort parameter if present
+//Ranked by completion time, only the users who completed every task of the course are listed
+//Returns 200 status code and the page of the leaderboard, or 404 if the course has no leaderboard
+func HandleLeaderboardGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := checkDatabase(r.Context()); err != nil {
+		respondError(w, err)
+		return
+	}
+	courseId := ps.ByName("course")
+	settings, err := store.getLeaderboardSettings(r.Context(), courseId)
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read leaderboard.", err))
+		return
+	}
+	if settings == nil {
+		respondError(w, newServiceError(http.StatusNotFound, "Course "+courseId+" has no leaderboard", nil))
+		return
+	}
+	query, err := parseLeaderboardQuery(r, settings.Pseudonymize)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	total := 0
+	if query.Sort == "completionTime" {
+		taskGroups, err := loadCourseCatalog(r.Context(), courseId)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		total = len(taskIds(taskGroups))
+	}
+	cohortId := r.URL.Query().Get("cohort")
+	if cohortId != "" {
+		cohort, err := store.getCohort(r.Context(), cohortId)
+		if err != nil {
+			respondError(w, failure(r.Context(), "Database error: can not read cohort.", err))
+			return
+		}
+		if cohort == nil {
+			respondError(w, newServiceError(http.StatusNotFound, "Cohort "+cohortId+" not found", nil))
+			return
+		}
+	}
+	entries, count, err := store.getLeaderboardPage(r.Context(), courseId, cohortId, total, query)
+	if err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not read leaderboard.", err))
+		return
+	}
+
+	nextCursor := ""
+	if len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+		nextCursor = encodeLeaderboardCursor(entries[query.Limit-1], query.Sort, settings.Pseudonymize)
+	}
+	if settings.Pseudonymize {
+		for i := range entries {
+			entries[i].UserId = leaderboardPseudonym(courseId, entries[i].UserId)
+		}
+	}
+	setPaginationHeaders(w, r, ListingPage{Total: count, NextCursor: nextCursor})
+	respondJSON(w, entries)
+}
+
+//Handles the put method on /courses/:course/leaderboard/opt-outs/:user
+//Hides the user from the leaderboard of the course
+//Returns 204 status code
+func HandleLeaderboardOptOutPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := store.setLeaderboardOptOut(r.Context(), ps.ByName("course"), ps.ByName("user"), true); err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not opt out of leaderboard.", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Handles the delete method on /courses/:course/leaderboard/opt-outs/:user
+//Shows the user on the leaderboard of the course again
+//Returns 204 status code
+func HandleLeaderboardOptOutDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := store.setLeaderboardOptOut(r.Context(), ps.ByName("course"), ps.ByName("user"), false); err != nil {
+		respondError(w, failure(r.Context(), "Database error: can not opt in to leaderboard.", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Handles the get method on /admin/leaderboards
+//Returns 200 status code and every leaderboard
+func HandleLeaderboardsGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	leaderboards, err := store.getLeaderboards(r.Context())
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to read leaderboards.", err))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: leaderboards})
+}
+
+//Handles the put method on /admin/leaderboards
+//Enables the leaderboard of every course of the body, replacing its settings
+//Returns 200 status code and every leaderboard
+func HandleLeaderboardsPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request LeaderboardsRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read leaderboards.", err))
+		return
+	}
+	for _, settings := range request.Leaderboards {
+		if settings.Pseudonymize && config.LeaderboardPseudonymKey == "" {
+			respondErrorV2(w, newServiceError(http.StatusUnprocessableEntity, "Leaderboard of course "+settings.CourseId+" can't be pseudonymized without a pseudonym key", nil))
+			return
+		}
+	}
+
+	if err := store.putLeaderboards(r.Context(), request.Leaderboards); err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to write leaderboards.", err))
+		return
+	}
+	HandleLeaderboardsGet(w, r, ps)
+}
+
+//Handles the delete method on /admin/leaderboards/:course
+//Returns 204 status code, or 404 if the course has no leaderboard
+func HandleLeaderboardDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	removed, err := store.removeLeaderboard(r.Context(), ps.ByName("course"))
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to remove leaderboard.", err))
+		return
+	}
+	if !removed {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "Course "+ps.ByName("course")+" has no leaderboard", nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//Filters on the stored progress, pushed down to the database query
+type ProgressFilter struct {
+	CourseId     string
+	Progress     string
+	UpdatedSince *time.Time
+	//Point in time the progress is reported at, nil for the current progress
+	At *time.Time
+	//Enrollments of the user, only their courses are listed, every course of the catalog if nil
+	Enrolled map[string]*EnrollmentRecord
+}
+
+//Returns true if only tasks with stored progress can match the filter
+func (f ProgressFilter) storedOnly() bool {
+	return f.UpdatedSince != nil || (f.Progress != "" && f.Progress != "not started")
+}
+
+//Returns true if the task matches the filter
+func (f ProgressFilter) matches(task TaskProgress) bool {
+	if f.Progress != "" && task.Progress != f.Progress {
+		return false
+	}
+	if f.UpdatedSince != nil && (task.UpdatedAt == nil || task.UpdatedAt.Before(*f.UpdatedSince)) {
+		return false
+	}
+	return true
+}
+
+//Filtering, sorting and pagination parameters of a progress listing
+type ProgressQuery struct {
+	Filter ProgressFilter
+	Sort   string
+	Cursor *ListingItem
+	Limit  int
+}
+
+//Task of a progress listing, with its position in the course catalog
+type ListingItem struct {
+	CourseId string
+	Group    string
+	Index    int
+	Task     TaskProgress
+}
+
+//Sort key of the last item of a page, encoded in the opaque cursor of the next page
+type listingCursor struct {
+	CourseId  string     `json:"c"`
+	Index     int        `json:"i"`
+	UpdatedAt *time.Time `json:"u,omitempty"`
+}
+
+//A page of a progress listing
+type ListingPage struct {
+	Items      []ListingItem
+	Total      int
+	NextCursor string
+	Courses    []CourseState
+}
+
+//Returns the entity tag of the page, derived from the versions of the listed courses and the query of the request
+func (p ListingPage) etag(r *http.Request) string {
+	return coursesETag(p.Courses, r.URL.RawQuery)
+}
+
+var listingSorts = []string{"updatedAt", "-updatedAt"}
+
+//Parses the filtering, sorting and pagination query parameters of a listing
+//Pagination is only applied if paginate is true or the limit or cursor parameters are present
+//Returns a service error on invalid parameters
+func parseProgressQuery(r *http.Request, paginate bool) (ProgressQuery, error) {
+	values := r.URL.Query()
+	query := ProgressQuery{
+		Filter: ProgressFilter{CourseId: values.Get("course"), Progress: values.Get("progress")},
+		Sort:   values.Get("sort"),
+	}
+
+	if query.Filter.Progress != "" && query.Filter.Progress != "not started" && query.Filter.Progress != "started" && query.Filter.Progress != "completed" {
+		return query, newServiceError(http.StatusUnprocessableEntity, "Invalid progress filter. Valid types: 'not started','started','completed'", nil)
+	}
+	if query.Sort != "" && query.Sort != listingSorts[0] && query.Sort != listingSorts[1] {
+		return query, newServiceError(http.StatusUnprocessableEntity, "Invalid sort. Valid sorts: 'updatedAt','-updatedAt'", nil)
+	}
+	if updatedSince := values.Get("updatedSince"); updatedSince != "" {
+		since, err := time.Parse(time.RFC3339, updatedSince)
+		if err != nil {
+			return query, newServiceError(http.StatusUnprocessableEntity, "Invalid updatedSince, expected RFC 3339 timestamp.", err)
+		}
+		query.Filter.UpdatedSince = &since
+	}
+	if at := values.Get("at"); at != "" {
+		parsed, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return query, newServiceError(http.StatusUnprocessableEntity, "Invalid at, expected RFC 3339 timestamp.", err)
+		}
+		query.Filter.At = &parsed
+	}
+
+	if values.Get("limit") == "" && values.Get("cursor") == "" && !paginate {
+		return query, nil
+	}
+	query.Limit = config.DefaultPageSize
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 {
+			return query, newServiceError(http.StatusUnprocessableEntity, "Invalid limit, expected positive integer.", err)
+		}
+		query.Limit = parsed
+	}
+	if query.Limit > config.MaxPageSize {
+		query.Limit = config.MaxPageSize
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		item, err := decodeCursor(cursor)
+		if err != nil {
+			return query, newServiceError(http.StatusBadRequest, "Invalid cursor.", err)
+		}
+		query.Cursor = item
+	}
+	return query, nil
+}
+
+func encodeCursor(item ListingItem) string {
+	data, _ := json.Marshal(listingCursor{CourseId: item.CourseId, Index: item.Index, UpdatedAt: item.Task.UpdatedAt})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (*ListingItem, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cursor listingCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &ListingItem{CourseId: cursor.CourseId, Index: cursor.Index, Task: TaskProgress{UpdatedAt: cursor.UpdatedAt}}, nil
+}
+
+//Compares two listing items in the given sort order
+//Tasks that were never updated are sorted last, ties are broken by course and catalog position
+func compareItems(a, b ListingItem, sortBy string) int {
+	if sortBy != "" {
+		switch {
+		case a.Task.UpdatedAt != nil && b.Task.UpdatedAt == nil:
+			return -1
+		case a.Task.UpdatedAt == nil && b.Task.UpdatedAt != nil:
+			return 1
+		case a.Task.UpdatedAt != nil && !a.Task.UpdatedAt.Equal(*b.Task.UpdatedAt):
+			result := 1
+			if a.Task.UpdatedAt.Before(*b.Task.UpdatedAt) {
+				result = -1
+			}
+			if sortBy == "-updatedAt" {
+				result = -result
+			}
+			return result
+		}
+	}
+	switch {
+	case a.CourseId < b.CourseId:
+		return -1
+	case a.CourseId > b.CourseId:
+		return 1
+	case a.Index < b.Index:
+		return -1
+	case a.Index > b.Index:
+		return 1
+	}
+	return 0
+}
+
+//Filters, sorts and paginates the tasks of the courses
+func paginateTasks(courses []CourseState, query ProgressQuery) ListingPage {
+	items := make([]ListingItem, 0)
+	for _, course := range courses {
+		if query.Filter.CourseId != "" && course.CourseId != query.Filter.CourseId {
+			continue
+		}
+		for i, task := range course.Tasks {
+			if query.Filter.matches(task) {
+				items = append(items, ListingItem{CourseId: course.CourseId, Group: course.groupOf(task.TaskId), Index: i, Task: task})
+			}
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return compareItems(items[i], items[j], query.Sort) < 0
+	})
+
+	page := ListingPage{Items: items, Total: len(items), Courses: courses}
+	if query.Limit == 0 {
+		return page
+	}
+	start := 0
+	if query.Cursor != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return compareItems(items[i], *query.Cursor, query.Sort) > 0
+		})
+	}
+	end := start + query.Limit
+	if end < len(items) {
+		page.NextCursor = encodeCursor(items[end-1])
+	} else {
+		end = len(items)
+	}
+	page.Items = items[start:end]
+	return page
+}
+
+//Get a page of the progress of the user on the tasks of the courses matching the query
+func listUserTasks(ctx context.Context, userId string, query ProgressQuery) (ListingPage, error) {
+	courses, err := loadUserState(ctx, userId, query.Filter)
+	if err != nil {
+		return ListingPage{}, err
+	}
+	return paginateTasks(courses, query), nil
+}
+
+//Get a page of the progress of the user on the tasks of the course matching the query
+func listCourseTasks(ctx context.Context, userId, courseId string, query ProgressQuery) (*CourseState, ListingPage, error) {
+	var course *CourseState
+	var err error
+	if query.Filter.At != nil {
+		course, err = loadCourseStateAt(ctx, userId, courseId, *query.Filter.At)
+	} else {
+		course, err = loadCourseState(ctx, userId, courseId)
+	}
+	if err != nil {
+		return nil, ListingPage{}, err
+	}
+	query.Filter.CourseId = ""
+	return course, paginateTasks([]CourseState{*course}, query), nil
+}
+
+//Sets the pagination headers of a v1 listing, which keeps the bare array as body
+func setPaginationHeaders(w http.ResponseWriter, r *http.Request, page ListingPage) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		next := *r.URL
+		values := next.Query()
+		values.Set("cursor", page.NextCursor)
+		next.RawQuery = values.Encode()
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+		w.Header().Set("Link", "<"+next.RequestURI()+">; rel=\"next\"")
+	}
+}
+
+//Query parameters shared by the progress listings, documented in the OpenAPI document
+var listingParameters = []apiParameter{
+	queryParameter("progress", "Only tasks with the given progress", &jsonSchema{Type: "string", Enum: []string{"not started", "started", "completed"}}),
+	queryParameter("updatedSince", "Only tasks updated at or after the given RFC 3339 timestamp", &jsonSchema{Type: "string", Format: "date-time"}),
+	queryParameter("at", "Report the progress as it was at the given RFC 3339 timestamp, replayed from the progress log", &jsonSchema{Type: "string", Format: "date-time"}),
+	queryParameter("sort", "Sort by last update, ascending or descending", &jsonSchema{Type: "string", Enum: listingSorts}),
+	queryParameter("limit", "Maximum number of tasks in the page", &jsonSchema{Type: "integer", Minimum: &minimumLimit}),
+	queryParameter("cursor", "Cursor of the page, as returned by the previous page", &jsonSchema{Type: "string"}),
+}
+
+var minimumLimit = 1.0
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseProgressQuery(t *testing.T) {
+	initConfig()
+	query, err := parseProgressQuery(httptest.NewRequest("GET", "/progress/ana?course=algebra&progress=completed&sort=-updatedAt&updatedSince=2018-05-14T09:30:00Z", nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Filter.CourseId != "algebra" || query.Filter.Progress != "completed" || query.Sort != "-updatedAt" ||
+		query.Filter.UpdatedSince == nil || !query.Filter.UpdatedSince.Equal(time.Date(2018, 5, 14, 9, 30, 0, 0, time.UTC)) {
+		t.Errorf("query %+v", query)
+	}
+	if query.Limit != 0 || !query.Filter.storedOnly() {
+		t.Errorf("query without limit nor cursor paginated by %d, or the completed tasks aren't only the stored ones", query.Limit)
+	}
+
+	if query, err := parseProgressQuery(httptest.NewRequest("GET", "/v2/users/ana/tasks", nil), true); err != nil || query.Limit != config.DefaultPageSize {
+		t.Errorf("paginated listing limited to %d, %v, want the default page size", query.Limit, err)
+	}
+	if query, err := parseProgressQuery(httptest.NewRequest("GET", "/progress/ana?limit=100000", nil), false); err != nil || query.Limit != config.MaxPageSize {
+		t.Errorf("limit capped at %d, %v, want the maximum page size", query.Limit, err)
+	}
+
+	for target, status := range map[string]int{
+		"/progress/ana?progress=finished":      http.StatusUnprocessableEntity,
+		"/progress/ana?sort=courseId":          http.StatusUnprocessableEntity,
+		"/progress/ana?updatedSince=yesterday": http.StatusUnprocessableEntity,
+		"/progress/ana?limit=-1":               http.StatusUnprocessableEntity,
+		"/progress/ana?cursor=not-a-cursor!":   http.StatusBadRequest,
+	} {
+		_, err := parseProgressQuery(httptest.NewRequest("GET", target, nil), false)
+		if serviceErr, ok := err.(*serviceError); !ok || serviceErr.Status != status {
+			t.Errorf("%s parsed with %v, want status %d", target, err, status)
+		}
+	}
+}
+
+func TestPaginateTasksWalksEveryPageOnce(t *testing.T) {
+	first := time.Date(2018, 5, 14, 9, 30, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		updated := first.Add(time.Duration(minutes) * time.Minute)
+		return &updated
+	}
+	groups := []TaskGroup{{Title: "Tasks", Tasks: []*BaseTaskInfo{{Id: "a"}, {Id: "b"}, {Id: "c"}}}}
+	courses := []CourseState{
+		newCourseState("algebra", groups, []TaskProgress{{TaskId: "a", Progress: "completed", UpdatedAt: at(3)}, {TaskId: "c", Progress: "started", UpdatedAt: at(1)}}),
+		newCourseState("biology", groups, []TaskProgress{{TaskId: "b", Progress: "completed", UpdatedAt: at(2)}, {TaskId: "c", Progress: "completed", UpdatedAt: at(3)}}),
+	}
+
+	//Updated tasks come first, the newest first with ties in catalog order, then the tasks never updated in catalog order
+	want := []string{"algebra/a", "biology/c", "biology/b", "algebra/c", "algebra/b", "biology/a"}
+	query := ProgressQuery{Sort: "-updatedAt", Limit: 4}
+	listed := make([]string, 0)
+	for pages := 0; pages < len(want); pages++ {
+		page := paginateTasks(courses, query)
+		if page.Total != len(want) {
+			t.Fatalf("page of %d tasks in total, want %d", page.Total, len(want))
+		}
+		for _, item := range page.Items {
+			listed = append(listed, item.CourseId+"/"+item.Task.TaskId)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor, err := decodeCursor(page.NextCursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query.Cursor, query.Limit = cursor, 1
+	}
+	if len(listed) != len(want) {
+		t.Fatalf("pages listed %v, want %v", listed, want)
+	}
+	for i := range want {
+		if listed[i] != want[i] {
+			t.Fatalf("pages listed %v, want %v", listed, want)
+		}
+	}
+
+	page := paginateTasks(courses, ProgressQuery{Filter: ProgressFilter{CourseId: "biology", Progress: "completed"}})
+	if page.Total != 2 || page.NextCursor != "" || page.Items[0].Task.TaskId != "b" || page.Items[0].Group != "Tasks" {
+		t.Errorf("filtered page %+v", page)
+	}
+}
+
+func TestListingPaginationHeaders(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/progress/ana?progress=completed&limit=2", nil)
+	setPaginationHeaders(recorder, request, ListingPage{Total: 5, NextCursor: "next"})
+	if recorder.Header().Get("X-Total-Count") != "5" || recorder.Header().Get("X-Next-Cursor") != "next" ||
+		recorder.Header().Get("Link") != `</progress/ana?cursor=next&limit=2&progress=completed>; rel="next"` {
+		t.Errorf("pagination headers %v", recorder.Header())
+	}
+
+	//The invalid parameters are rejected before the listing is loaded
+	initConfig()
+	for path, status := range map[string]int{
+		"/progress/ana?updatedSince=yesterday":       http.StatusUnprocessableEntity,
+		"/progress/ana?cursor=not-a-cursor!":         http.StatusBadRequest,
+		"/progress/ana/algebra?cursor=not-a-cursor!": http.StatusBadRequest,
+	} {
+		if resp := serveTestRequest("GET", path, "", nil); resp.Code != status {
+			t.Errorf("GET %s answered %d, want %d", path, resp.Code, status)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Scope of the LTI Assignment and Grade Services allowing to post scores
+const ltiScoreScope = "https://purl.imsglobal.org/spec/lti-ags/scope/score"
+
+//Scores posted per delivery run
+const ltiDeliveryBatch = 50
+
+//Attempts after which a score is left in the queue and no longer posted
+const ltiMaxAttempts = 10
+
+//Line item of the gradebook of a LMS context, mapped to a task
+//Scores are scaled between 0 and 1 and posted as a part of the maximum score of the line item
+type LtiLineItem struct {
+	CourseId     string  `json:"courseId"`
+	TaskId       string  `json:"taskId"`
+	ContextId    string  `json:"contextId"`
+	LineItemUrl  string  `json:"lineItemUrl"`
+	ScoreMaximum float64 `json:"scoreMaximum"`
+}
+
+type LtiLineItemsRequest struct {
+	LineItems []LtiLineItem `json:"lineItems"`
+}
+
+//Score of the Assignment and Grade Services, posted to the scores service of a line item
+type LtiScore struct {
+	UserId           string   `json:"userId"`
+	ScoreGiven       *float64 `json:"scoreGiven,omitempty"`
+	ScoreMaximum     *float64 `json:"scoreMaximum,omitempty"`
+	ActivityProgress string   `json:"activityProgress"`
+	GradingProgress  string   `json:"gradingProgress"`
+	Timestamp        string   `json:"timestamp"`
+}
+
+//Registers the write hooks queueing the scores of the mapped tasks, if a LTI platform is configured
+//A completed task is posted with the maximum score, a recorded score as its part of the maximum
+func initLti() {
+	if config.LtiTokenUrl == "" {
+		return
+	}
+	onProgressWrite(queueCompletionScore)
+	onScoreRecorded(queueRecordedScore)
+}
+
+//Returns the line item mapped to the task inside the transaction, nil if the task isn't mapped
+func (s *ProgressStore) lineItemOf(ctx context.Context, tx *sql.Tx, courseId, taskId string) (*LtiLineItem, error) {
+	lineItem := LtiLineItem{CourseId: courseId, TaskId: taskId}
+	err := tx.StmtContext(ctx, s.selectLineItem).QueryRowContext(ctx, courseId, taskId).Scan(&lineItem.ContextId, &lineItem.LineItemUrl, &lineItem.ScoreMaximum)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lineItem, nil
+}
+
+//Queues the score of the user on the line item mapped to the task, in the transaction of the change
+func (s *ProgressStore) queueScore(ctx context.Context, tx *sql.Tx, userId, courseId, taskId string, scaled float64, at time.Time) error {
+	lineItem, err := s.lineItemOf(ctx, tx, courseId, taskId)
+	if err != nil || lineItem == nil {
+		return err
+	}
+	given := scaled * lineItem.ScoreMaximum
+	score := LtiScore{
+		UserId:           userId,
+		ScoreGiven:       &given,
+		ScoreMaximum:     &lineItem.ScoreMaximum,
+		ActivityProgress: "Completed",
+		GradingProgress:  "FullyGraded",
+		Timestamp:        at.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+	}
+	body, err := json.Marshal(score)
+	if err != nil {
+		return err
+	}
+	//Truncated as DATETIME rounds the fractions of seconds, which would delay the first attempt
+	_, err = tx.StmtContext(ctx, s.insertLtiScore).ExecContext(ctx, lineItem.LineItemUrl, string(body), time.Now().UTC().Truncate(time.Second))
+	return err
+}
+
+func queueCompletionScore(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	if change.Current == nil || change.Current.Progress != "completed" || (change.Previous != nil && change.Previous.Progress == "completed") {
+		return nil
+	}
+	at := time.Now()
+	if change.Current.UpdatedAt != nil {
+		at = *change.Current.UpdatedAt
+	}
+	return store.queueScore(ctx, tx, change.UserId, change.CourseId, change.TaskId, 1, at)
+}
+
+func queueRecordedScore(ctx context.Context, tx *sql.Tx, event *ProgressEvent) error {
+	return store.queueScore(ctx, tx, event.UserId, event.CourseId, event.TaskId, *event.Score, event.OccurredAt)
+}
+
+//Access token of the platform, requested with the client credentials grant and cached until it expires
+var ltiToken struct {
+	mutex     sync.Mutex
+	value     string
+	expiresAt time.Time
+}
+
+//Returns the RSA private key of the tool, read from the PEM file in PKCS #1 or PKCS #8 format
+func ltiPrivateKey() (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(config.LtiPrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block in " + config.LtiPrivateKeyFile)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key of " + config.LtiPrivateKeyFile + " isn't a RSA key")
+	}
+	return rsaKey, nil
+}
+
+//Returns the JWT authenticating the tool to the token endpoint, signed with RS256
+func ltiClientAssertion(key *rsa.PrivateKey) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	audience := config.LtiAudience
+	if audience == "" {
+		audience = config.LtiTokenUrl
+	}
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": config.LtiKeyId})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": config.LtiClientId,
+		"sub": config.LtiClientId,
+		"aud": audience,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"jti": hex.EncodeToString(jti),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+//Returns the cached access token, or requests a new one from the token endpoint of the platform
+func ltiAccessToken(ctx context.Context) (string, error) {
+	ltiToken.mutex.Lock()
+	defer ltiToken.mutex.Unlock()
+	if ltiToken.value != "" && time.Now().Before(ltiToken.expiresAt) {
+		return ltiToken.value, nil
+	}
+
+	key, err := ltiPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	assertion, err := ltiClientAssertion(key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+		"scope":                 {ltiScoreScope},
+	}
+	req, err := http.NewRequest(http.MethodPost, config.LtiTokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("token endpoint returned status " + strconv.Itoa(resp.StatusCode) + ": " + string(body))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+	//The token is renewed a minute before it expires, so it doesn't expire during a delivery
+	ltiToken.value = token.AccessToken
+	ltiToken.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return ltiToken.value, nil
+}
+
+//Returns the URL of the scores service of the line item, the line item URL may have a query
+func ltiScoresUrl(lineItemUrl string) string {
+	path, query := lineItemUrl, ""
+	if i := strings.Index(lineItemUrl, "?"); i >= 0 {
+		path, query = lineItemUrl[:i], lineItemUrl[i:]
+	}
+	return strings.TrimSuffix(path, "/") + "/scores" + query
+}
+
+//Posts the score to the scores service of the line item
+//The cached access token is dropped if the platform rejects it, so the next attempt requests a new one
+func postLtiScore(ctx context.Context, lineItemUrl, score string) error {
+	token, err := ltiAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, ltiScoresUrl(lineItemUrl), strings.NewReader(score))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.ims.lis.v1.score+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		ltiToken.mutex.Lock()
+		ltiToken.value = ""
+		ltiToken.mutex.Unlock()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("scores service returned status " + strconv.Itoa(resp.StatusCode) + ": " + string(message))
+	}
+	return nil
+}
+
+//Returns the delay before the next attempt of a score that failed the given number of times
+//The delay doubles with every attempt, starting at the delivery interval and capped at an hour
+func ltiRetryDelay(attempts int) time.Duration {
+	delay := config.LtiDeliveryInterval
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+//Posts the queued scores due for an attempt, oldest first
+//Posted scores are removed from the queue, failed ones are retried later
+//Returns the number of scores attempted
+func (s *ProgressStore) deliverLtiScores(ctx context.Context) (int, error) {
+	queryCtx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectLtiScores.QueryContext(queryCtx, ltiMaxAttempts, time.Now().UTC(), ltiDeliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+	type queuedScore struct {
+		id          int64
+		lineItemUrl string
+		score       string
+		attempts    int
+	}
+	var queued []queuedScore
+	for rows.Next() {
+		var score queuedScore
+		if err := rows.Scan(&score.id, &score.lineItemUrl, &score.score, &score.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		queued = append(queued, score)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, score := range queued {
+		postCtx, cancel := context.WithTimeout(ctx, config.RequestTimeout)
+		postErr := postLtiScore(postCtx, score.lineItemUrl, score.score)
+		cancel()
+
+		queryCtx, cancel := queryContext(ctx)
+		if postErr == nil {
+			_, err = s.deleteLtiScore.ExecContext(queryCtx, score.id)
+		} else {
+			log.Println("Failed to post LTI score to " + score.lineItemUrl + ". \nCause: " + postErr.Error())
+			_, err = s.retryLtiScore.ExecContext(queryCtx, time.Now().UTC().Add(ltiRetryDelay(score.attempts+1)), score.id)
+		}
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(queued), nil
+}
+
+//Posts the queued scores at the configured interval until shutdown
+//On shutdown the scores due are posted once the delivery has stopped, within the shutdown timeout
+func scheduleLtiDelivery() {
+	if config.LtiTokenUrl == "" {
+		return
+	}
+	stopped := make(chan struct{})
+	onShutdown(func(ctx context.Context) {
+		<-stopped
+		for ctx.Err() == nil {
+			attempted, err := store.deliverLtiScores(ctx)
+			if err != nil {
+				log.Println("Failed to deliver LTI scores on shutdown. \nCause: " + err.Error())
+			}
+			if attempted < ltiDeliveryBatch {
+				return
+			}
+		}
+	})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(config.LtiDeliveryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for {
+					attempted, err := store.deliverLtiScores(jobContext)
+					if err != nil {
+						log.Println("Failed to deliver LTI scores. \nCause: " + err.Error())
+					}
+					if attempted < ltiDeliveryBatch || jobContext.Err() != nil {
+						break
+					}
+				}
+			case <-jobContext.Done():
+				return
+			}
+		}
+	}()
+}
+
+//Returns every line item mapping, ordered by course and task
+func (s *ProgressStore) getLineItems(ctx context.Context) ([]LtiLineItem, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectLineItems.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lineItems := make([]LtiLineItem, 0)
+	for rows.Next() {
+		var lineItem LtiLineItem
+		if err := rows.Scan(&lineItem.CourseId, &lineItem.TaskId, &lineItem.ContextId, &lineItem.LineItemUrl, &lineItem.ScoreMaximum); err != nil {
+			return nil, err
+		}
+		lineItems = append(lineItems, lineItem)
+	}
+	return lineItems, rows.Err()
+}
+
+//Replaces the line item mapped to the task of every given line item, in one transaction
+func (s *ProgressStore) putLineItems(ctx context.Context, lineItems []LtiLineItem) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, lineItem := range lineItems {
+		if _, err := s.deleteLineItem.in(tx).ExecContext(ctx, lineItem.CourseId, lineItem.TaskId); err != nil {
+			return err
+		}
+		_, err := s.insertLineItem.in(tx).ExecContext(ctx, lineItem.CourseId, lineItem.TaskId, lineItem.ContextId, lineItem.LineItemUrl, lineItem.ScoreMaximum)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//Removes the line item mapped to the task
+//Returns false if the task isn't mapped
+func (s *ProgressStore) removeLineItem(ctx context.Context, courseId, taskId string) (bool, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	result, err := s.deleteLineItem.ExecContext(ctx, courseId, taskId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+//Handles the get method on /admin/lti/line-items
+//Returns 200 status code and every line item mapping
+func HandleLineItemsGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	lineItems, err := store.getLineItems(r.Context())
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to read LTI line items.", err))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: lineItems})
+}
+
+//Handles the put method on /admin/lti/line-items
+//Maps every task of the body to its line item, replacing the line item it was mapped to
+//Returns 200 status code and every line item mapping
+func HandleLineItemsPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request LtiLineItemsRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read LTI line items.", err))
+		return
+	}
+	for _, lineItem := range request.LineItems {
+		parsed, err := url.Parse(lineItem.LineItemUrl)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+			respondErrorV2(w, newServiceError(http.StatusUnprocessableEntity, "Invalid line item URL "+lineItem.LineItemUrl, err))
+			return
+		}
+		if lineItem.ScoreMaximum <= 0 {
+			respondErrorV2(w, newServiceError(http.StatusUnprocessableEntity, "Score maximum of the line item "+lineItem.LineItemUrl+" must be positive", nil))
+			return
+		}
+	}
+
+	if err := store.putLineItems(r.Context(), request.LineItems); err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to write LTI line items.", err))
+		return
+	}
+	HandleLineItemsGet(w, r, ps)
+}
+
+//Handles the delete method on /admin/lti/line-items/:course/:task
+//Returns 204 status code, or 404 if the task isn't mapped
+func HandleLineItemDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	removed, err := store.removeLineItem(r.Context(), ps.ByName("course"), ps.ByName("task"))
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to remove LTI line item.", err))
+		return
+	}
+	if !removed {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "No LTI line item mapped to task "+ps.ByName("task")+" of course "+ps.ByName("course"), nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//LTI platform serving a token endpoint and the scores services of any line item
+//The client assertions are verified with the public key of the tool, the received scores are kept in memory
+type mockLtiPlatform struct {
+	key *rsa.PublicKey
+
+	mutex  sync.Mutex
+	tokens map[string]bool
+	scores []map[string]interface{}
+}
+
+//Verifies the JWT signed with RS256 by the public key
+//Returns the claims of the token
+func verifyRS256(token string, key *rsa.PublicKey) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+func (p *mockLtiPlatform) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/token":
+		p.token(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/lineitems/") && strings.HasSuffix(r.URL.Path, "/scores"):
+		p.score(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *mockLtiPlatform) token(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	claims, err := verifyRS256(r.FormValue("client_assertion"), p.key)
+	if err != nil {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	expiresAt, _ := claims["exp"].(float64)
+	if claims["iss"] != config.LtiClientId || claims["sub"] != config.LtiClientId || int64(expiresAt) < time.Now().Unix() {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	value := make([]byte, 16)
+	rand.Read(value)
+	token := hex.EncodeToString(value)
+	p.mutex.Lock()
+	p.tokens[token] = true
+	p.mutex.Unlock()
+	message, _ := json.Marshal(map[string]interface{}{"access_token": token, "token_type": "Bearer", "expires_in": 3600, "scope": r.FormValue("scope")})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(message)
+}
+
+func (p *mockLtiPlatform) score(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/vnd.ims.lis.v1.score+json" {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	var score map[string]interface{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &score)
+	}
+	if err != nil {
+		http.Error(w, "Invalid score: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	score["lineItem"] = strings.TrimSuffix(r.URL.Path, "/scores")
+	p.scores = append(p.scores, score)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Writes a new RSA key of the tool to a PEM file and configures the tool for the platform
+//Returns the key and a function removing the file
+func setTestLtiTool(t *testing.T, platformUrl string) (*rsa.PrivateKey, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "lti-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pem.Encode(file, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.LtiTokenUrl = platformUrl + "/token"
+	config.LtiAudience = ""
+	config.LtiClientId = "progress-tool"
+	config.LtiKeyId = "key-1"
+	config.LtiPrivateKeyFile = file.Name()
+	resetLtiToken()
+	return key, func() { os.Remove(file.Name()) }
+}
+
+func resetLtiToken() {
+	ltiToken.mutex.Lock()
+	ltiToken.value = ""
+	ltiToken.mutex.Unlock()
+}
+
+func TestLtiClientCredentials(t *testing.T) {
+	initConfig()
+	platform := &mockLtiPlatform{tokens: make(map[string]bool)}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+	key, cleanup := setTestLtiTool(t, server.URL)
+	defer cleanup()
+	platform.key = &key.PublicKey
+
+	assertion, err := ltiClientAssertion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := verifyRS256(assertion, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["iss"] != "progress-tool" || claims["sub"] != "progress-tool" || claims["aud"] != config.LtiTokenUrl || claims["jti"] == "" {
+		t.Errorf("client assertion claims %v", claims)
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(strings.Split(assertion, ".")[0])
+	var fields map[string]string
+	if err := json.Unmarshal(header, &fields); err != nil || fields["alg"] != "RS256" || fields["kid"] != "key-1" {
+		t.Errorf("client assertion header %s, %v", header, err)
+	}
+
+	token, err := ltiAccessToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := ltiAccessToken(context.Background()); err != nil || cached != token {
+		t.Errorf("second token %s, %v, want the cached %s", cached, err, token)
+	}
+	if len(platform.tokens) != 1 || !platform.tokens[token] {
+		t.Errorf("platform issued %v, want only %s", platform.tokens, token)
+	}
+
+	//A token rejected by the platform is dropped, the next post requests a new one
+	delete(platform.tokens, token)
+	if err := postLtiScore(context.Background(), server.URL+"/lineitems/1", `{"userId":"ana"}`); err == nil {
+		t.Error("score posted with a revoked token")
+	}
+	if err := postLtiScore(context.Background(), server.URL+"/lineitems/1", `{"userId":"ana"}`); err != nil {
+		t.Errorf("score not posted with a new token: %v", err)
+	}
+
+	//The platform doesn't issue a token to an assertion signed by another key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform.key = &other.PublicKey
+	resetLtiToken()
+	if _, err := ltiAccessToken(context.Background()); err == nil {
+		t.Error("token issued to an assertion signed by another key")
+	}
+}
+
+func TestLtiRetryDelay(t *testing.T) {
+	initConfig()
+	config.LtiDeliveryInterval = 10 * time.Second
+	delays := map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second, 20: time.Hour}
+	for attempts, want := range delays {
+		if delay := ltiRetryDelay(attempts); delay != want {
+			t.Errorf("delay after %d attempts is %s, want %s", attempts, delay, want)
+		}
+	}
+}
+
+func TestLtiScoreQueue(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		platform := &mockLtiPlatform{tokens: make(map[string]bool)}
+		server := httptest.NewServer(platform)
+		defer server.Close()
+		key, cleanup := setTestLtiTool(t, server.URL)
+		defer cleanup()
+		if _, err := connection.Exec("DELETE FROM COURSEPROGRESS_LTI_SCORES"); err != nil {
+			t.Fatal(err)
+		}
+
+		userId, courseId := testId("user"), testId("course")
+		lineItemUrl := server.URL + "/lineitems/" + testId("item")
+		err := store.putLineItems(ctx, []LtiLineItem{
+			{CourseId: courseId, TaskId: "completed", ContextId: "context", LineItemUrl: lineItemUrl + "?type=task", ScoreMaximum: 20},
+			{CourseId: courseId, TaskId: "scored", ContextId: "context", LineItemUrl: lineItemUrl, ScoreMaximum: 20},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//Queued like the write hooks, an unmapped task has no score
+		_, err = store.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+			var changes []*ProgressChange
+			for _, taskId := range []string{"completed", "unmapped"} {
+				previous, err := store.selectForUpdate(ctx, tx, userId, courseId, taskId)
+				if err != nil {
+					return nil, err
+				}
+				change, err := store.upsertLocked(ctx, tx, CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: taskId, Progress: "completed"}, previous)
+				if err != nil {
+					return nil, err
+				}
+				if err := queueCompletionScore(ctx, tx, change); err != nil {
+					return nil, err
+				}
+				changes = append(changes, change)
+			}
+			event, err := store.recordScoreLocked(ctx, tx, userId, courseId, "scored", 0.75, nil)
+			if err != nil {
+				return nil, err
+			}
+			return changes, queueRecordedScore(ctx, tx, event)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued := func() (int, int) {
+			var count, attempts sql.NullInt64
+			err := connection.QueryRow("SELECT count(*), MAX(attempts) FROM COURSEPROGRESS_LTI_SCORES").Scan(&count, &attempts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(count.Int64), int(attempts.Int64)
+		}
+		if count, _ := queued(); count != 2 {
+			t.Fatalf("%d scores queued, want 2", count)
+		}
+
+		//A platform rejecting the tool delays the scores, they aren't attempted again before the delay
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		platform.key = &other.PublicKey
+		for i := 1; i <= 2; i++ {
+			if attempted, err := store.deliverLtiScores(ctx); err != nil || attempted != 2 {
+				t.Fatalf("delivery attempted %d scores, %v, want 2", attempted, err)
+			}
+			if count, attempts := queued(); count != 2 || attempts != i {
+				t.Fatalf("%d scores queued after %d attempts, want 2 after %d", count, attempts, i)
+			}
+			if attempted, err := store.deliverLtiScores(ctx); err != nil || attempted != 0 {
+				t.Fatalf("delivery attempted %d delayed scores, %v", attempted, err)
+			}
+			if _, err := connection.Exec(dialect.rebind("UPDATE COURSEPROGRESS_LTI_SCORES set next_attempt_at =?"), time.Now().UTC().Add(-time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(platform.scores) != 0 {
+			t.Fatalf("platform received %v from a rejected tool", platform.scores)
+		}
+
+		platform.key = &key.PublicKey
+		if attempted, err := store.deliverLtiScores(ctx); err != nil || attempted != 2 {
+			t.Fatalf("delivery attempted %d scores, %v, want 2", attempted, err)
+		}
+		if count, _ := queued(); count != 0 {
+			t.Fatalf("%d scores still queued after their delivery", count)
+		}
+		itemPath := strings.TrimPrefix(lineItemUrl, server.URL)
+		want := []float64{20, 15}
+		if len(platform.scores) != len(want) {
+			t.Fatalf("platform received %v, want %d scores", platform.scores, len(want))
+		}
+		for i, score := range platform.scores {
+			if score["userId"] != userId || score["lineItem"] != itemPath || score["scoreGiven"] != want[i] || score["scoreMaximum"] != 20.0 ||
+				score["activityProgress"] != "Completed" || score["gradingProgress"] != "FullyGraded" {
+				t.Errorf("score %d is %v, want %v of 20 on %s", i, score, want[i], itemPath)
+			}
+		}
+
+		//A score rejected as many times as the attempts allow is left in the queue
+		_, err = store.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+			return nil, store.queueScore(ctx, tx, userId, courseId, "scored", 1, time.Now())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := connection.Exec(dialect.rebind("UPDATE COURSEPROGRESS_LTI_SCORES set attempts =?"), ltiMaxAttempts); err != nil {
+			t.Fatal(err)
+		}
+		if attempted, err := store.deliverLtiScores(ctx); err != nil || attempted != 0 {
+			t.Fatalf("delivery attempted %d scores, %v, want none", attempted, err)
+		}
+	})
+}
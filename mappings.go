@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type TaskRef struct {
+	CourseId string `json:"courseId"`
+	TaskId   string `json:"taskId"`
+}
+
+//Mapping of a task to the tasks replacing it
+//A task mapped by several mappings to the same task is merged, a task mapped to several tasks is split
+type TaskMapping struct {
+	From TaskRef   `json:"from"`
+	To   []TaskRef `json:"to"`
+}
+
+type TaskMappingRequest struct {
+	Mappings []TaskMapping `json:"mappings"`
+	DryRun   bool          `json:"dryRun"`
+}
+
+type TaskMappingResult struct {
+	From         TaskRef   `json:"from"`
+	To           []TaskRef `json:"to"`
+	ProgressRows int       `json:"progressRows"`
+	HistoryRows  int64     `json:"historyRows"`
+}
+
+//Report of the application of task mappings
+//Changes counts the task progress changes written, including the reset of the mapped tasks
+type TaskMappingReport struct {
+	DryRun       bool                `json:"dryRun"`
+	Mappings     []TaskMappingResult `json:"mappings"`
+	ProgressRows int                 `json:"progressRows"`
+	HistoryRows  int64               `json:"historyRows"`
+	Changes      int                 `json:"changes"`
+}
+
+//Returned by the write of a dry run, so its transaction is rolled back
+var errDryRun = errors.New("dry run")
+
+//Checks that no task is mapped twice or mapped to itself, and that no mapped task is the target of another mapping
+func validateTaskMappings(mappings []TaskMapping) error {
+	sources := make(map[TaskRef]bool)
+	for _, mapping := range mappings {
+		if sources[mapping.From] {
+			return newServiceError(http.StatusUnprocessableEntity, "Task "+mapping.From.TaskId+" of course "+mapping.From.CourseId+" is mapped more than once", nil)
+		}
+		sources[mapping.From] = true
+	}
+	for _, mapping := range mappings {
+		if len(mapping.To) == 0 {
+			return newServiceError(http.StatusUnprocessableEntity, "Task "+mapping.From.TaskId+" of course "+mapping.From.CourseId+" isn't mapped to any task", nil)
+		}
+		for _, target := range mapping.To {
+			if sources[target] {
+				return newServiceError(http.StatusUnprocessableEntity, "Task "+target.TaskId+" of course "+target.CourseId+" is both mapped and a mapping target", nil)
+			}
+		}
+	}
+	return nil
+}
+
+//Checks that every target task exists in the catalog of its course
+func checkMappingTargets(ctx context.Context, mappings []TaskMapping) error {
+	catalogs := make(map[string][]TaskGroup)
+	for _, mapping := range mappings {
+		for _, target := range mapping.To {
+			taskGroups, ok := catalogs[target.CourseId]
+			if !ok {
+				var err error
+				taskGroups, err = loadCourseCatalog(ctx, target.CourseId)
+				if err != nil {
+					return err
+				}
+				catalogs[target.CourseId] = taskGroups
+			}
+			if !catalogHasTask(taskGroups, target.TaskId) {
+				return newServiceError(http.StatusUnprocessableEntity, "Task "+target.TaskId+" not found in the catalog of course "+target.CourseId, nil)
+			}
+		}
+	}
+	return nil
+}
+
+//Applies the task mappings to the stored progress and its history, in one transaction
+//The progress of a mapped task is moved to every target task, keeping the most advanced progress of a target
+//The progress log is append-only, the moves are recorded in it as resets of the mapped tasks and writes of the targets
+//Completions are derived from the progress, so they follow the mapped progress
+//A dry run reports the same counts and rolls the transaction back
+func (s *ProgressStore) applyTaskMappings(ctx context.Context, mappings []TaskMapping, dryRun bool) (*TaskMappingReport, error) {
+	var report *TaskMappingReport
+	_, err := s.runBulkWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		report = &TaskMappingReport{DryRun: dryRun, Mappings: make([]TaskMappingResult, 0, len(mappings))}
+		for _, mapping := range mappings {
+			result := TaskMappingResult{From: mapping.From, To: mapping.To}
+			rows, err := s.selectTaskRowsForUpdate.in(tx).QueryContext(ctx, mapping.From.CourseId, mapping.From.TaskId)
+			if err != nil {
+				return nil, err
+			}
+			var sources []ProgressRecord
+			for rows.Next() {
+				record := ProgressRecord{CourseId: mapping.From.CourseId, TaskId: mapping.From.TaskId}
+				var createdAt, updatedAt time.Time
+				if err := rows.Scan(&record.UserId, &record.Progress, &createdAt, &updatedAt, &record.Version); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				record.CreatedAt, record.UpdatedAt = &createdAt, &updatedAt
+				sources = append(sources, record)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+
+			//The moves are recorded before the history is mapped, so the resets of the mapped task are moved with its history
+			for _, source := range sources {
+				moved, err := s.mapTaskProgress(ctx, tx, source, mapping.To)
+				if err != nil {
+					return nil, err
+				}
+				for _, change := range moved {
+					if change.Previous == nil && change.Current == nil {
+						continue
+					}
+					if err := s.recordChange(ctx, tx, change); err != nil {
+						return nil, err
+					}
+					report.Changes++
+				}
+			}
+			result.ProgressRows = len(sources)
+
+			historyRows, err := s.mapHistory(ctx, tx, mapping)
+			if err != nil {
+				return nil, err
+			}
+			result.HistoryRows = historyRows
+
+			report.ProgressRows += result.ProgressRows
+			report.HistoryRows += result.HistoryRows
+			report.Mappings = append(report.Mappings, result)
+		}
+		if dryRun {
+			return nil, errDryRun
+		}
+		return nil, nil
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+	return report, nil
+}
+
+//Moves the stored progress of a user on a mapped task to the target tasks, inside the transaction
+//The reset of the mapped task comes first, the moved progress keeps its creation and update times
+func (s *ProgressStore) mapTaskProgress(ctx context.Context, tx *sql.Tx, source ProgressRecord, targets []TaskRef) ([]*ProgressChange, error) {
+	previous := &TaskProgress{TaskId: source.TaskId, Progress: source.Progress, CreatedAt: source.CreatedAt, UpdatedAt: source.UpdatedAt, Version: source.Version}
+	reset, err := s.deleteLocked(ctx, tx, source.UserId, source.CourseId, source.TaskId, previous)
+	if err != nil {
+		return nil, err
+	}
+	changes := []*ProgressChange{reset}
+	for _, target := range targets {
+		current, err := s.selectForUpdate(ctx, tx, source.UserId, target.CourseId, target.TaskId)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && progressRank(current.Progress) >= progressRank(source.Progress) {
+			continue
+		}
+		moved := source
+		moved.CourseId, moved.TaskId = target.CourseId, target.TaskId
+		change, err := s.importLocked(ctx, tx, moved, current)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+//Moves the history of a mapped task to its target, or copies it to every target of a split
+//Returns the number of history rows of the mapped task
+func (s *ProgressStore) mapHistory(ctx context.Context, tx *sql.Tx, mapping TaskMapping) (int64, error) {
+	var result sql.Result
+	var err error
+	if len(mapping.To) == 1 {
+		target := mapping.To[0]
+		result, err = s.moveHistory.in(tx).ExecContext(ctx, target.CourseId, target.TaskId, mapping.From.CourseId, mapping.From.TaskId)
+	} else {
+		for _, target := range mapping.To {
+			_, err = s.copyHistory.in(tx).ExecContext(ctx, target.CourseId, target.TaskId, mapping.From.CourseId, mapping.From.TaskId)
+			if err != nil {
+				return 0, err
+			}
+		}
+		result, err = s.deleteHistory.in(tx).ExecContext(ctx, mapping.From.CourseId, mapping.From.TaskId)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+//Handles the post method on /admin/task-mappings
+//Applies the mappings of the body to the stored progress, or only reports the affected rows on a dry run
+//Returns 200 status code and the report of the mappings
+func HandleTaskMappingsPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request TaskMappingRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read task mappings.", err))
+		return
+	}
+	if err := validateTaskMappings(request.Mappings); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if err := checkMappingTargets(r.Context(), request.Mappings); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+
+	report, err := store.applyTaskMappings(r.Context(), request.Mappings, request.DryRun)
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to apply task mappings.", err))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: report})
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+)
+
+//Schema change, written for every SQL dialect
+type migration struct {
+	mysql    string
+	postgres string
+}
+
+//Schema changes applied in order after COURSEPROGRESS is created
+//The number of applied migrations is stored in SCHEMA_VERSION, so new migrations must only be appended
+var migrations = []migration{
+	{
+		mysql: "ALTER TABLE COURSEPROGRESS" +
+			" ADD COLUMN created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" ADD COLUMN updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP",
+		postgres: "ALTER TABLE COURSEPROGRESS" +
+			" ADD COLUMN created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" ADD COLUMN updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP",
+	},
+	{
+		mysql:    "ALTER TABLE COURSEPROGRESS ADD COLUMN version int NOT NULL DEFAULT 1",
+		postgres: "ALTER TABLE COURSEPROGRESS ADD COLUMN version int NOT NULL DEFAULT 1",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_HISTORY (" +
+			" id bigint NOT NULL AUTO_INCREMENT," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" previous_progress varchar(30) NULL," +
+			" progress varchar(30) NULL," +
+			" version int NOT NULL," +
+			" changed_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" learner_transition boolean NOT NULL DEFAULT false," +
+			" CONSTRAINT pk_courseprogress_history PRIMARY KEY (id)," +
+			" INDEX idx_courseprogress_history_user (user_id, changed_at))",
+		postgres: "CREATE TABLE COURSEPROGRESS_HISTORY (" +
+			" id bigserial NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" previous_progress varchar(30) NULL," +
+			" progress varchar(30) NULL," +
+			" version int NOT NULL," +
+			" changed_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" learner_transition boolean NOT NULL DEFAULT false," +
+			" CONSTRAINT pk_courseprogress_history PRIMARY KEY (id));" +
+			" CREATE INDEX idx_courseprogress_history_user ON COURSEPROGRESS_HISTORY (user_id, changed_at)",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_EVENTS (" +
+			" id bigint NOT NULL AUTO_INCREMENT," +
+			" event_type varchar(30) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" progress varchar(30) NULL," +
+			" score double NULL," +
+			" version int NOT NULL," +
+			" occurred_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_events PRIMARY KEY (id)," +
+			" INDEX idx_courseprogress_events_user (user_id, occurred_at)," +
+			" INDEX idx_courseprogress_events_task (user_id, course_id, task_id, id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_EVENTS (" +
+			" id bigserial NOT NULL," +
+			" event_type varchar(30) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" progress varchar(30) NULL," +
+			" score double precision NULL," +
+			" version int NOT NULL," +
+			" occurred_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_events PRIMARY KEY (id));" +
+			" CREATE INDEX idx_courseprogress_events_user ON COURSEPROGRESS_EVENTS (user_id, occurred_at);" +
+			" CREATE INDEX idx_courseprogress_events_task ON COURSEPROGRESS_EVENTS (user_id, course_id, task_id, id)",
+	},
+	//Seeds the progress log with the progress stored before it existed
+	{
+		mysql:    backfillEvents,
+		postgres: backfillEvents,
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_ARCHIVE (" +
+			" id bigint NOT NULL AUTO_INCREMENT," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" progress varchar(30) NOT NULL," +
+			" created_at DATETIME NOT NULL," +
+			" updated_at DATETIME NOT NULL," +
+			" version int NOT NULL," +
+			" reason varchar(100) NOT NULL," +
+			" archived_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_archive PRIMARY KEY (id)," +
+			" INDEX idx_courseprogress_archive_user (user_id, course_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_ARCHIVE (" +
+			" id bigserial NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" progress varchar(30) NOT NULL," +
+			" created_at timestamptz NOT NULL," +
+			" updated_at timestamptz NOT NULL," +
+			" version int NOT NULL," +
+			" reason varchar(100) NOT NULL," +
+			" archived_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_archive PRIMARY KEY (id));" +
+			" CREATE INDEX idx_courseprogress_archive_user ON COURSEPROGRESS_ARCHIVE (user_id, course_id)",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_IMPORTS (" +
+			" import_id varchar(100) NOT NULL," +
+			" rows_committed bigint NOT NULL," +
+			" imported bigint NOT NULL," +
+			" skipped bigint NOT NULL," +
+			" failed bigint NOT NULL," +
+			" updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_imports PRIMARY KEY (import_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_IMPORTS (" +
+			" import_id varchar(100) NOT NULL," +
+			" rows_committed bigint NOT NULL," +
+			" imported bigint NOT NULL," +
+			" skipped bigint NOT NULL," +
+			" failed bigint NOT NULL," +
+			" updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_imports PRIMARY KEY (import_id))",
+	},
+	//Records when a log entry was written, an import logs its changes with the times of the imported records
+	{
+		mysql: "ALTER TABLE COURSEPROGRESS_EVENTS ADD COLUMN recorded_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" ADD INDEX idx_courseprogress_events_recorded (recorded_at)",
+		//CURRENT_TIMESTAMP is the start of the transaction in Postgres, clock_timestamp() is closer to its commit
+		postgres: "ALTER TABLE COURSEPROGRESS_EVENTS ADD COLUMN recorded_at timestamptz NOT NULL DEFAULT clock_timestamp();" +
+			" CREATE INDEX idx_courseprogress_events_recorded ON COURSEPROGRESS_EVENTS (recorded_at)",
+	},
+	//Statements waiting to be sent to the learning record store, written in the transaction of the progress change
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_XAPI_OUTBOX (" +
+			" id bigint NOT NULL AUTO_INCREMENT," +
+			" statement_id varchar(36) NOT NULL," +
+			" statement TEXT NOT NULL," +
+			" attempts int NOT NULL DEFAULT 0," +
+			" created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_xapi_outbox PRIMARY KEY (id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_XAPI_OUTBOX (" +
+			" id bigserial NOT NULL," +
+			" statement_id varchar(36) NOT NULL," +
+			" statement text NOT NULL," +
+			" attempts int NOT NULL DEFAULT 0," +
+			" created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_xapi_outbox PRIMARY KEY (id))",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_LTI_LINE_ITEMS (" +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" context_id varchar(255) NOT NULL," +
+			" line_item_url varchar(1000) NOT NULL," +
+			" score_maximum double NOT NULL," +
+			" CONSTRAINT pk_courseprogress_lti_line_items PRIMARY KEY (course_id, task_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_LTI_LINE_ITEMS (" +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" context_id varchar(255) NOT NULL," +
+			" line_item_url varchar(1000) NOT NULL," +
+			" score_maximum double precision NOT NULL," +
+			" CONSTRAINT pk_courseprogress_lti_line_items PRIMARY KEY (course_id, task_id))",
+	},
+	//Scores waiting to be posted to the LTI platform, written in the transaction of the progress change
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_LTI_SCORES (" +
+			" id bigint NOT NULL AUTO_INCREMENT," +
+			" line_item_url varchar(1000) NOT NULL," +
+			" score TEXT NOT NULL," +
+			" attempts int NOT NULL DEFAULT 0," +
+			" next_attempt_at DATETIME NOT NULL," +
+			" created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_lti_scores PRIMARY KEY (id)," +
+			" INDEX idx_courseprogress_lti_scores_next (next_attempt_at))",
+		postgres: "CREATE TABLE COURSEPROGRESS_LTI_SCORES (" +
+			" id bigserial NOT NULL," +
+			" line_item_url varchar(1000) NOT NULL," +
+			" score text NOT NULL," +
+			" attempts int NOT NULL DEFAULT 0," +
+			" next_attempt_at timestamptz NOT NULL," +
+			" created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_lti_scores PRIMARY KEY (id));" +
+			" CREATE INDEX idx_courseprogress_lti_scores_next ON COURSEPROGRESS_LTI_SCORES (next_attempt_at)",
+	},
+	//Runtime data of the SCORM packages, the kept elements are stored as a JSON object
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_SCORM (" +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" scorm_version varchar(10) NOT NULL," +
+			" elements MEDIUMTEXT NOT NULL," +
+			" score double NULL," +
+			" updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_scorm PRIMARY KEY (user_id, course_id, task_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_SCORM (" +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" scorm_version varchar(10) NOT NULL," +
+			" elements text NOT NULL," +
+			" score double precision NULL," +
+			" updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_scorm PRIMARY KEY (user_id, course_id, task_id))",
+	},
+	//Certificates of completion, a certificate is issued once per completed task set
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_CERTIFICATES (" +
+			" id varchar(32) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" completed_at DATETIME NOT NULL," +
+			" tasks_hash varchar(64) NOT NULL," +
+			" issued_at DATETIME NOT NULL," +
+			" key_id varchar(16) NOT NULL," +
+			" signature varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_certificates PRIMARY KEY (id)," +
+			" CONSTRAINT uq_courseprogress_certificates UNIQUE (user_id, course_id, tasks_hash))",
+		postgres: "CREATE TABLE COURSEPROGRESS_CERTIFICATES (" +
+			" id varchar(32) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" completed_at timestamptz NOT NULL," +
+			" tasks_hash varchar(64) NOT NULL," +
+			" issued_at timestamptz NOT NULL," +
+			" key_id varchar(16) NOT NULL," +
+			" signature varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_certificates PRIMARY KEY (id)," +
+			" CONSTRAINT uq_courseprogress_certificates UNIQUE (user_id, course_id, tasks_hash))",
+	},
+	//Courses queued for the issuance of their certificate by the completion of one of their tasks
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_CERTIFICATE_QUEUE (" +
+			" id bigint NOT NULL AUTO_INCREMENT," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" attempts int NOT NULL DEFAULT 0," +
+			" queued_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_certificate_queue PRIMARY KEY (id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_CERTIFICATE_QUEUE (" +
+			" id bigserial NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" attempts int NOT NULL DEFAULT 0," +
+			" queued_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			" CONSTRAINT pk_courseprogress_certificate_queue PRIMARY KEY (id))",
+	},
+	//Deadlines of the tasks, the deadline of a course has an empty task id
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_DEADLINES (" +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" due_at DATETIME NOT NULL," +
+			" notified_at DATETIME NULL," +
+			" CONSTRAINT pk_courseprogress_deadlines PRIMARY KEY (course_id, task_id)," +
+			" INDEX idx_courseprogress_deadlines_due (due_at))",
+		postgres: "CREATE TABLE COURSEPROGRESS_DEADLINES (" +
+			" course_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" due_at timestamptz NOT NULL," +
+			" notified_at timestamptz NULL," +
+			" CONSTRAINT pk_courseprogress_deadlines PRIMARY KEY (course_id, task_id));" +
+			" CREATE INDEX idx_courseprogress_deadlines_due ON COURSEPROGRESS_DEADLINES (due_at)",
+	},
+	//Progress transitions by user and day, the days are the days of the timezone of the user
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_ACTIVITY (" +
+			" user_id varchar(100) NOT NULL," +
+			" day DATE NOT NULL," +
+			" transitions int NOT NULL," +
+			" CONSTRAINT pk_courseprogress_activity PRIMARY KEY (user_id, day))",
+		postgres: "CREATE TABLE COURSEPROGRESS_ACTIVITY (" +
+			" user_id varchar(100) NOT NULL," +
+			" day date NOT NULL," +
+			" transitions int NOT NULL," +
+			" CONSTRAINT pk_courseprogress_activity PRIMARY KEY (user_id, day))",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_STREAKS (" +
+			" user_id varchar(100) NOT NULL," +
+			" timezone varchar(64) NOT NULL," +
+			" last_day DATE NULL," +
+			" current_streak int NOT NULL," +
+			" longest_streak int NOT NULL," +
+			" CONSTRAINT pk_courseprogress_streaks PRIMARY KEY (user_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_STREAKS (" +
+			" user_id varchar(100) NOT NULL," +
+			" timezone varchar(64) NOT NULL," +
+			" last_day date NULL," +
+			" current_streak int NOT NULL," +
+			" longest_streak int NOT NULL," +
+			" CONSTRAINT pk_courseprogress_streaks PRIMARY KEY (user_id))",
+	},
+	//Rankings of the users by course, maintained by every progress write and recorded score
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_LEADERBOARD (" +
+			" course_id varchar(100) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" completed int NOT NULL," +
+			" score double NOT NULL," +
+			" started_at DATETIME NULL," +
+			" last_completed_at DATETIME NULL," +
+			" completion_time bigint NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboard PRIMARY KEY (course_id, user_id)," +
+			" INDEX idx_courseprogress_leaderboard_completed (course_id, completed)," +
+			" INDEX idx_courseprogress_leaderboard_score (course_id, score)," +
+			" INDEX idx_courseprogress_leaderboard_completion_time (course_id, completion_time))",
+		postgres: "CREATE TABLE COURSEPROGRESS_LEADERBOARD (" +
+			" course_id varchar(100) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" completed int NOT NULL," +
+			" score double precision NOT NULL," +
+			" started_at timestamptz NULL," +
+			" last_completed_at timestamptz NULL," +
+			" completion_time bigint NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboard PRIMARY KEY (course_id, user_id));" +
+			" CREATE INDEX idx_courseprogress_leaderboard_completed ON COURSEPROGRESS_LEADERBOARD (course_id, completed);" +
+			" CREATE INDEX idx_courseprogress_leaderboard_score ON COURSEPROGRESS_LEADERBOARD (course_id, score);" +
+			" CREATE INDEX idx_courseprogress_leaderboard_completion_time ON COURSEPROGRESS_LEADERBOARD (course_id, completion_time)",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_LEADERBOARD_SCORES (" +
+			" course_id varchar(100) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" score double NOT NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboard_scores PRIMARY KEY (course_id, user_id, task_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_LEADERBOARD_SCORES (" +
+			" course_id varchar(100) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" task_id varchar(100) NOT NULL," +
+			" score double precision NOT NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboard_scores PRIMARY KEY (course_id, user_id, task_id))",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_LEADERBOARDS (" +
+			" course_id varchar(100) NOT NULL," +
+			" pseudonymize boolean NOT NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboards PRIMARY KEY (course_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_LEADERBOARDS (" +
+			" course_id varchar(100) NOT NULL," +
+			" pseudonymize boolean NOT NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboards PRIMARY KEY (course_id))",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_LEADERBOARD_OPT_OUTS (" +
+			" course_id varchar(100) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboard_opt_outs PRIMARY KEY (course_id, user_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_LEADERBOARD_OPT_OUTS (" +
+			" course_id varchar(100) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_leaderboard_opt_outs PRIMARY KEY (course_id, user_id))",
+	},
+	//Seeds the rankings with the progress stored before them, the scores recorded before are restored by rebuild-projections
+	{
+		mysql:    backfillLeaderboard + "TIMESTAMPDIFF(SECOND, MIN(created_at), " + lastCompletedAt + ")" + backfillLeaderboardFrom,
+		postgres: backfillLeaderboard + "CAST(EXTRACT(EPOCH FROM " + lastCompletedAt + " - MIN(created_at)) AS bigint)" + backfillLeaderboardFrom,
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_COHORTS (" +
+			" id varchar(32) NOT NULL," +
+			" name varchar(200) NOT NULL," +
+			" created_at DATETIME NOT NULL," +
+			" CONSTRAINT pk_courseprogress_cohorts PRIMARY KEY (id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_COHORTS (" +
+			" id varchar(32) NOT NULL," +
+			" name varchar(200) NOT NULL," +
+			" created_at timestamptz NOT NULL," +
+			" CONSTRAINT pk_courseprogress_cohorts PRIMARY KEY (id))",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_COHORT_MEMBERS (" +
+			" cohort_id varchar(32) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_cohort_members PRIMARY KEY (cohort_id, user_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_COHORT_MEMBERS (" +
+			" cohort_id varchar(32) NOT NULL," +
+			" user_id varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_cohort_members PRIMARY KEY (cohort_id, user_id))",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_COHORT_COURSES (" +
+			" cohort_id varchar(32) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_cohort_courses PRIMARY KEY (cohort_id, course_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_COHORT_COURSES (" +
+			" cohort_id varchar(32) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_cohort_courses PRIMARY KEY (cohort_id, course_id))",
+	},
+	{
+		mysql: "CREATE TABLE COURSEPROGRESS_ENROLLMENTS (" +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" enrolled_at DATETIME NOT NULL," +
+			" source varchar(30) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_enrollments PRIMARY KEY (user_id, course_id))",
+		postgres: "CREATE TABLE COURSEPROGRESS_ENROLLMENTS (" +
+			" user_id varchar(100) NOT NULL," +
+			" course_id varchar(100) NOT NULL," +
+			" enrolled_at timestamptz NOT NULL," +
+			" source varchar(30) NOT NULL," +
+			" CONSTRAINT pk_courseprogress_enrollments PRIMARY KEY (user_id, course_id))",
+	},
+	{
+		mysql:    backfillEnrollments,
+		postgres: backfillEnrollments,
+	},
+}
+
+//Lock serializing the migrations of the instances started at the same time, by name on MySQL and by key on PostgreSQL
+const (
+	migrationLock    = "course_progress_migrations"
+	migrationLockKey = 7310002
+	//Seconds MySQL waits for the lock held by another instance
+	migrationLockTimeout = 3600
+)
+
+//Creates COURSEPROGRESS, then applies the migrations not yet recorded in SCHEMA_VERSION
+//The instances are serialized by a database lock held until every migration is applied, so each migration is applied once
+//Every migration is recorded in the transaction applying it. MySQL commits the schema changes implicitly, so only the data
+//migrations are rolled back with their version there, the schema changes are rolled back on PostgreSQL
+func migrate() {
+	ctx := context.Background()
+	conn, err := connection.Conn(ctx)
+	if err != nil {
+		log.Fatal("Failed to connect to database" + err.Error())
+	}
+	defer conn.Close()
+	if err := dialect.lockMigrations(ctx, conn); err != nil {
+		log.Fatal("Failed to lock the migrations" + err.Error())
+	}
+	defer func() {
+		if err := dialect.unlockMigrations(ctx, conn); err != nil {
+			log.Println("Failed to unlock the migrations. \nCause: " + err.Error())
+		}
+	}()
+
+	createProgressTable(ctx, conn)
+	_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS SCHEMA_VERSION (version int NOT NULL)")
+	if err != nil {
+		log.Fatal("Failed to create table SCHEMA_VERSION" + err.Error())
+	}
+
+	var version int
+	err = conn.QueryRowContext(ctx, "SELECT version FROM SCHEMA_VERSION").Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = conn.ExecContext(ctx, "INSERT INTO SCHEMA_VERSION(version) values (0)")
+	}
+	if err != nil {
+		log.Fatal("Failed to read schema version" + err.Error())
+	}
+
+	for ; version < len(migrations); version++ {
+		log.Println("Applying migration " + strconv.Itoa(version+1))
+		if err := applyMigration(ctx, conn, version); err != nil {
+			log.Fatal("Migration " + strconv.Itoa(version+1) + " failed: " + err.Error())
+		}
+	}
+}
+
+//Creates COURSEPROGRESS table in database if it not exist
+func createProgressTable(ctx context.Context, conn *sql.Conn) {
+	var res string
+	err := conn.QueryRowContext(ctx, "SELECT user_id FROM COURSEPROGRESS LIMIT 1").Scan(&res)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Creating table COURSEPROGRESS" + err.Error())
+		_, err = conn.ExecContext(ctx, "create table COURSEPROGRESS ("+
+			" user_id varchar(100) NOT NULL,"+
+			" course_id varchar(100) NOT NULL,"+
+			" task_id varchar(100) NOT NULL,"+
+			" progress varchar(30) NOT NULL,"+
+			" CONSTRAINT pk_courseprogress PRIMARY KEY (user_id,course_id,task_id))")
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Table COURSEPROGRESS has been successfully created")
+	}
+}
+
+//Applies the migration following the given schema version and records the new version, in one transaction
+//Returns an error if the recorded version isn't the given one anymore
+func applyMigration(ctx context.Context, conn *sql.Conn, version int) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, dialect.migration(migrations[version])); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, dialect.rebind("UPDATE SCHEMA_VERSION set version =? where version = ?"), version+1, version)
+	if err != nil {
+		return errors.New("Failed to record schema version" + err.Error())
+	}
+	if recorded, err := result.RowsAffected(); err != nil || recorded != 1 {
+		return errors.New("schema version " + strconv.Itoa(version) + " was changed by another instance")
+	}
+	return tx.Commit()
+}
+
+const backfillEvents = "INSERT INTO COURSEPROGRESS_EVENTS(event_type,user_id,course_id,task_id,progress,version,occurred_at)" +
+	" SELECT CASE progress WHEN 'completed' THEN 'ProgressCompleted' ELSE 'ProgressStarted' END," +
+	" user_id, course_id, task_id, progress, version, updated_at FROM COURSEPROGRESS"
+
+//The completion time of the rankings is the difference of the last completion and the start, computed by each dialect
+const lastCompletedAt = "MAX(CASE WHEN progress = 'completed' THEN updated_at END)"
+
+const backfillLeaderboard = "INSERT INTO COURSEPROGRESS_LEADERBOARD(course_id,user_id,completed,score,started_at,last_completed_at,completion_time)" +
+	" SELECT course_id, user_id, SUM(CASE WHEN progress = 'completed' THEN 1 ELSE 0 END), 0, MIN(created_at), " + lastCompletedAt + ", "
+
+const backfillLeaderboardFrom = " FROM COURSEPROGRESS GROUP BY course_id, user_id"
+
+const backfillEnrollments = "INSERT INTO COURSEPROGRESS_ENROLLMENTS(user_id,course_id,enrolled_at,source)" +
+	" SELECT user_id, course_id, MIN(created_at), '" + enrollmentSourceProgress + "' FROM COURSEPROGRESS GROUP BY user_id, course_id"
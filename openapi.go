@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Subset of JSON schema used by the OpenAPI document and by the request validation
+type jsonSchema struct {
+	Ref         string                 `json:"$ref,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Enum        []string               `json:"enum,omitempty"`
+	MaxLength   int                    `json:"maxLength,omitempty"`
+	Minimum     *float64               `json:"minimum,omitempty"`
+	Maximum     *float64               `json:"maximum,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	Items       *jsonSchema            `json:"items,omitempty"`
+	Nullable    bool                   `json:"nullable,omitempty"`
+}
+
+type apiParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+type apiResponse struct {
+	Description string
+	ContentType string
+	Schema      *jsonSchema
+}
+
+//Describes a route of the service: it is registered on the router and documented in the OpenAPI document
+//Path uses the httprouter syntax, path parameters are documented and validated automatically
+type apiRoute struct {
+	Method    string
+	Path      string
+	Handle    httprouter.Handle
+	Summary   string
+	Query     []apiParameter
+	Body      *jsonSchema
+	Responses map[int]apiResponse
+	//Admin routes require the admin token, checked before the request is validated
+	Admin bool
+	//Long-running routes stream their body or response, they aren't bounded by the request timeout nor the read and write timeouts of the server
+	LongRunning bool
+	//Format of the errors of the route, including the request validation errors
+	Errors errorStyle
+}
+
+//Format of the error responses of a route
+type errorStyle int
+
+const (
+	//Plain text errors of the v1 routes
+	plainErrors errorStyle = iota
+	//JSON error objects of the v2 routes
+	jsonErrors
+)
+
+func ref(name string) *jsonSchema {
+	return &jsonSchema{Ref: "#/components/schemas/" + name}
+}
+
+func arrayOf(items *jsonSchema) *jsonSchema {
+	return &jsonSchema{Type: "array", Items: items}
+}
+
+func jsonResponse(description string, schema *jsonSchema) apiResponse {
+	return apiResponse{Description: description, ContentType: "application/json", Schema: schema}
+}
+
+func errorResponse(description string) apiResponse {
+	return apiResponse{Description: description, ContentType: "text/plain", Schema: &jsonSchema{Type: "string"}}
+}
+
+func queryParameter(name, description string, schema *jsonSchema) apiParameter {
+	return apiParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+//Identifiers are stored in varchar(100) columns
+var idSchema = &jsonSchema{Type: "string", MaxLength: 100}
+
+//Returns the names of the path parameters of a httprouter path
+func pathParameters(path string) []string {
+	names := make([]string, 0)
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			names = append(names, segment[1:])
+		}
+	}
+	return names
+}
+
+//Converts a httprouter path to an OpenAPI path template
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+//Builds the OpenAPI 3 document from the given routes
+func buildOpenAPIDocument(routes []apiRoute) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		path := openAPIPath(route.Path)
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+
+		parameters := make([]apiParameter, 0)
+		for _, name := range pathParameters(route.Path) {
+			parameters = append(parameters, apiParameter{Name: name, In: "path", Required: true, Schema: idSchema})
+		}
+		parameters = append(parameters, route.Query...)
+
+		responses := make(map[string]interface{})
+		for status, response := range route.Responses {
+			content := make(map[string]interface{})
+			if response.Schema != nil {
+				content[response.ContentType] = map[string]interface{}{"schema": response.Schema}
+			}
+			responses[strconv.Itoa(status)] = map[string]interface{}{
+				"description": response.Description,
+				"content":     content,
+			}
+		}
+
+		operation := map[string]interface{}{
+			"summary":    route.Summary,
+			"parameters": parameters,
+			"responses":  responses,
+		}
+		if route.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": route.Body},
+				},
+			}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "course-progress-service",
+			"version": "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": apiSchemas},
+	}
+}
+
+//Validates the value against the schema
+//Returns nil if the value is valid or an error describing the first violation found
+func validateSchema(schema *jsonSchema, value interface{}, field string) error {
+	if schema.Ref != "" {
+		resolved, ok := apiSchemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", field, schema.Ref)
+		}
+		return validateSchema(resolved, value, field)
+	}
+	if value == nil && schema.Nullable {
+		return nil
+	}
+	if value == nil {
+		return fmt.Errorf("%s: must not be null", field)
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an object", field)
+		}
+		for _, name := range schema.Required {
+			if _, found := object[name]; !found {
+				return fmt.Errorf("%s: is required", joinField(field, name))
+			}
+		}
+		for name, propertyValue := range object {
+			if property, found := schema.Properties[name]; found {
+				if err := validateSchema(property, propertyValue, joinField(field, name)); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an array", field)
+		}
+		for i, item := range array {
+			if err := validateSchema(schema.Items, item, field+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", field)
+		}
+		return validateString(schema, text, field)
+	case "number", "integer":
+		number, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s: must be a number", field)
+		}
+		return validateNumber(schema, number, field)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: must be a boolean", field)
+		}
+	}
+	return nil
+}
+
+func validateString(schema *jsonSchema, text, field string) error {
+	if schema.MaxLength > 0 && len(text) > schema.MaxLength {
+		return fmt.Errorf("%s: must be at most %d characters long", field, schema.MaxLength)
+	}
+	if len(schema.Enum) != 0 {
+		for _, allowed := range schema.Enum {
+			if text == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: must be one of '%s'", field, strings.Join(schema.Enum, "','"))
+	}
+	return nil
+}
+
+func validateNumber(schema *jsonSchema, number float64, field string) error {
+	if schema.Type == "integer" && number != float64(int64(number)) {
+		return fmt.Errorf("%s: must be an integer", field)
+	}
+	if schema.Minimum != nil && number < *schema.Minimum {
+		return fmt.Errorf("%s: must be at least %v", field, *schema.Minimum)
+	}
+	if schema.Maximum != nil && number > *schema.Maximum {
+		return fmt.Errorf("%s: must be at most %v", field, *schema.Maximum)
+	}
+	return nil
+}
+
+//Validates a path or query parameter, given as text, against the schema
+func validateParameter(schema *jsonSchema, text, field string) error {
+	switch schema.Type {
+	case "integer", "number":
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("%s: must be a number", field)
+		}
+		return validateNumber(schema, number, field)
+	case "boolean":
+		if _, err := strconv.ParseBool(text); err != nil {
+			return fmt.Errorf("%s: must be a boolean", field)
+		}
+		return nil
+	}
+	return validateString(schema, text, field)
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+//Wraps the route handler with the validation of the path parameters, query parameters and JSON body
+//Responds with 400 status code on malformed body or 422 status code on schema violation
+func validateRequest(route apiRoute) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		for _, name := range pathParameters(route.Path) {
+			if err := validateParameter(idSchema, ps.ByName(name), name); err != nil {
+				rejectRequest(w, route, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+		query := r.URL.Query()
+		for _, parameter := range route.Query {
+			value := query.Get(parameter.Name)
+			if value == "" {
+				if parameter.Required {
+					rejectRequest(w, route, http.StatusUnprocessableEntity, fmt.Errorf("%s: is required", parameter.Name))
+					return
+				}
+				continue
+			}
+			if err := validateParameter(parameter.Schema, value, parameter.Name); err != nil {
+				rejectRequest(w, route, http.StatusUnprocessableEntity, err)
+				return
+			}
+		}
+
+		if route.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				rejectRequest(w, route, http.StatusBadRequest, err)
+				return
+			}
+			var value interface{}
+			if err := json.Unmarshal(body, &value); err != nil {
+				rejectRequest(w, route, http.StatusBadRequest, err)
+				return
+			}
+			if err := validateSchema(route.Body, value, "body"); err != nil {
+				rejectRequest(w, route, http.StatusUnprocessableEntity, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		route.Handle(w, r, ps)
+	}
+}
+
+//Responds with the validation error in the error format of the route
+func rejectRequest(w http.ResponseWriter, route apiRoute, status int, err error) {
+	validationErr := newServiceError(status, "Request validation failed.", err)
+	if route.Errors == jsonErrors {
+		respondErrorV2(w, validationErr)
+		return
+	}
+	respondError(w, validationErr)
+}
+
+//Handles the get method on /openapi.json
+//Returns the OpenAPI 3 document describing every route of the service
+func HandleOpenAPI(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	message, err := json.Marshal(buildOpenAPIDocument(routes))
+	if err != nil {
+		errorMessage := "JSON error: failed to marshall OpenAPI document. \nCause: " + err.Error()
+		log.Println(errorMessage)
+		http.Error(w, errorMessage, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(message)
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>course-progress-service</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+//Handles the get method on /docs
+//Returns the Swagger UI page rendering the OpenAPI document
+func HandleSwaggerUI(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
+
+//Bounds the context of the request by the configured request timeout
+//The context is also cancelled when the client disconnects, which stops the database and upstream calls
+func withDeadline(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+		handle(w, r.WithContext(ctx), ps)
+	}
+}
+
+//Clears the read and write deadlines set on the connection of the request by the server timeouts
+//The context of the request is still cancelled when the client disconnects
+func withoutTimeouts(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		connections.clearDeadlines(r.RemoteAddr)
+		handle(w, r, ps)
+	}
+}
+
+//Creates the router with every documented route, the OpenAPI document and the Swagger UI page
+func newRouter() *httprouter.Router {
+	router := httprouter.New()
+	for _, route := range routes {
+		handle := validateRequest(route)
+		if route.Admin {
+			handle = requireAdmin(handle)
+		}
+		if route.LongRunning {
+			handle = withoutTimeouts(handle)
+		} else {
+			handle = withDeadline(handle)
+		}
+		router.Handle(route.Method, route.Path, handle)
+	}
+	router.GET("/openapi.json", HandleOpenAPI)
+	router.GET("/docs", HandleSwaggerUI)
+	return router
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Serves the request with the router of the service and returns the recorded response
+//The requests of the tests are answered before the database is used, the store isn't connected
+func serveTestRequest(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+//Returns the values of the $ref properties found in the JSON value
+func schemaRefs(value interface{}) []string {
+	refs := make([]string, 0)
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, item := range value {
+			if ref, ok := item.(string); ok && name == "$ref" {
+				refs = append(refs, ref)
+				continue
+			}
+			refs = append(refs, schemaRefs(item)...)
+		}
+	case []interface{}:
+		for _, item := range value {
+			refs = append(refs, schemaRefs(item)...)
+		}
+	}
+	return refs
+}
+
+func TestOpenAPIDocumentDescribesEveryRoute(t *testing.T) {
+	initConfig()
+	resp := serveTestRequest("GET", "/openapi.json", "", nil)
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("document answered %d with %s", resp.Code, resp.Header().Get("Content-Type"))
+	}
+	var document struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(document.OpenAPI, "3.") {
+		t.Errorf("document version %s, want OpenAPI 3", document.OpenAPI)
+	}
+	for _, route := range routes {
+		operation := document.Paths[openAPIPath(route.Path)][strings.ToLower(route.Method)]
+		if operation == nil {
+			t.Errorf("%s %s isn't documented", route.Method, route.Path)
+			continue
+		}
+		if len(operation["responses"].(map[string]interface{})) == 0 {
+			t.Errorf("%s %s documents no response", route.Method, route.Path)
+		}
+	}
+
+	var raw interface{}
+	json.Unmarshal(resp.Body.Bytes(), &raw)
+	for _, ref := range schemaRefs(raw) {
+		if document.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")] == nil {
+			t.Errorf("%s isn't a schema of the document", ref)
+		}
+	}
+
+	if resp := serveTestRequest("GET", "/docs", "", nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "/openapi.json") {
+		t.Errorf("Swagger UI answered %d:\n%s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestRequestsAreValidatedBeforeTheHandlers(t *testing.T) {
+	initConfig()
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/progress/ana/algebra/intro", `{"progress":`, http.StatusBadRequest},
+		{"PUT", "/progress/ana/algebra/intro", `{}`, http.StatusUnprocessableEntity},
+		{"PUT", "/progress/ana/algebra/intro", `{"progress":"finished"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/progress/ana/algebra/intro", `{"progress":7}`, http.StatusUnprocessableEntity},
+		{"GET", "/progress/" + strings.Repeat("a", 101), "", http.StatusUnprocessableEntity},
+		{"GET", "/progress/ana?progress=finished", "", http.StatusUnprocessableEntity},
+		{"GET", "/progress/ana?limit=0", "", http.StatusUnprocessableEntity},
+	} {
+		resp := serveTestRequest(test.method, test.path, test.body, nil)
+		if resp.Code != test.status {
+			t.Errorf("%s %s with %q answered %d, want %d", test.method, test.path, test.body, resp.Code, test.status)
+		}
+		if !strings.HasPrefix(resp.Body.String(), "Request validation failed.") {
+			t.Errorf("%s %s with %q wasn't rejected by the validation: %s", test.method, test.path, test.body, resp.Body.String())
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Get the task groups of every course known by the course-manager-service, keyed by course id
+//Courses whose course-service returns no tasks are mapped to nil
+func loadCatalogs(ctx context.Context) (map[string][]TaskGroup, error) {
+	URLs, err := getAllCoursesURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if URLs == nil {
+		return nil, errors.New("course-manager-service returns no URL")
+	}
+	catalogs := make(map[string][]TaskGroup, len(URLs))
+	for courseId, URL := range URLs {
+		taskGroups, err := getCourseTaskGroups(ctx, URL)
+		if err != nil {
+			return nil, err
+		}
+		catalogs[courseId] = taskGroups
+	}
+	return catalogs, nil
+}
+
+//Reasons of the orphaned progress
+const (
+	orphanUnknownCourse      = "unknown course"
+	orphanTaskNotInCatalog   = "task not in catalog"
+	orphanCatalogUnavailable = "catalog unavailable"
+)
+
+//Returns why the stored progress is orphaned in the catalogs, or empty string if its task still exists
+//Progress of a course whose catalog couldn't be read is reported as such, it is never archived or remapped
+func orphanReason(catalogs map[string][]TaskGroup, record ProgressRecord) string {
+	taskGroups, ok := catalogs[record.CourseId]
+	if !ok {
+		return orphanUnknownCourse
+	}
+	if taskGroups == nil {
+		return orphanCatalogUnavailable
+	}
+	if !catalogHasTask(taskGroups, record.TaskId) {
+		return orphanTaskNotInCatalog
+	}
+	return ""
+}
+
+func catalogHasTask(taskGroups []TaskGroup, taskId string) bool {
+	for _, id := range taskIds(taskGroups) {
+		if id == taskId {
+			return true
+		}
+	}
+	return false
+}
+
+//Ranks the progress types, a task is never remapped to a less advanced progress
+func progressRank(progress string) int {
+	switch progress {
+	case "completed":
+		return 2
+	case "started":
+		return 1
+	}
+	return 0
+}
+
+//Moves the stored progress of the user from a task of the course to another one, in one transaction
+//If the user has progress on both tasks, the most advanced one is kept
+//Returns the changes of both tasks
+func (s *ProgressStore) moveTaskProgress(ctx context.Context, userId, courseId, fromTaskId, toTaskId string) ([]*ProgressChange, error) {
+	return s.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		from, err := s.selectForUpdate(ctx, tx, userId, courseId, fromTaskId)
+		if err != nil || from == nil {
+			return nil, err
+		}
+		to, err := s.selectForUpdate(ctx, tx, userId, courseId, toTaskId)
+		if err != nil {
+			return nil, err
+		}
+
+		changes := make([]*ProgressChange, 0, 2)
+		if to == nil || progressRank(from.Progress) > progressRank(to.Progress) {
+			moved := CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: toTaskId, Progress: from.Progress}
+			change, err := s.upsertLocked(ctx, tx, moved, to)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+		change, err := s.deleteLocked(ctx, tx, userId, courseId, fromTaskId, from)
+		if err != nil {
+			return nil, err
+		}
+		return append(changes, change), nil
+	})
+}
+
+//Moves the stored progress of the user on the task to COURSEPROGRESS_ARCHIVE, in one transaction
+//Returns the change of the task, recorded as a reset
+func (s *ProgressStore) archiveTaskProgress(ctx context.Context, userId, courseId, taskId, reason string) (*ProgressChange, error) {
+	return s.runWrite(ctx, func(ctx context.Context, tx *sql.Tx) (*ProgressChange, error) {
+		previous, err := s.selectForUpdate(ctx, tx, userId, courseId, taskId)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			_, err := tx.StmtContext(ctx, s.insertArchive).ExecContext(ctx, userId, courseId, taskId, previous.Progress, *previous.CreatedAt, *previous.UpdatedAt, previous.Version, reason)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s.deleteLocked(ctx, tx, userId, courseId, taskId, previous)
+	})
+}
+
+//Options of a reconciliation
+//Remap maps, per course, the ids of removed or renamed tasks to the ids of the tasks replacing them
+type ReconciliationOptions struct {
+	Archive bool                         `json:"archive"`
+	Remap   map[string]map[string]string `json:"remap,omitempty"`
+}
+
+//Actions taken on an orphaned progress
+const (
+	actionReported = "reported"
+	actionArchived = "archived"
+	actionRemapped = "remapped"
+	actionFailed   = "failed"
+)
+
+type OrphanResource struct {
+	UserId     string `json:"userId"`
+	TaskId     string `json:"taskId"`
+	Progress   string `json:"progress"`
+	Reason     string `json:"reason"`
+	Action     string `json:"action"`
+	RemappedTo string `json:"remappedTo,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type CourseReconciliation struct {
+	CourseId string           `json:"courseId"`
+	Orphans  []OrphanResource `json:"orphans"`
+}
+
+//Report of a reconciliation of the stored progress against the catalogs
+type ReconciliationReport struct {
+	Status     string                 `json:"status"`
+	Options    ReconciliationOptions  `json:"options"`
+	StartedAt  time.Time              `json:"startedAt"`
+	FinishedAt *time.Time             `json:"finishedAt,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Orphans    int                    `json:"orphans"`
+	Archived   int                    `json:"archived"`
+	Remapped   int                    `json:"remapped"`
+	Courses    []CourseReconciliation `json:"courses"`
+}
+
+//Reconciles the stored progress against the catalogs of every course
+//Orphans are remapped if the options map their task to a task of the catalog, otherwise archived if the options ask for it
+func reconcile(ctx context.Context, options ReconciliationOptions) (report ReconciliationReport) {
+	report = ReconciliationReport{Status: "completed", Options: options, StartedAt: time.Now().UTC(), Courses: make([]CourseReconciliation, 0)}
+	defer func() {
+		finishedAt := time.Now().UTC()
+		report.FinishedAt = &finishedAt
+	}()
+
+	catalogs, err := loadCatalogs(ctx)
+	if err != nil {
+		report.Status, report.Error = "failed", "Failed to load the course catalogs. \nCause: "+err.Error()
+		return report
+	}
+	var orphans []OrphanResource
+	var orphanCourses []string
+	err = store.eachProgress(ctx, func(record ProgressRecord) error {
+		if reason := orphanReason(catalogs, record); reason != "" {
+			orphans = append(orphans, OrphanResource{UserId: record.UserId, TaskId: record.TaskId, Progress: record.Progress, Reason: reason, Action: actionReported})
+			orphanCourses = append(orphanCourses, record.CourseId)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		report.Status, report.Error = "failed", "Failed to read the stored progress. \nCause: "+err.Error()
+		return report
+	}
+
+	byCourse := make(map[string]*CourseReconciliation)
+	for i := range orphans {
+		orphan, courseId := &orphans[i], orphanCourses[i]
+		if ctx.Err() == nil && orphan.Reason != orphanCatalogUnavailable {
+			reconcileOrphan(ctx, catalogs, courseId, orphan, options)
+		}
+		switch orphan.Action {
+		case actionArchived:
+			report.Archived++
+		case actionRemapped:
+			report.Remapped++
+		}
+		if byCourse[courseId] == nil {
+			byCourse[courseId] = &CourseReconciliation{CourseId: courseId}
+		}
+		byCourse[courseId].Orphans = append(byCourse[courseId].Orphans, *orphan)
+	}
+	report.Orphans = len(orphans)
+	for _, course := range byCourse {
+		report.Courses = append(report.Courses, *course)
+	}
+	sort.Slice(report.Courses, func(i, j int) bool {
+		return report.Courses[i].CourseId < report.Courses[j].CourseId
+	})
+	if ctx.Err() != nil {
+		report.Status, report.Error = "failed", "Reconciliation aborted. \nCause: "+ctx.Err().Error()
+	}
+	return report
+}
+
+//Remaps or archives the orphaned progress, as asked by the options
+func reconcileOrphan(ctx context.Context, catalogs map[string][]TaskGroup, courseId string, orphan *OrphanResource, options ReconciliationOptions) {
+	var err error
+	if target := options.Remap[courseId][orphan.TaskId]; target != "" && catalogHasTask(catalogs[courseId], target) {
+		_, err = store.moveTaskProgress(ctx, orphan.UserId, courseId, orphan.TaskId, target)
+		orphan.Action, orphan.RemappedTo = actionRemapped, target
+	} else if options.Archive {
+		_, err = store.archiveTaskProgress(ctx, orphan.UserId, courseId, orphan.TaskId, orphan.Reason)
+		orphan.Action = actionArchived
+	}
+	if err != nil {
+		orphan.Action, orphan.Error = actionFailed, err.Error()
+	}
+}
+
+//State of the reconciliation job, only one reconciliation runs at a time
+var reconciliation struct {
+	sync.Mutex
+	running bool
+	last    *ReconciliationReport
+}
+
+var errReconciliationRunning = newServiceError(http.StatusConflict, "A reconciliation is already running", nil)
+
+//Starts a reconciliation in background, bounded by the context
+//Returns the report of the running reconciliation, or a service error if one is already running
+func startReconciliation(ctx context.Context, options ReconciliationOptions) (ReconciliationReport, error) {
+	reconciliation.Lock()
+	defer reconciliation.Unlock()
+	if reconciliation.running {
+		return ReconciliationReport{}, errReconciliationRunning
+	}
+	reconciliation.running = true
+	running := ReconciliationReport{Status: "running", Options: options, StartedAt: time.Now().UTC(), Courses: make([]CourseReconciliation, 0)}
+
+	go func() {
+		report := reconcile(ctx, options)
+		if report.Error != "" {
+			log.Println("Reconciliation failed. " + report.Error)
+		} else {
+			log.Println("Reconciliation completed with " + strconv.Itoa(report.Orphans) + " orphans")
+		}
+		reconciliation.Lock()
+		reconciliation.running = false
+		reconciliation.last = &report
+		reconciliation.Unlock()
+	}()
+	return running, nil
+}
+
+//Returns the report of the last finished reconciliation, nil if none has finished
+//running is true if a reconciliation is in progress
+func lastReconciliation() (last *ReconciliationReport, running bool) {
+	reconciliation.Lock()
+	defer reconciliation.Unlock()
+	return reconciliation.last, reconciliation.running
+}
+
+//Runs a report-only reconciliation at the configured interval, until shutdown
+func scheduleReconciliation() {
+	if config.ReconciliationInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.ReconciliationInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := startReconciliation(jobContext, ReconciliationOptions{}); err != nil {
+					log.Println("Scheduled reconciliation skipped. \nCause: " + err.Error())
+				}
+			case <-jobContext.Done():
+				return
+			}
+		}
+	}()
+}
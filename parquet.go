@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+//Minimal Parquet writer for flat schemas of required and optional columns
+//Rows are buffered in row groups of bounded size, every column chunk is a single uncompressed PLAIN data page
+
+//Physical types, converted types and encodings of the Parquet format
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetNoConversion    = -1
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+var parquetMagic = []byte("PAR1")
+
+type parquetColumn struct {
+	name      string
+	physical  int32
+	converted int32
+	optional  bool
+
+	values  bytes.Buffer
+	defined []bool
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+type parquetRowGroup struct {
+	chunks []parquetChunk
+	size   int64
+	rows   int64
+}
+
+type parquetWriter struct {
+	w            io.Writer
+	offset       int64
+	columns      []*parquetColumn
+	rowGroupSize int
+	rows         int
+	totalRows    int64
+	rowGroups    []parquetRowGroup
+}
+
+func newParquetWriter(w io.Writer, rowGroupSize int, columns ...*parquetColumn) *parquetWriter {
+	return &parquetWriter{w: w, columns: columns, rowGroupSize: rowGroupSize}
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+func (c *parquetColumn) addByteArray(value string) {
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(value)))
+	c.values.WriteString(value)
+	c.defined = append(c.defined, true)
+}
+
+func (c *parquetColumn) addInt32(value int32) {
+	binary.Write(&c.values, binary.LittleEndian, value)
+	c.defined = append(c.defined, true)
+}
+
+func (c *parquetColumn) addInt64(value int64) {
+	binary.Write(&c.values, binary.LittleEndian, value)
+	c.defined = append(c.defined, true)
+}
+
+//Adds a null value, the column must be optional
+func (c *parquetColumn) addNull() {
+	c.defined = append(c.defined, false)
+}
+
+//Ends a row, after a value was added to every column
+//The row group is written once it is full
+func (p *parquetWriter) endRow() error {
+	p.rows++
+	if p.rows >= p.rowGroupSize {
+		return p.flushRowGroup()
+	}
+	return nil
+}
+
+//Encodes the definition levels of an optional column with the RLE hybrid encoding, prefixed by their length
+func (c *parquetColumn) definitionLevels() []byte {
+	var levels bytes.Buffer
+	for i := 0; i < len(c.defined); {
+		run := 1
+		for i+run < len(c.defined) && c.defined[i+run] == c.defined[i] {
+			run++
+		}
+		writeVarint(&levels, uint64(run)<<1)
+		if c.defined[i] {
+			levels.WriteByte(1)
+		} else {
+			levels.WriteByte(0)
+		}
+		i += run
+	}
+	prefixed := make([]byte, 4, 4+levels.Len())
+	binary.LittleEndian.PutUint32(prefixed, uint32(levels.Len()))
+	return append(prefixed, levels.Bytes()...)
+}
+
+func (p *parquetWriter) flushRowGroup() error {
+	if p.rows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: int64(p.rows)}
+	for _, column := range p.columns {
+		var page []byte
+		if column.optional {
+			page = column.definitionLevels()
+		}
+		page = append(page, column.values.Bytes()...)
+
+		var header thriftWriter
+		header.i32(1, 0)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.beginStruct(5)
+		header.i32(1, int32(p.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.stop()
+
+		chunk := parquetChunk{offset: p.offset, size: int64(header.buf.Len() + len(page)), values: int64(p.rows)}
+		if err := p.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := p.write(page); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.size
+
+		column.values.Reset()
+		column.defined = column.defined[:0]
+	}
+	p.rowGroups = append(p.rowGroups, group)
+	p.totalRows += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+//Writes the magic number, must be called before the first row is written
+func (p *parquetWriter) begin() error {
+	return p.write(parquetMagic)
+}
+
+//Writes the last row group and the footer with the file metadata
+func (p *parquetWriter) close() error {
+	if err := p.flushRowGroup(); err != nil {
+		return err
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listHeader(2, thriftStruct, len(p.columns)+1)
+	meta.beginElement()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(p.columns)))
+	meta.endElement()
+	for _, column := range p.columns {
+		repetition := int32(0)
+		if column.optional {
+			repetition = 1
+		}
+		meta.beginElement()
+		meta.i32(1, column.physical)
+		meta.i32(3, repetition)
+		meta.binary(4, column.name)
+		if column.converted != parquetNoConversion {
+			meta.i32(6, column.converted)
+		}
+		meta.endElement()
+	}
+	meta.i64(3, p.totalRows)
+	meta.listHeader(4, thriftStruct, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		meta.beginElement()
+		meta.listHeader(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			meta.beginElement()
+			meta.i64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.i32(1, column.physical)
+			meta.listHeader(2, thriftI32, 2)
+			meta.writeZigzag(parquetPlain)
+			meta.writeZigzag(parquetRLE)
+			meta.listHeader(3, thriftBinary, 1)
+			meta.writeString(column.name)
+			meta.i32(4, 0)
+			meta.i64(5, chunk.values)
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.endStruct()
+			meta.endElement()
+		}
+		meta.i64(2, group.size)
+		meta.i64(3, group.rows)
+		meta.endElement()
+	}
+	meta.binary(6, "course-progress-service")
+	meta.stop()
+
+	if err := p.write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(meta.buf.Len()))
+	if err := p.write(length); err != nil {
+		return err
+	}
+	return p.write(parquetMagic)
+}
+
+//Types of the Thrift compact protocol used by the Parquet metadata
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+//Writer of the Thrift compact protocol, tracking the last field id of the nested structs
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastIds []int16
+	lastId  int16
+}
+
+func writeVarint(buf *bytes.Buffer, value uint64) {
+	for value >= 0x80 {
+		buf.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	buf.WriteByte(byte(value))
+}
+
+func (t *thriftWriter) writeZigzag(value int64) {
+	writeVarint(&t.buf, uint64((value<<1)^(value>>63)))
+}
+
+func (t *thriftWriter) writeString(value string) {
+	writeVarint(&t.buf, uint64(len(value)))
+	t.buf.WriteString(value)
+}
+
+func (t *thriftWriter) fieldHeader(id int16, fieldType byte) {
+	if delta := id - t.lastId; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		t.buf.WriteByte(fieldType)
+		t.writeZigzag(int64(id))
+	}
+	t.lastId = id
+}
+
+func (t *thriftWriter) i32(id int16, value int32) {
+	t.fieldHeader(id, thriftI32)
+	t.writeZigzag(int64(value))
+}
+
+func (t *thriftWriter) i64(id int16, value int64) {
+	t.fieldHeader(id, thriftI64)
+	t.writeZigzag(value)
+}
+
+func (t *thriftWriter) binary(id int16, value string) {
+	t.fieldHeader(id, thriftBinary)
+	t.writeString(value)
+}
+
+func (t *thriftWriter) listHeader(id int16, elementType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elementType)
+		return
+	}
+	t.buf.WriteByte(0xF0 | elementType)
+	writeVarint(&t.buf, uint64(size))
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginElement()
+}
+
+func (t *thriftWriter) endStruct() {
+	t.endElement()
+}
+
+//Begins a struct element of a list, which has no field header
+func (t *thriftWriter) beginElement() {
+	t.lastIds = append(t.lastIds, t.lastId)
+	t.lastId = 0
+}
+
+func (t *thriftWriter) endElement() {
+	t.stop()
+	t.lastId = t.lastIds[len(t.lastIds)-1]
+	t.lastIds = t.lastIds[:len(t.lastIds)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//Rewrites the golden files with the current output, the test then decodes them with its own Parquet reader
+var updateGolden = flag.Bool("update", false, "rewrite the golden files")
+
+//Records of the golden export, in row groups of two records so the file has several, with null timestamps
+func goldenExportRecords() []ProgressRecord {
+	createdAt := time.Date(2018, 5, 14, 9, 30, 0, 0, time.UTC)
+	updatedAt := createdAt.Add(36*time.Hour + 250*time.Millisecond)
+	return []ProgressRecord{
+		{UserId: "ana", CourseId: "algebra", TaskId: "intro", Progress: "completed", CreatedAt: &createdAt, UpdatedAt: &updatedAt, Version: 3},
+		{UserId: "ana", CourseId: "algebra", TaskId: "matrices", Progress: "started", CreatedAt: &createdAt, UpdatedAt: &createdAt, Version: 1},
+		{UserId: "bogdan", CourseId: "algebra", TaskId: "intro", Progress: "not started", Version: 0},
+		{UserId: "bogdan", CourseId: "geometrie", TaskId: "unghiuri", Progress: "completed", CreatedAt: &createdAt, UpdatedAt: &updatedAt, Version: 12},
+		{UserId: "cristina", CourseId: "geometrie", TaskId: "triunghiuri", Progress: "started", UpdatedAt: &updatedAt, Version: 2},
+	}
+}
+
+func TestParquetExportMatchesGoldenFile(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := newParquetExportWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.writer.rowGroupSize = 2
+	for _, record := range goldenExportRecords() {
+		if err := writer.write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := "testdata/export.parquet"
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The golden file is checked against the records, not against the writer that produced it
+	file, err := readTestParquet(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.rowGroups) != 3 {
+		t.Errorf("golden file has %d row groups, want 3", len(file.rowGroups))
+	}
+	wantSchema := []testParquetColumn{
+		{"userId", parquetByteArray, parquetUTF8, false},
+		{"courseId", parquetByteArray, parquetUTF8, false},
+		{"taskId", parquetByteArray, parquetUTF8, false},
+		{"progress", parquetByteArray, parquetUTF8, false},
+		{"createdAt", parquetInt64, parquetTimestampMillis, true},
+		{"updatedAt", parquetInt64, parquetTimestampMillis, true},
+		{"version", parquetInt32, parquetNoConversion, false},
+	}
+	if !reflect.DeepEqual(file.columns, wantSchema) {
+		t.Fatalf("golden file schema %+v, want %+v", file.columns, wantSchema)
+	}
+	records, err := file.progressRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := goldenExportRecords()
+	if len(records) != len(expected) {
+		t.Fatalf("golden file has %d records, want %d", len(records), len(expected))
+	}
+	for i := range expected {
+		if !sameProgressRecord(records[i], expected[i]) {
+			t.Errorf("record %d is %s, want %s", i, formatTestRecord(records[i]), formatTestRecord(expected[i]))
+		}
+	}
+
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("export of %d bytes differs from %s of %d bytes", buf.Len(), golden, len(want))
+	}
+}
+
+func sameProgressRecord(a, b ProgressRecord) bool {
+	sameTime := func(x, y *time.Time) bool {
+		return x == nil && y == nil || x != nil && y != nil && x.Equal(*y)
+	}
+	return a.UserId == b.UserId && a.CourseId == b.CourseId && a.TaskId == b.TaskId && a.Progress == b.Progress &&
+		a.Version == b.Version && sameTime(a.CreatedAt, b.CreatedAt) && sameTime(a.UpdatedAt, b.UpdatedAt)
+}
+
+func formatTestRecord(record ProgressRecord) string {
+	format := func(t *time.Time) string {
+		if t == nil {
+			return "null"
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("{%s %s %s %s %s %s %d}", record.UserId, record.CourseId, record.TaskId, record.Progress,
+		format(record.CreatedAt), format(record.UpdatedAt), record.Version)
+}
+
+//Column of a flat Parquet schema, as read from the file metadata
+type testParquetColumn struct {
+	name      string
+	physical  int64
+	converted int64
+	optional  bool
+}
+
+//Values of a Parquet file by row group and column, a null value is nil
+type testParquetFile struct {
+	columns   []testParquetColumn
+	rowGroups [][][]interface{}
+}
+
+//Reads a Parquet file with a flat schema and uncompressed PLAIN data pages, following the format specification
+//It is independent of the writer of the service, so the golden file is checked against the specification
+func readTestParquet(data []byte) (*testParquetFile, error) {
+	if len(data) < 12 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		return nil, errors.New("missing PAR1 magic number")
+	}
+	footerLength := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footerStart := len(data) - 8 - footerLength
+	if footerStart < 4 {
+		return nil, errors.New("invalid footer length")
+	}
+	footer := &testThriftReader{data: data[footerStart : len(data)-8]}
+	meta, err := footer.readStruct()
+	if err != nil {
+		return nil, err
+	}
+
+	file := &testParquetFile{}
+	schema, _ := meta[2].([]interface{})
+	if len(schema) < 1 {
+		return nil, errors.New("missing schema")
+	}
+	root := schema[0].(map[int16]interface{})
+	if root[5] != int64(len(schema)-1) {
+		return nil, fmt.Errorf("schema root has %v children, want %d", root[5], len(schema)-1)
+	}
+	for _, element := range schema[1:] {
+		fields := element.(map[int16]interface{})
+		column := testParquetColumn{converted: parquetNoConversion}
+		column.name, _ = fields[4].(string)
+		column.physical, _ = fields[1].(int64)
+		if converted, ok := fields[6].(int64); ok {
+			column.converted = converted
+		}
+		switch fields[3] {
+		case int64(0):
+		case int64(1):
+			column.optional = true
+		default:
+			return nil, fmt.Errorf("column %s isn't required nor optional", column.name)
+		}
+		file.columns = append(file.columns, column)
+	}
+
+	var totalRows int64
+	groups, _ := meta[4].([]interface{})
+	for _, group := range groups {
+		groupFields := group.(map[int16]interface{})
+		rows := groupFields[3].(int64)
+		totalRows += rows
+		chunks := groupFields[1].([]interface{})
+		if len(chunks) != len(file.columns) {
+			return nil, fmt.Errorf("row group has %d column chunks, want %d", len(chunks), len(file.columns))
+		}
+		values := make([][]interface{}, len(chunks))
+		for i, chunk := range chunks {
+			chunkMeta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			path, _ := chunkMeta[3].([]interface{})
+			if len(path) != 1 || path[0] != file.columns[i].name || chunkMeta[1] != file.columns[i].physical || chunkMeta[4] != int64(0) {
+				return nil, fmt.Errorf("column chunk %d has the metadata %v", i, chunkMeta)
+			}
+			values[i], err = readTestParquetPage(data, chunkMeta[9].(int64), file.columns[i])
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", file.columns[i].name, err)
+			}
+			if int64(len(values[i])) != rows || chunkMeta[5] != rows {
+				return nil, fmt.Errorf("column %s has %d values, want %d", file.columns[i].name, len(values[i]), rows)
+			}
+		}
+		file.rowGroups = append(file.rowGroups, values)
+	}
+	if meta[3] != totalRows {
+		return nil, fmt.Errorf("file has %v rows, its row groups %d", meta[3], totalRows)
+	}
+	return file, nil
+}
+
+//Reads the values of the single data page of a column chunk
+func readTestParquetPage(data []byte, offset int64, column testParquetColumn) ([]interface{}, error) {
+	reader := &testThriftReader{data: data[offset:]}
+	header, err := reader.readStruct()
+	if err != nil {
+		return nil, err
+	}
+	dataHeader, _ := header[5].(map[int16]interface{})
+	if header[1] != int64(0) || dataHeader == nil || dataHeader[2] != int64(parquetPlain) {
+		return nil, fmt.Errorf("page header %v isn't a PLAIN data page", header)
+	}
+	count := int(dataHeader[1].(int64))
+	size := int(header[3].(int64))
+	if header[2] != header[3] || reader.offset+size > len(reader.data) {
+		return nil, fmt.Errorf("page header %v has an invalid size", header)
+	}
+	page := reader.data[reader.offset : reader.offset+size]
+
+	defined := make([]bool, count)
+	for i := range defined {
+		defined[i] = true
+	}
+	if column.optional {
+		if dataHeader[3] != int64(parquetRLE) || len(page) < 4 {
+			return nil, errors.New("missing RLE definition levels")
+		}
+		length := int(binary.LittleEndian.Uint32(page))
+		if 4+length > len(page) {
+			return nil, errors.New("invalid definition levels length")
+		}
+		if defined, err = readTestDefinitionLevels(page[4:4+length], count); err != nil {
+			return nil, err
+		}
+		page = page[4+length:]
+	}
+
+	values := make([]interface{}, count)
+	for i := range values {
+		if !defined[i] {
+			continue
+		}
+		switch column.physical {
+		case parquetInt32:
+			if len(page) < 4 {
+				return nil, errors.New("truncated INT32 value")
+			}
+			values[i], page = int64(int32(binary.LittleEndian.Uint32(page))), page[4:]
+		case parquetInt64:
+			if len(page) < 8 {
+				return nil, errors.New("truncated INT64 value")
+			}
+			values[i], page = int64(binary.LittleEndian.Uint64(page)), page[8:]
+		case parquetByteArray:
+			if len(page) < 4 || 4+int(binary.LittleEndian.Uint32(page)) > len(page) {
+				return nil, errors.New("truncated BYTE_ARRAY value")
+			}
+			length := int(binary.LittleEndian.Uint32(page))
+			values[i], page = string(page[4:4+length]), page[4+length:]
+		default:
+			return nil, fmt.Errorf("unsupported physical type %d", column.physical)
+		}
+	}
+	if len(page) != 0 {
+		return nil, fmt.Errorf("%d bytes left after the values", len(page))
+	}
+	return values, nil
+}
+
+//Decodes the definition levels of maximum level 1, in the RLE and bit-packed hybrid encoding of bit width 1
+func readTestDefinitionLevels(data []byte, count int) ([]bool, error) {
+	reader := &testThriftReader{data: data}
+	var defined []bool
+	for len(defined) < count {
+		header, err := reader.varint()
+		if err != nil {
+			return nil, err
+		}
+		if header&1 == 0 {
+			if reader.offset >= len(data) || data[reader.offset] > 1 {
+				return nil, errors.New("invalid RLE run value")
+			}
+			value := data[reader.offset] == 1
+			reader.offset++
+			for run := header >> 1; run > 0; run-- {
+				defined = append(defined, value)
+			}
+			continue
+		}
+		groups := int(header >> 1)
+		if reader.offset+groups > len(data) {
+			return nil, errors.New("truncated bit-packed run")
+		}
+		for _, packed := range data[reader.offset : reader.offset+groups] {
+			for bit := uint(0); bit < 8; bit++ {
+				defined = append(defined, packed>>bit&1 == 1)
+			}
+		}
+		reader.offset += groups
+	}
+	if reader.offset != len(data) {
+		return nil, errors.New("bytes left after the definition levels")
+	}
+	return defined[:count], nil
+}
+
+//Returns the rows of the export file as progress records
+func (f *testParquetFile) progressRecords() ([]ProgressRecord, error) {
+	index := make(map[string]int)
+	for i, column := range f.columns {
+		index[column.name] = i
+	}
+	var records []ProgressRecord
+	for _, values := range f.rowGroups {
+		for row := range values[0] {
+			value := func(name string) interface{} {
+				return values[index[name]][row]
+			}
+			timestamp := func(name string) *time.Time {
+				millis, ok := value(name).(int64)
+				if !ok {
+					return nil
+				}
+				t := time.Unix(millis/1000, millis%1000*int64(time.Millisecond)).UTC()
+				return &t
+			}
+			record := ProgressRecord{CreatedAt: timestamp("createdAt"), UpdatedAt: timestamp("updatedAt")}
+			var ok [5]bool
+			record.UserId, ok[0] = value("userId").(string)
+			record.CourseId, ok[1] = value("courseId").(string)
+			record.TaskId, ok[2] = value("taskId").(string)
+			record.Progress, ok[3] = value("progress").(string)
+			var version int64
+			version, ok[4] = value("version").(int64)
+			record.Version = int(version)
+			if ok != [5]bool{true, true, true, true, true} {
+				return nil, fmt.Errorf("row %d misses a required value", len(records))
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+//Reader of the Thrift compact protocol, returning the structs as values by field id
+//Integers are returned as int64, binaries as strings and lists as slices
+type testThriftReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *testThriftReader) byte() (byte, error) {
+	if r.offset >= len(r.data) {
+		return 0, errors.New("unexpected end of Thrift data")
+	}
+	r.offset++
+	return r.data[r.offset-1], nil
+}
+
+func (r *testThriftReader) varint() (uint64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(b&0x7F) << shift
+		if b < 0x80 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("varint overflow")
+}
+
+func (r *testThriftReader) zigzag() (int64, error) {
+	value, err := r.varint()
+	return int64(value>>1) ^ -int64(value&1), err
+}
+
+func (r *testThriftReader) readStruct() (map[int16]interface{}, error) {
+	fields := make(map[int16]interface{})
+	var lastId int16
+	for {
+		header, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return fields, nil
+		}
+		id := lastId + int16(header>>4)
+		if header>>4 == 0 {
+			long, err := r.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(long)
+		}
+		fieldType := header & 0x0F
+		switch fieldType {
+		case 1, 2:
+			fields[id] = fieldType == 1
+		default:
+			if fields[id], err = r.readValue(fieldType); err != nil {
+				return nil, err
+			}
+		}
+		lastId = id
+	}
+}
+
+func (r *testThriftReader) readValue(valueType byte) (interface{}, error) {
+	switch valueType {
+	case 1, 2:
+		b, err := r.byte()
+		return b == 1, err
+	case 3:
+		b, err := r.byte()
+		return int64(int8(b)), err
+	case 4, 5, 6:
+		return r.zigzag()
+	case 8:
+		length, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(r.data)-r.offset) < length {
+			return nil, errors.New("truncated Thrift binary")
+		}
+		r.offset += int(length)
+		return string(r.data[r.offset-int(length) : r.offset]), nil
+	case 9, 10:
+		header, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = r.varint(); err != nil {
+				return nil, err
+			}
+		}
+		list := make([]interface{}, 0, size)
+		for ; size > 0; size-- {
+			element, err := r.readValue(header & 0x0F)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, element)
+		}
+		return list, nil
+	case 12:
+		return r.readStruct()
+	}
+	return nil, fmt.Errorf("unsupported Thrift type %d", valueType)
+}
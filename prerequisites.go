@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Rule locking a task, or every task of a group, until the required tasks are completed
+//The required tasks are the listed tasks and the tasks of the required group, Count of them must be completed, all if 0
+//Required tasks missing from the catalog of the course are ignored
+type PrerequisiteRule struct {
+	Task          string   `json:"task,omitempty"`
+	Group         string   `json:"group,omitempty"`
+	Requires      []string `json:"requires,omitempty"`
+	RequiresGroup string   `json:"requiresGroup,omitempty"`
+	Count         int      `json:"count,omitempty"`
+}
+
+//Prerequisites of the tasks of a course
+//With SequentialGroups, the tasks of a group are locked until every task of the previous group is completed
+type CoursePrerequisites struct {
+	SequentialGroups bool               `json:"sequentialGroups"`
+	Rules            []PrerequisiteRule `json:"rules"`
+}
+
+//Prerequisites of the courses by course id, read from the prerequisites file of the configuration
+var prerequisites = make(map[string]*CoursePrerequisites)
+
+//Reads the prerequisites file, a JSON object of the prerequisites by course id, if one is configured
+func initPrerequisites() {
+	if config.PrerequisitesFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(config.PrerequisitesFile)
+	if err == nil {
+		err = json.Unmarshal(data, &prerequisites)
+	}
+	if err == nil {
+		err = validatePrerequisites(prerequisites)
+	}
+	if err != nil {
+		log.Fatal("Failed to read prerequisites file " + config.PrerequisitesFile + ". \nCause: " + err.Error())
+	}
+}
+
+//Checks that every rule locks either a task or a group, requires tasks and has a count no greater than its listed tasks
+func validatePrerequisites(courses map[string]*CoursePrerequisites) error {
+	for courseId, course := range courses {
+		if course == nil {
+			return errors.New("course " + courseId + " has no prerequisites")
+		}
+		for i, rule := range course.Rules {
+			name := "rule " + strconv.Itoa(i) + " of course " + courseId
+			if (rule.Task == "") == (rule.Group == "") {
+				return errors.New(name + " must lock either a task or a group")
+			}
+			if len(rule.Requires) == 0 && rule.RequiresGroup == "" {
+				return errors.New(name + " requires no task")
+			}
+			if rule.Count < 0 || (rule.RequiresGroup == "" && rule.Count > len(rule.Requires)) {
+				return errors.New(name + " has invalid count " + strconv.Itoa(rule.Count))
+			}
+		}
+	}
+	return nil
+}
+
+//Returns the tasks of the group of the course
+func (c *CourseState) groupTasks(title string) []string {
+	var tasks []string
+	for _, group := range c.Groups {
+		if group.Title == title {
+			for _, task := range group.Tasks {
+				tasks = append(tasks, task.Id)
+			}
+		}
+	}
+	return tasks
+}
+
+//Returns true if every given task of the course is completed, false if the count of completed ones is lower than the count
+func (c *CourseState) completedCount(tasks []string, count int) bool {
+	completed := 0
+	for _, taskId := range tasks {
+		if task := c.task(taskId); task != nil && task.Progress == "completed" {
+			completed++
+		}
+	}
+	return completed >= count
+}
+
+//Returns the prerequisites of the task not met by the progress of the course, empty if the task isn't locked
+func (p *CoursePrerequisites) unmet(course *CourseState, taskId string) []string {
+	var unmet []string
+	group := course.groupOf(taskId)
+	if p.SequentialGroups {
+		for i := 1; i < len(course.Groups); i++ {
+			if course.Groups[i].Title != group {
+				continue
+			}
+			previous := course.Groups[i-1].Title
+			if tasks := course.groupTasks(previous); !course.completedCount(tasks, len(tasks)) {
+				unmet = append(unmet, "every task of group "+previous)
+			}
+			break
+		}
+	}
+
+	for _, rule := range p.Rules {
+		if rule.Task != taskId && (rule.Group == "" || rule.Group != group) {
+			continue
+		}
+		var required []string
+		for _, id := range append(append([]string{}, rule.Requires...), course.groupTasks(rule.RequiresGroup)...) {
+			if id != taskId && course.task(id) != nil {
+				required = append(required, id)
+			}
+		}
+		count := rule.Count
+		if count == 0 || count > len(required) {
+			count = len(required)
+		}
+		if course.completedCount(required, count) {
+			continue
+		}
+		if count == len(required) {
+			unmet = append(unmet, "tasks "+strings.Join(required, ", "))
+		} else {
+			unmet = append(unmet, strconv.Itoa(count)+" of tasks "+strings.Join(required, ", "))
+		}
+	}
+	return unmet
+}
+
+//Sets the status of the tasks of the course, locked for the tasks not started yet whose prerequisites aren't met and available otherwise
+func (c *CourseState) applyPrerequisites() {
+	rules := prerequisites[c.CourseId]
+	for i := range c.Tasks {
+		c.Tasks[i].Status = "available"
+		if rules != nil && c.Tasks[i].Progress == "not started" && len(rules.unmet(c, c.Tasks[i].TaskId)) > 0 {
+			c.Tasks[i].Status = "locked"
+		}
+	}
+}
+
+//Checks that the user can start the task, its prerequisites are met or the task was already started
+//Returns a service error listing the unmet prerequisites if the task is locked
+func checkUnlocked(ctx context.Context, userId, courseId, taskId string) error {
+	rules := prerequisites[courseId]
+	if rules == nil {
+		return nil
+	}
+	course, task, err := loadTaskState(ctx, userId, courseId, taskId)
+	if err != nil {
+		return err
+	}
+	if task.Status != "locked" {
+		return nil
+	}
+	return newServiceError(http.StatusConflict, "Task "+taskId+" is locked.", errors.New("complete first "+strings.Join(rules.unmet(course, taskId), " and ")))
+}
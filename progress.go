@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//Error returned by the service layer, carrying the status code the handlers respond with
+type serviceError struct {
+	Status  int
+	Message string
+	Cause   error
+}
+
+func (e *serviceError) Error() string {
+	if e.Cause != nil {
+		return e.Message + " \nCause: " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+func newServiceError(status int, message string, cause error) *serviceError {
+	return &serviceError{Status: status, Message: message, Cause: cause}
+}
+
+//Status code of the requests cancelled by the client before the response was written
+const statusClientClosedRequest = 499
+
+//Returns the service error of a failed database or upstream call
+//If the call failed because the request was cancelled or its deadline was exceeded, the error reports it as such
+func failure(ctx context.Context, message string, cause error) *serviceError {
+	switch ctx.Err() {
+	case context.Canceled:
+		return newServiceError(statusClientClosedRequest, "Request cancelled. "+message, ctx.Err())
+	case context.DeadlineExceeded:
+		return newServiceError(http.StatusGatewayTimeout, "Request deadline exceeded. "+message, ctx.Err())
+	}
+	return newServiceError(http.StatusInternalServerError, message, cause)
+}
+
+//Progress of a user on every task of a course, merged from the upstream catalog and the database
+type CourseState struct {
+	CourseId       string
+	CatalogVersion string
+	Groups         []TaskGroup
+	Tasks          []TaskProgress
+}
+
+//Merges the stored progress of the user with the catalog of the course, and sets the status of the tasks from the prerequisites of the course
+func newCourseState(courseId string, taskGroups []TaskGroup, seenTasks []TaskProgress) CourseState {
+	course := CourseState{
+		CourseId:       courseId,
+		CatalogVersion: catalogVersion(taskGroups),
+		Groups:         taskGroups,
+		Tasks:          getAllTasks(taskIds(taskGroups), seenTasks),
+	}
+	course.applyPrerequisites()
+	return course
+}
+
+//Returns the progress of the task or nil if the task doesn't belong to the course
+func (c *CourseState) task(taskId string) *TaskProgress {
+	for i := range c.Tasks {
+		if c.Tasks[i].TaskId == taskId {
+			return &c.Tasks[i]
+		}
+	}
+	return nil
+}
+
+//Returns the title of the group containing the task or empty string if the task isn't found
+func (c *CourseState) groupOf(taskId string) string {
+	for _, group := range c.Groups {
+		for _, task := range group.Tasks {
+			if task.Id == taskId {
+				return group.Title
+			}
+		}
+	}
+	return ""
+}
+
+//Returns the number of completed tasks of the course
+func (c *CourseState) completedTasks() int {
+	completed := 0
+	for _, task := range c.Tasks {
+		if task.Progress == "completed" {
+			completed++
+		}
+	}
+	return completed
+}
+
+func checkDatabase(ctx context.Context) error {
+	if err := store.ping(ctx); err != nil {
+		return failure(ctx, "Database error: unable to connect.", err)
+	}
+	return nil
+}
+
+//Get the task groups of the course from the course-manager-service and the course-service
+//Returns the task groups or a service error if the course doesn't exist or has no tasks
+func loadCourseCatalog(ctx context.Context, courseId string) ([]TaskGroup, error) {
+	URL, err := getCourseURL(ctx, courseId)
+	if err != nil {
+		return nil, failure(ctx, "Server error: Request to course-manager-service failed. Can not get course URL.", err)
+	}
+	if URL == "" {
+		return nil, newServiceError(http.StatusNotFound, "Course "+courseId+" not found", nil)
+	}
+
+	taskGroups, err := getCourseTaskGroups(ctx, URL)
+	if err != nil {
+		return nil, failure(ctx, "Server error: Request to course-service failed. Can not retrieve tasks.", err)
+	}
+	if len(taskIds(taskGroups)) == 0 {
+		return nil, newServiceError(http.StatusNotFound, "User or course not found. Course service at "+URL+" return no tasks", nil)
+	}
+	return taskGroups, nil
+}
+
+//Get the progress of the user on every task of the course
+//Tasks without stored progress are reported as 'not started'
+func loadCourseState(ctx context.Context, userId, courseId string) (*CourseState, error) {
+	if err := checkDatabase(ctx); err != nil {
+		return nil, err
+	}
+
+	taskGroups, err := loadCourseCatalog(ctx, courseId)
+	if err != nil {
+		return nil, err
+	}
+
+	seenTasks, err := store.getCourseProgress(ctx, userId, courseId)
+	if err != nil {
+		return nil, failure(ctx, "Database error: can not get course progress.", err)
+	}
+
+	course := newCourseState(courseId, taskGroups, seenTasks)
+	return &course, nil
+}
+
+//Get the progress of the user on every task of the course as it was at the given time
+//The tasks are the ones of the current catalog of the course
+func loadCourseStateAt(ctx context.Context, userId, courseId string, at time.Time) (*CourseState, error) {
+	courses, err := loadUserState(ctx, userId, ProgressFilter{CourseId: courseId, At: &at})
+	if err != nil {
+		return nil, err
+	}
+	return &courses[0], nil
+}
+
+//Get the progress of the user on the task, with the course it belongs to
+//Returns a service error if the task doesn't belong to the course
+func loadTaskState(ctx context.Context, userId, courseId, taskId string) (*CourseState, *TaskProgress, error) {
+	course, err := loadCourseState(ctx, userId, courseId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if task := course.task(taskId); task != nil {
+		return course, task, nil
+	}
+	return nil, nil, newServiceError(http.StatusNotFound, "Task + "+taskId+" not found", nil)
+}
+
+//Get the progress of the user on every task of the courses known by the course-manager-service, or of the enrolled ones if the filter has enrollments
+//The filter is applied on the stored progress, and only the course-services of the courses it can match are queried
+//Courses are returned sorted by id, their tasks aren't filtered
+func loadUserState(ctx context.Context, userId string, filter ProgressFilter) ([]CourseState, error) {
+	if err := checkDatabase(ctx); err != nil {
+		return nil, err
+	}
+
+	userProgress, err := store.getUserProgress(ctx, userId, filter)
+	if err != nil {
+		return nil, failure(ctx, "Error accessing the database.", err)
+	}
+	seenTasks := make(map[string][]TaskProgress)
+	for _, item := range userProgress {
+		seenTasks[item.CourseId] = append(seenTasks[item.CourseId], TaskProgress{
+			TaskId:    item.TaskId,
+			Progress:  item.Progress,
+			CreatedAt: item.CreatedAt,
+			UpdatedAt: item.UpdatedAt,
+			Version:   item.Version,
+		})
+	}
+
+	var URLs map[string]string
+	if filter.CourseId != "" {
+		URL, err := getCourseURL(ctx, filter.CourseId)
+		if err != nil {
+			return nil, failure(ctx, "Server error: Request to course-manager-service failed. Can not get course URL.", err)
+		}
+		if URL == "" {
+			return nil, newServiceError(http.StatusNotFound, "Course "+filter.CourseId+" not found", nil)
+		}
+		URLs = map[string]string{filter.CourseId: URL}
+	} else {
+		URLs, err = getAllCoursesURL(ctx)
+		if err != nil {
+			return nil, failure(ctx, "Server error: Request to course-manager-service failed. Can not retrieve all courses's URLs.", err)
+		} else if URLs == nil {
+			return nil, newServiceError(http.StatusNotFound, "No URLs found. Course-manager-service returns no URL", nil)
+		}
+	}
+
+	courseIds := make([]string, 0, len(URLs))
+	for courseId := range URLs {
+		if filter.storedOnly() && seenTasks[courseId] == nil {
+			continue
+		}
+		if filter.Enrolled != nil && filter.Enrolled[courseId] == nil {
+			continue
+		}
+		courseIds = append(courseIds, courseId)
+	}
+	sort.Strings(courseIds)
+
+	courses := make([]CourseState, 0)
+	for _, courseId := range courseIds {
+		if ctx.Err() != nil {
+			return nil, failure(ctx, "Server error: Request to course-service aborted.", ctx.Err())
+		}
+		taskGroups, err := getCourseTaskGroups(ctx, URLs[courseId])
+		if err != nil {
+			return nil, failure(ctx, "Server error: Request to course-service failed. Can not retrieve tasks.", err)
+		}
+		if taskGroups == nil {
+			continue
+		}
+		courses = append(courses, newCourseState(courseId, taskGroups, seenTasks[courseId]))
+	}
+	if len(courses) == 0 && !filter.storedOnly() && filter.Enrolled == nil {
+		return nil, newServiceError(http.StatusNotFound, "No courses information found. No progress found", nil)
+	}
+	return courses, nil
+}
+
+//Reads the progress from the body of a progress update request
+//Returns a service error if the body can't be read or the progress type is invalid
+func readProgressUpdate(r *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", newServiceError(http.StatusBadRequest, "Failed to read HTTP body.", err)
+	}
+
+	type ProgressInfo struct {
+		Progress string `json:"progress"`
+	}
+	var progress ProgressInfo
+	err = json.Unmarshal(body, &progress)
+	if err != nil {
+		return "", newServiceError(http.StatusBadRequest, "Failed to unmarshal request.", err)
+	}
+
+	if progress.Progress != "started" && progress.Progress != "completed" {
+		return "", newServiceError(http.StatusUnprocessableEntity, "Invalid progress type. Valid types: 'started','completed'", nil)
+	}
+	return progress.Progress, nil
+}
+
+//Updates or inserts the progress of the user on the task
+//If ifMatch isn't empty, the write only happens if it matches the current entity tag of the task progress
+//Returns the committed change
+func setTaskProgress(ctx context.Context, userId, courseId, taskId, progress, ifMatch string) (*ProgressChange, error) {
+	if err := checkDatabase(ctx); err != nil {
+		return nil, err
+	}
+	if err := checkUnlocked(ctx, userId, courseId, taskId); err != nil {
+		return nil, err
+	}
+
+	expectedVersion, err := expectedVersion(ctx, userId, courseId, taskId, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	courseProgress := CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: taskId, Progress: progress}
+	change, err := store.upsertTaskProgress(ctx, courseProgress, expectedVersion)
+	if err == errVersionMismatch {
+		return nil, errVersionConflict
+	}
+	if err != nil {
+		return nil, failure(ctx, "Failed to update task progress.", err)
+	}
+	return change, nil
+}
+
+//Deletes the progress of the user on the task, so it is reported as 'not started' again
+//If ifMatch isn't empty, the delete only happens if it matches the current entity tag of the task progress
+//Returns the committed change
+func resetTaskProgress(ctx context.Context, userId, courseId, taskId, ifMatch string) (*ProgressChange, error) {
+	if err := checkDatabase(ctx); err != nil {
+		return nil, err
+	}
+
+	expectedVersion, err := expectedVersion(ctx, userId, courseId, taskId, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	change, err := store.deleteTaskProgress(ctx, userId, courseId, taskId, expectedVersion)
+	if err == errVersionMismatch {
+		return nil, errVersionConflict
+	}
+	if err != nil {
+		return nil, failure(ctx, "Failed to reset task progress.", err)
+	}
+	return change, nil
+}
+
+//Checks the If-Match header against the current entity tag of the task progress
+//Returns the version the write must be conditioned on, or nil if the header is empty
+func expectedVersion(ctx context.Context, userId, courseId, taskId, ifMatch string) (*int, error) {
+	if ifMatch == "" {
+		return nil, nil
+	}
+	course, task, err := loadTaskState(ctx, userId, courseId, taskId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIfMatch(ifMatch, taskETag(course, *task)); err != nil {
+		return nil, err
+	}
+	return &task.Version, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//Serves a course-manager-service answering no request until the requests are cancelled
+//Returns the channel receiving the requests once they are cancelled, and a function closing the server
+func stubHangingCatalog() (chan string, func()) {
+	cancelled := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.URL.Path
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	config.CourseManagerServiceUrl = server.URL
+	return cancelled, server.Close
+}
+
+func TestFailureReportsCancellation(t *testing.T) {
+	cause := errors.New("connection refused")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	for ctx, status := range map[context.Context]int{
+		context.Background(): http.StatusInternalServerError,
+		cancelled:            statusClientClosedRequest,
+		expired:              http.StatusGatewayTimeout,
+	} {
+		if err := failure(ctx, "Request failed.", cause); err.Status != status {
+			t.Errorf("failure answered %d: %s, want %d", err.Status, err.Error(), status)
+		}
+	}
+}
+
+func TestCancelledRequestsStopUpstreamCalls(t *testing.T) {
+	initConfig()
+	cancelled, closeCatalog := stubHangingCatalog()
+	defer closeCatalog()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := loadCourseCatalog(ctx, "algebra")
+	if serviceErr, ok := err.(*serviceError); !ok || serviceErr.Status != statusClientClosedRequest {
+		t.Fatalf("cancelled catalog request answered %v, want %d", err, statusClientClosedRequest)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled catalog request returned after %s", elapsed)
+	}
+	select {
+	case path := <-cancelled:
+		if path != "/courses/algebra" {
+			t.Errorf("cancelled request of %s", path)
+		}
+	case <-time.After(time.Second):
+		t.Error("upstream request not cancelled")
+	}
+}
+
+func TestRequestDeadlineBoundsUpstreamCalls(t *testing.T) {
+	initConfig()
+	config.RequestTimeout = 50 * time.Millisecond
+	_, closeCatalog := stubHangingCatalog()
+	defer closeCatalog()
+
+	handle := withDeadline(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if _, err := loadCourseCatalog(r.Context(), ps.ByName("course")); err != nil {
+			respondError(w, err)
+		}
+	})
+	recorder := httptest.NewRecorder()
+	start := time.Now()
+	handle(recorder, httptest.NewRequest("GET", "/progress/ana/algebra", nil), httprouter.Params{{Key: "course", Value: "algebra"}})
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("request past its deadline answered %d:\n%s", recorder.Code, recorder.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request past its deadline answered after %s", elapsed)
+	}
+}
@@ -0,0 +1,1229 @@
+package main
+
+//Schemas of the request and response bodies, published under components in the OpenAPI document
+var apiSchemas = map[string]*jsonSchema{
+	"TaskProgress": {
+		Type:     "object",
+		Required: []string{"taskId", "progress"},
+		Properties: map[string]*jsonSchema{
+			"taskId":   {Type: "string"},
+			"progress": {Type: "string", Enum: []string{"not started", "started", "completed"}},
+			"status":   {Type: "string", Enum: []string{"locked", "available"}, Description: "locked if the task isn't started and its prerequisites aren't met"},
+		},
+	},
+	"ProgressItem": {
+		Type:     "object",
+		Required: []string{"courseId", "taskId", "progress"},
+		Properties: map[string]*jsonSchema{
+			"courseId": {Type: "string"},
+			"taskId":   {Type: "string"},
+			"progress": {Type: "string", Enum: []string{"not started", "started", "completed"}},
+			"status":   {Type: "string", Enum: []string{"locked", "available"}, Description: "locked if the task isn't started and its prerequisites aren't met"},
+		},
+	},
+	"ProgressUpdate": {
+		Type:     "object",
+		Required: []string{"progress"},
+		Properties: map[string]*jsonSchema{
+			"progress": {Type: "string", Enum: []string{"started", "completed"}},
+		},
+	},
+	"Pagination": {
+		Type:     "object",
+		Required: []string{"total"},
+		Properties: map[string]*jsonSchema{
+			"total":      {Type: "integer"},
+			"nextCursor": {Type: "string"},
+		},
+	},
+	"Error": {
+		Type:     "object",
+		Required: []string{"error"},
+		Properties: map[string]*jsonSchema{
+			"error": {
+				Type:     "object",
+				Required: []string{"status", "message"},
+				Properties: map[string]*jsonSchema{
+					"status":  {Type: "integer"},
+					"message": {Type: "string"},
+				},
+			},
+		},
+	},
+	"Task": {
+		Type:     "object",
+		Required: []string{"id", "courseId", "group", "progress", "status"},
+		Properties: map[string]*jsonSchema{
+			"id":        {Type: "string"},
+			"courseId":  {Type: "string"},
+			"group":     {Type: "string"},
+			"progress":  {Type: "string", Enum: []string{"not started", "started", "completed"}},
+			"status":    {Type: "string", Enum: []string{"locked", "available"}, Description: "locked if the task isn't started and its prerequisites aren't met"},
+			"createdAt": {Type: "string", Format: "date-time"},
+			"updatedAt": {Type: "string", Format: "date-time"},
+		},
+	},
+	"Course": {
+		Type:     "object",
+		Required: []string{"id", "completedTasks", "totalTasks", "groups"},
+		Properties: map[string]*jsonSchema{
+			"id":             {Type: "string"},
+			"completedTasks": {Type: "integer"},
+			"totalTasks":     {Type: "integer"},
+			"groups": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"title", "tasks"},
+				Properties: map[string]*jsonSchema{
+					"title": {Type: "string"},
+					"tasks": arrayOf(ref("Task")),
+				},
+			}),
+		},
+	},
+	"Enrollment": {
+		Type:     "object",
+		Required: []string{"courseId", "progress", "completedTasks", "totalTasks"},
+		Properties: map[string]*jsonSchema{
+			"courseId":       {Type: "string"},
+			"progress":       {Type: "string", Enum: []string{"not started", "started", "completed"}},
+			"completedTasks": {Type: "integer"},
+			"totalTasks":     {Type: "integer"},
+			"enrolledAt":     {Type: "string", Format: "date-time", Description: "Absent with scope=catalog or for a course the user isn't enrolled in"},
+			"source":         {Type: "string", Description: "Source of the enrollment, absent with scope=catalog or for a course the user isn't enrolled in"},
+		},
+	},
+	"EnrollmentRecord": {
+		Type:     "object",
+		Required: []string{"userId", "courseId", "enrolledAt", "source"},
+		Properties: map[string]*jsonSchema{
+			"userId":     {Type: "string"},
+			"courseId":   {Type: "string"},
+			"enrolledAt": {Type: "string", Format: "date-time"},
+			"source":     {Type: "string", Description: "'api' by default, 'auto' when enrolled by the first progress write, 'progress' when enrolled by the migration"},
+		},
+	},
+	"EnrollmentRequest": {
+		Type: "object",
+		Properties: map[string]*jsonSchema{
+			"source": {Type: "string", MaxLength: 30, Description: "Source of the enrollment, 'api' if absent"},
+		},
+	},
+	"User": {
+		Type:     "object",
+		Required: []string{"id", "enrollments"},
+		Properties: map[string]*jsonSchema{
+			"id":          {Type: "string"},
+			"enrollments": arrayOf(ref("Enrollment")),
+		},
+	},
+	"ReconciliationOptions": {
+		Type: "object",
+		Properties: map[string]*jsonSchema{
+			"archive": {Type: "boolean", Description: "Archive the orphans that aren't remapped"},
+			"remap":   {Type: "object", Description: "Per course, the ids of removed or renamed tasks mapped to the ids of the tasks replacing them"},
+		},
+	},
+	"ReconciliationReport": {
+		Type:     "object",
+		Required: []string{"status", "options", "startedAt", "orphans", "archived", "remapped", "courses"},
+		Properties: map[string]*jsonSchema{
+			"status":     {Type: "string", Enum: []string{"running", "completed", "failed"}},
+			"options":    ref("ReconciliationOptions"),
+			"startedAt":  {Type: "string", Format: "date-time"},
+			"finishedAt": {Type: "string", Format: "date-time"},
+			"error":      {Type: "string"},
+			"orphans":    {Type: "integer"},
+			"archived":   {Type: "integer"},
+			"remapped":   {Type: "integer"},
+			"courses": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"courseId", "orphans"},
+				Properties: map[string]*jsonSchema{
+					"courseId": {Type: "string"},
+					"orphans": arrayOf(&jsonSchema{
+						Type:     "object",
+						Required: []string{"userId", "taskId", "progress", "reason", "action"},
+						Properties: map[string]*jsonSchema{
+							"userId":     {Type: "string"},
+							"taskId":     {Type: "string"},
+							"progress":   {Type: "string"},
+							"reason":     {Type: "string", Enum: []string{orphanUnknownCourse, orphanTaskNotInCatalog, orphanCatalogUnavailable}},
+							"action":     {Type: "string", Enum: []string{actionReported, actionArchived, actionRemapped, actionFailed}},
+							"remappedTo": {Type: "string"},
+							"error":      {Type: "string"},
+						},
+					}),
+				},
+			}),
+		},
+	},
+	"TaskRef": {
+		Type:     "object",
+		Required: []string{"courseId", "taskId"},
+		Properties: map[string]*jsonSchema{
+			"courseId": idSchema,
+			"taskId":   idSchema,
+		},
+	},
+	"TaskMappingRequest": {
+		Type:     "object",
+		Required: []string{"mappings"},
+		Properties: map[string]*jsonSchema{
+			"mappings": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"from", "to"},
+				Properties: map[string]*jsonSchema{
+					"from": ref("TaskRef"),
+					"to":   arrayOf(ref("TaskRef")),
+				},
+			}),
+			"dryRun": {Type: "boolean", Description: "Only report the affected rows, without applying the mappings"},
+		},
+	},
+	"TaskMappingReport": {
+		Type:     "object",
+		Required: []string{"dryRun", "mappings", "progressRows", "historyRows", "changes"},
+		Properties: map[string]*jsonSchema{
+			"dryRun": {Type: "boolean"},
+			"mappings": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"from", "to", "progressRows", "historyRows"},
+				Properties: map[string]*jsonSchema{
+					"from":         ref("TaskRef"),
+					"to":           arrayOf(ref("TaskRef")),
+					"progressRows": {Type: "integer"},
+					"historyRows":  {Type: "integer"},
+				},
+			}),
+			"progressRows": {Type: "integer"},
+			"historyRows":  {Type: "integer"},
+			"changes":      {Type: "integer"},
+		},
+	},
+	"ImportReport": {
+		Type:     "object",
+		Required: []string{"dryRun", "resumedAfter", "rows", "imported", "skipped", "failed", "errors"},
+		Properties: map[string]*jsonSchema{
+			"importId":     {Type: "string"},
+			"dryRun":       {Type: "boolean"},
+			"resumedAfter": {Type: "integer", Description: "Rows committed by the previous runs of the import, skipped by this run"},
+			"rows":         {Type: "integer"},
+			"imported":     {Type: "integer"},
+			"skipped":      {Type: "integer", Description: "Rows not more recent than the stored progress"},
+			"failed":       {Type: "integer"},
+			"errors": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"row", "error"},
+				Properties: map[string]*jsonSchema{
+					"row":   {Type: "integer"},
+					"error": {Type: "string"},
+				},
+			}),
+			"errorsTruncated": {Type: "boolean"},
+		},
+	},
+	"LtiLineItem": {
+		Type:     "object",
+		Required: []string{"courseId", "taskId", "contextId", "lineItemUrl", "scoreMaximum"},
+		Properties: map[string]*jsonSchema{
+			"courseId":     idSchema,
+			"taskId":       idSchema,
+			"contextId":    {Type: "string", MaxLength: 255, Description: "Id of the LMS context of the line item"},
+			"lineItemUrl":  {Type: "string", MaxLength: 1000, Description: "URL of the line item, its scores service is the URL with /scores appended to the path"},
+			"scoreMaximum": {Type: "number", Description: "Positive maximum score of the line item, scores are posted as their part of it"},
+		},
+	},
+	"LtiLineItemsRequest": {
+		Type:     "object",
+		Required: []string{"lineItems"},
+		Properties: map[string]*jsonSchema{
+			"lineItems": arrayOf(ref("LtiLineItem")),
+		},
+	},
+	"Certificate": {
+		Type:     "object",
+		Required: []string{"id", "userId", "courseId", "completedAt", "tasksHash", "issuedAt", "keyId", "signature"},
+		Properties: map[string]*jsonSchema{
+			"id":          {Type: "string"},
+			"userId":      {Type: "string"},
+			"courseId":    {Type: "string"},
+			"completedAt": {Type: "string", Format: "date-time", Description: "Last update of the tasks of the course"},
+			"tasksHash":   {Type: "string", Description: "Hex SHA-256 of the sorted ids of the completed tasks, one per line"},
+			"issuedAt":    {Type: "string", Format: "date-time"},
+			"keyId":       {Type: "string", Description: "Hex prefix of the SHA-256 of the Ed25519 public key of the signature"},
+			"signature":   {Type: "string", Description: "Base64 Ed25519 signature of the lines course-progress-certificate/v1, id, userId, courseId, completedAt, tasksHash, issuedAt and keyId, the times in RFC 3339 UTC"},
+		},
+	},
+	"CertificateVerification": {
+		Type:     "object",
+		Required: []string{"valid", "certificate"},
+		Properties: map[string]*jsonSchema{
+			"valid":       {Type: "boolean"},
+			"reason":      {Type: "string", Description: "Why the signature is invalid"},
+			"certificate": ref("Certificate"),
+		},
+	},
+	"Deadline": {
+		Type:     "object",
+		Required: []string{"courseId", "dueAt"},
+		Properties: map[string]*jsonSchema{
+			"courseId": idSchema,
+			"taskId":   {Type: "string", MaxLength: 100, Description: "Task of the deadline, every task of the course without a deadline of its own if absent"},
+			"dueAt":    {Type: "string", Format: "date-time", Nullable: true, Description: "Due date, null removes the deadline"},
+		},
+	},
+	"DeadlinesRequest": {
+		Type:     "object",
+		Required: []string{"deadlines"},
+		Properties: map[string]*jsonSchema{
+			"deadlines": arrayOf(ref("Deadline")),
+		},
+	},
+	"OverdueTask": {
+		Type:     "object",
+		Required: []string{"userId", "courseId", "taskId", "progress", "dueAt", "status"},
+		Properties: map[string]*jsonSchema{
+			"userId":      {Type: "string"},
+			"courseId":    {Type: "string"},
+			"taskId":      {Type: "string"},
+			"progress":    {Type: "string", Enum: []string{"not started", "started", "completed"}},
+			"dueAt":       {Type: "string", Format: "date-time"},
+			"completedAt": {Type: "string", Format: "date-time", Description: "Completion time of a late task"},
+			"status":      {Type: "string", Enum: []string{"overdue", "late"}, Description: "overdue if the task isn't completed past its due date, late if it was completed after it"},
+		},
+	},
+	"UserActivity": {
+		Type:     "object",
+		Required: []string{"userId", "timezone", "from", "to", "total", "currentStreak", "longestStreak", "days"},
+		Properties: map[string]*jsonSchema{
+			"userId":        {Type: "string"},
+			"timezone":      {Type: "string", Description: "IANA timezone of the days"},
+			"from":          {Type: "string", Format: "date"},
+			"to":            {Type: "string", Format: "date"},
+			"total":         {Type: "integer", Description: "Progress transitions of the range"},
+			"currentStreak": {Type: "integer", Description: "Consecutive active days ending today or yesterday"},
+			"longestStreak": {Type: "integer"},
+			"lastActiveDay": {Type: "string", Format: "date"},
+			"days": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"date", "count"},
+				Properties: map[string]*jsonSchema{
+					"date":  {Type: "string", Format: "date"},
+					"count": {Type: "integer", Description: "Progress transitions of the day"},
+				},
+			}),
+		},
+	},
+	"ActivityTimezone": {
+		Type:     "object",
+		Required: []string{"timezone"},
+		Properties: map[string]*jsonSchema{
+			"timezone": {Type: "string", MaxLength: 64, Description: "IANA timezone, like Europe/Bucharest"},
+		},
+	},
+	"LeaderboardEntry": {
+		Type:     "object",
+		Required: []string{"rank", "userId", "completedTasks", "score"},
+		Properties: map[string]*jsonSchema{
+			"rank":           {Type: "integer"},
+			"userId":         {Type: "string", Description: "Pseudonym of the user on a pseudonymized leaderboard"},
+			"completedTasks": {Type: "integer"},
+			"score":          {Type: "number", Description: "Sum of the last scores recorded on the tasks"},
+			"startedAt":      {Type: "string", Format: "date-time", Description: "Creation time of the oldest stored progress of the user on the course"},
+			"completedAt":    {Type: "string", Format: "date-time", Description: "Time of the last completed task"},
+			"completionTime": {Type: "integer", Description: "Seconds from startedAt to the completion of the course, ranked by completion time"},
+		},
+	},
+	"LeaderboardSettings": {
+		Type:     "object",
+		Required: []string{"courseId"},
+		Properties: map[string]*jsonSchema{
+			"courseId":     idSchema,
+			"pseudonymize": {Type: "boolean", Description: "Replace the user ids with pseudonyms stable per course"},
+		},
+	},
+	"LeaderboardsRequest": {
+		Type:     "object",
+		Required: []string{"leaderboards"},
+		Properties: map[string]*jsonSchema{
+			"leaderboards": arrayOf(ref("LeaderboardSettings")),
+		},
+	},
+	"Cohort": {
+		Type:     "object",
+		Required: []string{"id", "name", "createdAt", "members", "courses"},
+		Properties: map[string]*jsonSchema{
+			"id":        {Type: "string"},
+			"name":      {Type: "string"},
+			"createdAt": {Type: "string", Format: "date-time"},
+			"members":   arrayOf(&jsonSchema{Type: "string"}),
+			"courses":   arrayOf(&jsonSchema{Type: "string"}),
+		},
+	},
+	"CohortRequest": {
+		Type:     "object",
+		Required: []string{"name"},
+		Properties: map[string]*jsonSchema{
+			"name":    {Type: "string", MaxLength: 200},
+			"members": arrayOf(idSchema),
+			"courses": arrayOf(idSchema),
+		},
+	},
+	"CohortProgress": {
+		Type:     "object",
+		Required: []string{"cohortId", "courses"},
+		Properties: map[string]*jsonSchema{
+			"cohortId": {Type: "string"},
+			"courses": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"courseId", "tasks", "members"},
+				Properties: map[string]*jsonSchema{
+					"courseId": {Type: "string"},
+					"tasks": arrayOf(&jsonSchema{
+						Type:     "object",
+						Required: []string{"id", "group", "completed", "started", "notStarted", "completionRate"},
+						Properties: map[string]*jsonSchema{
+							"id":             {Type: "string"},
+							"group":          {Type: "string"},
+							"completed":      {Type: "integer"},
+							"started":        {Type: "integer"},
+							"notStarted":     {Type: "integer"},
+							"completionRate": {Type: "number", Description: "Part of the members who completed the task, between 0 and 1"},
+						},
+					}),
+					"members": arrayOf(&jsonSchema{
+						Type:     "object",
+						Required: []string{"userId", "completedTasks", "progress"},
+						Properties: map[string]*jsonSchema{
+							"userId":         {Type: "string"},
+							"completedTasks": {Type: "integer"},
+							"progress":       arrayOf(&jsonSchema{Type: "string", Enum: []string{"not started", "started", "completed"}, Description: "Progress on the task of the same index"}),
+						},
+					}),
+				},
+			}),
+		},
+	},
+	"ScormData": {
+		Type:        "object",
+		Description: "SCORM runtime data elements by name, like cmi.completion_status or cmi.core.lesson_status. Only the status, score, location and suspend data elements are kept",
+	},
+	"XapiIngestReport": {
+		Type:     "object",
+		Required: []string{"statements", "applied", "skipped", "results"},
+		Properties: map[string]*jsonSchema{
+			"statements": {Type: "integer"},
+			"applied":    {Type: "integer"},
+			"skipped":    {Type: "integer"},
+			"results": arrayOf(&jsonSchema{
+				Type:     "object",
+				Required: []string{"index", "status"},
+				Properties: map[string]*jsonSchema{
+					"index":       {Type: "integer"},
+					"statementId": {Type: "string"},
+					"status":      {Type: "string", Enum: []string{"applied", "skipped"}},
+					"progress":    {Type: "string", Enum: []string{"started", "completed"}},
+					"score":       {Type: "number", Description: "Score scaled between 0 and 1"},
+					"reason":      {Type: "string", Description: "Why the statement was skipped"},
+				},
+			}),
+		},
+	},
+}
+
+//Schema of the v2 envelope of a single resource
+func objectOf(data *jsonSchema) *jsonSchema {
+	return &jsonSchema{Type: "object", Required: []string{"data"}, Properties: map[string]*jsonSchema{"data": data}}
+}
+
+//Schema of the v2 envelope of a resource listing
+func listOf(items *jsonSchema) *jsonSchema {
+	return &jsonSchema{
+		Type:       "object",
+		Required:   []string{"data", "pagination"},
+		Properties: map[string]*jsonSchema{"data": arrayOf(items), "pagination": ref("Pagination")},
+	}
+}
+
+func errorResponseV2(description string) apiResponse {
+	return jsonResponse(description, ref("Error"))
+}
+
+//Every route of the service
+//The router and the OpenAPI document are both built from this table
+var routes = []apiRoute{
+	{
+		Method:  "GET",
+		Path:    "/progress/:user",
+		Handle:  HandleUserGet,
+		Summary: "Get the progress of the user on every task of the enrolled courses",
+		Query:   append([]apiParameter{queryParameter("course", "Only tasks of the given course", idSchema), scopeParameter}, listingParameters...),
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Progress of the user", arrayOf(ref("ProgressItem"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			400: errorResponse("Invalid cursor"),
+			404: errorResponse("No course information found"),
+			422: errorResponse("Invalid filter, sort or limit"),
+			500: errorResponse("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/progress/:user/:course",
+		Handle:  HandleUserCourseGet,
+		Summary: "Get the progress of the user on every task of the course",
+		Query:   listingParameters,
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Progress of the user on the course", arrayOf(ref("TaskProgress"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			400: errorResponse("Invalid cursor"),
+			404: errorResponse("Course not found or course has no tasks"),
+			422: errorResponse("Invalid filter, sort or limit"),
+			500: errorResponse("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/overdue/:user",
+		Handle:  HandleUserOverdueGet,
+		Summary: "List the tasks of the user past their deadline, not completed yet or completed late",
+		Query: []apiParameter{
+			queryParameter("course", "Only tasks of the given course", idSchema),
+			queryParameter("status", "Only the overdue tasks, or only the tasks completed late", &jsonSchema{Type: "string", Enum: []string{"overdue", "late"}}),
+		},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Overdue and late tasks", arrayOf(ref("OverdueTask"))),
+			404: errorResponse("Course not found"),
+			500: errorResponse("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/activity/:user",
+		Handle:  HandleUserActivityGet,
+		Summary: "Get the activity calendar of the user with the progress transitions the user made every day and the streaks of active days, in the timezone of the user",
+		Query: []apiParameter{
+			queryParameter("from", "First day of the calendar, YYYY-MM-DD, 364 days before the last one by default", &jsonSchema{Type: "string", Format: "date"}),
+			queryParameter("to", "Last day of the calendar, YYYY-MM-DD, today by default", &jsonSchema{Type: "string", Format: "date"}),
+		},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Activity calendar", ref("UserActivity")),
+			422: errorResponse("Invalid day or range longer than 731 days"),
+			500: errorResponse("Database failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/activity/:user/timezone",
+		Handle:  HandleUserActivityTimezonePut,
+		Body:    ref("ActivityTimezone"),
+		Summary: "Set the timezone of the activity calendar of the user, the activity is recounted from the progress history in the days of the timezone",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Timezone", ref("ActivityTimezone")),
+			400: errorResponse("Malformed body"),
+			422: errorResponse("Unknown timezone"),
+			500: errorResponse("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/courses/:course/overdue",
+		Handle:  HandleCourseOverdueGet,
+		Summary: "List the tasks of the course past their deadline, not completed yet or completed late, of every user with progress on the course, enrolled in it or member of a cohort it is assigned to",
+		Query:   []apiParameter{queryParameter("status", "Only the overdue tasks, or only the tasks completed late", &jsonSchema{Type: "string", Enum: []string{"overdue", "late"}})},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Overdue and late tasks ordered by user", arrayOf(ref("OverdueTask"))),
+			404: errorResponse("Course not found or course has no tasks"),
+			500: errorResponse("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/courses/:course/leaderboard",
+		Handle:  HandleLeaderboardGet,
+		Summary: "Rank the users with progress on the course, except the ones who opted out. Ties are broken by the earliest last completion, then by user id",
+		Query: []apiParameter{
+			queryParameter("sort", "Rank by completed tasks, score, or completion time of the users who completed the course, completed by default", &jsonSchema{Type: "string", Enum: leaderboardSorts}),
+			queryParameter("cohort", "Only rank the members of the cohort", &jsonSchema{Type: "string", MaxLength: 32}),
+			queryParameter("limit", "Maximum number of users in the page", &jsonSchema{Type: "integer", Minimum: &minimumLimit}),
+			queryParameter("cursor", "Cursor of the page, as returned by the previous page", &jsonSchema{Type: "string"}),
+		},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Page of the leaderboard, with the X-Total-Count, X-Next-Cursor and Link pagination headers", arrayOf(ref("LeaderboardEntry"))),
+			400: errorResponse("Invalid cursor"),
+			404: errorResponse("Course has no leaderboard, cohort not found, or course not found when ranked by completion time"),
+			422: errorResponse("Invalid sort or limit"),
+			500: errorResponse("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/courses/:course/leaderboard/opt-outs/:user",
+		Handle:  HandleLeaderboardOptOutPut,
+		Admin:   true,
+		Summary: "Hide the user from the leaderboard of the course",
+		Responses: map[int]apiResponse{
+			204: {Description: "User opted out"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			500: errorResponse("Database failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/courses/:course/leaderboard/opt-outs/:user",
+		Handle:  HandleLeaderboardOptOutDelete,
+		Admin:   true,
+		Summary: "Show the user on the leaderboard of the course again",
+		Responses: map[int]apiResponse{
+			204: {Description: "User opted in"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			500: errorResponse("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/progress/:user/:course/:task",
+		Handle:  HandleUserCourseTaskGet,
+		Summary: "Get the progress of the user on the task",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Progress of the user on the task", ref("TaskProgress")),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			404: errorResponse("Course or task not found"),
+			500: errorResponse("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/progress/:user/:course/:task",
+		Handle:  HandleUserCourseTaskPut,
+		Summary: "Set the progress of the user on the task",
+		Body:    ref("ProgressUpdate"),
+		Responses: map[int]apiResponse{
+			200: {Description: "Progress updated"},
+			400: errorResponse("Malformed request body"),
+			404: errorResponse("Course or task not found, when If-Match is present or the course has prerequisites"),
+			409: errorResponse("Task locked by its prerequisites"),
+			412: errorResponse("If-Match doesn't match the current ETag of the progress"),
+			422: errorResponse("Invalid progress type"),
+			500: errorResponse("Database failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/progress/:user/:course/:task",
+		Handle:  HandleUserCourseTaskDelete,
+		Summary: "Reset the progress of the user on the task to 'not started'",
+		Responses: map[int]apiResponse{
+			204: {Description: "Progress reset"},
+			404: errorResponse("Course or task not found, when If-Match is present or the course has prerequisites"),
+			409: errorResponse("Task locked by its prerequisites"),
+			412: errorResponse("If-Match doesn't match the current ETag of the progress"),
+			500: errorResponse("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/v2/users/:user",
+		Handle:  HandleV2UserGet,
+		Errors:  jsonErrors,
+		Summary: "Get the user with the summary of every enrollment",
+		Query:   []apiParameter{scopeParameter},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("User", objectOf(ref("User"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			404: errorResponseV2("No course information found"),
+			422: errorResponseV2("Invalid scope"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/v2/users/:user/enrollments",
+		Handle:  HandleV2EnrollmentsGet,
+		Errors:  jsonErrors,
+		Summary: "List the enrollments of the user",
+		Query:   []apiParameter{scopeParameter},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Enrollments of the user", listOf(ref("Enrollment"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			404: errorResponseV2("No course information found"),
+			422: errorResponseV2("Invalid scope"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/v2/users/:user/enrollments/:course",
+		Handle:  HandleEnrollmentPut,
+		Errors:  jsonErrors,
+		Summary: "Enroll the user in the course",
+		Body:    ref("EnrollmentRequest"),
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Existing enrollment, kept with its date and source", objectOf(ref("EnrollmentRecord"))),
+			201: jsonResponse("Created enrollment", objectOf(ref("EnrollmentRecord"))),
+			400: errorResponseV2("Malformed request body"),
+			404: errorResponseV2("Course not found"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/v2/users/:user/enrollments/:course",
+		Handle:  HandleEnrollmentDelete,
+		Errors:  jsonErrors,
+		Summary: "Unenroll the user from the course, keeping the progress",
+		Responses: map[int]apiResponse{
+			204: {Description: "User unenrolled"},
+			404: errorResponseV2("User not enrolled in the course"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/v2/users/:user/tasks",
+		Handle:  HandleV2UserTasksGet,
+		Errors:  jsonErrors,
+		Summary: "List the tasks of the enrolled courses with the progress of the user",
+		Query:   append([]apiParameter{queryParameter("course", "Only tasks of the given course", idSchema), scopeParameter}, listingParameters...),
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Tasks of every course", listOf(ref("Task"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			400: errorResponseV2("Invalid cursor"),
+			404: errorResponseV2("No course information found"),
+			422: errorResponseV2("Invalid filter, sort or limit"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/v2/users/:user/courses/:course",
+		Handle:  HandleV2CourseGet,
+		Errors:  jsonErrors,
+		Summary: "Get the course with its task groups and the progress of the user",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Course", objectOf(ref("Course"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			404: errorResponseV2("Course not found or course has no tasks"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/v2/users/:user/courses/:course/tasks",
+		Handle:  HandleV2TasksGet,
+		Errors:  jsonErrors,
+		Summary: "List the tasks of the course with the progress of the user",
+		Query:   listingParameters,
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Tasks of the course", listOf(ref("Task"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			400: errorResponseV2("Invalid cursor"),
+			422: errorResponseV2("Invalid filter, sort or limit"),
+			404: errorResponseV2("Course not found or course has no tasks"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/v2/users/:user/courses/:course/tasks/:task",
+		Handle:  HandleV2TaskGet,
+		Errors:  jsonErrors,
+		Summary: "Get the task with the progress of the user",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Task", objectOf(ref("Task"))),
+			304: {Description: "Not modified, If-None-Match matches the current ETag"},
+			404: errorResponseV2("Course or task not found"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/v2/users/:user/courses/:course/tasks/:task",
+		Handle:  HandleV2TaskPut,
+		Errors:  jsonErrors,
+		Summary: "Set the progress of the user on the task",
+		Body:    ref("ProgressUpdate"),
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Updated task", objectOf(ref("Task"))),
+			400: errorResponseV2("Malformed request body"),
+			404: errorResponseV2("Course or task not found"),
+			409: errorResponseV2("Task locked by its prerequisites"),
+			412: errorResponseV2("If-Match doesn't match the current ETag of the task"),
+			422: errorResponseV2("Invalid progress type"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/v2/users/:user/courses/:course/tasks/:task",
+		Handle:  HandleV2TaskDelete,
+		Errors:  jsonErrors,
+		Summary: "Reset the progress of the user on the task to 'not started'",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Reset task", objectOf(ref("Task"))),
+			404: errorResponseV2("Course or task not found"),
+			412: errorResponseV2("If-Match doesn't match the current ETag of the task"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/v2/users/:user/courses/:course/certificates",
+		Handle:  HandleCertificatePost,
+		Errors:  jsonErrors,
+		Summary: "Issue the signed certificate of completion of the course, once every task of the course is completed",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Certificate already issued for the same completed tasks", objectOf(ref("Certificate"))),
+			201: jsonResponse("Issued certificate", objectOf(ref("Certificate"))),
+			404: errorResponseV2("Course not found or course has no tasks"),
+			409: errorResponseV2("Course not completed"),
+			500: errorResponseV2("Database or upstream service failure"),
+			503: errorResponseV2("Certificates are disabled"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/cohorts",
+		Handle:  HandleCohortsGet,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "List the cohorts with their members and courses",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Every cohort ordered by name", listOf(ref("Cohort"))),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/cohorts",
+		Handle:  HandleCohortPost,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Body:    ref("CohortRequest"),
+		Summary: "Create a cohort with its members and the courses assigned to it",
+		Responses: map[int]apiResponse{
+			201: jsonResponse("Created cohort", objectOf(ref("Cohort"))),
+			400: errorResponseV2("Malformed body"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			422: errorResponseV2("Missing name"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/cohorts/:id",
+		Handle:  HandleCohortGet,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Get the cohort with its members and courses",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Cohort", objectOf(ref("Cohort"))),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Cohort not found"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/cohorts/:id",
+		Handle:  HandleCohortDelete,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Delete the cohort, the progress of its members is kept",
+		Responses: map[int]apiResponse{
+			204: {Description: "Cohort deleted"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Cohort not found"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/cohorts/:id/members/:user",
+		Handle:  HandleCohortMemberPut,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Add the user to the cohort",
+		Responses: map[int]apiResponse{
+			204: {Description: "User added"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Cohort not found"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/cohorts/:id/members/:user",
+		Handle:  HandleCohortMemberDelete,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Remove the user from the cohort",
+		Responses: map[int]apiResponse{
+			204: {Description: "User removed"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Cohort not found"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/cohorts/:id/courses/:course",
+		Handle:  HandleCohortCoursePut,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Assign the course to the cohort",
+		Responses: map[int]apiResponse{
+			204: {Description: "Course assigned"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Cohort not found"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/cohorts/:id/courses/:course",
+		Handle:  HandleCohortCourseDelete,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Unassign the course from the cohort",
+		Responses: map[int]apiResponse{
+			204: {Description: "Course unassigned"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Cohort not found"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/cohorts/:id/progress",
+		Handle:  HandleCohortProgressGet,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Get the progress of every member of the cohort on every task of its courses, with the completion of every task by the members",
+		Query:   []apiParameter{queryParameter("course", "Only the given course of the cohort", idSchema)},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Progress matrix of the members by task", objectOf(ref("CohortProgress"))),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Cohort not found, course not assigned to the cohort, or course has no tasks"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/admin/reconciliation",
+		Handle:  HandleReconciliationGet,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Get the report of the last reconciliation of the stored progress against the course catalogs",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Report of the last finished reconciliation", objectOf(ref("ReconciliationReport"))),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("No reconciliation has finished"),
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/admin/reconciliation",
+		Handle:  HandleReconciliationPost,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Start a reconciliation of the stored progress against the course catalogs, archiving or remapping the orphans",
+		Body:    ref("ReconciliationOptions"),
+		Responses: map[int]apiResponse{
+			202: jsonResponse("Reconciliation started", objectOf(ref("ReconciliationReport"))),
+			400: errorResponseV2("Malformed request body"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			409: errorResponseV2("A reconciliation is already running"),
+			422: errorResponseV2("Invalid reconciliation options"),
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/admin/task-mappings",
+		Handle:  HandleTaskMappingsPost,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Move the stored progress and history of renamed, merged or split tasks to the tasks replacing them",
+		Body:    ref("TaskMappingRequest"),
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Report of the applied mappings, or of the affected rows on a dry run", objectOf(ref("TaskMappingReport"))),
+			400: errorResponseV2("Malformed request body"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Course of a target task not found"),
+			422: errorResponseV2("Invalid mappings or target task not found"),
+			500: errorResponseV2("Database or upstream service failure"),
+		},
+	},
+	{
+		Method:      "POST",
+		Path:        "/admin/imports",
+		Handle:      HandleImportPost,
+		Errors:      jsonErrors,
+		Admin:       true,
+		LongRunning: true,
+		Summary:     "Import progress rows streamed as CSV or NDJSON, in batched transactions. The request isn't bounded by the request timeout, a named import resumes after its last committed batch",
+		Query: []apiParameter{
+			queryParameter("format", "Format of the body, by default CSV for a text/csv content type and NDJSON otherwise", &jsonSchema{Type: "string", Enum: []string{"csv", "ndjson"}}),
+			queryParameter("importId", "Id of the import, an interrupted import is resumed by posting it again with the same id", idSchema),
+			queryParameter("dryRun", "Only validate the rows", &jsonSchema{Type: "boolean"}),
+			queryParameter("checkCatalog", "Validate the tasks against the upstream course catalogs", &jsonSchema{Type: "boolean"}),
+			queryParameter("batchSize", "Number of rows written per transaction", &jsonSchema{Type: "integer", Minimum: &minimumLimit}),
+		},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Report of the import", objectOf(ref("ImportReport"))),
+			400: errorResponseV2("Unknown format or malformed CSV header"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			422: errorResponseV2("Invalid query parameter"),
+			500: errorResponseV2("Database or upstream service failure, the rows committed so far are kept"),
+		},
+	},
+	{
+		Method:      "GET",
+		Path:        "/admin/exports",
+		Handle:      HandleExportGet,
+		Errors:      jsonErrors,
+		Admin:       true,
+		LongRunning: true,
+		Summary:     "Stream the stored progress as CSV, NDJSON or Parquet. An export with the watermark of a previous export only has the tasks changed since, reset tasks are exported as not started. The response isn't bounded by the request timeout",
+		Query: []apiParameter{
+			queryParameter("format", "Format of the export, NDJSON by default", &jsonSchema{Type: "string", Enum: []string{"csv", "ndjson", "parquet"}}),
+			queryParameter("course", "Only the progress of the given course", idSchema),
+			queryParameter("updatedSince", "Only tasks updated at or after the given RFC 3339 timestamp, can't be combined with a watermark", &jsonSchema{Type: "string", Format: "date-time"}),
+			queryParameter("watermark", "X-Export-Watermark header of a previous export, only tasks changed since are exported", &jsonSchema{Type: "string", Format: "date-time"}),
+		},
+		Responses: map[int]apiResponse{
+			200: {Description: "Progress records ordered by user, course and task, the X-Export-Watermark header has the watermark of the next incremental export", ContentType: "text/csv", Schema: &jsonSchema{Type: "string"}},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			422: errorResponseV2("Invalid query parameter, or updatedSince combined with a watermark"),
+			500: errorResponseV2("Database failure, the response is aborted if it happens after the first row"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/admin/lti/line-items",
+		Handle:  HandleLineItemsGet,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "List the LTI line items the scores of the tasks are posted to",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Every line item mapping", objectOf(arrayOf(ref("LtiLineItem")))),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/admin/lti/line-items",
+		Handle:  HandleLineItemsPut,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Body:    ref("LtiLineItemsRequest"),
+		Summary: "Map tasks to LTI line items, replacing their previous line items. Completions of a mapped task are posted with the maximum score, recorded scores as their part of it",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Every line item mapping", objectOf(arrayOf(ref("LtiLineItem")))),
+			400: errorResponseV2("Malformed body"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			422: errorResponseV2("Invalid line item"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/admin/lti/line-items/:course/:task",
+		Handle:  HandleLineItemDelete,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Remove the LTI line item of the task, the scores already queued are still posted",
+		Responses: map[int]apiResponse{
+			204: {Description: "Line item removed"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Task not mapped to a line item"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/admin/deadlines",
+		Handle:  HandleDeadlinesGet,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "List the deadlines of the courses and tasks",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Every deadline", objectOf(arrayOf(ref("Deadline")))),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/admin/deadlines",
+		Handle:  HandleDeadlinesPut,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Body:    ref("DeadlinesRequest"),
+		Summary: "Set or remove deadlines of courses and tasks. A task.overdue event is appended for every user with progress on the course, enrolled in it or member of a cohort it is assigned to, who hasn't completed a task when its deadline passes",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Every deadline", objectOf(arrayOf(ref("Deadline")))),
+			400: errorResponseV2("Malformed body"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			422: errorResponseV2("Invalid deadline"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/admin/leaderboards",
+		Handle:  HandleLeaderboardsGet,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "List the courses with a leaderboard",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Every leaderboard", objectOf(arrayOf(ref("LeaderboardSettings")))),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/admin/leaderboards",
+		Handle:  HandleLeaderboardsPut,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Body:    ref("LeaderboardsRequest"),
+		Summary: "Enable the leaderboards of courses, replacing their settings",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Every leaderboard", objectOf(arrayOf(ref("LeaderboardSettings")))),
+			400: errorResponseV2("Malformed body"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			422: errorResponseV2("Pseudonymized leaderboard without a configured pseudonym key"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "DELETE",
+		Path:    "/admin/leaderboards/:course",
+		Handle:  HandleLeaderboardDelete,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Disable the leaderboard of the course, the rankings are still maintained",
+		Responses: map[int]apiResponse{
+			204: {Description: "Leaderboard disabled"},
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			404: errorResponseV2("Course has no leaderboard"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/scorm/:user/:course/:task",
+		Handle:  HandleScormGet,
+		Errors:  jsonErrors,
+		Summary: "Get the SCORM runtime data resuming the package of the task, with cmi.entry set to resume when a location or suspend data was committed",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Runtime data elements", objectOf(ref("ScormData"))),
+			404: errorResponseV2("No runtime data committed"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "PUT",
+		Path:    "/scorm/:user/:course/:task",
+		Handle:  HandleScormPut,
+		Errors:  jsonErrors,
+		Summary: "Commit SCORM 1.2 or 2004 runtime data of the package of the task. Passed or completed packages complete the task, failed or incomplete ones start it, progress is never lowered. A changed score is recorded",
+		Body:    ref("ScormData"),
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Merged runtime data elements", objectOf(ref("ScormData"))),
+			400: errorResponseV2("Malformed body"),
+			422: errorResponseV2("Invalid runtime data element"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/certificates/:id",
+		Handle:  HandleCertificateGet,
+		Errors:  jsonErrors,
+		Summary: "Download the certificate of completion",
+		Query: []apiParameter{
+			queryParameter("format", "pdf to render the certificate as a PDF document", &jsonSchema{Type: "string", Enum: []string{"json", "pdf"}}),
+		},
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Certificate, or a PDF document with format=pdf", objectOf(ref("Certificate"))),
+			404: errorResponseV2("Certificate not found"),
+			500: errorResponseV2("Database failure"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/certificates/:id/verify",
+		Handle:  HandleCertificateVerify,
+		Errors:  jsonErrors,
+		Summary: "Verify the signature of the certificate of completion with the public keys of the service",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Whether the signature is valid", objectOf(ref("CertificateVerification"))),
+			404: errorResponseV2("Certificate not found"),
+			500: errorResponseV2("Database failure or invalid configured keys"),
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/xapi/statements",
+		Handle:  HandleXapiStatementsPost,
+		Errors:  jsonErrors,
+		Admin:   true,
+		Summary: "Map a xAPI statement or an array of statements to progress. attempted starts the task, completed and passed complete it, scored records the score. The actor account and the activity must be of this service, progress is never lowered",
+		Responses: map[int]apiResponse{
+			200: jsonResponse("Outcome of every statement", objectOf(ref("XapiIngestReport"))),
+			400: errorResponseV2("Malformed statements"),
+			401: errorResponseV2("Invalid admin token"),
+			403: errorResponseV2("Admin endpoints are disabled"),
+			500: errorResponseV2("Database failure, the statements before the failed one are applied"),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/health",
+		Handle:  HandleHealthCheck,
+		Summary: "Check the database connection and the dependent services",
+		Responses: map[int]apiResponse{
+			200: {Description: "Service is healthy"},
+			500: errorResponse("Database or dependent service is down"),
+		},
+	},
+	{
+		Method:  "HEAD",
+		Path:    "/health",
+		Handle:  HandleHealthCheck,
+		Summary: "Check the database connection and the dependent services",
+		Responses: map[int]apiResponse{
+			200: {Description: "Service is healthy"},
+			500: {Description: "Database or dependent service is down"},
+		},
+	},
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Runtime data elements kept between the sessions of a SCORM package, by SCORM version
+//Other elements of a commit are ignored
+var scormElements = map[string][]string{
+	"1.2": {"cmi.core.lesson_status", "cmi.core.lesson_location", "cmi.core.score.raw", "cmi.core.score.min", "cmi.core.score.max", "cmi.suspend_data"},
+	"2004": {"cmi.completion_status", "cmi.success_status", "cmi.location", "cmi.score.scaled", "cmi.score.raw", "cmi.score.min", "cmi.score.max",
+		"cmi.suspend_data"},
+}
+
+//Valid values of the status elements
+var scormStatuses = map[string][]string{
+	"cmi.core.lesson_status": {"passed", "completed", "failed", "incomplete", "browsed", "not attempted"},
+	"cmi.completion_status":  {"completed", "incomplete", "not attempted", "unknown"},
+	"cmi.success_status":     {"passed", "failed", "unknown"},
+}
+
+//Runtime data of a SCORM package for a user on a task, merged from its commits
+type ScormData struct {
+	Version  string
+	Elements map[string]string
+	Score    *float64
+}
+
+//Returns the SCORM version of the elements, 1.2 if they use the cmi.core elements and 2004 if they use elements of SCORM 2004 only
+//Returns the given version if the elements are common to both versions
+func scormVersionOf(elements map[string]string, version string) string {
+	for name := range elements {
+		if strings.HasPrefix(name, "cmi.core.") {
+			return "1.2"
+		}
+		if name != "cmi.suspend_data" && isScormElement(scormElements["2004"], name) {
+			return "2004"
+		}
+	}
+	return version
+}
+
+//Reads the elements of a CommitData payload, a JSON object of element names and values
+//Values may be strings or numbers, elements not kept between sessions are dropped
+func parseScormCommit(body []byte) (map[string]string, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(payload))
+	for name, value := range payload {
+		switch value := value.(type) {
+		case string:
+			values[name] = value
+		case float64:
+			values[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			return nil, errors.New(name + " must be a string or a number")
+		}
+	}
+	elements := make(map[string]string)
+	for _, name := range scormElements[scormVersionOf(values, "2004")] {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if statuses, ok := scormStatuses[name]; ok && !isScormElement(statuses, value) {
+			return nil, errors.New(name + " has invalid value " + value)
+		}
+		if strings.Contains(name, ".score.") {
+			if _, err := strconv.ParseFloat(value, 64); err != nil && value != "" {
+				return nil, errors.New(name + " must be a number")
+			}
+		}
+		elements[name] = value
+	}
+	return elements, nil
+}
+
+//Returns true if the value is one of the element names or status values
+func isScormElement(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the score of the elements scaled between 0 and 1, nil if they have none
+//A SCORM 1.2 raw score ranges from 0 to 100 unless the range is given
+func (d *ScormData) scaledScore() *float64 {
+	prefix := "cmi.score."
+	if d.Version == "1.2" {
+		prefix = "cmi.core.score."
+	}
+	score := func(name string) *float64 {
+		if value, err := strconv.ParseFloat(d.Elements[prefix+name], 64); err == nil {
+			return &value
+		}
+		return nil
+	}
+	max := score("max")
+	if d.Version == "1.2" && max == nil {
+		hundred := 100.0
+		max = &hundred
+	}
+	return scaleScore(score("scaled"), score("raw"), score("min"), max)
+}
+
+//Returns the progress of the status elements, empty if the package wasn't attempted
+//Passed packages are completed, failed and incomplete ones are started
+func (d *ScormData) progress() string {
+	if d.Version == "1.2" {
+		switch d.Elements["cmi.core.lesson_status"] {
+		case "passed", "completed":
+			return "completed"
+		case "failed", "incomplete", "browsed":
+			return "started"
+		}
+		return ""
+	}
+	switch {
+	case d.Elements["cmi.success_status"] == "passed" || d.Elements["cmi.completion_status"] == "completed":
+		return "completed"
+	case d.Elements["cmi.success_status"] == "failed" || d.Elements["cmi.completion_status"] == "incomplete":
+		return "started"
+	}
+	return ""
+}
+
+//Returns the elements initializing the runtime of the package when it is launched again
+//The entry element tells the package to resume from its location and suspend data
+func (d *ScormData) resumeElements() map[string]string {
+	elements := make(map[string]string, len(d.Elements)+1)
+	for name, value := range d.Elements {
+		elements[name] = value
+	}
+	entry := "cmi.entry"
+	if d.Version == "1.2" {
+		entry = "cmi.core.entry"
+	}
+	elements[entry] = "ab-initio"
+	if d.Elements["cmi.suspend_data"] != "" || d.Elements["cmi.location"] != "" || d.Elements["cmi.core.lesson_location"] != "" {
+		elements[entry] = "resume"
+	}
+	return elements
+}
+
+//Scans the runtime data row, returns nil if there is no row
+func scanScormData(row *sql.Row) (*ScormData, error) {
+	var data ScormData
+	var elements string
+	var score sql.NullFloat64
+	err := row.Scan(&data.Version, &elements, &score)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if score.Valid {
+		data.Score = &score.Float64
+	}
+	return &data, json.Unmarshal([]byte(elements), &data.Elements)
+}
+
+//Returns the runtime data of the package for the user on the task, nil if it was never committed
+func (s *ProgressStore) getScormData(ctx context.Context, userId, courseId, taskId string) (*ScormData, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return scanScormData(s.selectScorm.QueryRowContext(ctx, userId, courseId, taskId))
+}
+
+//Merges the committed elements into the runtime data of the package, in one transaction with their progress and score
+//The progress is never lowered by a commit, a score is recorded when it differs from the last committed one
+//Returns the merged runtime data
+func (s *ProgressStore) commitScormData(ctx context.Context, userId, courseId, taskId string, elements map[string]string) (*ScormData, error) {
+	var data *ScormData
+	_, err := s.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		previous, err := scanScormData(tx.StmtContext(ctx, s.selectScormForUpdate).QueryRowContext(ctx, userId, courseId, taskId))
+		if err != nil {
+			return nil, err
+		}
+		data = &ScormData{Version: "2004", Elements: make(map[string]string)}
+		if previous != nil {
+			data.Version = previous.Version
+		}
+		data.Version = scormVersionOf(elements, data.Version)
+		if previous != nil && previous.Version == data.Version {
+			data.Elements = previous.Elements
+		}
+		for name, value := range elements {
+			data.Elements[name] = value
+		}
+		data.Score = data.scaledScore()
+
+		merged, err := json.Marshal(data.Elements)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			_, err = tx.StmtContext(ctx, s.insertScorm).ExecContext(ctx, userId, courseId, taskId, data.Version, string(merged), data.Score)
+			if err != nil && s.dialect.isDuplicate(err) {
+				return nil, errConcurrentInsert
+			}
+		} else {
+			_, err = tx.StmtContext(ctx, s.updateScorm).ExecContext(ctx, data.Version, string(merged), data.Score, userId, courseId, taskId)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := s.selectForUpdate(ctx, tx, userId, courseId, taskId)
+		if err != nil {
+			return nil, err
+		}
+		var changes []*ProgressChange
+		if progress := data.progress(); progress != "" && (current == nil || progressRank(current.Progress) < progressRank(progress)) {
+			change, err := s.upsertLocked(ctx, tx, CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: taskId, Progress: progress}, current)
+			if err != nil {
+				return nil, err
+			}
+			change.Learner = true
+			changes = append(changes, change)
+			current = change.Current
+		}
+		if data.Score != nil && (previous == nil || previous.Score == nil || *previous.Score != *data.Score) {
+			if _, err := s.recordScoreLocked(ctx, tx, userId, courseId, taskId, *data.Score, current); err != nil {
+				return nil, err
+			}
+		}
+		return changes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//Handles the put method on /scorm/:user/:course/:task
+//Accepts a SCORM 1.2 or 2004 CommitData payload and maps its status to the progress of the task
+//Returns 200 status code and the elements resuming the package
+func HandleScormPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body, err := ioutil.ReadAll(r.Body)
+	var elements map[string]string
+	if err == nil {
+		elements, err = parseScormCommit(body)
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusUnprocessableEntity, "Invalid SCORM runtime data.", err))
+		return
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+
+	data, err := store.commitScormData(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"), elements)
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to commit SCORM runtime data.", err))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: data.resumeElements()})
+}
+
+//Handles the get method on /scorm/:user/:course/:task
+//Returns 200 status code and the elements resuming the package, 404 if the package never committed data
+func HandleScormGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	data, err := store.getScormData(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"))
+	if err != nil {
+		respondErrorV2(w, failure(r.Context(), "Failed to read SCORM runtime data.", err))
+		return
+	}
+	if data == nil {
+		respondErrorV2(w, newServiceError(http.StatusNotFound, "No SCORM runtime data committed for task "+ps.ByName("task"), nil))
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: data.resumeElements()})
+}
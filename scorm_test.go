@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestParseScormCommit(t *testing.T) {
+	elements, err := parseScormCommit([]byte(`{"cmi.core.lesson_status":"incomplete","cmi.core.score.raw":72.5,"cmi.suspend_data":"page=3","cmi.core.session_time":"0000:10:00"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 3 || elements["cmi.core.lesson_status"] != "incomplete" || elements["cmi.core.score.raw"] != "72.5" || elements["cmi.suspend_data"] != "page=3" {
+		t.Errorf("SCORM 1.2 elements %v", elements)
+	}
+	if version := scormVersionOf(elements, "2004"); version != "1.2" {
+		t.Errorf("SCORM 1.2 elements read as SCORM %s", version)
+	}
+	if version := scormVersionOf(map[string]string{"cmi.suspend_data": "page=3"}, "1.2"); version != "1.2" {
+		t.Errorf("suspend data of a SCORM 1.2 package read as SCORM %s", version)
+	}
+
+	for _, body := range []string{
+		`{"cmi.completion_status":"done"}`,
+		`{"cmi.core.lesson_status":"unknown"}`,
+		`{"cmi.score.raw":"high"}`,
+		`{"cmi.location":true}`,
+		`["cmi.location"]`,
+	} {
+		if _, err := parseScormCommit([]byte(body)); err == nil {
+			t.Errorf("invalid commit %s accepted", body)
+		}
+	}
+}
+
+func TestScormDataMapsToProgress(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		elements map[string]string
+		progress string
+	}{
+		{"1.2", map[string]string{"cmi.core.lesson_status": "passed"}, "completed"},
+		{"1.2", map[string]string{"cmi.core.lesson_status": "completed"}, "completed"},
+		{"1.2", map[string]string{"cmi.core.lesson_status": "failed"}, "started"},
+		{"1.2", map[string]string{"cmi.core.lesson_status": "browsed"}, "started"},
+		{"1.2", map[string]string{"cmi.core.lesson_status": "not attempted"}, ""},
+		{"2004", map[string]string{"cmi.completion_status": "incomplete", "cmi.success_status": "passed"}, "completed"},
+		{"2004", map[string]string{"cmi.completion_status": "completed", "cmi.success_status": "failed"}, "completed"},
+		{"2004", map[string]string{"cmi.completion_status": "unknown", "cmi.success_status": "failed"}, "started"},
+		{"2004", map[string]string{"cmi.completion_status": "not attempted"}, ""},
+	} {
+		data := ScormData{Version: test.version, Elements: test.elements}
+		if progress := data.progress(); progress != test.progress {
+			t.Errorf("SCORM %s %v mapped to %q, want %q", test.version, test.elements, progress, test.progress)
+		}
+	}
+
+	for _, test := range []struct {
+		version  string
+		elements map[string]string
+		score    float64
+	}{
+		{"1.2", map[string]string{"cmi.core.score.raw": "80"}, 0.8},
+		{"1.2", map[string]string{"cmi.core.score.raw": "15", "cmi.core.score.min": "10", "cmi.core.score.max": "20"}, 0.5},
+		{"2004", map[string]string{"cmi.score.scaled": "0.25", "cmi.score.raw": "90", "cmi.score.max": "100"}, 0.25},
+		{"2004", map[string]string{"cmi.score.raw": "3", "cmi.score.max": "4"}, 0.75},
+	} {
+		data := ScormData{Version: test.version, Elements: test.elements}
+		if score := data.scaledScore(); score == nil || *score != test.score {
+			t.Errorf("SCORM %s %v scaled to %v, want %g", test.version, test.elements, score, test.score)
+		}
+	}
+	if score := (&ScormData{Version: "2004", Elements: map[string]string{"cmi.score.raw": "90"}}).scaledScore(); score != nil {
+		t.Errorf("SCORM 2004 raw score without range scaled to %g", *score)
+	}
+}
+
+func TestScormResumeElements(t *testing.T) {
+	fresh := ScormData{Version: "2004", Elements: map[string]string{"cmi.completion_status": "incomplete"}}
+	if elements := fresh.resumeElements(); elements["cmi.entry"] != "ab-initio" || elements["cmi.completion_status"] != "incomplete" {
+		t.Errorf("elements of a package without location %v", elements)
+	}
+	suspended := ScormData{Version: "1.2", Elements: map[string]string{"cmi.suspend_data": "page=3"}}
+	if elements := suspended.resumeElements(); elements["cmi.core.entry"] != "resume" || elements["cmi.suspend_data"] != "page=3" {
+		t.Errorf("elements of a suspended package %v", elements)
+	}
+	if _, ok := suspended.Elements["cmi.core.entry"]; ok {
+		t.Error("resume elements written to the stored elements")
+	}
+
+	//Invalid runtime data is rejected before it is committed
+	initConfig()
+	for body, status := range map[string]int{
+		`{"cmi.completion_status":`:        http.StatusBadRequest,
+		`{"cmi.completion_status":"done"}`: http.StatusUnprocessableEntity,
+	} {
+		resp := serveTestRequest("PUT", "/scorm/ana/algebra/intro", body, nil)
+		var envelope ErrorEnvelope
+		if err := json.Unmarshal(resp.Body.Bytes(), &envelope); err != nil || resp.Code != status || envelope.Error.Status != status {
+			t.Errorf("commit %s answered %d:\n%s", body, resp.Code, resp.Body.String())
+		}
+	}
+}
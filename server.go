@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var shutdownHooks []func(ctx context.Context)
+
+//Context of the background jobs, cancelled on shutdown once the HTTP server has drained
+var jobContext, cancelJobs = context.WithCancel(context.Background())
+
+//Registers a function to be called on graceful shutdown, after the HTTP server has drained
+//Hooks are called in registration order, before the prepared statements and the database connection are closed
+func onShutdown(hook func(ctx context.Context)) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+//Connections accepted by the server, by remote address
+//The handlers of the long-running routes find their connection there to clear the deadlines of the server timeouts
+type connectionRegistry struct {
+	mutex sync.Mutex
+	conns map[string]net.Conn
+}
+
+var connections = &connectionRegistry{conns: make(map[string]net.Conn)}
+
+//Clears the read and write deadlines of the connection, until the server sets them again for the next request on it
+//Connections that weren't accepted by runServer, as in tests, are left as they are
+func (registry *connectionRegistry) clearDeadlines(remoteAddr string) {
+	registry.mutex.Lock()
+	conn := registry.conns[remoteAddr]
+	registry.mutex.Unlock()
+	if conn != nil {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+//Listener registering the accepted connections until they are closed
+//Like the listener of ListenAndServe, it enables TCP keep-alives on the connections
+type registeringListener struct {
+	net.Listener
+	registry *connectionRegistry
+}
+
+func (l registeringListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(3 * time.Minute)
+	}
+	registered := &registeredConn{Conn: conn, registry: l.registry}
+	l.registry.mutex.Lock()
+	l.registry.conns[conn.RemoteAddr().String()] = registered
+	l.registry.mutex.Unlock()
+	return registered, nil
+}
+
+type registeredConn struct {
+	net.Conn
+	registry *connectionRegistry
+	once     sync.Once
+}
+
+func (c *registeredConn) Close() error {
+	c.once.Do(func() {
+		remoteAddr := c.RemoteAddr().String()
+		c.registry.mutex.Lock()
+		if c.registry.conns[remoteAddr] == c {
+			delete(c.registry.conns, remoteAddr)
+		}
+		c.registry.mutex.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+//Runs the HTTP server with the timeouts from configuration until SIGINT or SIGTERM is received
+//The long-running routes clear the read and write timeouts on their connection
+//On shutdown it drains in-flight requests, runs the shutdown hooks and closes the database connection
+func runServer(handler http.Handler) {
+	server := &http.Server{
+		Addr:         ":" + strconv.Itoa(config.Port),
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		closeConnection()
+		log.Fatal(err)
+	}
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- server.Serve(registeringListener{Listener: listener, registry: connections})
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serverErrors:
+		closeConnection()
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Println("Received " + sig.String() + ", shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Failed to drain in-flight requests. \nCause: " + err.Error())
+	}
+	cancelJobs()
+	for _, hook := range shutdownHooks {
+		hook(ctx)
+	}
+	closeConnection()
+	log.Println("Shutdown complete")
+}
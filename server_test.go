@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLongRunningRoutesOutliveServerTimeouts(t *testing.T) {
+	initConfig()
+	config.RequestTimeout = 100 * time.Millisecond
+	slow := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			w.Write([]byte("done"))
+		case <-r.Context().Done():
+			http.Error(w, r.Context().Err().Error(), http.StatusServiceUnavailable)
+		}
+	}
+	router := httprouter.New()
+	router.GET("/bounded", withDeadline(slow))
+	router.GET("/long", withoutTimeouts(slow))
+
+	server := httptest.NewUnstartedServer(router)
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Listener = registeringListener{Listener: server.Listener, registry: connections}
+	server.Start()
+	defer server.Close()
+
+	get := func(path string) (string, error) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+	if body, err := get("/bounded"); err == nil && body == "done" {
+		t.Error("bounded route outlived the request timeout")
+	}
+	if body, err := get("/long"); err != nil || body != "done" {
+		t.Errorf("long-running route answered %q, %v", body, err)
+	}
+
+	//The registry forgets the closed connections
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	open := -1
+	for i := 0; i < 50 && open != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		connections.mutex.Lock()
+		open = len(connections.conns)
+		connections.mutex.Unlock()
+	}
+	if open != 0 {
+		t.Errorf("%d closed connections still registered", open)
+	}
+}
+
+func TestStreamingRoutesAreLongRunning(t *testing.T) {
+	longRunning := map[string]bool{"POST /admin/imports": true, "GET /admin/exports": true}
+	for _, route := range routes {
+		if longRunning[route.Method+" "+route.Path] != route.LongRunning {
+			t.Errorf("%s %s long-running is %t", route.Method, route.Path, route.LongRunning)
+		}
+	}
+}
+
+func TestCourseIdsAreNotShadowedByUserRoutes(t *testing.T) {
+	router := newRouter()
+	for _, courseId := range []string{"overdue", "activity"} {
+		handle, ps, _ := router.Lookup("GET", "/progress/ana/"+courseId)
+		if handle == nil || ps.ByName("course") != courseId {
+			t.Errorf("course %s isn't served by the progress of the course", courseId)
+		}
+	}
+	for _, path := range []string{"/overdue/ana", "/activity/ana"} {
+		if handle, ps, _ := router.Lookup("GET", path); handle == nil || ps.ByName("user") != "ana" {
+			t.Errorf("GET %s isn't served for the user", path)
+		}
+	}
+	if handle, _, _ := router.Lookup("PUT", "/activity/ana/timezone"); handle == nil {
+		t.Error("PUT /activity/ana/timezone isn't served")
+	}
+}
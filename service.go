@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/julienschmidt/httprouter"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"strings"
+	"time"
 )
 
 var connection *sql.DB
@@ -22,14 +24,23 @@ type CourseProgressInfo struct {
 }
 
 type ProgressItem struct {
-	CourseId string `json:"courseId"`
-	TaskId   string `json:"taskId"`
-	Progress string `json:"progress"`
+	CourseId  string     `json:"courseId"`
+	TaskId    string     `json:"taskId"`
+	Progress  string     `json:"progress"`
+	Status    string     `json:"status,omitempty"`
+	CreatedAt *time.Time `json:"-"`
+	UpdatedAt *time.Time `json:"-"`
+	Version   int        `json:"-"`
 }
 
+//Status is locked if the task isn't started and its prerequisites aren't met, available otherwise
 type TaskProgress struct {
-	TaskId   string `json:"taskId"`
-	Progress string `json:"progress"`
+	TaskId    string     `json:"taskId"`
+	Progress  string     `json:"progress"`
+	Status    string     `json:"status,omitempty"`
+	CreatedAt *time.Time `json:"-"`
+	UpdatedAt *time.Time `json:"-"`
+	Version   int        `json:"-"`
 }
 
 type CourseProgress struct {
@@ -43,14 +54,29 @@ type CourseInfo struct {
 	URL  string `json:"url"`
 }
 
-//Initializes the connection with database
-//Creates COURSEPROGRESS table in database if it not exist
+type BaseTaskInfo struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+}
+
+type TaskGroup struct {
+	Title string          `json:"title"`
+	Tasks []*BaseTaskInfo `json:"tasks"`
+}
+
+//Initializes the connection with database, in the dialect selected by the scheme of the database URL
+//Creates COURSEPROGRESS table in database if it not exist and applies the pending migrations
 func initConnection() {
 	var err error
-	connection, err = sql.Open("mysql", config.DatabaseUrl)
+	var dsn string
+	dialect, dsn = dialectOf(config.DatabaseUrl)
+	connection, err = sql.Open(dialect.driver, dsn)
 	if err != nil {
 		log.Fatal("Failed to connect to database")
 	}
+	connection.SetMaxOpenConns(config.DatabaseMaxOpenConns)
+	connection.SetMaxIdleConns(config.DatabaseMaxIdleConns)
+	connection.SetConnMaxLifetime(config.DatabaseConnMaxLifetime)
 
 	err = connection.Ping()
 	if err != nil {
@@ -59,152 +85,54 @@ func initConnection() {
 		log.Println("Conexiune stabilita")
 	}
 
-	var res string
-	err = connection.QueryRow("SELECT user_id FROM COURSEPROGRESS LIMIT 1").Scan(&res)
-	if err != nil && err != sql.ErrNoRows {
-		log.Println("Creating table COURSEPROGRESS" + err.Error())
-		stmt, err := connection.Prepare("create table COURSEPROGRESS (" +
-			" user_id varchar(100) NOT NULL," +
-			" course_id varchar(100) NOT NULL," +
-			" task_id varchar(100) NOT NULL," +
-			" progress varchar(30) NOT NULL," +
-			" CONSTRAINT pk_courseprogress PRIMARY KEY (user_id,course_id,task_id))")
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = stmt.Exec()
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Println("Table COURSEPROGRESS has been successfully created")
-	}
-}
-
-//Get progress from database for the specified user,course and task
-//Returns the task progress and the error
-func getTaskProgress(userID, courseID, taskID string) (*TaskProgress, error) {
-	stmt, err := connection.Prepare("select progress from COURSEPROGRESS where user_id = ? and course_id = ? and task_id = ?")
-	if err != nil {
-		fmt.Println("Eroare la select: ", err)
-		return nil, err
-	}
-	defer stmt.Close()
-	var task string
-	rows, err := stmt.Query(userID, courseID, taskID)
-	if err != nil {
-		return nil, err
-	}
-	if rows.Next() {
-		err = rows.Scan(&task)
-		if err != nil {
-			return nil, err
-		}
-	}
-	var taskProgress TaskProgress
-	if task != "" {
-		taskProgress.TaskId = taskID
-	}
-	taskProgress.Progress = task
-	return &taskProgress, nil
-}
+	migrate()
 
-//Inserts in database new task progress
-//Returns nil on success or error otherwise
-func addTaskProgress(courseProgress CourseProgressInfo) error {
-	stmt, err := connection.Prepare("INSERT INTO COURSEPROGRESS(user_id,course_id,task_id,progress) values (?,?,?,?)")
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	_, err = stmt.Exec(courseProgress.UserId, courseProgress.CourseId, courseProgress.TaskId, courseProgress.Progress)
+	store, err = newProgressStore(connection, dialect)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		log.Fatal("Failed to prepare statements" + err.Error())
 	}
-	return nil
 }
 
-//Update  in database the task progress
-//Returns nil on success or error otherwise
-func updateTaskProgress(courseProgress CourseProgressInfo) error {
-	stmt, err := connection.Prepare("UPDATE COURSEPROGRESS set progress =? where User_id =? and course_id =? and Task_id =?")
-	if err != nil {
-		fmt.Println(err)
-		return err
+//Closes the prepared statements of the store and the connection with database
+func closeConnection() {
+	if err := store.Close(); err != nil {
+		log.Println("Failed to close prepared statements. \nCause: " + err.Error())
 	}
-	_, err = stmt.Exec(courseProgress.Progress, courseProgress.UserId, courseProgress.CourseId, courseProgress.TaskId)
-	if err != nil {
-		fmt.Println(err)
-		return err
+	if err := connection.Close(); err != nil {
+		log.Println("Failed to close database connection. \nCause: " + err.Error())
 	}
-	return nil
 }
 
-//Get progress from database for the specified user and course
-//Returns all tasks with progress and the error
-func getCourseProgress(userId, courseId string) ([]TaskProgress, error) {
-	stmt, err := connection.Prepare("select task_id,progress from COURSEPROGRESS where user_id = ? and course_id = ?")
-	if err != nil {
-		fmt.Println("Eroare la select: ", err)
-		return nil, err
+//Enables the parsing of DATETIME columns into time.Time on the MySQL data source name
+func withParseTime(dsn string) string {
+	if strings.Contains(dsn, "parseTime=") {
+		return dsn
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(userId, courseId)
-	if err != nil {
-		return nil, err
-	}
-
-	var taskId, progress string
-	tasks := make([]TaskProgress, 0)
-	var newTask TaskProgress
-
-	for rows.Next() {
-		err = rows.Scan(&taskId, &progress)
-		if err != nil {
-			fmt.Println("Database error during iterating tasks")
-			return nil, err
-		}
-		newTask.TaskId = taskId
-		newTask.Progress = progress
-		tasks = append(tasks, newTask)
+	if strings.Contains(dsn, "?") {
+		return dsn + "&parseTime=true"
 	}
-	return tasks, nil
+	return dsn + "?parseTime=true"
 }
 
-//Get progress from database for the specified user
-//Returns all courses with tasks and progress, and the error
-func getUserProgress(userId string) ([]ProgressItem, error) {
-	stmt, err := connection.Prepare("select course_id, task_id, progress from COURSEPROGRESS where user_id =?")
+//Sends a GET request to the URL, cancelled with the context
+func httpGet(ctx context.Context, URL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, URL, nil)
 	if err != nil {
-		fmt.Println("Eroare la select: ", err)
 		return nil, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(userId)
-
-	items := make([]ProgressItem, 0)
-	for rows.Next() {
-		var item ProgressItem
-		if err := rows.Scan(&item.CourseId, &item.TaskId, &item.Progress); err != nil {
-			return nil, err
-		}
-		items = append(items, item)
-	}
-	if len(items) == 0 {
-		return nil, nil
-	}
-	return items, nil
+	return http.DefaultClient.Do(req.WithContext(ctx))
 }
 
 //Get the course-service URL for the specified course from course-manager-service
 //Returns the URL and nil on success or empty string and nil
-func getCourseURL(course string) (string, error) {
+func getCourseURL(ctx context.Context, course string) (string, error) {
 	var courseInfo CourseInfo
-	resp, err := http.Get(config.CourseManagerServiceUrl + "/courses/" + course)
+	resp, err := httpGet(ctx, config.CourseManagerServiceUrl+"/courses/"+course)
 	if err != nil {
 		fmt.Println("Server error: Request to course-manager-service failed. Can not get course URL " + err.Error())
 		return "", err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		fmt.Println("Course-manager-service returned error code ", resp.StatusCode)
 		return "", err
@@ -225,14 +153,15 @@ func getCourseURL(course string) (string, error) {
 
 //Get all course-services URLs from course-manager-service
 //Returns a map of course ids and URLs and nil on success or empty map and nil
-func getAllCoursesURL() (map[string]string, error) {
+func getAllCoursesURL(ctx context.Context) (map[string]string, error) {
 	var coursesInfo []CourseInfo
 	URLs := make(map[string]string)
-	resp, err := http.Get(config.CourseManagerServiceUrl + "/courses")
+	resp, err := httpGet(ctx, config.CourseManagerServiceUrl+"/courses")
 	if err != nil {
 		fmt.Println("Server error: Request to course-manager-service failed. Can not get all course's URLs" + config.CourseManagerServiceUrl)
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		fmt.Println("Course-manager-service returned error code ", resp.StatusCode)
 		return nil, err
@@ -255,26 +184,16 @@ func getAllCoursesURL() (map[string]string, error) {
 	return URLs, nil
 }
 
-//Get all tasks from the course at the specified URL
-//Returns a slice of tasks and nil on success or empty slice and error
-func getCourseTasks(URL string) ([]string, error) {
-	type BaseTaskInfo struct {
-		Id    string `json:"id"`
-		Title string `json:"title"`
-	}
-
-	type TaskGroup struct {
-		Title string          `json:"title"`
-		Tasks []*BaseTaskInfo `json:"tasks"`
-	}
-
-	var taskGroup []TaskGroup
-	tasks := make([]string, 0)
-	resp, err := http.Get(URL + "/tasks")
+//Get the task groups of the course at the specified URL
+//Returns a slice of task groups and nil on success or nil and error
+func getCourseTaskGroups(ctx context.Context, URL string) ([]TaskGroup, error) {
+	var taskGroups []TaskGroup
+	resp, err := httpGet(ctx, URL+"/tasks")
 	if err != nil {
 		fmt.Println("Server error: Request to course-service failed. Can not retrieve tasks from " + URL + "/tasks")
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		fmt.Println("Course-service returned error code ", resp.StatusCode)
 		return nil, err
@@ -285,18 +204,33 @@ func getCourseTasks(URL string) ([]string, error) {
 		fmt.Println("Failed to read body response")
 		return nil, err
 	}
-	err = json.Unmarshal(body, &taskGroup)
+	err = json.Unmarshal(body, &taskGroups)
 	if err != nil {
 		fmt.Println("Failed to unmarshal body resoponse")
 		return nil, err
 	}
+	return taskGroups, nil
+}
+
+//Get all tasks from the course at the specified URL
+//Returns a slice of tasks and nil on success or empty slice and error
+func getCourseTasks(ctx context.Context, URL string) ([]string, error) {
+	taskGroups, err := getCourseTaskGroups(ctx, URL)
+	if err != nil {
+		return nil, err
+	}
+	return taskIds(taskGroups), nil
+}
 
-	for _, taskGroup := range taskGroup {
+//Returns the ids of the tasks of the given groups, in order
+func taskIds(taskGroups []TaskGroup) []string {
+	tasks := make([]string, 0)
+	for _, taskGroup := range taskGroups {
 		for _, taskInfo := range taskGroup.Tasks {
 			tasks = append(tasks, taskInfo.Id)
 		}
 	}
-	return tasks, nil
+	return tasks
 }
 
 //Get all available tasks with progress from the given list of available tasks and the task progress stored on database
@@ -310,9 +244,7 @@ func getAllTasks(courseTasks []string, seenTasks []TaskProgress) []TaskProgress
 		for _, seenTask := range seenTasks {
 			if courseTask == seenTask.TaskId {
 				seen = true
-				task.TaskId = seenTask.TaskId
-				task.Progress = seenTask.Progress
-				allTasks = append(allTasks, task)
+				allTasks = append(allTasks, seenTask)
 			}
 		}
 		if !seen {
@@ -324,344 +256,139 @@ func getAllTasks(courseTasks []string, seenTasks []TaskProgress) []TaskProgress
 	return allTasks
 }
 
-//Get all available tasks with progress from the given list of available tasks and the task progress stored on database
-//If the task isn't found in the second list, the default value of progress will be 'not started' and the default value of course will be the specified courseId
-//Returns a list of ProgressItem
-func getAllUserTasks(courseTasks []string, seenItems []ProgressItem, courseId string) []ProgressItem {
-	progressItems := make([]ProgressItem, 0)
-	var item ProgressItem
-	for _, courseTask := range courseTasks {
-		var seen = false
-		for _, seenItem := range seenItems {
-			if courseTask == seenItem.TaskId {
-				seen = true
-				item.CourseId = seenItem.CourseId
-				item.TaskId = seenItem.TaskId
-				item.Progress = seenItem.Progress
-				progressItems = append(progressItems, item)
-			}
-		}
-		if !seen {
-			item.CourseId = courseId
-			item.TaskId = courseTask
-			item.Progress = "not started"
-			progressItems = append(progressItems, item)
-		}
+//Writes the error to the response with the status code carried by the service error, or 500 status code otherwise
+func respondError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if serviceErr, ok := err.(*serviceError); ok {
+		status = serviceErr.Status
 	}
-	return progressItems
+	log.Println(err.Error())
+	http.Error(w, err.Error(), status)
 }
 
-//Handles the get method on /progress/:user/:course
-//It get the available tasks from the course-service and the progress stored on database
-//Returns 200 status code and the course progress on success or the error cause with the proper error code
-func HandleUserCourseGet(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
-	err := connection.Ping()
+//Writes the value as JSON to the response with 200 status code
+func respondJSON(w http.ResponseWriter, value interface{}) {
+	message, err := json.Marshal(value)
 	if err != nil {
-		errorMessage := "Database error: unable to connect. \nCause: " + err.Error()
+		errorMessage := "JSON error: failed to marshall progress. \nCause: " + err.Error()
 		log.Println(errorMessage)
 		http.Error(w, errorMessage, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(message)
+}
 
-	var URL string
-	URL, err = getCourseURL(ps.ByName("course"))
+//Handles the get method on /progress/:user/:course
+//It get the available tasks from the course-service and the progress stored on database
+//Returns 200 status code and the course progress on success or the error cause with the proper error code
+func HandleUserCourseGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query, err := parseProgressQuery(r, false)
 	if err != nil {
-		errorMessage := "Server error: Request to course-manager-service failed. Can not get course URL. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
-
-	var courseTasks []string
-	courseTasks, err = getCourseTasks(URL)
+	_, page, err := listCourseTasks(r.Context(), ps.ByName("user"), ps.ByName("course"), query)
 	if err != nil {
-		errorMessage := "Server error: Request to course-service failed. Can not retrieve tasks. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
 
-	if len(courseTasks) != 0 {
-		var courseProgress CourseProgress
-		courseProgress.CourseId = ps.ByName("course")
-		courseProgress.Tasks, err = getCourseProgress(ps.ByName("user"), ps.ByName("course"))
-		if err != nil {
-			errorMessage := "Database error: can not get course progress. \nCause: " + err.Error()
-			log.Println(errorMessage)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			return
-		}
-
-		if len(courseProgress.Tasks) != 0 {
-			var allTasks = getAllTasks(courseTasks, courseProgress.Tasks)
-			message, err := json.Marshal(allTasks)
-			if err != nil {
-				errorMessage := "JSON error: failed to marshall progress. \nCause: " + err.Error()
-				log.Println(errorMessage)
-				http.Error(w, errorMessage, http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(message)
-		} else {
-			allTasks := make([]TaskProgress, 0)
-			for _, task := range courseTasks {
-				var taskProgress TaskProgress
-				taskProgress.TaskId = task
-				taskProgress.Progress = "not started"
-				allTasks = append(allTasks, taskProgress)
-			}
-			message, err := json.Marshal(allTasks)
-			if err != nil {
-				errorMessage := "JSON error: failed to marshall progress. \nCause: " + err.Error()
-				log.Println(errorMessage)
-				http.Error(w, errorMessage, http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(message)
-		}
-	} else {
-		errorMessage := "User or course not found. Course service at " + URL + " return no tasks"
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusNotFound)
+	if notModified(w, r, page.etag(r)) {
 		return
 	}
+	allTasks := make([]TaskProgress, 0)
+	for _, item := range page.Items {
+		allTasks = append(allTasks, item.Task)
+	}
+	setPaginationHeaders(w, r, page)
+	respondJSON(w, allTasks)
 }
 
 //Handles the get method on /progress/:user/:course/:task
 //It get the available tasks from the course-service and the progress stored on database
 //Returns 200 status code and the task progress on success or the error cause with the proper error code
-func HandleUserCourseTaskGet(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
-	err := connection.Ping()
-	if err != nil {
-		errorMessage := "Database error: unable to connect. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-	}
-
-	var URL string
-	URL, err = getCourseURL(ps.ByName("course"))
-	if err != nil {
-		errorMessage := "Server error: Request to course-manager-service failed. Can not get course URL. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		return
-	}
-
-	var courseTasks []string
-	courseTasks, err = getCourseTasks(URL)
+func HandleUserCourseTaskGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	course, task, err := loadTaskState(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"))
 	if err != nil {
-		errorMessage := "Server error: Request to course-service failed. Can not retrieve tasks. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
-
-	if len(courseTasks) != 0 {
-		var taskFound = false
-		for _, taskId := range courseTasks {
-			if taskId == ps.ByName("task") {
-				taskFound = true
-			}
-		}
-		if taskFound {
-			taskProgress, err := getTaskProgress(ps.ByName("user"), ps.ByName("course"), ps.ByName("task"))
-			if err != nil {
-				errorMessage := "Database error: can not get task's progress. \nCause: " + err.Error()
-				log.Println(errorMessage)
-				http.Error(w, errorMessage, http.StatusInternalServerError)
-				return
-			}
-			if taskProgress.TaskId != "" {
-				message, err := json.Marshal(taskProgress)
-				if err != nil {
-					errorMessage := "JSON error: failed to marshall progress. \nCause: " + err.Error()
-					log.Println(errorMessage)
-					http.Error(w, errorMessage, http.StatusInternalServerError)
-					return
-				}
-				w.Header().Set("Content-Type", "application/json")
-				w.Write(message)
-			} else {
-				var task TaskProgress
-				task.TaskId = ps.ByName("task")
-				task.Progress = "not started"
-				message, err := json.Marshal(task)
-				if err != nil {
-					errorMessage := "JSON error: failed to marshall progress. \nCause: " + err.Error()
-					log.Println(errorMessage)
-					http.Error(w, errorMessage, http.StatusInternalServerError)
-					return
-				}
-				w.Header().Set("Content-Type", "application/json")
-				w.Write(message)
-			}
-		} else {
-			errorMessage := "Task + " + ps.ByName("task") + " not found"
-			log.Println(errorMessage)
-			http.Error(w, errorMessage, http.StatusNotFound)
-			return
-		}
-	} else {
-		errorMessage := "User or course not found. Course service at " + URL + " return no tasks"
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusNotFound)
+	if notModified(w, r, taskETag(course, *task)) {
 		return
 	}
+	respondJSON(w, task)
 }
 
 //Handles the put method on /progress/:user/:course/:task
 //It updates or insert the progress of the given user, course and task
 //Returns 200 status code and the course progress on success or the error cause with the proper error code
 func HandleUserCourseTaskPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	err := connection.Ping()
-	if err != nil {
-		errorMessage := "Database error: unable to connect. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		return
-	}
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		errorMessage := "Failed to read HTTP body. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusBadRequest)
-		return
-	}
-
-	var courseProgress CourseProgressInfo
-	type ProgressInfo struct {
-		Progress string `json:"progress"`
-	}
-	var progress ProgressInfo
-	err = json.Unmarshal(body, &progress)
+	progress, err := readProgressUpdate(r)
 	if err != nil {
-		errorMessage := "Failed to unmarshal request. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		return
-	}
-
-	if progress.Progress != "started" && progress.Progress != "completed" {
-		errorMessage := "Invalid progress type. Valid types: 'started','completed'"
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusUnprocessableEntity)
+		respondError(w, err)
 		return
 	}
 
-	courseProgress.UserId = ps.ByName("user")
-	courseProgress.CourseId = ps.ByName("course")
-	courseProgress.TaskId = ps.ByName("task")
-	courseProgress.Progress = progress.Progress
-
-	taskExist, err := getTaskProgress(courseProgress.UserId, courseProgress.CourseId, courseProgress.TaskId)
+	_, err = setTaskProgress(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"), progress, r.Header.Get("If-Match"))
 	if err != nil {
-		errorMessage := "Database error. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
+}
 
-	if taskExist.Progress != "" {
-		err = updateTaskProgress(courseProgress)
-	} else {
-		err = addTaskProgress(courseProgress)
-	}
-
+//Handles the delete method on /progress/:user/:course/:task
+//It deletes the progress of the given user, course and task, which is reported as 'not started' again
+//Returns 204 status code on success or the error cause with the proper error code
+func HandleUserCourseTaskDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, err := resetTaskProgress(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"), r.Header.Get("If-Match"))
 	if err != nil {
-		errorMessage := "Failed to update task progress. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 //Handles the get method on /progress/:user
-//It get the available courses from the course-service and the progress stored on database
+//It get the courses the user is enrolled in, or every available course with scope=catalog, from the course-service and the progress stored on database
 //Returns 200 status code and the user progress on success or the error cause with the proper error code
-func HandleUserGet(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
-	err := connection.Ping()
-	if err != nil {
-		errorMessage := "Database error: unable to connect. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		return
+func HandleUserGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query, err := parseProgressQuery(r, false)
+	if err == nil {
+		query.Filter, err = scopeFilter(r, ps.ByName("user"), query.Filter)
 	}
-
-	var URLs map[string]string
-	URLs, err = getAllCoursesURL()
 	if err != nil {
-		errorMessage := "Server error: Request to course-manager-service failed. Can not retrieve all courses's URLs. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
-		return
-	} else if URLs == nil {
-		errorMessage := "No URLs found. Course-manager-service returns no URL"
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusNotFound)
+		respondError(w, err)
 		return
 	}
-
-	userProgress, err := getUserProgress(ps.ByName("user"))
+	page, err := listUserTasks(r.Context(), ps.ByName("user"), query)
 	if err != nil {
-		errorMessage := "Error accessing the database. \nCause: " + err.Error()
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusInternalServerError)
+		respondError(w, err)
 		return
 	}
 
-	var emptyResponse = true
-	allProgressItems := make([]ProgressItem, 0)
-
-	for courseId, URL := range URLs {
-		var courseTasks []string
-		courseTasks, err = getCourseTasks(URL)
-		if err != nil {
-			errorMessage := "Server error: Request to course-service failed. Can not retrieve tasks. \nCause: " + err.Error()
-			log.Println(errorMessage)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			return
-		}
-
-		if courseTasks != nil {
-			emptyResponse = false
-			progressItems := getAllUserTasks(courseTasks, userProgress, courseId)
-			if progressItems != nil {
-				allProgressItems = append(allProgressItems, progressItems...)
-			}
-		}
-	}
-	if emptyResponse {
-		errorMessage := "No courses information found. No progress found"
-		log.Println(errorMessage)
-		http.Error(w, errorMessage, http.StatusNotFound)
+	if notModified(w, r, page.etag(r)) {
 		return
 	}
-	if allProgressItems != nil {
-		message, err := json.Marshal(allProgressItems)
-		if err != nil {
-			errorMessage := "JSON error: failed to marshall progress" + err.Error()
-			log.Println(errorMessage)
-			http.Error(w, errorMessage, http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(message)
+	allProgressItems := make([]ProgressItem, 0)
+	for _, item := range page.Items {
+		allProgressItems = append(allProgressItems, ProgressItem{CourseId: item.CourseId, TaskId: item.Task.TaskId, Progress: item.Task.Progress, Status: item.Task.Status})
 	}
+	setPaginationHeaders(w, r, page)
+	respondJSON(w, allProgressItems)
 }
 
 //Checks if the service at the given URL is UP
 //Returns true if the service is UP or false otherwise
-func checkHealth(w http.ResponseWriter, url string) bool {
-	resp, err := http.Get(url)
+func checkHealth(ctx context.Context, w http.ResponseWriter, url string) bool {
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		errorMessage := "Failed to communicate with: " + url + "\nCause: " + err.Error()
 		log.Println(errorMessage)
 		http.Error(w, errorMessage, http.StatusInternalServerError)
 		return false
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		errorMessage := "Failed to read response from: " + url + "\nCause: " + err.Error()
@@ -680,17 +407,17 @@ func checkHealth(w http.ResponseWriter, url string) bool {
 
 //Handle the get and head method on /health
 //Verify the connection with the database and the status of dependent services
-func HandleHealthCheck(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	if err := connection.Ping(); err != nil {
+func HandleHealthCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := store.ping(r.Context()); err != nil {
 		errorMessage := "Database connection failed: " + err.Error()
 		log.Println(errorMessage)
 		http.Error(w, errorMessage, http.StatusInternalServerError)
 		return
 	}
-	if success := checkHealth(w, config.CourseManagerServiceUrl+"/health"); !success {
+	if success := checkHealth(r.Context(), w, config.CourseManagerServiceUrl+"/health"); !success {
 		return
 	}
-	URLs, err := getAllCoursesURL()
+	URLs, err := getAllCoursesURL(r.Context())
 	if err != nil {
 		errorMessage := "Failed to get course services from course-manager-service \nCause: " + err.Error()
 		log.Println(errorMessage)
@@ -698,7 +425,7 @@ func HandleHealthCheck(w http.ResponseWriter, _ *http.Request, _ httprouter.Para
 		return
 	}
 	for _, URL := range URLs {
-		if success := checkHealth(w, URL+"/health"); !success {
+		if success := checkHealth(r.Context(), w, URL+"/health"); !success {
 			return
 		}
 	}
@@ -706,14 +433,12 @@ func HandleHealthCheck(w http.ResponseWriter, _ *http.Request, _ httprouter.Para
 
 func main() {
 	initConfig()
-	initConnection()
-	defer connection.Close()
-	router := httprouter.New()
-	router.GET("/progress/:user", HandleUserGet)
-	router.GET("/progress/:user/:course", HandleUserCourseGet)
-	router.GET("/progress/:user/:course/:task", HandleUserCourseTaskGet)
-	router.PUT("/progress/:user/:course/:task", HandleUserCourseTaskPut)
-	router.GET("/health", HandleHealthCheck)
-	router.HEAD("/health", HandleHealthCheck)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(config.Port), router))
+	initPrerequisites()
+	initXapi()
+	initLti()
+	initActivity()
+	initLeaderboards()
+	initEnrollments()
+	initCertificates()
+	runCommand(os.Args[1:])
 }
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+//Change of the progress of a user on a task, as committed by a write
+//Previous is nil if there was no stored progress, Current is nil if the progress was reset
+//Learner is true if the write was made by the user, not by an admin or a bulk job
+type ProgressChange struct {
+	UserId   string
+	CourseId string
+	TaskId   string
+	Previous *TaskProgress
+	Current  *TaskProgress
+	Learner  bool
+}
+
+//Stored progress of a user on a task, as exported and imported
+type ProgressRecord struct {
+	UserId    string     `json:"userId"`
+	CourseId  string     `json:"courseId"`
+	TaskId    string     `json:"taskId"`
+	Progress  string     `json:"progress"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	Version   int        `json:"version,omitempty"`
+}
+
+//Returns the time of the change, the update time of the current progress
+//Returns nil for a reset, which is timestamped by the database
+func (c *ProgressChange) changedAt() interface{} {
+	if c.Current != nil && c.Current.UpdatedAt != nil {
+		return *c.Current.UpdatedAt
+	}
+	return nil
+}
+
+//Returns true if the change is a transition of the progress made by the user, the activity of the user
+//Resets and writes of the same progress aren't transitions
+func (c *ProgressChange) learnerTransition() bool {
+	return c.Learner && c.Current != nil && (c.Previous == nil || c.Previous.Progress != c.Current.Progress)
+}
+
+//Functions called inside the transaction of every progress write, after the history is recorded
+//An error returned by a hook rolls back the write
+var progressWriteHooks []func(ctx context.Context, tx *sql.Tx, change *ProgressChange) error
+
+//Registers a function to be called inside the transaction of every progress write
+func onProgressWrite(hook func(ctx context.Context, tx *sql.Tx, change *ProgressChange) error) {
+	progressWriteHooks = append(progressWriteHooks, hook)
+}
+
+//Returned when the stored version isn't the expected one
+var errVersionMismatch = errors.New("stored progress version doesn't match the expected version")
+
+//Returned when the row was inserted by a concurrent transaction after it was read
+var errConcurrentInsert = errors.New("progress was inserted concurrently")
+
+const maxWriteAttempts = 3
+
+//Progress store with the statements of the requests and the write hooks prepared once, on startup
+//The queries of the admin endpoints and the background jobs run unprepared, so they aren't kept prepared on every connection of the pool
+type ProgressStore struct {
+	db      *sql.DB
+	dialect *sqlDialect
+
+	selectTask          *sql.Stmt
+	selectTaskForUpdate *sql.Stmt
+	selectCourse        *sql.Stmt
+	selectUser          *sql.Stmt
+	upsertTask          *sql.Stmt
+	deleteTask          *sql.Stmt
+	insertHistory       *sql.Stmt
+
+	insertEvent           *sql.Stmt
+	selectUserEventsUntil *sql.Stmt
+	selectTaskEvents      storeQuery
+	selectLastScore       storeQuery
+	insertProjected       *sql.Stmt
+	selectAll             storeQuery
+	insertArchive         *sql.Stmt
+
+	selectTaskRowsForUpdate storeQuery
+	moveHistory             storeQuery
+	copyHistory             storeQuery
+	deleteHistory           storeQuery
+
+	importTask   *sql.Stmt
+	selectImport storeQuery
+	insertImport storeQuery
+	updateImport storeQuery
+
+	insertOutbox *sql.Stmt
+	selectOutbox storeQuery
+	deleteOutbox storeQuery
+	failOutbox   storeQuery
+
+	selectLineItem  *sql.Stmt
+	selectLineItems storeQuery
+	insertLineItem  storeQuery
+	deleteLineItem  storeQuery
+	insertLtiScore  *sql.Stmt
+	selectLtiScores storeQuery
+	deleteLtiScore  storeQuery
+	retryLtiScore   storeQuery
+
+	selectScorm          *sql.Stmt
+	selectScormForUpdate *sql.Stmt
+	insertScorm          *sql.Stmt
+	updateScorm          *sql.Stmt
+
+	selectCertificate       *sql.Stmt
+	selectCertificateByHash *sql.Stmt
+	insertCertificate       *sql.Stmt
+	insertCertificateQueue  *sql.Stmt
+	selectCertificateQueue  storeQuery
+	deleteCertificateQueue  storeQuery
+	failCertificateQueue    storeQuery
+
+	selectDeadlines         storeQuery
+	selectDueDeadlines      storeQuery
+	selectDeadlineForUpdate storeQuery
+	insertDeadline          storeQuery
+	deleteDeadline          storeQuery
+	markDeadlineNotified    storeQuery
+	selectCourseRows        storeQuery
+	selectCourseLearners    storeQuery
+	selectUserCompletions   *sql.Stmt
+	selectCourseCompletions *sql.Stmt
+
+	selectStreak          *sql.Stmt
+	selectStreakForUpdate *sql.Stmt
+	insertStreak          *sql.Stmt
+	updateStreak          *sql.Stmt
+	selectActivity        *sql.Stmt
+	selectActivityDays    *sql.Stmt
+	insertActivity        *sql.Stmt
+	updateActivity        *sql.Stmt
+	deleteActivity        storeQuery
+	selectUserTransitions *sql.Stmt
+	selectHistoryUsers    storeQuery
+
+	selectLeaderboardTotals      *sql.Stmt
+	selectLeaderboardScoreTotal  *sql.Stmt
+	insertLeaderboardScore       *sql.Stmt
+	deleteLeaderboardScore       *sql.Stmt
+	insertLeaderboardEntry       *sql.Stmt
+	deleteLeaderboardEntry       *sql.Stmt
+	selectLeaderboardSettings    *sql.Stmt
+	selectAllLeaderboardSettings storeQuery
+	insertLeaderboardSettings    storeQuery
+	deleteLeaderboardSettings    storeQuery
+	insertLeaderboardOptOut      storeQuery
+	deleteLeaderboardOptOut      storeQuery
+
+	selectCohort           storeQuery
+	selectCohortForUpdate  storeQuery
+	selectCohorts          storeQuery
+	insertCohort           storeQuery
+	deleteCohort           storeQuery
+	selectCohortMembers    storeQuery
+	selectAllCohortMembers storeQuery
+	insertCohortMember     storeQuery
+	deleteCohortMember     storeQuery
+	deleteCohortMembers    storeQuery
+	selectCohortCourses    storeQuery
+	selectAllCohortCourses storeQuery
+	insertCohortCourse     storeQuery
+	deleteCohortCourse     storeQuery
+	deleteCohortCourses    storeQuery
+
+	selectEnrollment  *sql.Stmt
+	selectEnrollments *sql.Stmt
+	insertEnrollment  *sql.Stmt
+	deleteEnrollment  *sql.Stmt
+
+	prepared []*sql.Stmt
+}
+
+var store *ProgressStore
+
+//Runs the queries of the store, the database or a transaction
+type queryRunner interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+//Query of the store run without a prepared statement
+type storeQuery struct {
+	runner queryRunner
+	text   string
+}
+
+//Returns the query run in the transaction
+func (q storeQuery) in(tx *sql.Tx) storeQuery {
+	return storeQuery{runner: tx, text: q.text}
+}
+
+func (q storeQuery) QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	return q.runner.QueryContext(ctx, q.text, args...)
+}
+
+func (q storeQuery) QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row {
+	return q.runner.QueryRowContext(ctx, q.text, args...)
+}
+
+func (q storeQuery) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	return q.runner.ExecContext(ctx, q.text, args...)
+}
+
+//Prepares the statements of the progress store in the SQL dialect of the database
+//Returns the store or the error of the first statement that failed to prepare
+func newProgressStore(db *sql.DB, dialect *sqlDialect) (*ProgressStore, error) {
+	s := &ProgressStore{db: db, dialect: dialect}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.selectTask, "select progress, created_at, updated_at, version from COURSEPROGRESS where user_id = ? and course_id = ? and task_id = ?"},
+		{&s.selectTaskForUpdate, "select progress, created_at, updated_at, version from COURSEPROGRESS where user_id = ? and course_id = ? and task_id = ? FOR UPDATE"},
+		{&s.selectCourse, "select task_id, progress, created_at, updated_at, version from COURSEPROGRESS where user_id = ? and course_id = ?"},
+		{&s.selectUser, dialect.selectUser},
+		{&s.upsertTask, dialect.upsertTask},
+		{&s.deleteTask, "DELETE FROM COURSEPROGRESS where user_id = ? and course_id = ? and task_id = ?"},
+		{&s.insertHistory, "INSERT INTO COURSEPROGRESS_HISTORY(user_id,course_id,task_id,previous_progress,progress,version,changed_at,learner_transition)" +
+			" values (?,?,?,?,?,?,COALESCE(?, CURRENT_TIMESTAMP),?)"},
+		{&s.insertEvent, "INSERT INTO COURSEPROGRESS_EVENTS(event_type,user_id,course_id,task_id,progress,score,version,occurred_at)" +
+			" values (?,?,?,?,?,?,?,COALESCE(?, CURRENT_TIMESTAMP))"},
+		{&s.selectUserEventsUntil, "select id, event_type, user_id, course_id, task_id, progress, score, version, occurred_at from COURSEPROGRESS_EVENTS" +
+			" where user_id = ? and occurred_at <= ? order by id"},
+		{&s.insertArchive, "INSERT INTO COURSEPROGRESS_ARCHIVE(user_id,course_id,task_id,progress,created_at,updated_at,version,reason,archived_at)" +
+			" values (?,?,?,?,?,?,?,?,CURRENT_TIMESTAMP)"},
+		{&s.importTask, dialect.importTask},
+		{&s.insertOutbox, "INSERT INTO COURSEPROGRESS_XAPI_OUTBOX(statement_id,statement,attempts,created_at) values (?,?,0,CURRENT_TIMESTAMP)"},
+		{&s.selectLineItem, "select context_id, line_item_url, score_maximum from COURSEPROGRESS_LTI_LINE_ITEMS where course_id = ? and task_id = ?"},
+		{&s.insertLtiScore, "INSERT INTO COURSEPROGRESS_LTI_SCORES(line_item_url,score,attempts,next_attempt_at,created_at) values (?,?,0,?,CURRENT_TIMESTAMP)"},
+		{&s.selectScorm, "select scorm_version, elements, score from COURSEPROGRESS_SCORM where user_id = ? and course_id = ? and task_id = ?"},
+		{&s.selectScormForUpdate, "select scorm_version, elements, score from COURSEPROGRESS_SCORM where user_id = ? and course_id = ? and task_id = ? FOR UPDATE"},
+		{&s.insertScorm, "INSERT INTO COURSEPROGRESS_SCORM(user_id,course_id,task_id,scorm_version,elements,score,updated_at) values (?,?,?,?,?,?,CURRENT_TIMESTAMP)"},
+		{&s.updateScorm, "UPDATE COURSEPROGRESS_SCORM set scorm_version =?, elements =?, score =?, updated_at =CURRENT_TIMESTAMP where user_id = ? and course_id = ? and task_id = ?"},
+		{&s.selectCertificate, "select id, user_id, course_id, completed_at, tasks_hash, issued_at, key_id, signature from COURSEPROGRESS_CERTIFICATES where id = ?"},
+		{&s.selectCertificateByHash, "select id, user_id, course_id, completed_at, tasks_hash, issued_at, key_id, signature from COURSEPROGRESS_CERTIFICATES where user_id = ? and course_id = ? and tasks_hash = ?"},
+		{&s.insertCertificate, "INSERT INTO COURSEPROGRESS_CERTIFICATES(id,user_id,course_id,completed_at,tasks_hash,issued_at,key_id,signature) values (?,?,?,?,?,?,?,?)"},
+		{&s.insertCertificateQueue, "INSERT INTO COURSEPROGRESS_CERTIFICATE_QUEUE(user_id,course_id,attempts,queued_at) values (?,?,0,CURRENT_TIMESTAMP)"},
+		{&s.selectUserCompletions, "select e.user_id, e.course_id, e.task_id, MIN(e.occurred_at) from COURSEPROGRESS_EVENTS e where e.user_id = ?" + sinceLastStart},
+		{&s.selectCourseCompletions, "select e.user_id, e.course_id, e.task_id, MIN(e.occurred_at) from COURSEPROGRESS_EVENTS e where e.course_id = ?" + sinceLastStart},
+		{&s.selectStreak, "select timezone, last_day, current_streak, longest_streak from COURSEPROGRESS_STREAKS where user_id = ?"},
+		{&s.selectStreakForUpdate, "select timezone, last_day, current_streak, longest_streak from COURSEPROGRESS_STREAKS where user_id = ? FOR UPDATE"},
+		{&s.insertStreak, "INSERT INTO COURSEPROGRESS_STREAKS(user_id,timezone,last_day,current_streak,longest_streak) values (?,?,?,?,?)"},
+		{&s.updateStreak, "UPDATE COURSEPROGRESS_STREAKS set timezone =?, last_day =?, current_streak =?, longest_streak =? where user_id = ?"},
+		{&s.selectActivity, "select day, transitions from COURSEPROGRESS_ACTIVITY where user_id = ? and day >= ? and day <= ? order by day"},
+		{&s.selectActivityDays, "select day from COURSEPROGRESS_ACTIVITY where user_id = ? order by day"},
+		{&s.insertActivity, "INSERT INTO COURSEPROGRESS_ACTIVITY(user_id,day,transitions) values (?,?,?)"},
+		{&s.updateActivity, "UPDATE COURSEPROGRESS_ACTIVITY set transitions =transitions+? where user_id = ? and day = ?"},
+		{&s.selectUserTransitions, "select changed_at from COURSEPROGRESS_HISTORY where user_id = ? and learner_transition = ?"},
+		{&s.selectLeaderboardTotals, "select count(*), SUM(CASE WHEN progress = 'completed' THEN 1 ELSE 0 END), MIN(created_at)," +
+			" MAX(CASE WHEN progress = 'completed' THEN updated_at END) from COURSEPROGRESS where user_id = ? and course_id = ?"},
+		{&s.selectLeaderboardScoreTotal, "select count(*), SUM(score) from COURSEPROGRESS_LEADERBOARD_SCORES where course_id = ? and user_id = ?"},
+		{&s.insertLeaderboardScore, "INSERT INTO COURSEPROGRESS_LEADERBOARD_SCORES(course_id,user_id,task_id,score) values (?,?,?,?)"},
+		{&s.deleteLeaderboardScore, "DELETE FROM COURSEPROGRESS_LEADERBOARD_SCORES where course_id = ? and user_id = ? and task_id = ?"},
+		{&s.insertLeaderboardEntry, "INSERT INTO COURSEPROGRESS_LEADERBOARD(course_id,user_id,completed,score,started_at,last_completed_at,completion_time) values (?,?,?,?,?,?,?)"},
+		{&s.deleteLeaderboardEntry, "DELETE FROM COURSEPROGRESS_LEADERBOARD where course_id = ? and user_id = ?"},
+		{&s.selectLeaderboardSettings, "select pseudonymize from COURSEPROGRESS_LEADERBOARDS where course_id = ?"},
+		{&s.selectEnrollment, "select source from COURSEPROGRESS_ENROLLMENTS where user_id = ? and course_id = ?"},
+		{&s.selectEnrollments, "select course_id, enrolled_at, source from COURSEPROGRESS_ENROLLMENTS where user_id = ? order by course_id"},
+		{&s.insertEnrollment, "INSERT INTO COURSEPROGRESS_ENROLLMENTS(user_id,course_id,enrolled_at,source) values (?,?,?,?)"},
+		{&s.deleteEnrollment, "DELETE FROM COURSEPROGRESS_ENROLLMENTS where user_id = ? and course_id = ?"},
+		{&s.insertProjected, "INSERT INTO COURSEPROGRESS(user_id,course_id,task_id,progress,created_at,updated_at,version) values (?,?,?,?,?,?,?)"},
+	}
+	for _, statement := range statements {
+		stmt, err := db.Prepare(dialect.rebind(statement.query))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		*statement.stmt = stmt
+		s.prepared = append(s.prepared, stmt)
+	}
+	queries := []struct {
+		query *storeQuery
+		text  string
+	}{
+		{&s.selectTaskEvents, "select id, event_type, user_id, course_id, task_id, progress, score, version, occurred_at from COURSEPROGRESS_EVENTS" +
+			" order by user_id, course_id, task_id, id"},
+		{&s.selectLastScore, "select score from COURSEPROGRESS_EVENTS where user_id = ? and course_id = ? and task_id = ? and event_type = ? order by id desc LIMIT 1"},
+		{&s.selectAll, "select user_id, course_id, task_id, progress, created_at, updated_at, version from COURSEPROGRESS order by user_id, course_id, task_id"},
+		{&s.selectTaskRowsForUpdate, "select user_id, progress, created_at, updated_at, version from COURSEPROGRESS where course_id = ? and task_id = ? order by user_id FOR UPDATE"},
+		{&s.moveHistory, "UPDATE COURSEPROGRESS_HISTORY set course_id =?, task_id =? where course_id = ? and task_id = ?"},
+		{&s.copyHistory, dialect.copyHistory},
+		{&s.deleteHistory, "DELETE FROM COURSEPROGRESS_HISTORY where course_id = ? and task_id = ?"},
+		{&s.selectImport, "select rows_committed, imported, skipped, failed from COURSEPROGRESS_IMPORTS where import_id = ?"},
+		{&s.insertImport, "INSERT INTO COURSEPROGRESS_IMPORTS(import_id,rows_committed,imported,skipped,failed,updated_at) values (?,0,0,0,0,CURRENT_TIMESTAMP)"},
+		{&s.updateImport, "UPDATE COURSEPROGRESS_IMPORTS set rows_committed =?, imported =?, skipped =?, failed =?, updated_at =CURRENT_TIMESTAMP where import_id = ?"},
+		{&s.selectCertificateQueue, "select id, user_id, course_id from COURSEPROGRESS_CERTIFICATE_QUEUE where attempts < ? order by id LIMIT ?"},
+		{&s.deleteCertificateQueue, "DELETE FROM COURSEPROGRESS_CERTIFICATE_QUEUE where id = ?"},
+		{&s.failCertificateQueue, "UPDATE COURSEPROGRESS_CERTIFICATE_QUEUE set attempts =attempts+1 where id = ?"},
+		{&s.selectOutbox, "select id, statement from COURSEPROGRESS_XAPI_OUTBOX where attempts < ? order by id LIMIT ?"},
+		{&s.deleteOutbox, "DELETE FROM COURSEPROGRESS_XAPI_OUTBOX where id = ?"},
+		{&s.failOutbox, "UPDATE COURSEPROGRESS_XAPI_OUTBOX set attempts =attempts+1 where id = ?"},
+		{&s.selectLineItems, "select course_id, task_id, context_id, line_item_url, score_maximum from COURSEPROGRESS_LTI_LINE_ITEMS order by course_id, task_id"},
+		{&s.insertLineItem, "INSERT INTO COURSEPROGRESS_LTI_LINE_ITEMS(course_id,task_id,context_id,line_item_url,score_maximum) values (?,?,?,?,?)"},
+		{&s.deleteLineItem, "DELETE FROM COURSEPROGRESS_LTI_LINE_ITEMS where course_id = ? and task_id = ?"},
+		{&s.selectLtiScores, "select id, line_item_url, score, attempts from COURSEPROGRESS_LTI_SCORES where attempts < ? and next_attempt_at <= ? order by id LIMIT ?"},
+		{&s.deleteLtiScore, "DELETE FROM COURSEPROGRESS_LTI_SCORES where id = ?"},
+		{&s.retryLtiScore, "UPDATE COURSEPROGRESS_LTI_SCORES set attempts =attempts+1, next_attempt_at =? where id = ?"},
+		{&s.selectDeadlines, "select course_id, task_id, due_at from COURSEPROGRESS_DEADLINES order by course_id, task_id"},
+		{&s.selectDueDeadlines, "select course_id, task_id, due_at from COURSEPROGRESS_DEADLINES where notified_at IS NULL and due_at <= ? order by due_at"},
+		{&s.selectDeadlineForUpdate, "select course_id from COURSEPROGRESS_DEADLINES where course_id = ? and task_id = ? and due_at = ? and notified_at IS NULL FOR UPDATE"},
+		{&s.insertDeadline, "INSERT INTO COURSEPROGRESS_DEADLINES(course_id,task_id,due_at) values (?,?,?)"},
+		{&s.deleteDeadline, "DELETE FROM COURSEPROGRESS_DEADLINES where course_id = ? and task_id = ?"},
+		{&s.markDeadlineNotified, "UPDATE COURSEPROGRESS_DEADLINES set notified_at =CURRENT_TIMESTAMP where course_id = ? and task_id = ? and due_at = ?"},
+		{&s.selectCourseRows, "select user_id, task_id, progress, created_at, updated_at, version from COURSEPROGRESS where course_id = ?"},
+		{&s.selectCourseLearners, "select user_id from COURSEPROGRESS_ENROLLMENTS where course_id = ? UNION select m.user_id from COURSEPROGRESS_COHORT_MEMBERS m" +
+			" join COURSEPROGRESS_COHORT_COURSES c on c.cohort_id = m.cohort_id where c.course_id = ?"},
+		{&s.deleteActivity, "DELETE FROM COURSEPROGRESS_ACTIVITY where user_id = ?"},
+		{&s.selectHistoryUsers, "select distinct user_id from COURSEPROGRESS_HISTORY order by user_id"},
+		{&s.selectAllLeaderboardSettings, "select course_id, pseudonymize from COURSEPROGRESS_LEADERBOARDS order by course_id"},
+		{&s.insertLeaderboardSettings, "INSERT INTO COURSEPROGRESS_LEADERBOARDS(course_id,pseudonymize) values (?,?)"},
+		{&s.deleteLeaderboardSettings, "DELETE FROM COURSEPROGRESS_LEADERBOARDS where course_id = ?"},
+		{&s.insertLeaderboardOptOut, "INSERT INTO COURSEPROGRESS_LEADERBOARD_OPT_OUTS(course_id,user_id) values (?,?)"},
+		{&s.deleteLeaderboardOptOut, "DELETE FROM COURSEPROGRESS_LEADERBOARD_OPT_OUTS where course_id = ? and user_id = ?"},
+		{&s.selectCohort, "select name, created_at from COURSEPROGRESS_COHORTS where id = ?"},
+		{&s.selectCohortForUpdate, "select name from COURSEPROGRESS_COHORTS where id = ? FOR UPDATE"},
+		{&s.selectCohorts, "select id, name, created_at from COURSEPROGRESS_COHORTS order by name, id"},
+		{&s.insertCohort, "INSERT INTO COURSEPROGRESS_COHORTS(id,name,created_at) values (?,?,?)"},
+		{&s.deleteCohort, "DELETE FROM COURSEPROGRESS_COHORTS where id = ?"},
+		{&s.selectCohortMembers, "select cohort_id, user_id from COURSEPROGRESS_COHORT_MEMBERS where cohort_id = ? order by user_id"},
+		{&s.selectAllCohortMembers, "select cohort_id, user_id from COURSEPROGRESS_COHORT_MEMBERS order by cohort_id, user_id"},
+		{&s.insertCohortMember, "INSERT INTO COURSEPROGRESS_COHORT_MEMBERS(cohort_id,user_id) values (?,?)"},
+		{&s.deleteCohortMember, "DELETE FROM COURSEPROGRESS_COHORT_MEMBERS where cohort_id = ? and user_id = ?"},
+		{&s.deleteCohortMembers, "DELETE FROM COURSEPROGRESS_COHORT_MEMBERS where cohort_id = ?"},
+		{&s.selectCohortCourses, "select cohort_id, course_id from COURSEPROGRESS_COHORT_COURSES where cohort_id = ? order by course_id"},
+		{&s.selectAllCohortCourses, "select cohort_id, course_id from COURSEPROGRESS_COHORT_COURSES order by cohort_id, course_id"},
+		{&s.insertCohortCourse, "INSERT INTO COURSEPROGRESS_COHORT_COURSES(cohort_id,course_id) values (?,?)"},
+		{&s.deleteCohortCourse, "DELETE FROM COURSEPROGRESS_COHORT_COURSES where cohort_id = ? and course_id = ?"},
+		{&s.deleteCohortCourses, "DELETE FROM COURSEPROGRESS_COHORT_COURSES where cohort_id = ?"},
+	}
+	for _, query := range queries {
+		*query.query = storeQuery{runner: db, text: dialect.rebind(query.text)}
+	}
+	return s, nil
+}
+
+//Closes the prepared statements of the store
+func (s *ProgressStore) Close() error {
+	var firstErr error
+	for _, stmt := range s.prepared {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Returns a context derived from the given one, bounded by the configured query timeout
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, config.QueryTimeout)
+}
+
+//Checks the connection with the database
+func (s *ProgressStore) ping(ctx context.Context) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+//Get progress from database for the specified user,course and task
+//Returns the task progress and the error
+func (s *ProgressStore) getTaskProgress(ctx context.Context, userID, courseID, taskID string) (*TaskProgress, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	task, err := scanTaskProgress(s.selectTask.QueryRowContext(ctx, userID, courseID, taskID), taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task == nil {
+		return &TaskProgress{}, nil
+	}
+	return task, nil
+}
+
+//Get progress from database for the specified user and course
+//Returns all tasks with progress and the error
+func (s *ProgressStore) getCourseProgress(ctx context.Context, userId, courseId string) ([]TaskProgress, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectCourse.QueryContext(ctx, userId, courseId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := make([]TaskProgress, 0)
+	for rows.Next() {
+		var newTask TaskProgress
+		var createdAt, updatedAt time.Time
+		err = rows.Scan(&newTask.TaskId, &newTask.Progress, &createdAt, &updatedAt, &newTask.Version)
+		if err != nil {
+			return nil, err
+		}
+		newTask.CreatedAt = &createdAt
+		newTask.UpdatedAt = &updatedAt
+		tasks = append(tasks, newTask)
+	}
+	return tasks, rows.Err()
+}
+
+//Get progress from database for the specified user, matching the filter
+//If the filter has a point in time, the progress is replayed from the progress log
+//Returns all courses with tasks and progress, and the error
+func (s *ProgressStore) getUserProgress(ctx context.Context, userId string, filter ProgressFilter) ([]ProgressItem, error) {
+	progress := filter.Progress
+	if progress == "not started" {
+		progress = ""
+	}
+	if filter.At != nil {
+		return s.getUserProgressMatching(ctx, userId, filter, progress)
+	}
+	var updatedSince interface{}
+	if filter.UpdatedSince != nil {
+		updatedSince = *filter.UpdatedSince
+	}
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectUser.QueryContext(ctx, userId, filter.CourseId, filter.CourseId, progress, progress, updatedSince, updatedSince)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]ProgressItem, 0)
+	for rows.Next() {
+		var item ProgressItem
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&item.CourseId, &item.TaskId, &item.Progress, &createdAt, &updatedAt, &item.Version); err != nil {
+			return nil, err
+		}
+		item.CreatedAt = &createdAt
+		item.UpdatedAt = &updatedAt
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return items, nil
+}
+
+func (s *ProgressStore) getUserProgressMatching(ctx context.Context, userId string, filter ProgressFilter, progress string) ([]ProgressItem, error) {
+	replayed, err := s.getUserProgressAt(ctx, userId, *filter.At)
+	if err != nil {
+		return nil, err
+	}
+	var items []ProgressItem
+	for _, item := range replayed {
+		if filter.CourseId != "" && item.CourseId != filter.CourseId {
+			continue
+		}
+		if progress != "" && item.Progress != progress {
+			continue
+		}
+		if filter.UpdatedSince != nil && item.UpdatedAt.Before(*filter.UpdatedSince) {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+//Calls the function for every stored progress, ordered by user, course and task
+//The iteration isn't bounded by the query timeout and stops at the first error returned by the function
+func (s *ProgressStore) eachProgress(ctx context.Context, fn func(record ProgressRecord) error) error {
+	rows, err := s.selectAll.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record ProgressRecord
+		var createdAt, updatedAt time.Time
+		err := rows.Scan(&record.UserId, &record.CourseId, &record.TaskId, &record.Progress, &createdAt, &updatedAt, &record.Version)
+		if err != nil {
+			return err
+		}
+		record.CreatedAt = &createdAt
+		record.UpdatedAt = &updatedAt
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//Scans a task progress row
+//Returns nil if there is no row
+func scanTaskProgress(row *sql.Row, taskId string) (*TaskProgress, error) {
+	var task TaskProgress
+	var createdAt, updatedAt time.Time
+	err := row.Scan(&task.Progress, &createdAt, &updatedAt, &task.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	task.TaskId = taskId
+	task.CreatedAt = &createdAt
+	task.UpdatedAt = &updatedAt
+	return &task, nil
+}
+
+//Runs the write in a transaction, retrying it when it lost a race against a concurrent write
+//The history and the write hooks are written in the same transaction
+func (s *ProgressStore) runWrite(ctx context.Context, write func(ctx context.Context, tx *sql.Tx) (*ProgressChange, error)) (*ProgressChange, error) {
+	changes, err := s.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		change, err := write(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		return []*ProgressChange{change}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes[0], nil
+}
+
+//Runs a write of several tasks in a transaction, retrying it when it lost a race against a concurrent write
+func (s *ProgressStore) runWrites(ctx context.Context, write func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error)) ([]*ProgressChange, error) {
+	return s.retryWrites(ctx, true, true, write)
+}
+
+//Runs a bulk write in a transaction like runWrites, without bounding it by the query timeout
+func (s *ProgressStore) runBulkWrites(ctx context.Context, write func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error)) ([]*ProgressChange, error) {
+	return s.retryWrites(ctx, false, true, write)
+}
+
+//Runs a bulk write of historical progress like runBulkWrites, recording its history and progress log without running the write hooks
+//Imported progress isn't delivered to the LRS or the LTI platform, the leaderboards and the activity are rebuilt by their commands
+func (s *ProgressStore) runImportWrites(ctx context.Context, write func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error)) ([]*ProgressChange, error) {
+	return s.retryWrites(ctx, false, false, write)
+}
+
+func (s *ProgressStore) retryWrites(ctx context.Context, bounded, hooks bool, write func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error)) ([]*ProgressChange, error) {
+	for attempt := 1; ; attempt++ {
+		changes, err := s.tryWrite(ctx, bounded, hooks, write)
+		if (err == errConcurrentInsert || s.dialect.isDeadlock(err)) && attempt < maxWriteAttempts {
+			continue
+		}
+		return changes, err
+	}
+}
+
+func (s *ProgressStore) tryWrite(ctx context.Context, bounded, hooks bool, write func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error)) (changes []*ProgressChange, err error) {
+	if bounded {
+		var cancel context.CancelFunc
+		ctx, cancel = queryContext(ctx)
+		defer cancel()
+	}
+	//Read committed doesn't lock the gaps of the missing rows read for update, so the writes of a new task don't deadlock on MySQL
+	//The loser of the race waits for the row inserted by the winner and is retried, as on PostgreSQL
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	changes, err = write(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if change.Previous == nil && change.Current == nil {
+			continue
+		}
+		if hooks {
+			err = s.recordChange(ctx, tx, change)
+		} else {
+			err = s.recordHistory(ctx, tx, change)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+//Reads the task progress inside the transaction, locking its row until the transaction ends
+func (s *ProgressStore) selectForUpdate(ctx context.Context, tx *sql.Tx, userId, courseId, taskId string) (*TaskProgress, error) {
+	return scanTaskProgress(tx.StmtContext(ctx, s.selectTaskForUpdate).QueryRowContext(ctx, userId, courseId, taskId), taskId)
+}
+
+//Atomically inserts or updates in database the task progress, written by the user through the progress endpoints
+//If expectedVersion isn't nil, the write only happens if the stored version is the expected one, 0 meaning no stored progress
+//Returns the previous and the new progress, or errVersionMismatch
+func (s *ProgressStore) upsertTaskProgress(ctx context.Context, courseProgress CourseProgressInfo, expectedVersion *int) (*ProgressChange, error) {
+	return s.runWrite(ctx, func(ctx context.Context, tx *sql.Tx) (*ProgressChange, error) {
+		previous, err := s.selectForUpdate(ctx, tx, courseProgress.UserId, courseProgress.CourseId, courseProgress.TaskId)
+		if err != nil {
+			return nil, err
+		}
+		if expectedVersion != nil && versionOf(previous) != *expectedVersion {
+			return nil, errVersionMismatch
+		}
+		change, err := s.upsertLocked(ctx, tx, courseProgress, previous)
+		if err != nil {
+			return nil, err
+		}
+		change.Learner = true
+		return change, nil
+	})
+}
+
+//Inserts or updates the task progress inside the transaction, after its previous progress was read for update
+func (s *ProgressStore) upsertLocked(ctx context.Context, tx *sql.Tx, courseProgress CourseProgressInfo, previous *TaskProgress) (*ProgressChange, error) {
+	inserted, err := s.dialect.upsertInserted(ctx, tx.StmtContext(ctx, s.upsertTask), courseProgress.UserId, courseProgress.CourseId, courseProgress.TaskId, courseProgress.Progress)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil && !inserted {
+		return nil, errConcurrentInsert
+	}
+
+	current, err := s.selectForUpdate(ctx, tx, courseProgress.UserId, courseProgress.CourseId, courseProgress.TaskId)
+	if err != nil {
+		return nil, err
+	}
+	return &ProgressChange{
+		UserId:   courseProgress.UserId,
+		CourseId: courseProgress.CourseId,
+		TaskId:   courseProgress.TaskId,
+		Previous: previous,
+		Current:  current,
+	}, nil
+}
+
+//Writes the progress of the record with its creation and update times, inside the transaction and after the previous progress was read for update
+//An update keeps the creation time of the stored progress
+func (s *ProgressStore) importLocked(ctx context.Context, tx *sql.Tx, record ProgressRecord, previous *TaskProgress) (*ProgressChange, error) {
+	inserted, err := s.dialect.upsertInserted(ctx, tx.StmtContext(ctx, s.importTask), record.UserId, record.CourseId, record.TaskId, record.Progress, *record.CreatedAt, *record.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil && !inserted {
+		return nil, errConcurrentInsert
+	}
+
+	current, err := s.selectForUpdate(ctx, tx, record.UserId, record.CourseId, record.TaskId)
+	if err != nil {
+		return nil, err
+	}
+	return &ProgressChange{UserId: record.UserId, CourseId: record.CourseId, TaskId: record.TaskId, Previous: previous, Current: current}, nil
+}
+
+//Deletes from database the task progress
+//If expectedVersion isn't nil, the delete only happens if the stored version is the expected one
+//Returns the previous progress, or errVersionMismatch
+func (s *ProgressStore) deleteTaskProgress(ctx context.Context, userId, courseId, taskId string, expectedVersion *int) (*ProgressChange, error) {
+	return s.runWrite(ctx, func(ctx context.Context, tx *sql.Tx) (*ProgressChange, error) {
+		previous, err := s.selectForUpdate(ctx, tx, userId, courseId, taskId)
+		if err != nil {
+			return nil, err
+		}
+		if expectedVersion != nil && versionOf(previous) != *expectedVersion {
+			return nil, errVersionMismatch
+		}
+		return s.deleteLocked(ctx, tx, userId, courseId, taskId, previous)
+	})
+}
+
+//Deletes the task progress inside the transaction, after its previous progress was read for update
+func (s *ProgressStore) deleteLocked(ctx context.Context, tx *sql.Tx, userId, courseId, taskId string, previous *TaskProgress) (*ProgressChange, error) {
+	if previous != nil {
+		if _, err := tx.StmtContext(ctx, s.deleteTask).ExecContext(ctx, userId, courseId, taskId); err != nil {
+			return nil, err
+		}
+	}
+	return &ProgressChange{UserId: userId, CourseId: courseId, TaskId: taskId, Previous: previous}, nil
+}
+
+//Records the change in the history and the progress log, and runs the write hooks
+func (s *ProgressStore) recordChange(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	if err := s.recordHistory(ctx, tx, change); err != nil {
+		return err
+	}
+	for _, hook := range progressWriteHooks {
+		if err := hook(ctx, tx, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Records the change in the history and the progress log
+func (s *ProgressStore) recordHistory(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	var previousProgress, progress sql.NullString
+	version := 0
+	if change.Previous != nil {
+		previousProgress = sql.NullString{String: change.Previous.Progress, Valid: true}
+		version = change.Previous.Version
+	}
+	if change.Current != nil {
+		progress = sql.NullString{String: change.Current.Progress, Valid: true}
+		version = change.Current.Version
+	}
+	_, err := tx.StmtContext(ctx, s.insertHistory).ExecContext(ctx, change.UserId, change.CourseId, change.TaskId, previousProgress, progress, version, change.changedAt(), change.learnerTransition())
+	if err != nil {
+		return err
+	}
+	return s.appendEvent(ctx, tx, change)
+}
+
+//Returns the version of the stored progress, 0 if there is none
+func versionOf(task *TaskProgress) int {
+	if task == nil {
+		return 0
+	}
+	return task.Version
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Databases of the store tests by backend, the tests of a backend are skipped if the variable of its URL isn't set
+//The URLs are given like COURSE_PROGRESS_DATABASE_URL, the databases are migrated by the tests
+//The rows written by the tests are kept, under ids unique to the run
+var testDatabases = []struct {
+	backend  string
+	variable string
+}{
+	{"mysql", "COURSE_PROGRESS_TEST_MYSQL_URL"},
+	{"postgres", "COURSE_PROGRESS_TEST_POSTGRES_URL"},
+}
+
+//Runs the test on the store of every configured database, connected and migrated like on startup
+func forEachStore(t *testing.T, test func(t *testing.T)) {
+	for _, database := range testDatabases {
+		t.Run(database.backend, func(t *testing.T) {
+			url := os.Getenv(database.variable)
+			if url == "" {
+				t.Skip(database.variable + " isn't set")
+			}
+			initConfig()
+			config.DatabaseUrl = url
+			initConnection()
+			defer closeConnection()
+			test(t)
+		})
+	}
+}
+
+//Returns an id unique to the test run, so the runs don't read the rows of the previous ones
+func testId(prefix string) string {
+	random := make([]byte, 6)
+	rand.Read(random)
+	return prefix + "-" + hex.EncodeToString(random)
+}
+
+func setTestProgress(t *testing.T, userId, courseId, taskId, progress string) *ProgressChange {
+	change, err := store.upsertTaskProgress(context.Background(), CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: taskId, Progress: progress}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return change
+}
+
+//Serves the course-manager-service and the course-services of the given courses, the tasks of a course in one group
+//Returns a function closing the server
+func stubCatalog(courses map[string][]string) func() {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	courseInfo := func(courseId string) CourseInfo {
+		return CourseInfo{Id: courseId, Name: courseId, URL: server.URL + "/course-services/" + courseId}
+	}
+	mux.HandleFunc("/courses", func(w http.ResponseWriter, r *http.Request) {
+		infos := make([]CourseInfo, 0)
+		for courseId := range courses {
+			infos = append(infos, courseInfo(courseId))
+		}
+		respondJSON(w, infos)
+	})
+	mux.HandleFunc("/courses/", func(w http.ResponseWriter, r *http.Request) {
+		courseId := strings.TrimPrefix(r.URL.Path, "/courses/")
+		if _, ok := courses[courseId]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		respondJSON(w, courseInfo(courseId))
+	})
+	mux.HandleFunc("/course-services/", func(w http.ResponseWriter, r *http.Request) {
+		taskIds, ok := courses[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/course-services/"), "/tasks")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		group := TaskGroup{Title: "Tasks"}
+		for _, taskId := range taskIds {
+			group.Tasks = append(group.Tasks, &BaseTaskInfo{Id: taskId, Title: taskId})
+		}
+		respondJSON(w, []TaskGroup{group})
+	})
+	config.CourseManagerServiceUrl = server.URL
+	return server.Close
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		migrate()
+		var version int
+		if err := connection.QueryRow("SELECT version FROM SCHEMA_VERSION").Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(migrations) {
+			t.Fatalf("schema version %d, want %d", version, len(migrations))
+		}
+		var versions int
+		if err := connection.QueryRow("SELECT count(*) FROM SCHEMA_VERSION").Scan(&versions); err != nil {
+			t.Fatal(err)
+		}
+		if versions != 1 {
+			t.Fatalf("%d rows in SCHEMA_VERSION, want 1", versions)
+		}
+	})
+}
+
+func TestStoreUpsertReportsInsertAndUpdate(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		userId, courseId := testId("user"), testId("course")
+		inserted := setTestProgress(t, userId, courseId, "task", "started")
+		if inserted.Previous != nil || inserted.Current == nil || inserted.Current.Version != 1 || inserted.Current.Progress != "started" {
+			t.Fatalf("insert change %+v", inserted)
+		}
+		updated := setTestProgress(t, userId, courseId, "task", "completed")
+		if updated.Previous == nil || updated.Previous.Version != 1 || updated.Current.Version != 2 || updated.Current.Progress != "completed" {
+			t.Fatalf("update change %+v", updated)
+		}
+		if !updated.Current.CreatedAt.Equal(*inserted.Current.CreatedAt) {
+			t.Fatalf("creation time changed from %v to %v", inserted.Current.CreatedAt, updated.Current.CreatedAt)
+		}
+
+		task, err := store.getTaskProgress(context.Background(), userId, courseId, "task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Progress != "completed" || task.Version != 2 {
+			t.Fatalf("stored progress %+v", task)
+		}
+	})
+}
+
+func TestStoreConditionalWrites(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, courseId := testId("user"), testId("course")
+		progress := CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: "task", Progress: "started"}
+		none, stale := 0, 1
+		if _, err := store.upsertTaskProgress(ctx, progress, &none); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.upsertTaskProgress(ctx, progress, &none); err != errVersionMismatch {
+			t.Fatalf("write expecting no progress: %v, want errVersionMismatch", err)
+		}
+		if _, err := store.upsertTaskProgress(ctx, progress, &stale); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.deleteTaskProgress(ctx, userId, courseId, "task", &stale); err != errVersionMismatch {
+			t.Fatalf("delete of a stale version: %v, want errVersionMismatch", err)
+		}
+
+		current := 2
+		change, err := store.deleteTaskProgress(ctx, userId, courseId, "task", &current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Previous == nil || change.Previous.Version != 2 || change.Current != nil {
+			t.Fatalf("delete change %+v", change)
+		}
+		again, err := store.deleteTaskProgress(ctx, userId, courseId, "task", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Previous != nil {
+			t.Fatalf("delete of a reset task found %+v", again.Previous)
+		}
+	})
+}
+
+func TestStoreUserProgressFilters(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, first, second := testId("user"), testId("course"), testId("course")
+		setTestProgress(t, userId, first, "a", "started")
+		setTestProgress(t, userId, first, "b", "completed")
+		setTestProgress(t, userId, second, "a", "completed")
+
+		filters := []struct {
+			filter ProgressFilter
+			want   int
+		}{
+			{ProgressFilter{}, 3},
+			{ProgressFilter{CourseId: first}, 2},
+			{ProgressFilter{Progress: "completed"}, 2},
+			{ProgressFilter{CourseId: first, Progress: "started"}, 1},
+			{ProgressFilter{Progress: "not started"}, 3},
+		}
+		for _, f := range filters {
+			items, err := store.getUserProgress(ctx, userId, f.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != f.want {
+				t.Errorf("filter %+v: %d items, want %d", f.filter, len(items), f.want)
+			}
+		}
+
+		future := time.Now().Add(time.Hour)
+		items, err := store.getUserProgress(ctx, userId, ProgressFilter{UpdatedSince: &future})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if items != nil {
+			t.Fatalf("%d items updated in the future", len(items))
+		}
+	})
+}
+
+func TestStoreReplaysProgressLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, courseId := testId("user"), testId("course")
+		setTestProgress(t, userId, courseId, "a", "started")
+		setTestProgress(t, userId, courseId, "a", "completed")
+		setTestProgress(t, userId, courseId, "b", "started")
+		if _, err := store.deleteTaskProgress(ctx, userId, courseId, "b", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		items, err := store.getUserProgressAt(ctx, userId, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || items[0].TaskId != "a" || items[0].Progress != "completed" || items[0].Version != 2 {
+			t.Fatalf("replayed progress %+v", items)
+		}
+		items, err = store.getUserProgressAt(ctx, userId, time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 0 {
+			t.Fatalf("replayed progress before the writes %+v", items)
+		}
+	})
+}
+
+func TestStoreImportKeepsMoreRecentProgress(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, courseId := testId("user"), testId("course")
+		createdAt := time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Second)
+		updatedAt := createdAt.Add(time.Hour)
+		older, newer := createdAt.Add(time.Minute), updatedAt.Add(time.Hour)
+		record := ProgressRecord{UserId: userId, CourseId: courseId, TaskId: "task", Progress: "started", CreatedAt: &createdAt, UpdatedAt: &updatedAt}
+
+		//Imported progress is historical, the write hooks aren't run for it
+		hooks := progressWriteHooks
+		defer func() { progressWriteHooks = hooks }()
+		hooked := 0
+		onProgressWrite(func(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+			hooked++
+			return nil
+		})
+
+		report := &ImportReport{}
+		if err := store.importBatch(ctx, []ProgressRecord{record}, 1, report); err != nil {
+			t.Fatal(err)
+		}
+		record.Progress, record.UpdatedAt = "completed", &older
+		if err := store.importBatch(ctx, []ProgressRecord{record}, 2, report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Imported != 1 || report.Skipped != 1 {
+			t.Fatalf("report %+v, want 1 imported and 1 skipped", report)
+		}
+		record.UpdatedAt = &newer
+		if err := store.importBatch(ctx, []ProgressRecord{record}, 3, report); err != nil {
+			t.Fatal(err)
+		}
+
+		task, err := store.getTaskProgress(ctx, userId, courseId, "task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Progress != "completed" || task.Version != 2 || !task.UpdatedAt.Equal(newer) || !task.CreatedAt.Equal(createdAt) {
+			t.Fatalf("imported progress %+v", task)
+		}
+		if hooked != 0 {
+			t.Errorf("write hooks run %d times by the import", hooked)
+		}
+	})
+}
+
+func TestStoreSplitsTaskWithHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, courseId := testId("user"), testId("course")
+		setTestProgress(t, userId, courseId, "old", "started")
+		setTestProgress(t, userId, courseId, "old", "completed")
+		source, err := store.getTaskProgress(ctx, userId, courseId, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mapping := TaskMapping{From: TaskRef{CourseId: courseId, TaskId: "old"}, To: []TaskRef{{CourseId: courseId, TaskId: "first"}, {CourseId: courseId, TaskId: "second"}}}
+		report, err := store.applyTaskMappings(ctx, []TaskMapping{mapping}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//The 2 writes of the mapped task and its reset
+		if report.ProgressRows != 1 || report.HistoryRows != 3 {
+			t.Fatalf("report %+v, want 1 progress row and 3 history rows", report)
+		}
+
+		tasks, err := store.getCourseProgress(ctx, userId, courseId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		progress := make(map[string]string)
+		for _, task := range tasks {
+			progress[task.TaskId] = task.Progress
+			if !task.CreatedAt.Equal(*source.CreatedAt) || !task.UpdatedAt.Equal(*source.UpdatedAt) {
+				t.Errorf("task %s created at %s and updated at %s, want the times of the mapped task %s and %s",
+					task.TaskId, task.CreatedAt, task.UpdatedAt, source.CreatedAt, source.UpdatedAt)
+			}
+		}
+		if len(progress) != 2 || progress["first"] != "completed" || progress["second"] != "completed" {
+			t.Fatalf("mapped progress %v", progress)
+		}
+		//The 3 copied rows and the write of the mapped progress, none is left on the mapped task
+		for taskId, want := range map[string]int{"first": 4, "second": 4, "old": 0} {
+			var copied int
+			err := connection.QueryRow(dialect.rebind("SELECT count(*) FROM COURSEPROGRESS_HISTORY where user_id = ? and course_id = ? and task_id = ?"),
+				userId, courseId, taskId).Scan(&copied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copied != want {
+				t.Errorf("%d history rows of task %s, want %d", copied, taskId, want)
+			}
+		}
+	})
+}
+
+func TestConcurrentProgressWritesAreSerialized(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		server := httptest.NewServer(newRouter())
+		defer server.Close()
+		userId, courseId := testId("user"), testId("course")
+		url := server.URL + "/progress/" + userId + "/" + courseId + "/task"
+
+		const writes = 20
+		statuses := make(chan int, writes)
+		var wg sync.WaitGroup
+		for i := 0; i < writes; i++ {
+			progress := "started"
+			if i%2 == 1 {
+				progress = "completed"
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(`{"progress":"`+progress+`"}`))
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		for status := range statuses {
+			if status != http.StatusOK {
+				t.Fatalf("concurrent write answered %d", status)
+			}
+		}
+
+		task, err := store.getTaskProgress(context.Background(), userId, courseId, "task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Version != writes {
+			t.Fatalf("version %d after %d writes, an update was lost", task.Version, writes)
+		}
+
+		//Every write is in the history, in version order, each starting from the progress of the previous one
+		rows, err := connection.Query(dialect.rebind("SELECT previous_progress, progress, version FROM COURSEPROGRESS_HISTORY"+
+			" where user_id = ? and course_id = ? and task_id = ? order by version"), userId, courseId, "task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var previous sql.NullString
+		version := 0
+		for rows.Next() {
+			var from, to sql.NullString
+			var rowVersion int
+			if err := rows.Scan(&from, &to, &rowVersion); err != nil {
+				t.Fatal(err)
+			}
+			version++
+			if rowVersion != version || from != previous {
+				t.Fatalf("history row %d is version %d from %v, want version %d from %v", version, rowVersion, from, version, previous)
+			}
+			previous = to
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if version != writes || previous.String != task.Progress {
+			t.Fatalf("%d history rows ending with %s, want %d ending with %s", version, previous.String, writes, task.Progress)
+		}
+	})
+}
+
+func TestConcurrentConditionalWritesApplyOnce(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		server := httptest.NewServer(newRouter())
+		defer server.Close()
+		userId, courseId := testId("user"), testId("course")
+		defer stubCatalog(map[string][]string{courseId: {"task"}})()
+		setTestProgress(t, userId, courseId, "task", "started")
+		url := server.URL + "/progress/" + userId + "/" + courseId + "/task"
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || etag == "" {
+			t.Fatalf("task answered %d with ETag %q", resp.StatusCode, etag)
+		}
+
+		//Every write is conditioned on the same version, only the first one to commit applies
+		const writes = 10
+		statuses := make(chan int, writes)
+		var wg sync.WaitGroup
+		for i := 0; i < writes; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(`{"progress":"completed"}`))
+				req.Header.Set("If-Match", etag)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+		counts := make(map[int]int)
+		for status := range statuses {
+			counts[status]++
+		}
+		if counts[http.StatusOK] != 1 || counts[http.StatusPreconditionFailed] != writes-1 {
+			t.Fatalf("concurrent conditional writes answered %v, want one 200 and %d 412", counts, writes-1)
+		}
+		task, err := store.getTaskProgress(context.Background(), userId, courseId, "task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Version != 2 || task.Progress != "completed" {
+			t.Fatalf("task is %s at version %d, want completed at version 2", task.Progress, task.Version)
+		}
+	})
+}
+
+func TestRebuildProgressProjection(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, courseId := testId("user"), testId("course")
+		setTestProgress(t, userId, courseId, "a", "started")
+		setTestProgress(t, userId, courseId, "a", "completed")
+		setTestProgress(t, userId, courseId, "b", "started")
+		setTestProgress(t, userId, courseId, "c", "completed")
+		if _, err := store.deleteTaskProgress(ctx, userId, courseId, "c", nil); err != nil {
+			t.Fatal(err)
+		}
+		before, err := store.getCourseProgress(ctx, userId, courseId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.rebuildProgressProjection(ctx); err != nil {
+			t.Fatal(err)
+		}
+		after, err := store.getCourseProgress(ctx, userId, courseId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != 2 || len(before) != 2 {
+			t.Fatalf("%d tasks rebuilt from %d", len(after), len(before))
+		}
+		rebuilt := make(map[string]TaskProgress)
+		for _, task := range after {
+			rebuilt[task.TaskId] = task
+		}
+		for _, task := range before {
+			if r := rebuilt[task.TaskId]; r.Progress != task.Progress || r.Version != task.Version {
+				t.Errorf("task %s rebuilt as %s version %d, was %s version %d", task.TaskId, r.Progress, r.Version, task.Progress, task.Version)
+			}
+		}
+	})
+}
+
+func TestLeaderboardPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		courseId := testId("course")
+		first, second, third, started, optedOut := testId("a"), testId("b"), testId("c"), testId("d"), testId("e")
+		setTestProgress(t, first, courseId, "1", "completed")
+		setTestProgress(t, first, courseId, "2", "completed")
+		setTestProgress(t, second, courseId, "1", "completed")
+		setTestProgress(t, third, courseId, "2", "completed")
+		setTestProgress(t, started, courseId, "1", "started")
+		for _, taskId := range []string{"1", "2", "3"} {
+			setTestProgress(t, optedOut, courseId, taskId, "completed")
+		}
+		if err := store.setLeaderboardOptOut(ctx, courseId, optedOut, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.rebuildLeaderboards(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		config.LeaderboardPseudonymKey = "test"
+		query := LeaderboardQuery{Sort: "completed", Limit: 2}
+		var ranked []string
+		for {
+			entries, total, err := store.getLeaderboardPage(ctx, courseId, "", 0, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 4 {
+				t.Fatalf("%d ranked users, want 4", total)
+			}
+			next := len(entries) > query.Limit
+			if next {
+				entries = entries[:query.Limit]
+			}
+			for _, entry := range entries {
+				if entry.Rank != len(ranked)+1 {
+					t.Fatalf("%s ranked %d after %d users", entry.UserId, entry.Rank, len(ranked))
+				}
+				ranked = append(ranked, entry.UserId)
+			}
+			if !next {
+				break
+			}
+			cursor := encodeLeaderboardCursor(entries[query.Limit-1], query.Sort, true)
+			if query.Cursor, err = decodeLeaderboardCursor(cursor, query.Sort, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if strings.Join(ranked, ",") != strings.Join([]string{first, second, third, started}, ",") {
+			t.Fatalf("ranked %v", ranked)
+		}
+	})
+}
+
+func TestCohortMembership(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId := testId("user")
+		cohortId, err := store.createCohort(ctx, CohortRequest{Name: testId("cohort")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if found, err := store.setCohortId(ctx, cohortId, userId, store.insertCohortMember, store.deleteCohortMember, true); err != nil || !found {
+				t.Fatalf("adding a member answered %v, %v", found, err)
+			}
+		}
+		cohort, err := store.getCohort(ctx, cohortId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cohort.Members) != 1 || cohort.Members[0] != userId {
+			t.Fatalf("members %v after adding %s twice", cohort.Members, userId)
+		}
+
+		if removed, err := store.removeCohort(ctx, cohortId); err != nil || !removed {
+			t.Fatalf("removing the cohort answered %v, %v", removed, err)
+		}
+		if found, err := store.setCohortId(ctx, cohortId, userId, store.insertCohortMember, store.deleteCohortMember, true); err != nil || found {
+			t.Fatalf("adding a member to a removed cohort answered %v, %v", found, err)
+		}
+	})
+}
+
+func TestCompletionTimeIgnoresRepeatedWrites(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, courseId := testId("user"), testId("course")
+		setTestProgress(t, userId, courseId, "redone", "completed")
+		first := setTestProgress(t, userId, courseId, "task", "completed")
+		time.Sleep(1100 * time.Millisecond)
+		setTestProgress(t, userId, courseId, "task", "completed")
+		setTestProgress(t, userId, courseId, "redone", "started")
+		again := setTestProgress(t, userId, courseId, "redone", "completed")
+
+		for _, stmt := range []*sql.Stmt{store.selectUserCompletions, store.selectCourseCompletions} {
+			id := userId
+			if stmt == store.selectCourseCompletions {
+				id = courseId
+			}
+			completions, err := store.getCompletionTimes(ctx, stmt, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if at := completions[userId].completedAt(courseId, "task"); at == nil || !at.Equal(*first.Current.UpdatedAt) {
+				t.Errorf("task completed at %v, want %v", at, *first.Current.UpdatedAt)
+			}
+			if at := completions[userId].completedAt(courseId, "redone"); at == nil || !at.Equal(*again.Current.UpdatedAt) {
+				t.Errorf("redone task completed at %v, want %v", at, *again.Current.UpdatedAt)
+			}
+		}
+	})
+}
+
+func TestDeadlineNotifiesEveryLearner(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		courseId := testId("course")
+		withProgress, enrolled, member, otherMember := testId("user"), testId("user"), testId("user"), testId("user")
+		setTestProgress(t, withProgress, courseId, "task", "started")
+		if _, _, err := store.enroll(ctx, enrolled, courseId, enrollmentSourceApi); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.createCohort(ctx, CohortRequest{Name: testId("cohort"), Members: []string{member}, Courses: []string{courseId}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.createCohort(ctx, CohortRequest{Name: testId("cohort"), Members: []string{otherMember}, Courses: []string{testId("course")}}); err != nil {
+			t.Fatal(err)
+		}
+
+		taskGroups := []TaskGroup{{Tasks: []*BaseTaskInfo{{Id: "task"}}}}
+		courses, err := store.getCourseStates(ctx, courseId, taskGroups, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(courses) != 3 || courses[withProgress] == nil || courses[enrolled] == nil || courses[member] == nil {
+			t.Fatalf("%d learners of the course, want %s, %s and %s", len(courses), withProgress, enrolled, member)
+		}
+
+		dueAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+		deadline := Deadline{CourseId: courseId, DueAt: &dueAt}
+		if err := store.putDeadlines(ctx, []Deadline{deadline}); err != nil {
+			t.Fatal(err)
+		}
+		notified, err := store.notifyDeadline(ctx, deadline, newDeadlineSet([]Deadline{deadline}), taskGroups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if notified != 3 {
+			t.Fatalf("%d overdue events, want 3", notified)
+		}
+		var events int
+		err = connection.QueryRow(dialect.rebind("SELECT count(*) FROM COURSEPROGRESS_EVENTS where course_id = ? and event_type = ?"), courseId, eventTaskOverdue).Scan(&events)
+		if err != nil || events != 3 {
+			t.Fatalf("%d %s events, %v", events, eventTaskOverdue, err)
+		}
+	})
+}
+
+func TestActivityCountsLearnerTransitions(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		userId, courseId := testId("user"), testId("course")
+		setTestProgress(t, userId, courseId, "task", "started")
+		setTestProgress(t, userId, courseId, "task", "started")
+		setTestProgress(t, userId, courseId, "task", "completed")
+		//Written like the admin and bulk writes, not by the user
+		_, err := store.runWrite(ctx, func(ctx context.Context, tx *sql.Tx) (*ProgressChange, error) {
+			previous, err := store.selectForUpdate(ctx, tx, userId, courseId, "other")
+			if err != nil {
+				return nil, err
+			}
+			return store.upsertLocked(ctx, tx, CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: "other", Progress: "completed"}, previous)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.rebuildActivity(ctx, userId, "UTC"); err != nil {
+			t.Fatal(err)
+		}
+		today := time.Now().UTC().Format(activityDayLayout)
+		counts, err := store.getActivity(ctx, userId, today, today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[today] != 2 {
+			t.Fatalf("%d transitions today, want the 2 transitions made by the user", counts[today])
+		}
+	})
+}
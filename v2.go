@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"time"
+)
+
+//Envelope of a single resource in the v2 API
+type ObjectEnvelope struct {
+	Data interface{} `json:"data"`
+}
+
+//Envelope of a resource listing in the v2 API
+type ListEnvelope struct {
+	Data       interface{} `json:"data"`
+	Pagination Pagination  `json:"pagination"`
+}
+
+type Pagination struct {
+	Total      int    `json:"total"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+//Envelope of an error in the v2 API
+type ErrorEnvelope struct {
+	Error ErrorInfo `json:"error"`
+}
+
+type ErrorInfo struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type TaskResource struct {
+	Id        string     `json:"id"`
+	CourseId  string     `json:"courseId"`
+	Group     string     `json:"group"`
+	Progress  string     `json:"progress"`
+	Status    string     `json:"status"`
+	CreatedAt *time.Time `json:"createdAt"`
+	UpdatedAt *time.Time `json:"updatedAt"`
+}
+
+type GroupResource struct {
+	Title string         `json:"title"`
+	Tasks []TaskResource `json:"tasks"`
+}
+
+type CourseResource struct {
+	Id             string          `json:"id"`
+	CompletedTasks int             `json:"completedTasks"`
+	TotalTasks     int             `json:"totalTasks"`
+	Groups         []GroupResource `json:"groups"`
+}
+
+type EnrollmentResource struct {
+	CourseId       string     `json:"courseId"`
+	Progress       string     `json:"progress"`
+	CompletedTasks int        `json:"completedTasks"`
+	TotalTasks     int        `json:"totalTasks"`
+	EnrolledAt     *time.Time `json:"enrolledAt,omitempty"`
+	Source         string     `json:"source,omitempty"`
+}
+
+type UserResource struct {
+	Id          string               `json:"id"`
+	Enrollments []EnrollmentResource `json:"enrollments"`
+}
+
+func newTaskResource(course *CourseState, task TaskProgress) TaskResource {
+	return TaskResource{
+		Id:        task.TaskId,
+		CourseId:  course.CourseId,
+		Group:     course.groupOf(task.TaskId),
+		Progress:  task.Progress,
+		Status:    task.Status,
+		CreatedAt: task.CreatedAt,
+		UpdatedAt: task.UpdatedAt,
+	}
+}
+
+func newTaskResources(course *CourseState) []TaskResource {
+	tasks := make([]TaskResource, 0, len(course.Tasks))
+	for _, task := range course.Tasks {
+		tasks = append(tasks, newTaskResource(course, task))
+	}
+	return tasks
+}
+
+func newCourseResource(course *CourseState) CourseResource {
+	resource := CourseResource{
+		Id:             course.CourseId,
+		CompletedTasks: course.completedTasks(),
+		TotalTasks:     len(course.Tasks),
+		Groups:         make([]GroupResource, 0, len(course.Groups)),
+	}
+	tasks := newTaskResources(course)
+	for _, group := range course.Groups {
+		groupResource := GroupResource{Title: group.Title, Tasks: make([]TaskResource, 0)}
+		for _, task := range tasks {
+			if task.Group == group.Title {
+				groupResource.Tasks = append(groupResource.Tasks, task)
+			}
+		}
+		resource.Groups = append(resource.Groups, groupResource)
+	}
+	return resource
+}
+
+func newEnrollmentResource(course *CourseState) EnrollmentResource {
+	resource := EnrollmentResource{
+		CourseId:       course.CourseId,
+		Progress:       "not started",
+		CompletedTasks: course.completedTasks(),
+		TotalTasks:     len(course.Tasks),
+	}
+	if resource.TotalTasks > 0 && resource.CompletedTasks == resource.TotalTasks {
+		resource.Progress = "completed"
+	} else {
+		for _, task := range course.Tasks {
+			if task.Progress != "not started" {
+				resource.Progress = "started"
+				break
+			}
+		}
+	}
+	return resource
+}
+
+func newEnrollmentResources(courses []CourseState) []EnrollmentResource {
+	enrollments := make([]EnrollmentResource, 0, len(courses))
+	for i := range courses {
+		enrollments = append(enrollments, newEnrollmentResource(&courses[i]))
+	}
+	return enrollments
+}
+
+//Writes the error to the response as an error envelope
+func respondErrorV2(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if serviceErr, ok := err.(*serviceError); ok {
+		status = serviceErr.Status
+	}
+	log.Println(err.Error())
+	message, _ := json.Marshal(ErrorEnvelope{Error: ErrorInfo{Status: status, Message: err.Error()}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(message)
+}
+
+//Handles the get method on /v2/users/:user
+//Returns 200 status code and the user with the summary of every enrollment
+func HandleV2UserGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filter, err := scopeFilter(r, ps.ByName("user"), ProgressFilter{})
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	courses, err := loadUserState(r.Context(), ps.ByName("user"), filter)
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if notModified(w, r, coursesETag(courses, "user"+enrollmentsVersion(filter.Enrolled))) {
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: UserResource{Id: ps.ByName("user"), Enrollments: newScopedEnrollmentResources(courses, filter)}})
+}
+
+//Handles the get method on /v2/users/:user/enrollments
+//Returns 200 status code and the enrollments of the user
+func HandleV2EnrollmentsGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filter, err := scopeFilter(r, ps.ByName("user"), ProgressFilter{})
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	courses, err := loadUserState(r.Context(), ps.ByName("user"), filter)
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if notModified(w, r, coursesETag(courses, "enrollments"+enrollmentsVersion(filter.Enrolled))) {
+		return
+	}
+	enrollments := newScopedEnrollmentResources(courses, filter)
+	respondJSON(w, ListEnvelope{Data: enrollments, Pagination: Pagination{Total: len(enrollments)}})
+}
+
+//Handles the get method on /v2/users/:user/courses/:course
+//Returns 200 status code and the course with its task groups and the progress of the user
+func HandleV2CourseGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	course, err := loadCourseState(r.Context(), ps.ByName("user"), ps.ByName("course"))
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if notModified(w, r, coursesETag([]CourseState{*course}, "course")) {
+		return
+	}
+	respondJSON(w, ObjectEnvelope{Data: newCourseResource(course)})
+}
+
+//Handles the get method on /v2/users/:user/tasks
+//Returns 200 status code and a page of the tasks of every course with the progress of the user
+func HandleV2UserTasksGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query, err := parseProgressQuery(r, true)
+	if err == nil {
+		query.Filter, err = scopeFilter(r, ps.ByName("user"), query.Filter)
+	}
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	page, err := listUserTasks(r.Context(), ps.ByName("user"), query)
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if notModified(w, r, page.etag(r)) {
+		return
+	}
+
+	tasks := make([]TaskResource, 0, len(page.Items))
+	for _, item := range page.Items {
+		tasks = append(tasks, TaskResource{
+			Id:        item.Task.TaskId,
+			CourseId:  item.CourseId,
+			Group:     item.Group,
+			Progress:  item.Task.Progress,
+			CreatedAt: item.Task.CreatedAt,
+			UpdatedAt: item.Task.UpdatedAt,
+		})
+	}
+	respondJSON(w, ListEnvelope{Data: tasks, Pagination: Pagination{Total: page.Total, NextCursor: page.NextCursor}})
+}
+
+//Handles the get method on /v2/users/:user/courses/:course/tasks
+//Returns 200 status code and a page of the tasks of the course with the progress of the user
+func HandleV2TasksGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query, err := parseProgressQuery(r, true)
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	course, page, err := listCourseTasks(r.Context(), ps.ByName("user"), ps.ByName("course"), query)
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if notModified(w, r, page.etag(r)) {
+		return
+	}
+
+	tasks := make([]TaskResource, 0, len(page.Items))
+	for _, item := range page.Items {
+		tasks = append(tasks, newTaskResource(course, item.Task))
+	}
+	respondJSON(w, ListEnvelope{Data: tasks, Pagination: Pagination{Total: page.Total, NextCursor: page.NextCursor}})
+}
+
+//Handles the get method on /v2/users/:user/courses/:course/tasks/:task
+//Returns 200 status code and the task with the progress of the user
+func HandleV2TaskGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	respondTaskV2(w, r, ps, true)
+}
+
+//Handles the put method on /v2/users/:user/courses/:course/tasks/:task
+//Returns 200 status code and the task with the updated progress of the user
+func HandleV2TaskPut(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	progress, err := readProgressUpdate(r)
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if _, _, err := loadTaskState(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task")); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if _, err := setTaskProgress(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"), progress, r.Header.Get("If-Match")); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	respondTaskV2(w, r, ps, false)
+}
+
+//Handles the delete method on /v2/users/:user/courses/:course/tasks/:task
+//Returns 200 status code and the task with the progress of the user reset to 'not started'
+func HandleV2TaskDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, _, err := loadTaskState(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task")); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	if _, err := resetTaskProgress(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"), r.Header.Get("If-Match")); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	respondTaskV2(w, r, ps, false)
+}
+
+//Responds with the task and its entity tag
+//If conditional is true, 304 status code is returned when the If-None-Match header of the request matches
+func respondTaskV2(w http.ResponseWriter, r *http.Request, ps httprouter.Params, conditional bool) {
+	course, task, err := loadTaskState(r.Context(), ps.ByName("user"), ps.ByName("course"), ps.ByName("task"))
+	if err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+	etag := taskETag(course, *task)
+	if conditional && notModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("ETag", etag)
+	respondJSON(w, ObjectEnvelope{Data: newTaskResource(course, *task)})
+}
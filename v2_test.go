@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestV2ResourcesNestGroupsAndSummarizeEnrollments(t *testing.T) {
+	updated := time.Date(2018, 5, 14, 9, 30, 0, 0, time.UTC)
+	groups := []TaskGroup{
+		{Title: "Basics", Tasks: []*BaseTaskInfo{{Id: "intro"}, {Id: "sets"}}},
+		{Title: "Advanced", Tasks: []*BaseTaskInfo{{Id: "matrices"}}},
+	}
+	course := newCourseState("algebra", groups, []TaskProgress{{TaskId: "sets", Progress: "completed", UpdatedAt: &updated}})
+
+	resource := newCourseResource(&course)
+	if resource.Id != "algebra" || resource.CompletedTasks != 1 || resource.TotalTasks != 3 || len(resource.Groups) != 2 {
+		t.Fatalf("course resource %+v", resource)
+	}
+	if basics := resource.Groups[0]; basics.Title != "Basics" || len(basics.Tasks) != 2 || basics.Tasks[1].Id != "sets" ||
+		basics.Tasks[1].Progress != "completed" || basics.Tasks[1].Group != "Basics" || basics.Tasks[1].UpdatedAt != &updated {
+		t.Errorf("first group %+v", basics)
+	}
+	if advanced := resource.Groups[1]; len(advanced.Tasks) != 1 || advanced.Tasks[0].Progress != "not started" || advanced.Tasks[0].Status != "available" {
+		t.Errorf("second group %+v", advanced)
+	}
+
+	for _, test := range []struct {
+		seen     []TaskProgress
+		progress string
+	}{
+		{nil, "not started"},
+		{[]TaskProgress{{TaskId: "intro", Progress: "started"}}, "started"},
+		{[]TaskProgress{{TaskId: "intro", Progress: "completed"}, {TaskId: "sets", Progress: "completed"}}, "started"},
+		{[]TaskProgress{{TaskId: "intro", Progress: "completed"}, {TaskId: "sets", Progress: "completed"}, {TaskId: "matrices", Progress: "completed"}}, "completed"},
+	} {
+		course := newCourseState("algebra", groups, test.seen)
+		if enrollment := newEnrollmentResource(&course); enrollment.Progress != test.progress || enrollment.TotalTasks != 3 {
+			t.Errorf("enrollment of %+v is %+v, want %s", test.seen, enrollment, test.progress)
+		}
+	}
+
+	message, err := json.Marshal(ListEnvelope{Data: []TaskResource{}, Pagination: Pagination{Total: 3}})
+	if err != nil || string(message) != `{"data":[],"pagination":{"total":3}}` {
+		t.Errorf("list envelope %s, %v", message, err)
+	}
+}
+
+func TestV2RoutesRespondWithErrorEnvelopes(t *testing.T) {
+	initConfig()
+	for _, route := range routes {
+		if strings.HasPrefix(route.Path, "/v2/") && route.Errors != jsonErrors {
+			t.Errorf("%s %s doesn't respond with error envelopes", route.Method, route.Path)
+		}
+	}
+
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/v2/users/ana?scope=everything", "", http.StatusUnprocessableEntity},
+		{"GET", "/v2/users/ana/tasks?sort=title", "", http.StatusUnprocessableEntity},
+		{"PUT", "/v2/users/ana/courses/algebra/tasks/intro", `{"progress":`, http.StatusBadRequest},
+		{"PUT", "/v2/users/ana/courses/algebra/tasks/intro", `{"progress":"finished"}`, http.StatusUnprocessableEntity},
+	} {
+		resp := serveTestRequest(test.method, test.path, test.body, nil)
+		var envelope ErrorEnvelope
+		if err := json.Unmarshal(resp.Body.Bytes(), &envelope); err != nil || resp.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s answered %s, not an error envelope: %v", test.method, test.path, resp.Body.String(), err)
+			continue
+		}
+		if resp.Code != test.status || envelope.Error.Status != test.status || envelope.Error.Message == "" {
+			t.Errorf("%s %s answered %d with %+v, want %d", test.method, test.path, resp.Code, envelope, test.status)
+		}
+	}
+
+	//The v1 routes keep their plain text errors
+	if resp := serveTestRequest("PUT", "/progress/ana/algebra/intro", `{"progress":`, nil); strings.HasPrefix(resp.Body.String(), "{") {
+		t.Errorf("v1 route answered an error envelope %s", resp.Body.String())
+	}
+}
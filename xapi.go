@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Verbs of the ADL vocabulary translated to and from progress
+const (
+	xapiAttempted = "http://adlnet.gov/expapi/verbs/attempted"
+	xapiCompleted = "http://adlnet.gov/expapi/verbs/completed"
+	xapiPassed    = "http://adlnet.gov/expapi/verbs/passed"
+	xapiScored    = "http://adlnet.gov/expapi/verbs/scored"
+)
+
+const xapiVersion = "1.0.3"
+
+//Statements sent per request to the learning record store
+const xapiDeliveryBatch = 50
+
+//Attempts after which a statement is left in the outbox and no longer sent
+const xapiMaxAttempts = 10
+
+type XapiAccount struct {
+	HomePage string `json:"homePage"`
+	Name     string `json:"name"`
+}
+
+type XapiActor struct {
+	ObjectType string       `json:"objectType,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	Mbox       string       `json:"mbox,omitempty"`
+	Account    *XapiAccount `json:"account,omitempty"`
+}
+
+type XapiVerb struct {
+	Id      string            `json:"id"`
+	Display map[string]string `json:"display,omitempty"`
+}
+
+type XapiObject struct {
+	ObjectType string `json:"objectType,omitempty"`
+	Id         string `json:"id"`
+}
+
+type XapiScore struct {
+	Scaled *float64 `json:"scaled,omitempty"`
+	Raw    *float64 `json:"raw,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+}
+
+type XapiResult struct {
+	Score      *XapiScore `json:"score,omitempty"`
+	Success    *bool      `json:"success,omitempty"`
+	Completion *bool      `json:"completion,omitempty"`
+}
+
+//xAPI statement, with the properties the service reads and writes
+type XapiStatement struct {
+	Id        string      `json:"id,omitempty"`
+	Actor     XapiActor   `json:"actor"`
+	Verb      XapiVerb    `json:"verb"`
+	Object    XapiObject  `json:"object"`
+	Result    *XapiResult `json:"result,omitempty"`
+	Timestamp *time.Time  `json:"timestamp,omitempty"`
+}
+
+//Registers the write hooks queueing the statements of the progress changes, if a learning record store is configured
+//Statements are queued by every command writing progress and sent by the server
+func initXapi() {
+	if config.XapiLrsUrl == "" {
+		return
+	}
+	onProgressWrite(queueProgressStatement)
+	onScoreRecorded(queueScoreStatement)
+}
+
+//Returns the IRI of the activity of the task
+func xapiActivityId(courseId, taskId string) string {
+	return strings.TrimSuffix(config.XapiBaseUrl, "/") + "/courses/" + url.PathEscape(courseId) + "/tasks/" + url.PathEscape(taskId)
+}
+
+//Returns the course and the task of an activity IRI of the service
+func parseXapiActivityId(id string) (courseId, taskId string, err error) {
+	prefix := strings.TrimSuffix(config.XapiBaseUrl, "/") + "/courses/"
+	if !strings.HasPrefix(id, prefix) {
+		return "", "", errors.New("object " + id + " isn't a task activity of " + config.XapiBaseUrl)
+	}
+	segments := strings.Split(strings.TrimPrefix(id, prefix), "/")
+	if len(segments) != 3 || segments[1] != "tasks" {
+		return "", "", errors.New("object " + id + " isn't a task activity of " + config.XapiBaseUrl)
+	}
+	if courseId, err = url.PathUnescape(segments[0]); err == nil {
+		taskId, err = url.PathUnescape(segments[2])
+	}
+	if err == nil && (courseId == "" || taskId == "") {
+		err = errors.New("object " + id + " has an empty course or task")
+	}
+	return courseId, taskId, err
+}
+
+func newXapiStatement(userId, courseId, taskId, verb string, timestamp time.Time) *XapiStatement {
+	display := verb[strings.LastIndex(verb, "/")+1:]
+	return &XapiStatement{
+		Actor:     XapiActor{ObjectType: "Agent", Account: &XapiAccount{HomePage: config.XapiBaseUrl, Name: userId}},
+		Verb:      XapiVerb{Id: verb, Display: map[string]string{"en-US": display}},
+		Object:    XapiObject{ObjectType: "Activity", Id: xapiActivityId(courseId, taskId)},
+		Timestamp: &timestamp,
+	}
+}
+
+//Returns a name based UUID derived from the parts, so a statement queued again keeps its id
+//The learning record store ignores a statement it already stored with the same id
+func xapiStatementId(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	id := hex.EncodeToString(sum[:16])
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32]
+}
+
+//Context key of the writes of ingested statements, which aren't sent back to the learning record store
+type xapiIngestedKey struct{}
+
+func (s *ProgressStore) queueStatement(ctx context.Context, tx *sql.Tx, statement *XapiStatement) error {
+	if ingested, _ := ctx.Value(xapiIngestedKey{}).(bool); ingested {
+		return nil
+	}
+	body, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+	_, err = tx.StmtContext(ctx, s.insertOutbox).ExecContext(ctx, statement.Id, string(body))
+	return err
+}
+
+//Queues the attempted or completed statement of a progress change, resets have no statement
+//A completion is also passed if the last score recorded on the task meets the pass threshold
+func queueProgressStatement(ctx context.Context, tx *sql.Tx, change *ProgressChange) error {
+	if change.Current == nil || (change.Previous != nil && change.Previous.Progress == change.Current.Progress) {
+		return nil
+	}
+	verb := xapiAttempted
+	if change.Current.Progress == "completed" {
+		verb = xapiCompleted
+	}
+	timestamp := time.Now().UTC()
+	if change.Current.UpdatedAt != nil {
+		timestamp = change.Current.UpdatedAt.UTC()
+	}
+	statement := newXapiStatement(change.UserId, change.CourseId, change.TaskId, verb, timestamp)
+	statement.Id = xapiStatementId(change.UserId, change.CourseId, change.TaskId, verb, strconv.Itoa(change.Current.Version))
+	if err := store.queueStatement(ctx, tx, statement); err != nil || verb != xapiCompleted {
+		return err
+	}
+
+	score, err := store.lastScore(ctx, tx, change.UserId, change.CourseId, change.TaskId)
+	if err != nil || score == nil || *score < config.XapiPassThreshold {
+		return err
+	}
+	passed := newPassedStatement(change.UserId, change.CourseId, change.TaskId, *score, timestamp)
+	passed.Id = xapiStatementId(change.UserId, change.CourseId, change.TaskId, xapiPassed, strconv.Itoa(change.Current.Version))
+	return store.queueStatement(ctx, tx, passed)
+}
+
+//Queues the scored statement of a recorded score, the score is scaled between 0 and 1
+//A score meeting the pass threshold on a completed task is also queued as passed
+func queueScoreStatement(ctx context.Context, tx *sql.Tx, event *ProgressEvent) error {
+	statement := newXapiStatement(event.UserId, event.CourseId, event.TaskId, xapiScored, event.OccurredAt)
+	statement.Result = &XapiResult{Score: &XapiScore{Scaled: event.Score}}
+	scoreId := strconv.FormatFloat(*event.Score, 'g', -1, 64)
+	statement.Id = xapiStatementId(event.UserId, event.CourseId, event.TaskId, xapiScored, event.OccurredAt.Format(time.RFC3339), scoreId)
+	if err := store.queueStatement(ctx, tx, statement); err != nil || *event.Score < config.XapiPassThreshold {
+		return err
+	}
+
+	current, err := store.selectForUpdate(ctx, tx, event.UserId, event.CourseId, event.TaskId)
+	if err != nil || current == nil || current.Progress != "completed" {
+		return err
+	}
+	passed := newPassedStatement(event.UserId, event.CourseId, event.TaskId, *event.Score, event.OccurredAt)
+	passed.Id = xapiStatementId(event.UserId, event.CourseId, event.TaskId, xapiPassed, event.OccurredAt.Format(time.RFC3339), scoreId)
+	return store.queueStatement(ctx, tx, passed)
+}
+
+//Returns the passed statement of a task completed with the scaled score
+func newPassedStatement(userId, courseId, taskId string, score float64, timestamp time.Time) *XapiStatement {
+	success, completion := true, true
+	statement := newXapiStatement(userId, courseId, taskId, xapiPassed, timestamp)
+	statement.Result = &XapiResult{Score: &XapiScore{Scaled: &score}, Success: &success, Completion: &completion}
+	return statement
+}
+
+//Sends the oldest queued statements to the learning record store in one request
+//Sent statements are removed from the outbox, the attempts of rejected ones are counted
+//Returns the number of statements sent
+func (s *ProgressStore) deliverStatements(ctx context.Context) (int, error) {
+	queryCtx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := s.selectOutbox.QueryContext(queryCtx, xapiMaxAttempts, xapiDeliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var statements []json.RawMessage
+	for rows.Next() {
+		var id int64
+		var statement string
+		if err := rows.Scan(&id, &statement); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		statements = append(statements, json.RawMessage(statement))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	sendErr := postStatements(ctx, statements)
+	update := s.deleteOutbox
+	if sendErr != nil {
+		update = s.failOutbox
+	}
+	queryCtx, cancel = queryContext(ctx)
+	defer cancel()
+	for _, id := range ids {
+		if _, err := update.ExecContext(queryCtx, id); err != nil {
+			return 0, err
+		}
+	}
+	if sendErr != nil {
+		return 0, sendErr
+	}
+	return len(ids), nil
+}
+
+//Posts the statements to the statements resource of the learning record store
+func postStatements(ctx context.Context, statements []json.RawMessage) error {
+	body, err := json.Marshal(statements)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(config.XapiLrsUrl, "/")+"/statements", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Experience-API-Version", xapiVersion)
+	if config.XapiLrsUsername != "" {
+		req.SetBasicAuth(config.XapiLrsUsername, config.XapiLrsPassword)
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("learning record store returned status " + strconv.Itoa(resp.StatusCode) + ": " + string(message))
+	}
+	return nil
+}
+
+//Sends the queued statements to the learning record store at the configured interval until shutdown
+//A full batch is followed by the next one without waiting
+//On shutdown the statements still queued are sent once the delivery has stopped, within the shutdown timeout
+func scheduleXapiDelivery() {
+	if config.XapiLrsUrl == "" {
+		return
+	}
+	stopped := make(chan struct{})
+	onShutdown(func(ctx context.Context) {
+		<-stopped
+		for ctx.Err() == nil {
+			sent, err := store.deliverStatements(ctx)
+			if err != nil {
+				log.Println("Failed to send xAPI statements on shutdown. \nCause: " + err.Error())
+			}
+			if sent < xapiDeliveryBatch {
+				return
+			}
+		}
+	})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(config.XapiDeliveryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for {
+					sent, err := store.deliverStatements(jobContext)
+					if err != nil {
+						log.Println("Failed to send xAPI statements. \nCause: " + err.Error())
+					}
+					if sent < xapiDeliveryBatch {
+						break
+					}
+				}
+			case <-jobContext.Done():
+				return
+			}
+		}
+	}()
+}
+
+//Writes the progress unless the stored progress is already as advanced, inside one transaction
+//Returns the change, nil if the progress was kept
+func (s *ProgressStore) advanceTaskProgress(ctx context.Context, courseProgress CourseProgressInfo) (*ProgressChange, error) {
+	changes, err := s.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+		current, err := s.selectForUpdate(ctx, tx, courseProgress.UserId, courseProgress.CourseId, courseProgress.TaskId)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && progressRank(current.Progress) >= progressRank(courseProgress.Progress) {
+			return nil, nil
+		}
+		change, err := s.upsertLocked(ctx, tx, courseProgress, current)
+		if err != nil {
+			return nil, err
+		}
+		change.Learner = true
+		return []*ProgressChange{change}, nil
+	})
+	if err != nil || len(changes) == 0 {
+		return nil, err
+	}
+	return changes[0], nil
+}
+
+//Outcome of an ingested statement
+const (
+	xapiApplied = "applied"
+	xapiSkipped = "skipped"
+)
+
+type XapiIngestResult struct {
+	Index       int      `json:"index"`
+	StatementId string   `json:"statementId,omitempty"`
+	Status      string   `json:"status"`
+	Progress    string   `json:"progress,omitempty"`
+	Score       *float64 `json:"score,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+}
+
+type XapiIngestReport struct {
+	Statements int                `json:"statements"`
+	Applied    int                `json:"applied"`
+	Skipped    int                `json:"skipped"`
+	Results    []XapiIngestResult `json:"results"`
+}
+
+//Returns the score of the result scaled between 0 and 1, from the scaled score or the raw score and its range
+func scaledScoreOf(result *XapiResult) *float64 {
+	if result == nil || result.Score == nil {
+		return nil
+	}
+	return scaleScore(result.Score.Scaled, result.Score.Raw, result.Score.Min, result.Score.Max)
+}
+
+//Returns the scaled score if it is given, or the raw score scaled by its range, the minimum defaults to 0
+//Returns nil if there is neither a scaled score nor a raw score with a valid range
+func scaleScore(scaled, raw, min, max *float64) *float64 {
+	if scaled != nil {
+		return scaled
+	}
+	if raw == nil || max == nil {
+		return nil
+	}
+	low := 0.0
+	if min != nil {
+		low = *min
+	}
+	if *max <= low {
+		return nil
+	}
+	score := (*raw - low) / (*max - low)
+	return &score
+}
+
+//Maps the statement to the progress of a user on a task
+//attempted starts the task, completed and passed complete it, scored records the score and completes the task if the result is complete
+//Progress is never lowered by a statement
+func ingestStatement(ctx context.Context, statement XapiStatement) (result XapiIngestResult, err error) {
+	result.StatementId = statement.Id
+	skip := func(reason string) (XapiIngestResult, error) {
+		result.Status, result.Reason = xapiSkipped, reason
+		return result, nil
+	}
+	account := statement.Actor.Account
+	if account == nil || account.Name == "" || strings.TrimSuffix(account.HomePage, "/") != strings.TrimSuffix(config.XapiBaseUrl, "/") {
+		return skip("actor has no account of " + config.XapiBaseUrl)
+	}
+	courseId, taskId, err := parseXapiActivityId(statement.Object.Id)
+	if err != nil {
+		return skip(err.Error())
+	}
+	for _, id := range []string{account.Name, courseId, taskId} {
+		if err := validateParameter(idSchema, id, "id"); err != nil {
+			return skip(err.Error())
+		}
+	}
+
+	completion := statement.Result != nil && statement.Result.Completion != nil && *statement.Result.Completion
+	switch statement.Verb.Id {
+	case xapiAttempted:
+		result.Progress = "started"
+	case xapiCompleted, xapiPassed:
+		result.Progress = "completed"
+	case xapiScored:
+		if completion {
+			result.Progress = "completed"
+		}
+	default:
+		return skip("verb " + statement.Verb.Id + " isn't mapped to progress")
+	}
+	result.Score = scaledScoreOf(statement.Result)
+	if result.Progress == "" && result.Score == nil {
+		return skip("scored statement has no score")
+	}
+
+	ctx = context.WithValue(ctx, xapiIngestedKey{}, true)
+	if result.Progress != "" {
+		courseProgress := CourseProgressInfo{UserId: account.Name, CourseId: courseId, TaskId: taskId, Progress: result.Progress}
+		if _, err := store.advanceTaskProgress(ctx, courseProgress); err != nil {
+			return result, err
+		}
+	}
+	if result.Score != nil {
+		if _, err := store.recordScore(ctx, account.Name, courseId, taskId, *result.Score); err != nil {
+			return result, err
+		}
+	}
+	result.Status = xapiApplied
+	return result, nil
+}
+
+//Handles the post method on /xapi/statements
+//Maps a statement or an array of statements to progress, in order, statements that can't be mapped are skipped
+//Returns 200 status code and the outcome of every statement
+func HandleXapiStatementsPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var statements []XapiStatement
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 && body[0] == '[' {
+			err = json.Unmarshal(body, &statements)
+		} else {
+			var statement XapiStatement
+			err = json.Unmarshal(body, &statement)
+			statements = []XapiStatement{statement}
+		}
+	}
+	if err != nil {
+		respondErrorV2(w, newServiceError(http.StatusBadRequest, "Failed to read xAPI statements.", err))
+		return
+	}
+	if err := checkDatabase(r.Context()); err != nil {
+		respondErrorV2(w, err)
+		return
+	}
+
+	report := XapiIngestReport{Statements: len(statements), Results: make([]XapiIngestResult, 0, len(statements))}
+	for i, statement := range statements {
+		result, err := ingestStatement(r.Context(), statement)
+		if err != nil {
+			respondErrorV2(w, failure(r.Context(), "Failed to apply xAPI statement "+strconv.Itoa(i)+", the previous statements are applied.", err))
+			return
+		}
+		result.Index = i
+		if result.Status == xapiApplied {
+			report.Applied++
+		} else {
+			report.Skipped++
+		}
+		report.Results = append(report.Results, result)
+	}
+	respondJSON(w, ObjectEnvelope{Data: report})
+}
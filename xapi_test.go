@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testXapiBaseUrl = "http://progress.test"
+
+func TestXapiStatementTranslation(t *testing.T) {
+	initConfig()
+	config.XapiBaseUrl = testXapiBaseUrl
+	timestamp := time.Date(2018, 5, 14, 9, 30, 0, 0, time.UTC)
+	for _, verb := range []string{xapiAttempted, xapiCompleted, xapiPassed, xapiScored} {
+		statement := newXapiStatement("ana", "algebra 1", "intro/2", verb, timestamp)
+		if account := statement.Actor.Account; statement.Actor.ObjectType != "Agent" || account == nil || account.HomePage != testXapiBaseUrl || account.Name != "ana" {
+			t.Errorf("%s: actor %+v", verb, statement.Actor)
+		}
+		if display := verb[strings.LastIndex(verb, "/")+1:]; statement.Verb.Id != verb || statement.Verb.Display["en-US"] != display {
+			t.Errorf("%s: verb %+v", verb, statement.Verb)
+		}
+		if want := testXapiBaseUrl + "/courses/algebra%201/tasks/intro%2F2"; statement.Object.ObjectType != "Activity" || statement.Object.Id != want {
+			t.Errorf("%s: object %+v, want %s", verb, statement.Object, want)
+		}
+		courseId, taskId, err := parseXapiActivityId(statement.Object.Id)
+		if err != nil || courseId != "algebra 1" || taskId != "intro/2" {
+			t.Errorf("%s: activity parsed as %q %q, %v", verb, courseId, taskId, err)
+		}
+	}
+
+	id := xapiStatementId("ana", "algebra", "intro", xapiCompleted, "2")
+	if id != xapiStatementId("ana", "algebra", "intro", xapiCompleted, "2") || id == xapiStatementId("ana", "algebra", "intro", xapiCompleted, "3") {
+		t.Errorf("statement id %s isn't derived from its parts", id)
+	}
+	if len(id) != 36 || id[14] != '5' || strings.IndexByte("89ab", id[19]) < 0 {
+		t.Errorf("statement id %s isn't a name based UUID", id)
+	}
+}
+
+func TestXapiStatementsSkippedWithoutTask(t *testing.T) {
+	initConfig()
+	config.XapiBaseUrl = testXapiBaseUrl
+	actor := XapiActor{Account: &XapiAccount{HomePage: testXapiBaseUrl, Name: "ana"}}
+	object := XapiObject{Id: xapiActivityId("algebra", "intro")}
+	statements := map[string]XapiStatement{
+		"foreign actor":      {Actor: XapiActor{Account: &XapiAccount{HomePage: "http://other.test", Name: "ana"}}, Verb: XapiVerb{Id: xapiCompleted}, Object: object},
+		"foreign activity":   {Actor: actor, Verb: XapiVerb{Id: xapiCompleted}, Object: XapiObject{Id: "http://other.test/courses/algebra/tasks/intro"}},
+		"unmapped verb":      {Actor: actor, Verb: XapiVerb{Id: "http://adlnet.gov/expapi/verbs/experienced"}, Object: object},
+		"scored, no score":   {Actor: actor, Verb: XapiVerb{Id: xapiScored}, Object: object},
+		"invalid task id":    {Actor: actor, Verb: XapiVerb{Id: xapiCompleted}, Object: XapiObject{Id: xapiActivityId("algebra", strings.Repeat("x", 101))}},
+		"activity of course": {Actor: actor, Verb: XapiVerb{Id: xapiCompleted}, Object: XapiObject{Id: testXapiBaseUrl + "/courses/algebra"}},
+	}
+	for name, statement := range statements {
+		result, err := ingestStatement(context.Background(), statement)
+		if err != nil || result.Status != xapiSkipped || result.Reason == "" {
+			t.Errorf("%s: %+v, %v", name, result, err)
+		}
+	}
+}
+
+func TestXapiStatementsRequireAdmin(t *testing.T) {
+	initConfig()
+	router := newRouter()
+	post := func(token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/xapi/statements", strings.NewReader("[]"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if status := post("admin-token"); status != http.StatusForbidden {
+		t.Errorf("statements posted without a configured admin token answered %d, want 403", status)
+	}
+	config.AdminToken = "admin-token"
+	for _, token := range []string{"", "other-token"} {
+		if status := post(token); status != http.StatusUnauthorized {
+			t.Errorf("statements posted with the token %q answered %d, want 401", token, status)
+		}
+	}
+}
+
+func TestXapiStatementsIngestion(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		config.XapiBaseUrl = testXapiBaseUrl
+		server := httptest.NewServer(newRouter())
+		defer server.Close()
+		userId, courseId := testId("user"), testId("course")
+		statement := func(verb, taskId string, result string) string {
+			if result != "" {
+				result = `,"result":` + result
+			}
+			return `{"actor":{"account":{"homePage":"` + testXapiBaseUrl + `","name":"` + userId + `"}},"verb":{"id":"` + verb + `"},` +
+				`"object":{"id":"` + xapiActivityId(courseId, taskId) + `"}` + result + `}`
+		}
+		body := "[" + strings.Join([]string{
+			statement(xapiAttempted, "attempted", ""),
+			statement(xapiCompleted, "completed", ""),
+			statement(xapiPassed, "passed", `{"success":true}`),
+			statement(xapiScored, "scored", `{"score":{"raw":8,"max":10},"completion":true}`),
+			statement(xapiAttempted, "completed", ""),
+			statement("http://adlnet.gov/expapi/verbs/experienced", "experienced", ""),
+		}, ",") + "]"
+
+		config.AdminToken = "admin-token"
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/xapi/statements", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer admin-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var envelope struct {
+			Data XapiIngestReport `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("ingestion answered %d, %v", resp.StatusCode, err)
+		}
+		report := envelope.Data
+		if report.Statements != 6 || report.Applied != 5 || report.Skipped != 1 || report.Results[5].Status != xapiSkipped {
+			t.Fatalf("report %+v", report)
+		}
+		if score := report.Results[3].Score; score == nil || *score != 0.8 {
+			t.Errorf("scored statement recorded score %v, want 0.8", score)
+		}
+
+		tasks, err := store.getCourseProgress(context.Background(), userId, courseId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		progress := make(map[string]string)
+		for _, task := range tasks {
+			progress[task.TaskId] = task.Progress
+		}
+		want := map[string]string{"attempted": "started", "completed": "completed", "passed": "completed", "scored": "completed"}
+		if len(progress) != len(want) {
+			t.Fatalf("progress %v, want %v", progress, want)
+		}
+		for taskId, p := range want {
+			if progress[taskId] != p {
+				t.Errorf("task %s is %s, want %s", taskId, progress[taskId], p)
+			}
+		}
+	})
+}
+
+//Sends the queued statements until the outbox holds none to send
+func drainXapiOutbox(t *testing.T) {
+	for {
+		sent, err := store.deliverStatements(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent < xapiDeliveryBatch {
+			return
+		}
+	}
+}
+
+//Learning record store keeping the statements in memory
+//It serves the statements resource only: POST stores statements, GET returns every stored statement
+type stubLRS struct {
+	mutex      sync.Mutex
+	statements []map[string]interface{}
+}
+
+func (l *stubLRS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/statements" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("X-Experience-API-Version") == "" {
+		http.Error(w, "Missing X-Experience-API-Version header", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		l.post(w, r)
+	case http.MethodGet:
+		l.mutex.Lock()
+		message, _ := json.Marshal(map[string]interface{}{"statements": l.statements, "more": ""})
+		l.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(message)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (l *stubLRS) post(w http.ResponseWriter, r *http.Request) {
+	var statements []map[string]interface{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 && body[0] == '[' {
+			err = json.Unmarshal(body, &statements)
+		} else {
+			var statement map[string]interface{}
+			err = json.Unmarshal(body, &statement)
+			statements = append(statements, statement)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Invalid statements: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ids := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		id, _ := statement["id"].(string)
+		if id == "" {
+			id = xapiStatementId("stub", strconv.Itoa(len(l.statements)))
+			statement["id"] = id
+		}
+		ids = append(ids, id)
+		l.statements = append(l.statements, statement)
+	}
+	message, _ := json.Marshal(ids)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(message)
+}
+
+func TestXapiOutboxRetries(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		config.XapiBaseUrl = testXapiBaseUrl
+		lrs := &stubLRS{}
+		stub := httptest.NewServer(lrs)
+		defer stub.Close()
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+		config.XapiLrsUrl = stub.URL
+		drainXapiOutbox(t)
+		lrs.statements = nil
+
+		//Queued like the write hook, an ingested statement isn't sent back
+		userId, courseId := testId("user"), testId("course")
+		_, err := store.runWrite(ctx, func(ctx context.Context, tx *sql.Tx) (*ProgressChange, error) {
+			previous, err := store.selectForUpdate(ctx, tx, userId, courseId, "task")
+			if err != nil {
+				return nil, err
+			}
+			change, err := store.upsertLocked(ctx, tx, CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: "task", Progress: "completed"}, previous)
+			if err != nil {
+				return nil, err
+			}
+			ingested := newXapiStatement(userId, courseId, "task", xapiAttempted, time.Now())
+			ingested.Id = xapiStatementId("ingested", userId)
+			if err := store.queueStatement(context.WithValue(ctx, xapiIngestedKey{}, true), tx, ingested); err != nil {
+				return nil, err
+			}
+			return change, queueProgressStatement(ctx, tx, change)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		statementId := xapiStatementId(userId, courseId, "task", xapiCompleted, "1")
+		attempts := func() (int, int) {
+			var queued, attempts sql.NullInt64
+			err := connection.QueryRow(dialect.rebind("SELECT count(*), MAX(attempts) FROM COURSEPROGRESS_XAPI_OUTBOX where statement_id = ?"), statementId).Scan(&queued, &attempts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(queued.Int64), int(attempts.Int64)
+		}
+		if queued, _ := attempts(); queued != 1 {
+			t.Fatalf("%d statements %s queued, want 1", queued, statementId)
+		}
+		var ingested int
+		err = connection.QueryRow(dialect.rebind("SELECT count(*) FROM COURSEPROGRESS_XAPI_OUTBOX where statement_id = ?"), xapiStatementId("ingested", userId)).Scan(&ingested)
+		if err != nil || ingested != 0 {
+			t.Fatalf("%d ingested statements queued, %v", ingested, err)
+		}
+
+		config.XapiLrsUrl = failing.URL
+		for i := 1; i <= 2; i++ {
+			if sent, err := store.deliverStatements(ctx); err == nil || sent != 0 {
+				t.Fatalf("delivery to a failing store sent %d, %v", sent, err)
+			}
+			if queued, tries := attempts(); queued != 1 || tries != i {
+				t.Fatalf("%d statements queued after %d attempts, want 1 after %d", queued, tries, i)
+			}
+		}
+
+		config.XapiLrsUrl = stub.URL
+		if sent, err := store.deliverStatements(ctx); err != nil || sent != 1 {
+			t.Fatalf("delivery sent %d, %v, want the queued statement", sent, err)
+		}
+		if queued, _ := attempts(); queued != 0 {
+			t.Fatalf("statement %s still queued after its delivery", statementId)
+		}
+		if len(lrs.statements) != 1 || lrs.statements[0]["id"] != statementId {
+			t.Fatalf("store received %v, want %s", lrs.statements, statementId)
+		}
+		verb, _ := lrs.statements[0]["verb"].(map[string]interface{})
+		if verb["id"] != xapiCompleted {
+			t.Errorf("delivered verb %v, want %s", verb["id"], xapiCompleted)
+		}
+
+		//A statement rejected as many times as the attempts allow is left in the outbox
+		_, err = store.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+			return nil, store.queueStatement(ctx, tx, &XapiStatement{Id: statementId})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := connection.Exec(dialect.rebind("UPDATE COURSEPROGRESS_XAPI_OUTBOX set attempts =? where statement_id = ?"), xapiMaxAttempts, statementId); err != nil {
+			t.Fatal(err)
+		}
+		if sent, err := store.deliverStatements(ctx); err != nil || sent != 0 {
+			t.Fatalf("delivery sent %d, %v, want no statement", sent, err)
+		}
+	})
+}
+
+func TestXapiPassedStatements(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		ctx := context.Background()
+		config.XapiBaseUrl = testXapiBaseUrl
+		config.XapiPassThreshold = 0.8
+		userId, courseId := testId("user"), testId("course")
+
+		//Written like the write and score hooks
+		complete := func(taskId string) {
+			_, err := store.runWrite(ctx, func(ctx context.Context, tx *sql.Tx) (*ProgressChange, error) {
+				previous, err := store.selectForUpdate(ctx, tx, userId, courseId, taskId)
+				if err != nil {
+					return nil, err
+				}
+				change, err := store.upsertLocked(ctx, tx, CourseProgressInfo{UserId: userId, CourseId: courseId, TaskId: taskId, Progress: "completed"}, previous)
+				if err != nil {
+					return nil, err
+				}
+				return change, queueProgressStatement(ctx, tx, change)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		score := func(taskId string, score float64) *ProgressEvent {
+			var event *ProgressEvent
+			_, err := store.runWrites(ctx, func(ctx context.Context, tx *sql.Tx) ([]*ProgressChange, error) {
+				current, err := store.selectForUpdate(ctx, tx, userId, courseId, taskId)
+				if err != nil {
+					return nil, err
+				}
+				if event, err = store.recordScoreLocked(ctx, tx, userId, courseId, taskId, score, current); err != nil {
+					return nil, err
+				}
+				return nil, queueScoreStatement(ctx, tx, event)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return event
+		}
+		queued := func(id string) bool {
+			var count int
+			err := connection.QueryRow(dialect.rebind("SELECT count(*) FROM COURSEPROGRESS_XAPI_OUTBOX where statement_id = ?"), id).Scan(&count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return count == 1
+		}
+		scoredPassed := func(event *ProgressEvent) string {
+			return xapiStatementId(userId, courseId, event.TaskId, xapiPassed, event.OccurredAt.Format(time.RFC3339), strconv.FormatFloat(*event.Score, 'g', -1, 64))
+		}
+
+		//A completion after a passing score is passed
+		if event := score("scored-first", 0.9); queued(scoredPassed(event)) {
+			t.Error("passing score of a task not completed queued as passed")
+		}
+		complete("scored-first")
+		if !queued(xapiStatementId(userId, courseId, "scored-first", xapiPassed, "1")) {
+			t.Error("completion after a passing score not queued as passed")
+		}
+
+		//A completion without score isn't passed, a passing score after it is
+		complete("completed-first")
+		if queued(xapiStatementId(userId, courseId, "completed-first", xapiPassed, "1")) {
+			t.Error("completion without score queued as passed")
+		}
+		if event := score("completed-first", 0.5); queued(scoredPassed(event)) {
+			t.Error("score below the pass threshold queued as passed")
+		}
+		if event := score("completed-first", 0.8); !queued(scoredPassed(event)) {
+			t.Error("score meeting the pass threshold on a completed task not queued as passed")
+		}
+
+		//The last score decides, a failing score after a passing one isn't passed
+		score("failed-last", 0.9)
+		score("failed-last", 0.4)
+		complete("failed-last")
+		if queued(xapiStatementId(userId, courseId, "failed-last", xapiPassed, "1")) {
+			t.Error("completion after a failing score queued as passed")
+		}
+	})
+}